@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/portfolio"
+)
+
+// account is a brokerage account camelid trades in
+type account struct {
+	name           string // empty for the default account
+	exchangeClient exchange.Client
+	limiter        *exchange.RateLimitedClient
+}
+
+func (a account) String() string {
+	if a.name == "" {
+		return "the default account"
+	}
+	return "account " + a.name
+}
+
+// validAccountName keeps account names usable as env var prefixes
+var validAccountName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// accountNames reads the accounts to trade in besides the default account, from
+// CAMELID_ACCOUNTS, a comma separated list of names like "ira,joint"
+func accountNames() ([]string, error) {
+	s := os.Getenv("CAMELID_ACCOUNTS")
+	if s == "" {
+		return nil, nil
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if !validAccountName.MatchString(name) {
+			return nil, fmt.Errorf("CAMELID_ACCOUNTS must be lowercase names like ira, got %q", name)
+		} else if seen[name] {
+			return nil, fmt.Errorf("CAMELID_ACCOUNTS lists %s twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// envPrefix is what the named account's env vars start with, e.g. JOINT_ for
+// joint. The default account's have no prefix.
+func envPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+}
+
+// accountEnv reads the account's own setting of the env var, falling back to the
+// one shared by every account. It returns the value and the var it came from.
+func accountEnv(prefix, name string) (string, string) {
+	if s := os.Getenv(prefix + name); s != "" {
+		return s, prefix + name
+	}
+	return os.Getenv(name), name
+}
+
+// newAccountClient connects to the named account's broker, see connectBroker and wrapExchangeClient
+func newAccountClient(name string) (exchange.Client, *exchange.RateLimitedClient, error) {
+	broker, err := connectBroker(envPrefix(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapExchangeClient(broker, envPrefix(name))
+}
+
+// newAccounts connects to the CAMELID_ACCOUNTS, besides the default account
+func newAccounts() ([]account, error) {
+	names, err := accountNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []account
+	for _, name := range names {
+		exchangeClient, limiter, err := newAccountClient(name)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to account %s: %w", name, err)
+		}
+		accounts = append(accounts, account{name, exchangeClient, limiter})
+	}
+	return accounts, nil
+}
+
+// newAccountClients connects to every account, the default first
+func newAccountClients() ([]exchange.Client, error) {
+	exchangeClient, _, err := newExchangeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := newAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	exchangeClients := []exchange.Client{exchangeClient}
+	for _, acct := range accounts {
+		exchangeClients = append(exchangeClients, acct.exchangeClient)
+	}
+	return exchangeClients, nil
+}
+
+// splitRule reads how buys are split between accounts from CAMELID_ACCOUNT_SPLIT,
+// "most-cash" (the default), "proportional" or "in-order"
+func splitRule() (portfolio.SplitRule, error) {
+	s := os.Getenv("CAMELID_ACCOUNT_SPLIT")
+	if s == "" {
+		return portfolio.SplitMostCash, nil
+	}
+
+	rule, err := portfolio.ParseSplitRule(s)
+	if err != nil {
+		return "", fmt.Errorf("parsing CAMELID_ACCOUNT_SPLIT: %w", err)
+	}
+	return rule, nil
+}
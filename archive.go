@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/golang/glog"
+
+	"github.com/jchorl/camelid/internal/archive"
+	"github.com/jchorl/camelid/internal/reconciliation"
+)
+
+// defaultRetentionMonths is how long reconciled records stay in the hot store,
+// unless CAMELID_RETENTION_MONTHS says otherwise
+const defaultRetentionMonths = 12
+
+// newArchiveSink opens the archive at CAMELID_ARCHIVE_URL, e.g. file:///var/lib/camelid/archive
+// or s3://bucket/prefix. CAMELID_S3_ENDPOINT points s3 URLs at any S3-compatible store.
+func newArchiveSink() (archive.Sink, error) {
+	archiveURL := os.Getenv("CAMELID_ARCHIVE_URL")
+	if archiveURL == "" {
+		return nil, errors.New("CAMELID_ARCHIVE_URL is required to archive, export or import records")
+	}
+
+	return archive.Open(archiveURL, func() s3iface.S3API {
+		cfg := aws.NewConfig()
+		if endpoint := os.Getenv("CAMELID_S3_ENDPOINT"); endpoint != "" {
+			// S3-compatible stores generally don't do virtual hosted buckets
+			cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+		}
+		return s3.New(session.New(), cfg)
+	})
+}
+
+// archiveRecords moves reconciled records older than the retention period to the archive.
+// If CAMELID_ARCHIVE_EXPIRE_DAYS is set, archived records are then expired from dynamo by its TTL.
+func archiveRecords(ctx context.Context) error {
+	opts, err := archiveOptions()
+	if err != nil {
+		return err
+	}
+
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	sink, err := newArchiveSink()
+	if err != nil {
+		return err
+	}
+
+	name, archived, err := reconciliation.Archive(ctx, store, sink, opts)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("archived %d records reconciled before %s to %s", archived, opts.Before.Format("2006-01-02"), name)
+	return nil
+}
+
+func archiveOptions() (reconciliation.ArchiveOptions, error) {
+	months := defaultRetentionMonths
+	if s := os.Getenv("CAMELID_RETENTION_MONTHS"); s != "" {
+		m, err := strconv.Atoi(s)
+		if err != nil || m < 1 {
+			return reconciliation.ArchiveOptions{}, fmt.Errorf("CAMELID_RETENTION_MONTHS must be a positive number of months, got %q", s)
+		}
+		months = m
+	}
+
+	var expire time.Duration
+	if s := os.Getenv("CAMELID_ARCHIVE_EXPIRE_DAYS"); s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 0 {
+			return reconciliation.ArchiveOptions{}, fmt.Errorf("CAMELID_ARCHIVE_EXPIRE_DAYS must be a number of days, got %q", s)
+		}
+		expire = time.Duration(days) * 24 * time.Hour
+	}
+
+	return reconciliation.ArchiveOptions{
+		Before: time.Now().AddDate(0, -months, 0),
+		Expire: expire,
+	}, nil
+}
+
+// exportRecords writes every record to the archive under name
+func exportRecords(ctx context.Context, name string) error {
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	sink, err := newArchiveSink()
+	if err != nil {
+		return err
+	}
+
+	exported, err := reconciliation.Export(ctx, store, sink, name)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("exported %d records to %s", exported, name)
+	return nil
+}
+
+// importRecords restores the records in the named archive
+func importRecords(ctx context.Context, name string) error {
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	sink, err := newArchiveSink()
+	if err != nil {
+		return err
+	}
+
+	imported, err := reconciliation.Import(ctx, store, sink, name)
+	glog.Infof("imported %d records from %s", imported, name)
+	return err
+}
@@ -8,6 +8,7 @@ require (
 	github.com/aws/aws-sdk-go v1.33.17
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/google/uuid v1.1.1
+	github.com/gorilla/websocket v1.4.0
 	github.com/shopspring/decimal v1.2.0
 	github.com/stretchr/testify v1.5.1
 )
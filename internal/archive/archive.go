@@ -0,0 +1,46 @@
+// Package archive stores cold data, like old trade records, outside the hot tables.
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+var ErrNotFound = errors.New("archive not found")
+
+// Sink holds named archive files, e.g. a local directory or an S3 bucket
+type Sink interface {
+	Write(ctx context.Context, name string, data []byte) error
+	// Read returns ErrNotFound if there is no archive with the name
+	Read(ctx context.Context, name string) ([]byte, error)
+	// List returns the names of all archives, sorted
+	List(ctx context.Context) ([]string, error)
+}
+
+// Open returns the sink at an archive location like file:///var/lib/camelid/archive
+// or s3://bucket/prefix. newS3Client is only called for s3 locations.
+func Open(rawURL string, newS3Client func() s3iface.S3API) (Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing archive URL %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("archive URL %q has no path", rawURL)
+		}
+		return NewDirSink(u.Path)
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("archive URL %q has no bucket", rawURL)
+		}
+		return NewS3Sink(newS3Client(), u.Host, u.Path), nil
+	default:
+		return nil, fmt.Errorf("unsupported archive URL scheme %q, expected file or s3", u.Scheme)
+	}
+}
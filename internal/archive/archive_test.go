@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camelid-archive")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dirSink, err := Open("file://"+dir, nil)
+	require.NoError(t, err)
+
+	fake := newFakeS3()
+	// unrelated objects in the bucket are ignored
+	fake.objects["other/thing"] = []byte("x")
+	fake.objects["camelid/records/nested/thing"] = []byte("x")
+	s3Sink, err := Open("s3://bucket/camelid/records", func() s3iface.S3API { return fake })
+	require.NoError(t, err)
+
+	for name, sink := range map[string]Sink{"dir": dirSink, "s3": s3Sink} {
+		sink := sink
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			_, err := sink.Read(ctx, "a.jsonl.gz")
+			require.Equal(t, ErrNotFound, err)
+
+			require.NoError(t, sink.Write(ctx, "b.jsonl.gz", []byte("bbb")))
+			require.NoError(t, sink.Write(ctx, "a.jsonl.gz", []byte("a")))
+			require.NoError(t, sink.Write(ctx, "a.jsonl.gz", []byte("aaa")))
+
+			data, err := sink.Read(ctx, "a.jsonl.gz")
+			require.NoError(t, err)
+			require.Equal(t, []byte("aaa"), data)
+
+			names, err := sink.List(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a.jsonl.gz", "b.jsonl.gz"}, names)
+		})
+	}
+
+	require.Contains(t, fake.objects, "camelid/records/a.jsonl.gz")
+	_, err = os.Stat(filepath.Join(dir, "a.jsonl.gz"))
+	require.NoError(t, err)
+}
+
+func TestOpen_Errors(t *testing.T) {
+	for _, rawURL := range []string{"", "gs://bucket", "s3:///prefix", "file://"} {
+		_, err := Open(rawURL, nil)
+		require.Error(t, err, rawURL)
+	}
+}
+
+func TestDirSink_RejectsPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camelid-archive")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sink, err := NewDirSink(dir)
+	require.NoError(t, err)
+	require.Error(t, sink.Write(context.TODO(), "../escape", []byte("x")))
+	require.Error(t, sink.Write(context.TODO(), ".hidden", []byte("x")))
+}
+
+// fakeS3 holds objects in memory, implementing just what the sink uses
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string][]byte // key -> body, for a single bucket
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}}
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[aws.StringValue(input.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	// one object per page, to exercise paging
+	for i, key := range keys {
+		page := &s3.ListObjectsV2Output{Contents: []*s3.Object{{Key: aws.String(key)}}}
+		if !fn(page, i == len(keys)-1) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type s3Sink struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3Sink keeps archives as objects in bucket, under prefix.
+// Any S3-compatible store works, given a client configured with its endpoint.
+func NewS3Sink(client s3iface.S3API, bucket, prefix string) Sink {
+	return &s3Sink{client, bucket, strings.Trim(prefix, "/")}
+}
+
+func (s *s3Sink) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3Sink) Write(ctx context.Context, name string, data []byte) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("putting s3://%s/%s: %w", s.bucket, s.key(name), err)
+	}
+
+	return nil
+}
+
+func (s *s3Sink) Read(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("getting s3://%s/%s: %w", s.bucket, s.key(name), err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading s3://%s/%s: %w", s.bucket, s.key(name), err)
+	}
+
+	return data, nil
+}
+
+func (s *s3Sink) List(ctx context.Context) ([]string, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+
+	var names []string
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(obj.Key), prefix)
+			// only archives directly under the prefix
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		return true // keep paging
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing s3://%s/%s: %w", s.bucket, prefix, err)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,24 @@
+package dbtest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// ForEachBackend runs test as a subtest against each kind of store, dynamo and
+// the file store. The file store's subtest gets an empty directory, removed
+// once it ends, and dynamo's gets "".
+func ForEachBackend(t *testing.T, test func(t *testing.T, dir string)) {
+	t.Run("dynamo", func(t *testing.T) {
+		test(t, "")
+	})
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "camelid-store")
+		if err != nil {
+			t.Fatalf("creating a directory for the file store: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		test(t, dir)
+	})
+}
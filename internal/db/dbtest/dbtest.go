@@ -3,81 +3,562 @@ package dbtest
 import (
 	"fmt"
 	"strconv"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
-	"github.com/golang/glog"
 )
 
 var _ dynamodbiface.DynamoDBAPI = (*MockClient)(nil)
 
 type dynamoItem map[string]*dynamodb.AttributeValue
 
-func (i dynamoItem) getIntVal(key string) int {
-	intVal, err := strconv.Atoi(aws.StringValue(i[key].N))
-	if err != nil {
-		glog.Fatalf("failed to convert key %s to int, AttributeValue: %+v: %v", key, i[key], err)
-	}
-	return intVal
-}
-
+// MockClient is an in-memory dynamo emulator.
+// It evaluates condition, filter, key condition, update and projection
+// expressions, and maintains global and local secondary indexes.
+// Anything unimplemented panics via the embedded nil interface.
 type MockClient struct {
 	dynamodbiface.DynamoDBAPI
 
-	items map[string]map[string]dynamoItem // table_name -> key -> item
+	mu     sync.Mutex
+	tables map[string]*table
+
+	onWrite           map[string]func(key map[string]*dynamodb.AttributeValue) // table -> hook
+	inWriteHook       bool
+	conditionFailures int
 }
 
+// NewMockClient creates a client with a table for each name,
+// each with a string hash key named ID and no indexes.
+// Use CreateTable for anything fancier.
 func NewMockClient(tableNames ...string) *MockClient {
-	items := map[string]map[string]dynamoItem{}
+	tables := map[string]*table{}
 	for _, name := range tableNames {
-		items[name] = map[string]dynamoItem{}
+		tables[name] = newTable(keySchema{hashKey: "ID"})
 	}
 
 	return &MockClient{
-		items: items,
+		tables:  tables,
+		onWrite: map[string]func(map[string]*dynamodb.AttributeValue){},
 	}
 }
 
-func (c *MockClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
-	table, ok := c.items[aws.StringValue(input.TableName)]
+// OnWrite registers fn to run just before every PutItem, UpdateItem or
+// DeleteItem on the table, with the key being written. fn can make writes of
+// its own, which don't trigger it again. It's handy for simulating a
+// concurrent writer sneaking in between a read and a conditional write.
+func (c *MockClient) OnWrite(tableName string, fn func(key map[string]*dynamodb.AttributeValue)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onWrite[tableName] = fn
+}
+
+// ConditionFailures counts the writes rejected by their condition expression
+func (c *MockClient) ConditionFailures() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conditionFailures
+}
+
+// beforeWrite runs the OnWrite hook of the table, if any, with the key of item
+func (c *MockClient) beforeWrite(tableName *string, item map[string]*dynamodb.AttributeValue) {
+	c.mu.Lock()
+	fn := c.onWrite[aws.StringValue(tableName)]
+	t, err := c.getTable(tableName)
+	if fn == nil || err != nil || c.inWriteHook {
+		c.mu.Unlock()
+		return
+	}
+	c.inWriteHook = true
+	key := copyItem(t.key(item))
+	c.mu.Unlock()
+
+	fn(key)
+
+	c.mu.Lock()
+	c.inWriteHook = false
+	c.mu.Unlock()
+}
+
+func (c *MockClient) getTable(name *string) (*table, error) {
+	t, ok := c.tables[aws.StringValue(name)]
 	if !ok {
-		return nil, fmt.Errorf("table %s not found", aws.StringValue(input.TableName))
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, fmt.Sprintf("table %s not found", aws.StringValue(name)), nil)
+	}
+	return t, nil
+}
+
+func (c *MockClient) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	return c.CreateTableWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MockClient) CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := aws.StringValue(input.TableName)
+	if _, ok := c.tables[name]; ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, fmt.Sprintf("table %s already exists", name), nil)
+	}
+
+	t := newTable(newKeySchema(input.KeySchema))
+	if t.hashKey == "" {
+		return nil, validationErr("a hash key is required")
 	}
 
-	item, ok := table[aws.StringValue(input.Key["ID"].S)]
+	addIndex := func(name *string, keys []*dynamodb.KeySchemaElement, projection *dynamodb.Projection) {
+		idx := index{keySchema: newKeySchema(keys)}
+		if projection != nil {
+			idx.projectionType = aws.StringValue(projection.ProjectionType)
+			idx.nonKeyAttributes = aws.StringValueSlice(projection.NonKeyAttributes)
+		}
+		t.indexes[aws.StringValue(name)] = idx
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		addIndex(gsi.IndexName, gsi.KeySchema, gsi.Projection)
+	}
+	for _, lsi := range input.LocalSecondaryIndexes {
+		addIndex(lsi.IndexName, lsi.KeySchema, lsi.Projection)
+	}
+
+	c.tables[name] = t
+	return &dynamodb.CreateTableOutput{
+		TableDescription: &dynamodb.TableDescription{
+			TableName:   input.TableName,
+			KeySchema:   input.KeySchema,
+			TableStatus: aws.String(dynamodb.TableStatusActive),
+		},
+	}, nil
+}
+
+func (c *MockClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return c.GetItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MockClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key); err != nil {
+		return nil, err
+	}
+
+	var paths []path
+	if input.ProjectionExpression != nil {
+		paths, err = parseProjection(aws.StringValue(input.ProjectionExpression), input.ExpressionAttributeNames)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	item, ok := t.items[t.encode(input.Key)]
 	if !ok {
-		return nil, fmt.Errorf("item %s, table %s not found", aws.StringValue(input.Key["ID"].S), aws.StringValue(input.TableName))
+		return &dynamodb.GetItemOutput{}, nil
 	}
 
-	return &dynamodb.GetItemOutput{Item: item}, nil
+	return &dynamodb.GetItemOutput{Item: project(copyItem(item), paths)}, nil
+}
+
+func (c *MockClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return c.PutItemWithContext(aws.BackgroundContext(), input)
 }
 
 func (c *MockClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
-	c.items[aws.StringValue(input.TableName)][aws.StringValue(input.Item["ID"].S)] = input.Item
-	return &dynamodb.PutItemOutput{}, nil
+	c.beforeWrite(input.TableName, input.Item)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateItem(input.Item); err != nil {
+		return nil, err
+	}
+
+	key := t.encode(input.Item)
+	old := t.items[key]
+	if err := c.checkCondition(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+
+	t.items[key] = copyItem(input.Item)
+
+	out := &dynamodb.PutItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+func (c *MockClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return c.DeleteItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MockClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	c.beforeWrite(input.TableName, input.Key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key); err != nil {
+		return nil, err
+	}
+
+	key := t.encode(input.Key)
+	old := t.items[key]
+	if err := c.checkCondition(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+
+	delete(t.items, key)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+func (c *MockClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return c.UpdateItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MockClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	c.beforeWrite(input.TableName, input.Key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key); err != nil {
+		return nil, err
+	}
+
+	key := t.encode(input.Key)
+	old := t.items[key]
+	if err := c.checkCondition(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+
+	actions, err := parseUpdate(aws.StringValue(input.UpdateExpression), input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	base := old
+	if base == nil {
+		// updates create the item if it doesn't exist
+		base = copyItem(input.Key)
+	}
+	for _, action := range actions {
+		if name := action.path[0].name; name == t.hashKey || name == t.rangeKey {
+			return nil, validationErr(fmt.Sprintf("cannot update attribute %s, it is part of the key", name))
+		}
+	}
+
+	updated, err := applyUpdate(base, actions)
+	if err != nil {
+		return nil, err
+	}
+	t.items[key] = updated
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllOld:
+		out.Attributes = copyItem(old)
+	case dynamodb.ReturnValueAllNew:
+		out.Attributes = copyItem(updated)
+	case dynamodb.ReturnValueUpdatedOld:
+		out.Attributes = updatedAttributes(old, actions)
+	case dynamodb.ReturnValueUpdatedNew:
+		out.Attributes = updatedAttributes(updated, actions)
+	}
+	return out, nil
+}
+
+// updatedAttributes returns the top-level attributes of item touched by actions
+func updatedAttributes(item dynamoItem, actions []updateAction) dynamoItem {
+	attrs := dynamoItem{}
+	for _, action := range actions {
+		name := action.path[0].name
+		if av, ok := item[name]; ok {
+			attrs[name] = copyValue(av)
+		}
+	}
+	return attrs
+}
+
+// checkCondition evaluates a write's condition expression against the current item.
+// callers must hold c.mu.
+func (c *MockClient) checkCondition(item dynamoItem, expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	if expr == nil {
+		return nil
+	}
+
+	cond, err := parseCondition(aws.StringValue(expr), names, values)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		item = dynamoItem{}
+	}
+	if !cond.eval(item) {
+		c.conditionFailures++
+		return conditionFailedErr()
+	}
+	return nil
+}
+
+func (c *MockClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return c.QueryWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MockClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	ks, items, less, err := t.view(aws.StringValue(input.IndexName))
+	if err != nil {
+		return nil, err
+	}
+
+	keyCond, err := parseCondition(aws.StringValue(input.KeyConditionExpression), input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := hashKeyValue(keyCond, ks.hashKey); !ok {
+		return nil, validationErr(fmt.Sprintf("query key condition must specify an equality condition on %s", ks.hashKey))
+	}
+
+	var matching []dynamoItem
+	for _, item := range items {
+		if keyCond.eval(item) {
+			matching = append(matching, item)
+		}
+	}
+
+	forward := input.ScanIndexForward == nil || *input.ScanIndexForward
+	if !forward {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+	}
+
+	page, err := c.read(t, ks, matching, less, forward, readInput{
+		exclusiveStartKey: input.ExclusiveStartKey,
+		limit:             input.Limit,
+		filterExpression:  input.FilterExpression,
+		projection:        input.ProjectionExpression,
+		names:             input.ExpressionAttributeNames,
+		values:            input.ExpressionAttributeValues,
+		selectCount:       aws.StringValue(input.Select) == dynamodb.SelectCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.QueryOutput{
+		Items:            page.items,
+		Count:            aws.Int64(page.count),
+		ScannedCount:     aws.Int64(page.scannedCount),
+		LastEvaluatedKey: page.lastEvaluatedKey,
+	}, nil
+}
+
+func (c *MockClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	return c.QueryPagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (c *MockClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	in := *input
+	for {
+		out, err := c.QueryWithContext(ctx, &in, opts...)
+		if err != nil {
+			return err
+		}
+
+		last := out.LastEvaluatedKey == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (c *MockClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return c.ScanWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MockClient) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	ks, items, less, err := t.view(aws.StringValue(input.IndexName))
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := c.read(t, ks, items, less, true, readInput{
+		exclusiveStartKey: input.ExclusiveStartKey,
+		limit:             input.Limit,
+		filterExpression:  input.FilterExpression,
+		projection:        input.ProjectionExpression,
+		names:             input.ExpressionAttributeNames,
+		values:            input.ExpressionAttributeValues,
+		selectCount:       aws.StringValue(input.Select) == dynamodb.SelectCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.ScanOutput{
+		Items:            page.items,
+		Count:            aws.Int64(page.count),
+		ScannedCount:     aws.Int64(page.scannedCount),
+		LastEvaluatedKey: page.lastEvaluatedKey,
+	}, nil
+}
+
+func (c *MockClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	return c.ScanPagesWithContext(aws.BackgroundContext(), input, fn)
 }
 
 func (c *MockClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
-	// instead of reimplementing the dynamo API
-	// just check for a specific query
-	if (aws.StringValue(input.ExpressionAttributeNames["#0"]) == "Status") &&
-		(aws.StringValue(input.ExpressionAttributeValues[":0"].N) == "1") &&
-		(aws.StringValue(input.FilterExpression) == "#0 <> :0") &&
-		(aws.StringValue(input.IndexName) == "StatusIndex") {
-		for _, record := range c.items[aws.StringValue(input.TableName)] {
-			if record.getIntVal("Status") != 1 {
-				if !fn(
-					&dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{record}},
-					false, // who even uses this param
-				) {
-					break
-				}
+	in := *input
+	for {
+		out, err := c.ScanWithContext(ctx, &in, opts...)
+		if err != nil {
+			return err
+		}
+
+		last := out.LastEvaluatedKey == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// readInput holds the parts of Query and Scan that behave the same
+type readInput struct {
+	exclusiveStartKey map[string]*dynamodb.AttributeValue
+	limit             *int64
+	filterExpression  *string
+	projection        *string
+	names             map[string]*string
+	values            map[string]*dynamodb.AttributeValue
+	selectCount       bool
+}
+
+type readPage struct {
+	items            []map[string]*dynamodb.AttributeValue
+	count            int64
+	scannedCount     int64
+	lastEvaluatedKey map[string]*dynamodb.AttributeValue
+}
+
+// read pages through items, which are already sorted in read order,
+// applying the limit before the filter like dynamo does
+func (c *MockClient) read(t *table, ks keySchema, items []dynamoItem, less func(a, b dynamoItem) bool, forward bool, in readInput) (readPage, error) {
+	if in.limit != nil && *in.limit < 1 {
+		return readPage{}, validationErr(fmt.Sprintf("1 validation error detected: Value '%d' at 'limit' failed to satisfy constraint: Member must have value greater than or equal to 1", *in.limit))
+	}
+
+	var filter condition
+	if in.filterExpression != nil {
+		var err error
+		filter, err = parseCondition(aws.StringValue(in.filterExpression), in.names, in.values)
+		if err != nil {
+			return readPage{}, err
+		}
+	}
+
+	var paths []path
+	if in.projection != nil {
+		var err error
+		paths, err = parseProjection(aws.StringValue(in.projection), in.names)
+		if err != nil {
+			return readPage{}, err
+		}
+	}
+
+	if in.exclusiveStartKey != nil {
+		start := dynamoItem(in.exclusiveStartKey)
+		for len(items) > 0 {
+			if forward && less(start, items[0]) || !forward && less(items[0], start) {
+				break
 			}
+			items = items[1:]
+		}
+	}
+
+	var page readPage
+	for _, item := range items {
+		page.scannedCount++
+		if filter == nil || filter.eval(item) {
+			page.count++
+			if !in.selectCount {
+				page.items = append(page.items, project(item, paths))
+			}
+		}
+
+		if in.limit != nil && page.scannedCount == *in.limit {
+			// dynamo stops at the limit without looking for more, so the
+			// page has a last evaluated key even if it was the last item
+			page.lastEvaluatedKey = t.lastEvaluatedKey(ks, item)
+			break
 		}
+	}
+
+	return page, nil
+}
+
+// Items returns a copy of every item in the table, in key order.
+// It's handy for asserting on what was written.
+func (c *MockClient) Items(tableName string) []map[string]*dynamodb.AttributeValue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.tables[tableName]
+	if !ok {
 		return nil
 	}
 
-	return fmt.Errorf("please implement this query in MockClient.ScanPagesWithContext")
+	_, items, _, _ := t.view("")
+	var out []map[string]*dynamodb.AttributeValue
+	for _, item := range items {
+		out = append(out, item)
+	}
+	return out
+}
+
+// N is shorthand for a number attribute value
+func N(n int) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}
+}
+
+// S is shorthand for a string attribute value
+func S(s string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(s)}
 }
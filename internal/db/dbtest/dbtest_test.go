@@ -0,0 +1,412 @@
+package dbtest
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/stretchr/testify/require"
+)
+
+const testTable = "Orders"
+
+// newTestClient creates a table keyed on Account/ID, with a sparse index on Open
+func newTestClient(t *testing.T) *MockClient {
+	c := NewMockClient()
+	_, err := c.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(testTable),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Account"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("ID"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("OpenIndex"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("Open"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("Qty"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, item := range []dynamoItem{
+		{"Account": S("a"), "ID": S("1"), "Symbol": S("VOO"), "Qty": N(3), "Open": N(1)},
+		{"Account": S("a"), "ID": S("2"), "Symbol": S("VXUS"), "Qty": N(10)},
+		{"Account": S("a"), "ID": S("3"), "Symbol": S("BND"), "Qty": N(20), "Open": N(1)},
+		{"Account": S("b"), "ID": S("1"), "Symbol": S("VOO"), "Qty": N(1), "Tags": {SS: aws.StringSlice([]string{"manual"})}},
+	} {
+		_, err := c.PutItem(&dynamodb.PutItemInput{TableName: aws.String(testTable), Item: item})
+		require.NoError(t, err)
+	}
+	return c
+}
+
+func key(account, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"Account": S(account), "ID": S(id)}
+}
+
+func requireErrCode(t *testing.T, code string, err error) {
+	require.Error(t, err)
+	aerr, ok := err.(awserr.Error)
+	require.True(t, ok, "expected awserr.Error, got %T: %v", err, err)
+	require.Equal(t, code, aerr.Code())
+}
+
+func TestGetItem(t *testing.T) {
+	c := newTestClient(t)
+
+	out, err := c.GetItem(&dynamodb.GetItemInput{TableName: aws.String(testTable), Key: key("a", "2")})
+	require.NoError(t, err)
+	require.Equal(t, "VXUS", aws.StringValue(out.Item["Symbol"].S))
+
+	out, err = c.GetItem(&dynamodb.GetItemInput{TableName: aws.String(testTable), Key: key("a", "404")})
+	require.NoError(t, err)
+	require.Nil(t, out.Item)
+
+	_, err = c.GetItem(&dynamodb.GetItemInput{TableName: aws.String(testTable), Key: map[string]*dynamodb.AttributeValue{"ID": S("1")}})
+	requireErrCode(t, "ValidationException", err)
+
+	_, err = c.GetItem(&dynamodb.GetItemInput{TableName: aws.String("nope"), Key: key("a", "1")})
+	requireErrCode(t, dynamodb.ErrCodeResourceNotFoundException, err)
+}
+
+func TestPutItem(t *testing.T) {
+	c := newTestClient(t)
+
+	for _, item := range []dynamoItem{
+		{"ID": S("5"), "Symbol": S("VTI")},
+		{"Account": S("a"), "Symbol": S("VTI")},
+	} {
+		_, err := c.PutItem(&dynamodb.PutItemInput{TableName: aws.String(testTable), Item: item})
+		requireErrCode(t, "ValidationException", err)
+	}
+	require.Len(t, c.Items(testTable), 4)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	cases := []struct {
+		name      string
+		cond      expression.ConditionBuilder
+		expectErr bool
+	}{
+		{
+			name: "not exists on existing item",
+			cond: expression.AttributeNotExists(expression.Name("ID")),
+			// the item exists
+			expectErr: true,
+		},
+		{
+			name:      "equal",
+			cond:      expression.Name("Qty").Equal(expression.Value(3)),
+			expectErr: false,
+		},
+		{
+			name:      "not equal",
+			cond:      expression.Name("Qty").NotEqual(expression.Value(3)),
+			expectErr: true,
+		},
+		{
+			name:      "compare numbers numerically",
+			cond:      expression.Name("Qty").LessThan(expression.Value(20)),
+			expectErr: false,
+		},
+		{
+			name: "and, or, not",
+			cond: expression.Name("Symbol").Equal(expression.Value("BND")).
+				Or(expression.Not(expression.AttributeExists(expression.Name("Open")))).
+				Or(expression.Name("Qty").Between(expression.Value(1), expression.Value(3)).And(expression.Name("Symbol").In(expression.Value("VOO"), expression.Value("VTI")))),
+			expectErr: false,
+		},
+		{
+			name:      "begins with",
+			cond:      expression.Name("Symbol").BeginsWith("VX"),
+			expectErr: true,
+		},
+		{
+			name:      "size",
+			cond:      expression.Name("Symbol").Size().Equal(expression.Value(3)),
+			expectErr: false,
+		},
+		{
+			name:      "missing attribute",
+			cond:      expression.Name("Version").Equal(expression.Value(1)),
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t)
+			expr, err := expression.NewBuilder().WithCondition(tc.cond).Build()
+			require.NoError(t, err)
+
+			_, err = c.PutItem(&dynamodb.PutItemInput{
+				TableName:                 aws.String(testTable),
+				Item:                      dynamoItem{"Account": S("a"), "ID": S("1"), "Qty": N(4)},
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			})
+
+			out, getErr := c.GetItem(&dynamodb.GetItemInput{TableName: aws.String(testTable), Key: key("a", "1")})
+			require.NoError(t, getErr)
+			if tc.expectErr {
+				requireErrCode(t, dynamodb.ErrCodeConditionalCheckFailedException, err)
+				require.Equal(t, "3", aws.StringValue(out.Item["Qty"].N))
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "4", aws.StringValue(out.Item["Qty"].N))
+			}
+		})
+	}
+}
+
+func TestOnWrite(t *testing.T) {
+	c := newTestClient(t)
+
+	// a concurrent writer bumps the version between our read and our write
+	c.OnWrite(testTable, func(k map[string]*dynamodb.AttributeValue) {
+		_, err := c.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(testTable),
+			Key:                       k,
+			UpdateExpression:          aws.String("SET Version = :v"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": N(2)},
+		})
+		require.NoError(t, err)
+	})
+
+	_, err := c.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(testTable),
+		Item:                      dynamoItem{"Account": S("a"), "ID": S("1"), "Qty": N(4), "Version": N(2)},
+		ConditionExpression:       aws.String("attribute_not_exists(Version)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{},
+	})
+	requireErrCode(t, dynamodb.ErrCodeConditionalCheckFailedException, err)
+	require.Equal(t, 1, c.ConditionFailures())
+
+	out, err := c.GetItem(&dynamodb.GetItemInput{TableName: aws.String(testTable), Key: key("a", "1")})
+	require.NoError(t, err)
+	require.Equal(t, "3", aws.StringValue(out.Item["Qty"].N))
+	require.Equal(t, "2", aws.StringValue(out.Item["Version"].N))
+
+	c.OnWrite(testTable, nil)
+	_, err = c.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(testTable),
+		Key:                       key("a", "1"),
+		ConditionExpression:       aws.String("Version = :v"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": N(2)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, c.ConditionFailures())
+}
+
+func TestUpdateItem(t *testing.T) {
+	c := newTestClient(t)
+
+	update := expression.Set(expression.Name("Qty"), expression.Name("Qty").Plus(expression.Value(2))).
+		Set(expression.Name("Version"), expression.IfNotExists(expression.Name("Version"), expression.Value(1))).
+		Remove(expression.Name("Open")).
+		Add(expression.Name("Tags"), expression.Value(&dynamodb.AttributeValue{SS: aws.StringSlice([]string{"a", "b"})}))
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("Open"))).
+		Build()
+	require.NoError(t, err)
+
+	out, err := c.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(testTable),
+		Key:                       key("a", "1"),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "5", aws.StringValue(out.Attributes["Qty"].N))
+	require.Equal(t, "1", aws.StringValue(out.Attributes["Version"].N))
+	require.Nil(t, out.Attributes["Open"])
+	require.Len(t, out.Attributes["Tags"].SS, 2)
+
+	// Open was removed, so the same update now fails its condition
+	_, err = c.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(testTable),
+		Key:                       key("a", "1"),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	requireErrCode(t, dynamodb.ErrCodeConditionalCheckFailedException, err)
+
+	// DELETE the last member of a set removes the attribute
+	del, err := expression.NewBuilder().
+		WithUpdate(expression.Delete(expression.Name("Tags"), expression.Value(&dynamodb.AttributeValue{SS: aws.StringSlice([]string{"manual"})}))).
+		Build()
+	require.NoError(t, err)
+	out, err = c.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(testTable),
+		Key:                       key("b", "1"),
+		UpdateExpression:          del.Update(),
+		ExpressionAttributeNames:  del.Names(),
+		ExpressionAttributeValues: del.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	require.NoError(t, err)
+	require.NotContains(t, out.Attributes, "Tags")
+
+	// keys can't be updated
+	bad, err := expression.NewBuilder().WithUpdate(expression.Set(expression.Name("ID"), expression.Value("9"))).Build()
+	require.NoError(t, err)
+	_, err = c.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(testTable),
+		Key:                       key("b", "1"),
+		UpdateExpression:          bad.Update(),
+		ExpressionAttributeNames:  bad.Names(),
+		ExpressionAttributeValues: bad.Values(),
+	})
+	requireErrCode(t, "ValidationException", err)
+}
+
+func TestQuery(t *testing.T) {
+	c := newTestClient(t)
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("Account").Equal(expression.Value("a")).And(expression.Key("ID").GreaterThanEqual(expression.Value("2")))).
+		WithFilter(expression.Name("Symbol").NotEqual(expression.Value("BND"))).
+		Build()
+	require.NoError(t, err)
+
+	out, err := c.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(testTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), aws.Int64Value(out.ScannedCount))
+	require.Len(t, out.Items, 1)
+	require.Equal(t, "VXUS", aws.StringValue(out.Items[0]["Symbol"].S))
+
+	// the sparse index only has open items, in descending Qty order, keys only
+	idx, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("Open").Equal(expression.Value(1))).
+		Build()
+	require.NoError(t, err)
+	var ids []string
+	err = c.QueryPages(&dynamodb.QueryInput{
+		TableName:                 aws.String(testTable),
+		IndexName:                 aws.String("OpenIndex"),
+		KeyConditionExpression:    idx.KeyCondition(),
+		ExpressionAttributeNames:  idx.Names(),
+		ExpressionAttributeValues: idx.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int64(1),
+	}, func(page *dynamodb.QueryOutput, last bool) bool {
+		for _, item := range page.Items {
+			require.Nil(t, item["Symbol"])
+			ids = append(ids, aws.StringValue(item["ID"].S))
+		}
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"3", "1"}, ids)
+
+	// queries need the hash key
+	bad, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("ID").Equal(expression.Value("1"))).
+		Build()
+	require.NoError(t, err)
+	_, err = c.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(testTable),
+		KeyConditionExpression:    bad.KeyCondition(),
+		ExpressionAttributeNames:  bad.Names(),
+		ExpressionAttributeValues: bad.Values(),
+	})
+	requireErrCode(t, "ValidationException", err)
+}
+
+func TestScan(t *testing.T) {
+	c := newTestClient(t)
+
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("Symbol").Equal(expression.Value("VOO"))).
+		WithProjection(expression.NamesList(expression.Name("ID"), expression.Name("Account"))).
+		Build()
+	require.NoError(t, err)
+
+	var pages int
+	var items []map[string]*dynamodb.AttributeValue
+	err = c.ScanPages(&dynamodb.ScanInput{
+		TableName:                 aws.String(testTable),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Limit:                     aws.Int64(3),
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		pages++
+		items = append(items, page.Items...)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, pages)
+	require.Len(t, items, 2)
+	for _, item := range items {
+		require.Len(t, item, 2)
+	}
+
+	// a page that stops at the limit has a last evaluated key, even with nothing after it
+	out, err := c.Scan(&dynamodb.ScanInput{TableName: aws.String(testTable), Limit: aws.Int64(4)})
+	require.NoError(t, err)
+	require.Len(t, out.Items, 4)
+	require.NotNil(t, out.LastEvaluatedKey)
+	out, err = c.Scan(&dynamodb.ScanInput{TableName: aws.String(testTable), Limit: aws.Int64(4), ExclusiveStartKey: out.LastEvaluatedKey})
+	require.NoError(t, err)
+	require.Empty(t, out.Items)
+	require.Nil(t, out.LastEvaluatedKey)
+
+	_, err = c.Scan(&dynamodb.ScanInput{TableName: aws.String(testTable), Limit: aws.Int64(0)})
+	requireErrCode(t, "ValidationException", err)
+
+	_, err = c.Scan(&dynamodb.ScanInput{TableName: aws.String(testTable), IndexName: aws.String("nope")})
+	requireErrCode(t, dynamodb.ErrCodeResourceNotFoundException, err)
+}
+
+func TestDeleteItem(t *testing.T) {
+	c := newTestClient(t)
+
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("Symbol").Equal(expression.Value("BND"))).
+		Build()
+	require.NoError(t, err)
+
+	_, err = c.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(testTable),
+		Key:                       key("a", "1"),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	requireErrCode(t, dynamodb.ErrCodeConditionalCheckFailedException, err)
+
+	out, err := c.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(testTable),
+		Key:          key("a", "3"),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+		// the same condition passes for this item
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "BND", aws.StringValue(out.Attributes["Symbol"].S))
+	require.Len(t, c.Items(testTable), 3)
+}
@@ -0,0 +1,927 @@
+package dbtest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// this file implements just enough of the dynamo expression grammar to
+// evaluate condition, filter, key condition, update and projection
+// expressions against in-memory items.
+// https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Expressions.html
+
+type tokenKind int
+
+const (
+	tokEOF    tokenKind = iota
+	tokIdent            // attribute names, keywords and function names
+	tokName             // #name placeholders
+	tokValue            // :value placeholders
+	tokNumber           // list indexes
+	tokPunct            // ( ) , . [ ] = <> < <= > >= + -
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func lex(expr string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '<' || ch == '>':
+			if i+1 < len(expr) && (expr[i+1] == '=' || (ch == '<' && expr[i+1] == '>')) {
+				toks = append(toks, token{tokPunct, expr[i : i+2]})
+				i += 2
+			} else {
+				toks = append(toks, token{tokPunct, string(ch)})
+				i++
+			}
+		case strings.IndexByte("(),.[]=+-", ch) >= 0:
+			toks = append(toks, token{tokPunct, string(ch)})
+			i++
+		case ch == '#' || ch == ':' || isIdentChar(ch):
+			j := i + 1
+			for j < len(expr) && isIdentChar(expr[j]) {
+				j++
+			}
+			kind := tokIdent
+			if ch == '#' {
+				kind = tokName
+			} else if ch == ':' {
+				kind = tokValue
+			} else if _, err := strconv.Atoi(expr[i:j]); err == nil {
+				kind = tokNumber
+			}
+			toks = append(toks, token{kind, expr[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", ch, i)
+		}
+	}
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+type parser struct {
+	toks   []token
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func newParser(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*parser, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, validationErr(fmt.Sprintf("invalid expression %q: %v", expr, err))
+	}
+	return &parser{toks: toks, names: names, values: values}, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && strings.EqualFold(tok.text, kw)
+}
+
+func (p *parser) isPunct(punct string) bool {
+	tok := p.peek()
+	return tok.kind == tokPunct && tok.text == punct
+}
+
+func (p *parser) expectPunct(punct string) error {
+	if tok := p.next(); tok.kind != tokPunct || tok.text != punct {
+		return p.errorf("expected %q, got %q", punct, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) expectEOF() error {
+	if tok := p.peek(); tok.kind != tokEOF {
+		return p.errorf("unexpected %q", tok.text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return validationErr(fmt.Sprintf("invalid expression: "+format, args...))
+}
+
+// operands
+
+type pathElem struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type path []pathElem
+
+func (pth path) String() string {
+	var sb strings.Builder
+	for i, elem := range pth {
+		if elem.isIndex {
+			fmt.Fprintf(&sb, "[%d]", elem.index)
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(elem.name)
+	}
+	return sb.String()
+}
+
+// get resolves the path in the item, returning nil if any part is missing
+func (pth path) get(item dynamoItem) *dynamodb.AttributeValue {
+	av := item[pth[0].name]
+	for _, elem := range pth[1:] {
+		if av == nil {
+			return nil
+		}
+		if elem.isIndex {
+			if elem.index >= len(av.L) {
+				return nil
+			}
+			av = av.L[elem.index]
+		} else {
+			av = av.M[elem.name]
+		}
+	}
+	return av
+}
+
+// set writes the value at the path. parent documents must already exist.
+func (pth path) set(item dynamoItem, value *dynamodb.AttributeValue) error {
+	if len(pth) == 1 {
+		item[pth[0].name] = value
+		return nil
+	}
+
+	parent := path(pth[:len(pth)-1]).get(item)
+	last := pth[len(pth)-1]
+	switch {
+	case parent == nil:
+		return validationErr(fmt.Sprintf("the document path %s is invalid for update", pth))
+	case last.isIndex && parent.L != nil:
+		if last.index >= len(parent.L) {
+			parent.L = append(parent.L, value)
+		} else {
+			parent.L[last.index] = value
+		}
+	case !last.isIndex && parent.M != nil:
+		parent.M[last.name] = value
+	default:
+		return validationErr(fmt.Sprintf("the document path %s is invalid for update", pth))
+	}
+	return nil
+}
+
+func (pth path) remove(item dynamoItem) {
+	if len(pth) == 1 {
+		delete(item, pth[0].name)
+		return
+	}
+
+	parent := path(pth[:len(pth)-1]).get(item)
+	last := pth[len(pth)-1]
+	switch {
+	case parent == nil:
+	case last.isIndex && last.index < len(parent.L):
+		parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+	case !last.isIndex && parent.M != nil:
+		delete(parent.M, last.name)
+	}
+}
+
+func (p *parser) parsePath() (path, error) {
+	var pth path
+	for {
+		tok := p.next()
+		var name string
+		switch tok.kind {
+		case tokName:
+			n, ok := p.names[tok.text]
+			if !ok {
+				return nil, p.errorf("unknown attribute name placeholder %s", tok.text)
+			}
+			name = aws.StringValue(n)
+		case tokIdent:
+			name = tok.text
+		default:
+			return nil, p.errorf("expected attribute name, got %q", tok.text)
+		}
+		pth = append(pth, pathElem{name: name})
+
+		for p.isPunct("[") {
+			p.next()
+			idx := p.next()
+			if idx.kind != tokNumber {
+				return nil, p.errorf("expected list index, got %q", idx.text)
+			}
+			i, _ := strconv.Atoi(idx.text)
+			pth = append(pth, pathElem{index: i, isIndex: true})
+			if err := p.expectPunct("]"); err != nil {
+				return nil, err
+			}
+		}
+
+		if !p.isPunct(".") {
+			return pth, nil
+		}
+		p.next()
+	}
+}
+
+type operand interface {
+	resolve(item dynamoItem) *dynamodb.AttributeValue
+}
+
+type pathOperand struct {
+	path path
+}
+
+func (o pathOperand) resolve(item dynamoItem) *dynamodb.AttributeValue {
+	return o.path.get(item)
+}
+
+type valueOperand struct {
+	value *dynamodb.AttributeValue
+}
+
+func (o valueOperand) resolve(dynamoItem) *dynamodb.AttributeValue {
+	return o.value
+}
+
+type sizeOperand struct {
+	path path
+}
+
+func (o sizeOperand) resolve(item dynamoItem) *dynamodb.AttributeValue {
+	av := o.path.get(item)
+	var size int
+	switch attrType(av) {
+	case "S":
+		size = len(*av.S)
+	case "B":
+		size = len(av.B)
+	case "SS", "NS", "BS":
+		size = len(setMembers(av))
+	case "L":
+		size = len(av.L)
+	case "M":
+		size = len(av.M)
+	default:
+		return nil
+	}
+	return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(size))}
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokValue:
+		p.next()
+		av, ok := p.values[tok.text]
+		if !ok {
+			return nil, p.errorf("unknown attribute value placeholder %s", tok.text)
+		}
+		return valueOperand{av}, nil
+	case tok.kind == tokIdent && strings.EqualFold(tok.text, "size") && p.toks[p.pos+1].text == "(":
+		p.next()
+		p.next()
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return sizeOperand{pth}, nil
+	}
+
+	pth, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{pth}, nil
+}
+
+// conditions
+
+type condition interface {
+	eval(item dynamoItem) bool
+}
+
+type andCondition struct{ left, right condition }
+
+func (c andCondition) eval(item dynamoItem) bool { return c.left.eval(item) && c.right.eval(item) }
+
+type orCondition struct{ left, right condition }
+
+func (c orCondition) eval(item dynamoItem) bool { return c.left.eval(item) || c.right.eval(item) }
+
+type notCondition struct{ cond condition }
+
+func (c notCondition) eval(item dynamoItem) bool { return !c.cond.eval(item) }
+
+type compareCondition struct {
+	op          string
+	left, right operand
+}
+
+func (c compareCondition) eval(item dynamoItem) bool {
+	l, r := c.left.resolve(item), c.right.resolve(item)
+	if l == nil || r == nil {
+		return c.op == "<>"
+	}
+
+	switch c.op {
+	case "=":
+		return equalValues(l, r)
+	case "<>":
+		return !equalValues(l, r)
+	}
+
+	switch typ := attrType(l); {
+	case typ != attrType(r):
+		return false
+	case typ != "S" && typ != "N" && typ != "B":
+		// ordering only applies to scalars
+		return false
+	}
+	cmp := compareScalar(l, r)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type betweenCondition struct {
+	value, low, high operand
+}
+
+func (c betweenCondition) eval(item dynamoItem) bool {
+	return compareCondition{">=", c.value, c.low}.eval(item) &&
+		compareCondition{"<=", c.value, c.high}.eval(item)
+}
+
+type inCondition struct {
+	value   operand
+	options []operand
+}
+
+func (c inCondition) eval(item dynamoItem) bool {
+	for _, opt := range c.options {
+		if (compareCondition{"=", c.value, opt}).eval(item) {
+			return true
+		}
+	}
+	return false
+}
+
+type functionCondition struct {
+	name string
+	path path
+	arg  operand
+}
+
+func (c functionCondition) eval(item dynamoItem) bool {
+	av := c.path.get(item)
+	switch c.name {
+	case "attribute_exists":
+		return av != nil
+	case "attribute_not_exists":
+		return av == nil
+	case "attribute_type":
+		typ := c.arg.resolve(item)
+		return av != nil && typ != nil && attrType(av) == aws.StringValue(typ.S)
+	case "begins_with":
+		prefix := c.arg.resolve(item)
+		switch {
+		case av == nil || prefix == nil:
+			return false
+		case av.S != nil && prefix.S != nil:
+			return strings.HasPrefix(*av.S, *prefix.S)
+		case av.B != nil && prefix.B != nil:
+			return strings.HasPrefix(string(av.B), string(prefix.B))
+		}
+		return false
+	case "contains":
+		needle := c.arg.resolve(item)
+		switch {
+		case av == nil || needle == nil:
+			return false
+		case av.S != nil && needle.S != nil:
+			return strings.Contains(*av.S, *needle.S)
+		case av.SS != nil || av.NS != nil || av.BS != nil:
+			return containsMember(setMembers(av), needle)
+		case av.L != nil:
+			for _, elem := range av.L {
+				if equalValues(elem, needle) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// parseCondition parses a full condition expression
+func parseCondition(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (condition, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	return cond, p.expectEOF()
+}
+
+func (p *parser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		cond, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{cond}, nil
+	}
+	return p.parsePrimary()
+}
+
+var conditionFunctions = map[string]int{ // name -> number of args
+	"attribute_exists":     1,
+	"attribute_not_exists": 1,
+	"attribute_type":       2,
+	"begins_with":          2,
+	"contains":             2,
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.isPunct("(") {
+		p.next()
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.expectPunct(")")
+	}
+
+	tok := p.peek()
+	if nargs, ok := conditionFunctions[strings.ToLower(tok.text)]; ok && tok.kind == tokIdent && p.toks[p.pos+1].text == "(" {
+		p.next()
+		p.next()
+		fn := functionCondition{name: strings.ToLower(tok.text)}
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		fn.path = pth
+		if nargs == 2 {
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			fn.arg, err = p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return fn, p.expectPunct(")")
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, p.errorf("expected AND in BETWEEN")
+		}
+		p.next()
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenCondition{left, low, high}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		in := inCondition{value: left}
+		for {
+			opt, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			in.options = append(in.options, opt)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		return in, p.expectPunct(")")
+	}
+
+	op := p.next()
+	switch op.text {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, p.errorf("expected comparator, got %q", op.text)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareCondition{op.text, left, right}, nil
+}
+
+// hashKeyValue finds the equality condition on the hash key in a key condition expression
+func hashKeyValue(cond condition, hashKey string) (*dynamodb.AttributeValue, bool) {
+	switch c := cond.(type) {
+	case andCondition:
+		if av, ok := hashKeyValue(c.left, hashKey); ok {
+			return av, ok
+		}
+		return hashKeyValue(c.right, hashKey)
+	case compareCondition:
+		pth, ok := c.left.(pathOperand)
+		val, isVal := c.right.(valueOperand)
+		if c.op == "=" && ok && isVal && len(pth.path) == 1 && pth.path[0].name == hashKey {
+			return val.value, true
+		}
+	}
+	return nil, false
+}
+
+// updates
+
+type updateAction struct {
+	kind  string // SET, REMOVE, ADD or DELETE
+	path  path
+	value updateValue
+}
+
+type updateValue interface {
+	resolve(item dynamoItem) (*dynamodb.AttributeValue, error)
+}
+
+type operandValue struct {
+	operand operand
+}
+
+func (v operandValue) resolve(item dynamoItem) (*dynamodb.AttributeValue, error) {
+	av := v.operand.resolve(item)
+	if av == nil {
+		return nil, validationErr("the provided expression refers to an attribute that does not exist in the item")
+	}
+	return av, nil
+}
+
+type arithmeticValue struct {
+	op          string
+	left, right updateValue
+}
+
+func (v arithmeticValue) resolve(item dynamoItem) (*dynamodb.AttributeValue, error) {
+	l, err := v.left.resolve(item)
+	if err != nil {
+		return nil, err
+	}
+	r, err := v.right.resolve(item)
+	if err != nil {
+		return nil, err
+	}
+	if l.N == nil || r.N == nil {
+		return nil, validationErr("an operand in the update expression has an incorrect data type")
+	}
+
+	result := mustDecimal(l).Add(mustDecimal(r))
+	if v.op == "-" {
+		result = mustDecimal(l).Sub(mustDecimal(r))
+	}
+	return &dynamodb.AttributeValue{N: aws.String(result.String())}, nil
+}
+
+type ifNotExistsValue struct {
+	path     path
+	fallback updateValue
+}
+
+func (v ifNotExistsValue) resolve(item dynamoItem) (*dynamodb.AttributeValue, error) {
+	if av := v.path.get(item); av != nil {
+		return av, nil
+	}
+	return v.fallback.resolve(item)
+}
+
+type listAppendValue struct {
+	left, right updateValue
+}
+
+func (v listAppendValue) resolve(item dynamoItem) (*dynamodb.AttributeValue, error) {
+	l, err := v.left.resolve(item)
+	if err != nil {
+		return nil, err
+	}
+	r, err := v.right.resolve(item)
+	if err != nil {
+		return nil, err
+	}
+	if l.L == nil || r.L == nil {
+		return nil, validationErr("list_append operands must be lists")
+	}
+	return &dynamodb.AttributeValue{L: append(append([]*dynamodb.AttributeValue{}, l.L...), r.L...)}, nil
+}
+
+func parseUpdate(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) ([]updateAction, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []updateAction
+	for p.peek().kind != tokEOF {
+		clause := strings.ToUpper(p.next().text)
+		switch clause {
+		case "SET", "REMOVE", "ADD", "DELETE":
+		default:
+			return nil, p.errorf("expected SET, REMOVE, ADD or DELETE, got %q", clause)
+		}
+
+		for {
+			action := updateAction{kind: clause}
+			action.path, err = p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+
+			switch clause {
+			case "SET":
+				if err := p.expectPunct("="); err != nil {
+					return nil, err
+				}
+				action.value, err = p.parseSetValue()
+			case "ADD", "DELETE":
+				var op operand
+				op, err = p.parseOperand()
+				action.value = operandValue{op}
+			}
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, action)
+
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil, p.errorf("empty update expression")
+	}
+	return actions, nil
+}
+
+func (p *parser) parseSetValue() (updateValue, error) {
+	left, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.isPunct("+") || p.isPunct("-") {
+		op := p.next().text
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return arithmeticValue{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseSetOperand() (updateValue, error) {
+	tok := p.peek()
+	if tok.kind == tokIdent && p.toks[p.pos+1].text == "(" {
+		switch strings.ToLower(tok.text) {
+		case "if_not_exists":
+			p.next()
+			p.next()
+			pth, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			fallback, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			return ifNotExistsValue{pth, fallback}, p.expectPunct(")")
+		case "list_append":
+			p.next()
+			p.next()
+			left, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			right, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			return listAppendValue{left, right}, p.expectPunct(")")
+		}
+	}
+
+	op, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return operandValue{op}, nil
+}
+
+// applyUpdate applies the actions to a copy of item and returns it.
+// as in dynamo, all operands are resolved against the original item.
+func applyUpdate(item dynamoItem, actions []updateAction) (dynamoItem, error) {
+	updated := copyItem(item)
+	for _, action := range actions {
+		var value *dynamodb.AttributeValue
+		if action.value != nil {
+			var err error
+			value, err = action.value.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			value = copyValue(value)
+		}
+
+		switch action.kind {
+		case "SET":
+			if err := action.path.set(updated, value); err != nil {
+				return nil, err
+			}
+		case "REMOVE":
+			action.path.remove(updated)
+		case "ADD":
+			current := action.path.get(updated)
+			switch {
+			case current == nil:
+				if err := action.path.set(updated, value); err != nil {
+					return nil, err
+				}
+			case current.N != nil && value.N != nil:
+				sum := mustDecimal(current).Add(mustDecimal(value))
+				current.N = aws.String(sum.String())
+			case attrType(current) == attrType(value) && strings.HasSuffix(attrType(value), "S"):
+				members := setMembers(current)
+				for _, m := range setMembers(value) {
+					if !containsMember(members, m) {
+						members = append(members, m)
+					}
+				}
+				if err := action.path.set(updated, newSet(attrType(value), members)); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, validationErr("an operand in the update expression has an incorrect data type")
+			}
+		case "DELETE":
+			current := action.path.get(updated)
+			if current == nil {
+				continue
+			}
+			if attrType(current) != attrType(value) || !strings.HasSuffix(attrType(value), "S") {
+				return nil, validationErr("an operand in the update expression has an incorrect data type")
+			}
+			var remaining []*dynamodb.AttributeValue
+			for _, m := range setMembers(current) {
+				if !containsMember(setMembers(value), m) {
+					remaining = append(remaining, m)
+				}
+			}
+			if len(remaining) == 0 {
+				action.path.remove(updated)
+			} else if err := action.path.set(updated, newSet(attrType(value), remaining)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+// projections
+
+func parseProjection(expr string, names map[string]*string) ([]path, error) {
+	p, err := newParser(expr, names, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []path
+	for {
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, pth)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	return paths, p.expectEOF()
+}
+
+// project keeps the top-level attributes named by paths.
+// nested paths keep their whole top-level attribute.
+func project(item dynamoItem, paths []path) dynamoItem {
+	if paths == nil {
+		return item
+	}
+
+	projected := dynamoItem{}
+	for _, pth := range paths {
+		if av, ok := item[pth[0].name]; ok {
+			projected[pth[0].name] = av
+		}
+	}
+	return projected
+}
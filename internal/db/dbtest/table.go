@@ -0,0 +1,404 @@
+package dbtest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/shopspring/decimal"
+)
+
+// keySchema is the hash and (optional) range key of a table or index
+type keySchema struct {
+	hashKey  string
+	rangeKey string
+}
+
+func newKeySchema(elems []*dynamodb.KeySchemaElement) keySchema {
+	var ks keySchema
+	for _, elem := range elems {
+		switch aws.StringValue(elem.KeyType) {
+		case dynamodb.KeyTypeHash:
+			ks.hashKey = aws.StringValue(elem.AttributeName)
+		case dynamodb.KeyTypeRange:
+			ks.rangeKey = aws.StringValue(elem.AttributeName)
+		}
+	}
+	return ks
+}
+
+// has reports whether the item has all key attributes, i.e. whether it
+// belongs in an index with this schema
+func (ks keySchema) has(item dynamoItem) bool {
+	if item[ks.hashKey] == nil {
+		return false
+	}
+	if ks.rangeKey != "" && item[ks.rangeKey] == nil {
+		return false
+	}
+	return true
+}
+
+// key extracts only the key attributes of the item
+func (ks keySchema) key(item dynamoItem) dynamoItem {
+	key := dynamoItem{ks.hashKey: item[ks.hashKey]}
+	if ks.rangeKey != "" {
+		key[ks.rangeKey] = item[ks.rangeKey]
+	}
+	return key
+}
+
+// encode returns a string that uniquely identifies the key of the item
+func (ks keySchema) encode(item dynamoItem) string {
+	enc := encodeScalar(item[ks.hashKey])
+	if ks.rangeKey != "" {
+		enc += "|" + encodeScalar(item[ks.rangeKey])
+	}
+	return enc
+}
+
+func (ks keySchema) validateKey(key dynamoItem) error {
+	if len(key) != len(ks.key(key)) || !ks.has(key) {
+		return validationErr("the provided key element does not match the schema")
+	}
+	for name, av := range key {
+		if av == nil || av.S == nil && av.N == nil && av.B == nil {
+			return validationErr(fmt.Sprintf("key attribute %s must be a scalar", name))
+		}
+	}
+	return nil
+}
+
+// validateItem checks an item to be put has its key attributes
+func (ks keySchema) validateItem(item dynamoItem) error {
+	for _, name := range []string{ks.hashKey, ks.rangeKey} {
+		if name == "" {
+			continue
+		}
+		if av, ok := item[name]; !ok || av == nil {
+			return validationErr(fmt.Sprintf("One or more parameter values were invalid: Missing the key %s in the item", name))
+		}
+	}
+	return ks.validateKey(ks.key(item))
+}
+
+type index struct {
+	keySchema
+	projectionType   string
+	nonKeyAttributes []string
+}
+
+// project trims the item down to the attributes projected into the index
+func (idx index) project(item dynamoItem, tableKeys keySchema) dynamoItem {
+	if idx.projectionType == dynamodb.ProjectionTypeAll || idx.projectionType == "" {
+		return item
+	}
+
+	projected := dynamoItem{}
+	for _, name := range []string{idx.hashKey, idx.rangeKey, tableKeys.hashKey, tableKeys.rangeKey} {
+		if av, ok := item[name]; ok {
+			projected[name] = av
+		}
+	}
+	if idx.projectionType == dynamodb.ProjectionTypeInclude {
+		for _, name := range idx.nonKeyAttributes {
+			if av, ok := item[name]; ok {
+				projected[name] = av
+			}
+		}
+	}
+	return projected
+}
+
+type table struct {
+	keySchema
+	indexes map[string]index
+	items   map[string]dynamoItem // encoded key -> item
+}
+
+func newTable(ks keySchema) *table {
+	return &table{
+		keySchema: ks,
+		indexes:   map[string]index{},
+		items:     map[string]dynamoItem{},
+	}
+}
+
+// view returns the table, or one of its indexes, as a sorted list of items.
+// less orders any two items (or keys) from the view.
+func (t *table) view(indexName string) (ks keySchema, items []dynamoItem, less func(a, b dynamoItem) bool, err error) {
+	ks = t.keySchema
+	var idx *index
+	if indexName != "" {
+		i, ok := t.indexes[indexName]
+		if !ok {
+			return keySchema{}, nil, nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, fmt.Sprintf("index %s not found", indexName), nil)
+		}
+		ks = i.keySchema
+		idx = &i
+	}
+
+	for _, item := range t.items {
+		if !ks.has(item) {
+			// sparse index
+			continue
+		}
+		if idx != nil {
+			item = idx.project(item, t.keySchema)
+		}
+		items = append(items, copyItem(item))
+	}
+
+	less = func(a, b dynamoItem) bool {
+		if c := compareScalar(a[ks.hashKey], b[ks.hashKey]); c != 0 {
+			return c < 0
+		}
+		if ks.rangeKey != "" {
+			if c := compareScalar(a[ks.rangeKey], b[ks.rangeKey]); c != 0 {
+				return c < 0
+			}
+		}
+		// index keys need not be unique, so fall back to the table key
+		return t.encode(a) < t.encode(b)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	return ks, items, less, nil
+}
+
+// lastEvaluatedKey is the key to resume a paginated read of the view after item
+func (t *table) lastEvaluatedKey(ks keySchema, item dynamoItem) dynamoItem {
+	key := t.key(item)
+	for k, v := range ks.key(item) {
+		key[k] = v
+	}
+	return copyItem(key)
+}
+
+func validationErr(msg string) error {
+	return awserr.New("ValidationException", msg, nil)
+}
+
+func conditionFailedErr() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func encodeScalar(av *dynamodb.AttributeValue) string {
+	switch {
+	case av == nil:
+		return ""
+	case av.S != nil:
+		return "S:" + *av.S
+	case av.N != nil:
+		d, err := decimal.NewFromString(*av.N)
+		if err != nil {
+			return "N:" + *av.N
+		}
+		return "N:" + d.String()
+	case av.B != nil:
+		return fmt.Sprintf("B:%x", av.B)
+	}
+	return fmt.Sprintf("?:%v", av)
+}
+
+// compareScalar orders two scalars of the same type.
+// values of different types are ordered by type name.
+func compareScalar(a, b *dynamodb.AttributeValue) int {
+	ta, tb := attrType(a), attrType(b)
+	if ta != tb {
+		return strings.Compare(ta, tb)
+	}
+
+	switch ta {
+	case dynamodb.ScalarAttributeTypeS:
+		return strings.Compare(*a.S, *b.S)
+	case dynamodb.ScalarAttributeTypeN:
+		return mustDecimal(a).Cmp(mustDecimal(b))
+	case dynamodb.ScalarAttributeTypeB:
+		return bytes.Compare(a.B, b.B)
+	}
+	return 0
+}
+
+func mustDecimal(av *dynamodb.AttributeValue) decimal.Decimal {
+	d, err := decimal.NewFromString(aws.StringValue(av.N))
+	if err != nil {
+		return decimal.Zero
+	}
+	return d
+}
+
+// attrType returns the dynamo type descriptor of the value, e.g. "S" or "NS"
+func attrType(av *dynamodb.AttributeValue) string {
+	switch {
+	case av == nil:
+		return ""
+	case av.S != nil:
+		return "S"
+	case av.N != nil:
+		return "N"
+	case av.B != nil:
+		return "B"
+	case av.BOOL != nil:
+		return "BOOL"
+	case av.NULL != nil:
+		return "NULL"
+	case av.SS != nil:
+		return "SS"
+	case av.NS != nil:
+		return "NS"
+	case av.BS != nil:
+		return "BS"
+	case av.L != nil:
+		return "L"
+	case av.M != nil:
+		return "M"
+	}
+	return ""
+}
+
+// equalValues compares two attribute values, numerically for numbers
+func equalValues(a, b *dynamodb.AttributeValue) bool {
+	ta, tb := attrType(a), attrType(b)
+	if ta != tb {
+		return false
+	}
+
+	switch ta {
+	case "S", "N", "B":
+		return compareScalar(a, b) == 0
+	case "BOOL":
+		return *a.BOOL == *b.BOOL
+	case "NULL":
+		return true
+	case "SS", "NS", "BS":
+		as, bs := setMembers(a), setMembers(b)
+		if len(as) != len(bs) {
+			return false
+		}
+		for _, m := range as {
+			if !containsMember(bs, m) {
+				return false
+			}
+		}
+		return true
+	case "L":
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !equalValues(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case "M":
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, av := range a.M {
+			if !equalValues(av, b.M[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// setMembers returns the members of a set as scalar attribute values
+func setMembers(av *dynamodb.AttributeValue) []*dynamodb.AttributeValue {
+	var members []*dynamodb.AttributeValue
+	for _, s := range av.SS {
+		members = append(members, &dynamodb.AttributeValue{S: s})
+	}
+	for _, n := range av.NS {
+		members = append(members, &dynamodb.AttributeValue{N: n})
+	}
+	for _, b := range av.BS {
+		members = append(members, &dynamodb.AttributeValue{B: b})
+	}
+	return members
+}
+
+func containsMember(members []*dynamodb.AttributeValue, m *dynamodb.AttributeValue) bool {
+	for _, other := range members {
+		if compareScalar(m, other) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newSet builds a set of the given type ("SS", "NS" or "BS") from scalar members
+func newSet(typ string, members []*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	set := &dynamodb.AttributeValue{}
+	for _, m := range members {
+		switch typ {
+		case "SS":
+			set.SS = append(set.SS, m.S)
+		case "NS":
+			set.NS = append(set.NS, m.N)
+		case "BS":
+			set.BS = append(set.BS, m.B)
+		}
+	}
+	return set
+}
+
+func copyItem(item dynamoItem) dynamoItem {
+	if item == nil {
+		return nil
+	}
+	cp := make(dynamoItem, len(item))
+	for k, v := range item {
+		cp[k] = copyValue(v)
+	}
+	return cp
+}
+
+func copyValue(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	cp := &dynamodb.AttributeValue{
+		S:    av.S,
+		N:    av.N,
+		BOOL: av.BOOL,
+		NULL: av.NULL,
+	}
+	if av.B != nil {
+		cp.B = append([]byte(nil), av.B...)
+	}
+	if av.SS != nil {
+		cp.SS = append([]*string(nil), av.SS...)
+	}
+	if av.NS != nil {
+		cp.NS = append([]*string(nil), av.NS...)
+	}
+	if av.BS != nil {
+		cp.BS = make([][]byte, len(av.BS))
+		for i, b := range av.BS {
+			cp.BS[i] = append([]byte(nil), b...)
+		}
+	}
+	if av.L != nil {
+		cp.L = make([]*dynamodb.AttributeValue, len(av.L))
+		for i, v := range av.L {
+			cp.L[i] = copyValue(v)
+		}
+	}
+	if av.M != nil {
+		cp.M = make(map[string]*dynamodb.AttributeValue, len(av.M))
+		for k, v := range av.M {
+			cp.M[k] = copyValue(v)
+		}
+	}
+	return cp
+}
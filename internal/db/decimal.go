@@ -0,0 +1,51 @@
+// Package db holds helpers shared by the stores.
+package db
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/shopspring/decimal"
+)
+
+// Decimal is a decimal.Decimal that dynamo stores as a number.
+// It marshals to JSON the same way decimal.Decimal does.
+type Decimal struct {
+	decimal.Decimal
+}
+
+func NewDecimal(d decimal.Decimal) Decimal {
+	return Decimal{d}
+}
+
+func (d Decimal) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	av.N = aws.String(d.String())
+	return nil
+}
+
+func (d *Decimal) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	if av.N == nil {
+		d.Decimal = decimal.Zero
+		return nil
+	}
+
+	parsed, err := decimal.NewFromString(*av.N)
+	if err != nil {
+		return err
+	}
+
+	d.Decimal = parsed
+	return nil
+}
+
+// DecimalMap converts a map of decimals for storage
+func DecimalMap(m map[string]decimal.Decimal) map[string]Decimal {
+	if m == nil {
+		return nil
+	}
+
+	converted := make(map[string]Decimal, len(m))
+	for k, v := range m {
+		converted[k] = Decimal{v}
+	}
+	return converted
+}
@@ -0,0 +1,201 @@
+// Package filedb stores JSON documents in a directory, one file per key.
+// It's meant for running camelid on a single machine without AWS.
+package filedb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrNotFound = errors.New("not found")
+
+const ext = ".json"
+
+type Table struct {
+	dir string
+}
+
+// Open opens the table stored in dir, creating the directory if needed
+func Open(dir string) (*Table, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", dir, err)
+	}
+
+	return &Table{dir: dir}, nil
+}
+
+func (t *Table) path(key string) string {
+	// keys are escaped so they can't traverse out of dir,
+	// and can't be mistaken for hidden temp files
+	name := url.PathEscape(key)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return filepath.Join(t.dir, name+ext)
+}
+
+// Get unmarshals the document stored under key into v
+func (t *Table) Get(key string, v interface{}) error {
+	data, err := ioutil.ReadFile(t.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("unmarshaling %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Put stores v under key, replacing any existing document.
+// The write is atomic, readers see either the old or new document.
+func (t *Table) Put(key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling %s: %w", key, err)
+	}
+
+	tmp, err := ioutil.TempFile(t.dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	err = os.Rename(tmp.Name(), t.path(key))
+	if err != nil {
+		return fmt.Errorf("renaming %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Update atomically reads the document stored under key into v, calls fn,
+// then stores v unless fn returns an error, which Update returns.
+// found reports whether there was a document under key.
+// Updates of the same key are serialized, even across processes,
+// but a plain Put can still race with them.
+func (t *Table) Update(key string, v interface{}, fn func(found bool) error) error {
+	unlock, err := t.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	found := true
+	err = t.Get(key, v)
+	if errors.Is(err, ErrNotFound) {
+		found = false
+	} else if err != nil {
+		return err
+	}
+
+	err = fn(found)
+	if err != nil {
+		return err
+	}
+
+	return t.Put(key, v)
+}
+
+// lock takes an exclusive lock on key, through a lock file next to it, until
+// the returned func is called. The OS drops the lock if the holder dies, so
+// it's never stale. The lock file is left in place, removing it could let one
+// process lock the removed file while another locks a new one.
+func (t *Table) lock(key string) (func(), error) {
+	path := filepath.Join(t.dir, "."+filepath.Base(t.path(key))+".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("locking %s: %w", key, err)
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", key, err)
+	}
+
+	return func() { f.Close() }, nil
+}
+
+// Delete removes the document stored under key, if any
+func (t *Table) Delete(key string) error {
+	err := os.Remove(t.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("deleting %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Keys lists every key in the table, sorted
+func (t *Table) Keys() ([]string, error) {
+	entries, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", t.dir, err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		key, err := url.PathUnescape(strings.TrimSuffix(name, ext))
+		if err != nil {
+			return nil, fmt.Errorf("bad filename %s: %w", name, err)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Scan calls fn with the raw document stored under each key, in key order.
+// Documents deleted mid-scan are skipped.
+func (t *Table) Scan(fn func(key string, data []byte) error) error {
+	keys, err := t.Keys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		data, err := ioutil.ReadFile(t.path(key))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", key, err)
+		}
+
+		err = fn(key, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
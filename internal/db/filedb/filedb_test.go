@@ -0,0 +1,153 @@
+package filedb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type doc struct {
+	Name  string
+	Count int
+}
+
+func TestTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	table, err := Open(dir)
+	require.NoError(t, err)
+
+	var d doc
+	require.Equal(t, ErrNotFound, table.Get("a", &d))
+
+	require.NoError(t, table.Put("a", doc{"a", 1}))
+	require.NoError(t, table.Put("../b/c", doc{"b", 2}))
+	require.NoError(t, table.Put("a", doc{"a", 3}))
+
+	require.NoError(t, table.Get("a", &d))
+	require.Equal(t, doc{"a", 3}, d)
+
+	keys, err := table.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"../b/c", "a"}, keys)
+
+	var scanned []string
+	err = table.Scan(func(key string, data []byte) error {
+		scanned = append(scanned, key)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, keys, scanned)
+
+	require.NoError(t, table.Delete("a"))
+	require.NoError(t, table.Delete("a"))
+	require.Equal(t, ErrNotFound, table.Get("a", &d))
+
+	// nothing escaped the directory
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	table, err := Open(dir)
+	require.NoError(t, err)
+
+	// concurrent increments must not be lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var d doc
+			err := table.Update("counter", &d, func(found bool) error {
+				d.Name = "counter"
+				d.Count++
+				return nil
+			})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	var d doc
+	require.NoError(t, table.Get("counter", &d))
+	require.Equal(t, doc{"counter", 20}, d)
+
+	// an error from fn aborts the write
+	abort := errors.New("abort")
+	err = table.Update("counter", &d, func(found bool) error {
+		require.True(t, found)
+		d.Count = 0
+		return abort
+	})
+	require.Equal(t, abort, err)
+	require.NoError(t, table.Get("counter", &d))
+	require.Equal(t, 20, d.Count)
+
+	err = table.Update("new", &d, func(found bool) error {
+		require.False(t, found)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// lock files aren't keys
+	keys, err := table.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"counter", "new"}, keys)
+}
+
+func TestUpdate_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	table, err := Open(dir)
+	require.NoError(t, err)
+
+	// a lock file left behind doesn't hold anything up
+	lockPath := filepath.Join(dir, ".k.json.lock")
+	require.NoError(t, ioutil.WriteFile(lockPath, nil, 0600))
+	var d doc
+	require.NoError(t, table.Update("k", &d, func(found bool) error { return nil }))
+
+	// but a held lock is waited on, however old its file
+	unlock, err := table.lock("k")
+	require.NoError(t, err)
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(lockPath, old, old))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var d doc
+		err := table.Update("k", &d, func(found bool) error {
+			d.Count++
+			return nil
+		})
+		require.NoError(t, err)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Update didn't wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-done
+	require.NoError(t, table.Get("k", &d))
+	require.Equal(t, 1, d.Count)
+}
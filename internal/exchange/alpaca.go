@@ -0,0 +1,220 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+)
+
+// alpacaAPI is the part of the alpaca client camelid uses
+type alpacaAPI interface {
+	GetAccount() (*alpaca.Account, error)
+	GetLastQuote(string) (*alpaca.LastQuoteResponse, error)
+	GetOrder(string) (*alpaca.Order, error)
+	ListOrders(status *string, until *time.Time, limit *int, nested *bool) ([]alpaca.Order, error)
+	PlaceOrder(alpaca.PlaceOrderRequest) (*alpaca.Order, error)
+	ListPositions() ([]alpaca.Position, error)
+}
+
+var _ alpacaAPI = (*alpaca.Client)(nil)
+
+type alpacaClient struct {
+	client alpacaAPI
+}
+
+// AlpacaDefaults stay under alpaca's limit of 200 requests a minute,
+// leaving some for anyone else using the keys
+func AlpacaDefaults() BrokerDefaults {
+	return BrokerDefaults{
+		RateLimits: map[EndpointClass]RateLimit{
+			AllEndpoints: {PerMinute: 180, Burst: 10},
+		},
+		Retries: RetryPolicy{
+			Attempts:  3,
+			BaseDelay: 500 * time.Millisecond,
+			MaxDelay:  5 * time.Second,
+			// a request frees up every 300ms, wait for a few
+			RateLimitDelay: 3 * time.Second,
+		},
+	}
+}
+
+// NewAlpacaClient adapts an alpaca client to Client
+func NewAlpacaClient(client *alpaca.Client) Client {
+	return &alpacaClient{client}
+}
+
+func (c *alpacaClient) GetAccount(ctx context.Context) (*Account, error) {
+	var account *alpaca.Account
+	err := do(ctx, func() (err error) {
+		account, err = c.client.GetAccount()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Account{ID: account.ID, Cash: account.Cash}, nil
+}
+
+func (c *alpacaClient) GetLastQuote(ctx context.Context, symbol string) (*Quote, error) {
+	var resp *alpaca.LastQuoteResponse
+	err := do(ctx, func() (err error) {
+		resp, err = c.client.GetLastQuote(symbol)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Quote{
+		Symbol:    symbol,
+		BidPrice:  decimal.NewFromFloat32(resp.Last.BidPrice),
+		AskPrice:  decimal.NewFromFloat32(resp.Last.AskPrice),
+		Timestamp: resp.Last.Time(),
+	}, nil
+}
+
+func (c *alpacaClient) GetOrder(ctx context.Context, id string) (*Order, error) {
+	var order *alpaca.Order
+	err := do(ctx, func() (err error) {
+		order, err = c.client.GetOrder(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := fromAlpacaOrder(order)
+	return &converted, nil
+}
+
+func (c *alpacaClient) ListOrders(ctx context.Context, req ListOrdersRequest) ([]Order, error) {
+	var status *string
+	if req.Status != "" {
+		status = &req.Status
+	}
+	var limit *int
+	if req.Limit > 0 {
+		limit = &req.Limit
+	}
+
+	var orders []alpaca.Order
+	err := do(ctx, func() (err error) {
+		orders, err = c.client.ListOrders(status, req.Until, limit, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := make([]Order, 0, len(orders))
+	for i := range orders {
+		converted = append(converted, fromAlpacaOrder(&orders[i]))
+	}
+	return converted, nil
+}
+
+func (c *alpacaClient) PlaceOrder(ctx context.Context, req OrderRequest) (*Order, error) {
+	symbol := req.Symbol
+	var order *alpaca.Order
+	err := do(ctx, func() (err error) {
+		order, err = c.client.PlaceOrder(alpaca.PlaceOrderRequest{
+			AssetKey:      &symbol,
+			Qty:           req.Qty,
+			Side:          alpaca.Side(req.Side),
+			Type:          alpaca.OrderType(req.Type),
+			TimeInForce:   alpaca.TimeInForce(req.TimeInForce),
+			LimitPrice:    req.LimitPrice,
+			ClientOrderID: req.ClientOrderID,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := fromAlpacaOrder(order)
+	return &converted, nil
+}
+
+func (c *alpacaClient) ListPositions(ctx context.Context) ([]Position, error) {
+	var positions []alpaca.Position
+	err := do(ctx, func() (err error) {
+		positions, err = c.client.ListPositions()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	converted := make([]Position, 0, len(positions))
+	for _, position := range positions {
+		converted = append(converted, Position{
+			Symbol:       position.Symbol,
+			Qty:          position.Qty,
+			MarketValue:  position.MarketValue,
+			CurrentPrice: position.CurrentPrice,
+		})
+	}
+	return converted, nil
+}
+
+// do calls fn, giving up on it once ctx is done. The alpaca client doesn't
+// take a context, so fn is left to finish in the background.
+func do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fromAlpacaError(fn())
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fromAlpacaError classifies errors from alpaca, leaving the rest as is
+func fromAlpacaError(err error) error {
+	var apiErr *alpaca.APIError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &apiErr):
+		// alpaca's error codes start with the HTTP status, e.g. 42210000 is a 422
+		status := apiErr.Code / 100000
+		return &Error{StatusCode: status, Retryable: retryableStatus(status), Err: err}
+	case errors.As(err, &syntaxErr):
+		// error responses that aren't JSON come from in front of alpaca, e.g. a 502 from its load balancer
+		return &Error{Retryable: true, Err: err}
+	}
+	return err
+}
+
+func fromAlpacaOrder(order *alpaca.Order) Order {
+	return Order{
+		ID:             order.ID,
+		ClientOrderID:  order.ClientOrderID,
+		Symbol:         order.Symbol,
+		Side:           Side(order.Side),
+		Type:           OrderType(order.Type),
+		TimeInForce:    TimeInForce(order.TimeInForce),
+		Qty:            order.Qty,
+		FilledQty:      order.FilledQty,
+		FilledAvgPrice: order.FilledAvgPrice,
+		Status:         OrderStatus(order.Status),
+		CreatedAt:      order.CreatedAt,
+		SubmittedAt:    order.SubmittedAt,
+		UpdatedAt:      order.UpdatedAt,
+		FilledAt:       order.FilledAt,
+	}
+}
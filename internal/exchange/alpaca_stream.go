@@ -0,0 +1,190 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/gorilla/websocket"
+)
+
+// streamHandshakeTimeout bounds how long authenticating and subscribing can take
+const streamHandshakeTimeout = 10 * time.Second
+
+// streamMessage is a message on alpaca's stream, in either direction
+type streamMessage struct {
+	Stream string          `json:"stream,omitempty"`
+	Action string          `json:"action,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type alpacaStream struct {
+	url         string
+	credentials *common.APIKey
+}
+
+// NewAlpacaTradeStream streams trade updates from the alpaca API at baseURL,
+// e.g. https://paper-api.alpaca.markets. The alpaca client's own stream
+// reconnects forever, and panics if it can't, so this talks to it directly.
+func NewAlpacaTradeStream(baseURL string, credentials *common.APIKey) (TradeStream, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing alpaca URL: %w", err)
+	}
+
+	scheme := "wss"
+	if u.Scheme == "http" {
+		scheme = "ws"
+	}
+	streamURL := url.URL{Scheme: scheme, Host: u.Host, Path: "/stream"}
+	return &alpacaStream{url: streamURL.String(), credentials: credentials}, nil
+}
+
+func (s *alpacaStream) SubscribeTradeUpdates(ctx context.Context) (TradeSubscription, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", s.url, err)
+	}
+
+	err = handshake(conn, s.credentials)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sub := &alpacaSubscription{conn: conn, done: make(chan struct{})}
+	// reads don't take a context, closing the connection cuts them short
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.done:
+		}
+	}()
+	return sub, nil
+}
+
+// handshake authenticates and subscribes to trade updates
+func handshake(conn *websocket.Conn, credentials *common.APIKey) error {
+	conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := send(conn, "authenticate", map[string]string{
+		"key_id":     credentials.ID,
+		"secret_key": credentials.Secret,
+	})
+	if err != nil {
+		return fmt.Errorf("authenticating: %w", err)
+	}
+	var auth struct {
+		Status string `json:"status"`
+	}
+	err = receive(conn, "authorization", &auth)
+	if err != nil {
+		return fmt.Errorf("authenticating: %w", err)
+	} else if !strings.EqualFold(auth.Status, "authorized") {
+		return fmt.Errorf("authenticating: %s", auth.Status)
+	}
+
+	err = send(conn, "listen", map[string][]string{"streams": {alpaca.TradeUpdates}})
+	if err != nil {
+		return fmt.Errorf("subscribing to trade updates: %w", err)
+	}
+	var listening struct {
+		Streams []string `json:"streams"`
+	}
+	err = receive(conn, "listening", &listening)
+	if err != nil {
+		return fmt.Errorf("subscribing to trade updates: %w", err)
+	}
+	for _, stream := range listening.Streams {
+		if stream == alpaca.TradeUpdates {
+			return nil
+		}
+	}
+	return fmt.Errorf("subscribing to trade updates: listening to %v", listening.Streams)
+}
+
+func send(conn *websocket.Conn, action string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(streamMessage{Action: action, Data: raw})
+}
+
+// receive decodes the data of the next message, which must be on stream
+func receive(conn *websocket.Conn, stream string, data interface{}) error {
+	msg, err := readMessage(conn)
+	if err != nil {
+		return err
+	} else if msg.Stream != stream {
+		return fmt.Errorf("expected a message on %s, got one on %s: %s", stream, msg.Stream, msg.Data)
+	}
+	return json.Unmarshal(msg.Data, data)
+}
+
+// readMessage reads the next message, which alpaca sends as text or binary frames
+func readMessage(conn *websocket.Conn) (*streamMessage, error) {
+	_, raw, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg streamMessage
+	err = json.Unmarshal(raw, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("decoding stream message: %w", err)
+	}
+	return &msg, nil
+}
+
+type alpacaSubscription struct {
+	conn *websocket.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (s *alpacaSubscription) Next() (*TradeUpdate, error) {
+	for {
+		msg, err := readMessage(s.conn)
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil, errors.New("subscription closed")
+			default:
+				return nil, err
+			}
+		}
+		if msg.Stream != alpaca.TradeUpdates {
+			continue
+		}
+
+		var update alpaca.TradeUpdate
+		err = json.Unmarshal(msg.Data, &update)
+		if err != nil {
+			return nil, fmt.Errorf("decoding trade update: %w", err)
+		}
+		return &TradeUpdate{Event: update.Event, Order: fromAlpacaOrder(&update.Order)}, nil
+	}
+}
+
+func (s *alpacaSubscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		err = s.conn.Close()
+	})
+	return err
+}
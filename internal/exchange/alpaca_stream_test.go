@@ -0,0 +1,74 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange/alpacatest"
+)
+
+func TestAlpacaTradeStream(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+	defer server.Install()()
+	server.SetCash(decimal.NewFromInt(1000))
+	server.SetQuote("VOO", decimal.RequireFromString("326.35"), decimal.RequireFromString("326.5"))
+
+	credentials := &common.APIKey{ID: "key", Secret: "secret"}
+	client := NewAlpacaClient(alpaca.NewClient(credentials))
+	stream, err := NewAlpacaTradeStream(server.URL, credentials)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub, err := stream.SubscribeTradeUpdates(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, server.Subscribers())
+
+	placed, err := client.PlaceOrder(ctx, OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(2), Side: Buy, Type: Market, TimeInForce: Day, ClientOrderID: "trade1"})
+	require.NoError(t, err)
+	update, err := sub.Next()
+	require.NoError(t, err)
+	require.Equal(t, "new", update.Event)
+	require.Equal(t, placed.ID, update.Order.ID)
+	require.Equal(t, "trade1", update.Order.ClientOrderID)
+
+	server.FillOrders()
+	update, err = sub.Next()
+	require.NoError(t, err)
+	require.Equal(t, "fill", update.Event)
+	require.Equal(t, OrderFilled, update.Order.Status)
+	require.True(t, decimal.NewFromInt(2).Equal(update.Order.FilledQty))
+
+	// the subscription ends when the stream drops
+	server.SetStreamDown(true)
+	_, err = sub.Next()
+	require.Error(t, err)
+	sub.Close()
+	_, err = stream.SubscribeTradeUpdates(ctx)
+	require.Error(t, err)
+
+	// or the context is done
+	server.SetStreamDown(false)
+	sub, err = stream.SubscribeTradeUpdates(ctx)
+	require.NoError(t, err)
+	cancel()
+	_, err = sub.Next()
+	require.Error(t, err)
+}
+
+func TestAlpacaTradeStream_Unauthorized(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+
+	stream, err := NewAlpacaTradeStream(server.URL, &common.APIKey{ID: "key", Secret: "wrong"})
+	require.NoError(t, err)
+	_, err = stream.SubscribeTradeUpdates(context.TODO())
+	require.EqualError(t, err, "authenticating: unauthorized")
+	require.Equal(t, 0, server.Subscribers())
+}
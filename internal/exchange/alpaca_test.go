@@ -0,0 +1,266 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange/alpacatest"
+)
+
+// fakeAlpaca returns canned responses, and keeps the requests it was sent
+type fakeAlpaca struct {
+	alpacaAPI // panics on anything not faked
+
+	order     alpaca.Order
+	quote     alpaca.LastQuoteResponse
+	positions []alpaca.Position
+
+	placed     []alpaca.PlaceOrderRequest
+	listStatus *string
+	listUntil  *time.Time
+	listLimit  *int
+}
+
+func (f *fakeAlpaca) GetLastQuote(symbol string) (*alpaca.LastQuoteResponse, error) {
+	return &f.quote, nil
+}
+
+func (f *fakeAlpaca) GetOrder(id string) (*alpaca.Order, error) {
+	return &f.order, nil
+}
+
+func (f *fakeAlpaca) ListOrders(status *string, until *time.Time, limit *int, nested *bool) ([]alpaca.Order, error) {
+	f.listStatus, f.listUntil, f.listLimit = status, until, limit
+	return []alpaca.Order{f.order}, nil
+}
+
+func (f *fakeAlpaca) PlaceOrder(req alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+	f.placed = append(f.placed, req)
+	return &f.order, nil
+}
+
+func (f *fakeAlpaca) ListPositions() ([]alpaca.Position, error) {
+	return f.positions, nil
+}
+
+func TestAlpacaClient(t *testing.T) {
+	now := time.Now().UTC()
+	fillPrice := decimal.RequireFromString("298.45")
+	fake := &fakeAlpaca{
+		order: alpaca.Order{
+			ID:             "alpaca11",
+			ClientOrderID:  "trade1",
+			Symbol:         "VOO",
+			Side:           alpaca.Buy,
+			Type:           alpaca.Market,
+			TimeInForce:    alpaca.Day,
+			Qty:            decimal.NewFromInt(3),
+			FilledQty:      decimal.NewFromInt(2),
+			FilledAvgPrice: &fillPrice,
+			Status:         "partially_filled",
+			CreatedAt:      now,
+			SubmittedAt:    now,
+			UpdatedAt:      now,
+		},
+		quote: alpaca.LastQuoteResponse{
+			Symbol: "VOO",
+			Last:   alpaca.LastQuote{AskPrice: 326.41, BidPrice: 326.35, Timestamp: 1596226084553000000},
+		},
+		positions: []alpaca.Position{
+			{Symbol: "VOO", Qty: decimal.NewFromInt(4), MarketValue: decimal.NewFromInt(1200), CurrentPrice: decimal.NewFromInt(300)},
+		},
+	}
+	client := &alpacaClient{fake}
+	ctx := context.TODO()
+
+	expectedOrder := Order{
+		ID:             "alpaca11",
+		ClientOrderID:  "trade1",
+		Symbol:         "VOO",
+		Side:           Buy,
+		Type:           Market,
+		TimeInForce:    Day,
+		Qty:            decimal.NewFromInt(3),
+		FilledQty:      decimal.NewFromInt(2),
+		FilledAvgPrice: &fillPrice,
+		Status:         OrderPartiallyFilled,
+		CreatedAt:      now,
+		SubmittedAt:    now,
+		UpdatedAt:      now,
+	}
+
+	order, err := client.GetOrder(ctx, "alpaca11")
+	require.NoError(t, err)
+	require.Equal(t, expectedOrder, *order)
+
+	quote, err := client.GetLastQuote(ctx, "VOO")
+	require.NoError(t, err)
+	require.Equal(t, "VOO", quote.Symbol)
+	require.True(t, decimal.NewFromFloat32(326.35).Equal(quote.BidPrice))
+	require.True(t, decimal.NewFromFloat32(326.41).Equal(quote.AskPrice))
+	require.True(t, time.Unix(0, 1596226084553000000).Equal(quote.Timestamp))
+
+	positions, err := client.ListPositions(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Position{
+		{Symbol: "VOO", Qty: decimal.NewFromInt(4), MarketValue: decimal.NewFromInt(1200), CurrentPrice: decimal.NewFromInt(300)},
+	}, positions)
+
+	// zero fields are left to alpaca's defaults
+	orders, err := client.ListOrders(ctx, ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []Order{expectedOrder}, orders)
+	require.Nil(t, fake.listStatus)
+	require.Nil(t, fake.listUntil)
+	require.Nil(t, fake.listLimit)
+
+	_, err = client.ListOrders(ctx, ListOrdersRequest{Status: "all", Until: &now, Limit: 500})
+	require.NoError(t, err)
+	require.Equal(t, "all", *fake.listStatus)
+	require.Equal(t, &now, fake.listUntil)
+	require.Equal(t, 500, *fake.listLimit)
+
+	placed, err := client.PlaceOrder(ctx, OrderRequest{
+		Symbol:        "VOO",
+		Qty:           decimal.NewFromInt(3),
+		Side:          Buy,
+		Type:          Market,
+		TimeInForce:   Day,
+		ClientOrderID: "trade1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedOrder, *placed)
+	require.Len(t, fake.placed, 1)
+	require.Equal(t, "VOO", *fake.placed[0].AssetKey)
+	require.True(t, decimal.NewFromInt(3).Equal(fake.placed[0].Qty))
+	require.Equal(t, alpaca.Buy, fake.placed[0].Side)
+	require.Equal(t, alpaca.Market, fake.placed[0].Type)
+	require.Equal(t, alpaca.Day, fake.placed[0].TimeInForce)
+	require.Equal(t, "trade1", fake.placed[0].ClientOrderID)
+}
+
+func TestAlpacaClient_HTTP(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+	defer server.Install()()
+	server.SetCash(decimal.NewFromInt(1000))
+	server.SetQuote("VOO", decimal.RequireFromString("326.35"), decimal.RequireFromString("326.5"))
+	server.SetPosition("VOO", decimal.NewFromInt(2), decimal.NewFromInt(300))
+
+	client := NewAlpacaClient(alpaca.NewClient(&common.APIKey{ID: "key", Secret: "secret"}))
+	ctx := context.TODO()
+
+	account, err := client.GetAccount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, alpacatest.AccountID, account.ID)
+	require.True(t, decimal.NewFromInt(1000).Equal(account.Cash))
+
+	quote, err := client.GetLastQuote(ctx, "VOO")
+	require.NoError(t, err)
+	require.True(t, decimal.RequireFromString("326.35").Equal(quote.BidPrice))
+	require.True(t, decimal.RequireFromString("326.5").Equal(quote.AskPrice))
+
+	positions, err := client.ListPositions(ctx)
+	require.NoError(t, err)
+	require.Len(t, positions, 1)
+	require.True(t, decimal.RequireFromString("652.7").Equal(positions[0].MarketValue))
+
+	placed, err := client.PlaceOrder(ctx, OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(3), Side: Buy, Type: Market, TimeInForce: Day, ClientOrderID: "trade1"})
+	require.NoError(t, err)
+	require.Equal(t, "trade1", placed.ClientOrderID)
+	require.Equal(t, OrderAccepted, placed.Status)
+
+	open, err := client.ListOrders(ctx, ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Len(t, open, 1)
+
+	server.FillOrders()
+	order, err := client.GetOrder(ctx, placed.ID)
+	require.NoError(t, err)
+	require.Equal(t, OrderFilled, order.Status)
+	require.True(t, decimal.NewFromInt(3).Equal(order.FilledQty))
+	require.True(t, decimal.RequireFromString("326.5").Equal(*order.FilledAvgPrice))
+	require.True(t, decimal.RequireFromString("20.5").Equal(server.Cash()))
+	require.True(t, decimal.NewFromInt(5).Equal(server.Positions()["VOO"]))
+
+	open, err = client.ListOrders(ctx, ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Empty(t, open)
+	all, err := client.ListOrders(ctx, ListOrdersRequest{Status: "all", Limit: 500})
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+}
+
+func TestAlpacaClient_HTTPErrors(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+	defer server.Install()()
+	server.SetCash(decimal.NewFromInt(100))
+	server.SetQuote("VOO", decimal.RequireFromString("326.35"), decimal.RequireFromString("326.5"))
+
+	client := NewAlpacaClient(alpaca.NewClient(&common.APIKey{ID: "key", Secret: "secret"}))
+	ctx := context.TODO()
+	buy := OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(3), Side: Buy, Type: Market, TimeInForce: Day}
+
+	testCases := []struct {
+		name      string
+		fault     *alpacatest.Fault
+		call      func() error
+		status    int
+		retryable bool
+	}{
+		{
+			name:   "insufficient buying power",
+			call:   func() error { _, err := client.PlaceOrder(ctx, buy); return err },
+			status: 403,
+		},
+		{
+			name:   "unknown order",
+			call:   func() error { _, err := client.GetOrder(ctx, "missing"); return err },
+			status: 404,
+		},
+		{
+			name:      "rate limited",
+			fault:     &alpacatest.Fault{Status: 429},
+			call:      func() error { _, err := client.GetAccount(ctx); return err },
+			status:    429,
+			retryable: true,
+		},
+		{
+			name:      "load balancer",
+			fault:     &alpacatest.Fault{Status: 502, Body: "<html>bad gateway</html>"},
+			call:      func() error { _, err := client.GetAccount(ctx); return err },
+			retryable: true,
+		},
+		{
+			name: "wrong key",
+			call: func() error {
+				_, err := NewAlpacaClient(alpaca.NewClient(&common.APIKey{ID: "key", Secret: "wrong"})).GetAccount(ctx)
+				return err
+			},
+			status: 401,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.fault != nil {
+				server.Fail(alpacatest.RouteAccount, *tc.fault)
+			}
+
+			err := tc.call()
+			var exchangeErr *Error
+			require.True(t, errors.As(err, &exchangeErr), "got %v", err)
+			require.Equal(t, tc.status, exchangeErr.StatusCode)
+			require.Equal(t, tc.retryable, IsRetryable(err))
+		})
+	}
+}
@@ -0,0 +1,697 @@
+// Package alpacatest fakes alpaca's REST API and trade update stream, so that the real
+// alpaca client, and everything wired to it, can be tested offline.
+package alpacatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+)
+
+// routes the server answers, for use with Fail and Requests
+const (
+	RouteAccount    = "GET /v2/account"
+	RoutePositions  = "GET /v2/positions"
+	RouteLastQuote  = "GET /v1/last_quote/stocks/{symbol}"
+	RouteListOrders = "GET /v2/orders"
+	RouteGetOrder   = "GET /v2/orders/{id}"
+	RoutePlaceOrder = "POST /v2/orders"
+	RouteStream     = "GET /stream"
+)
+
+// AccountID is the ID of the fake account
+const AccountID = "fake-account"
+
+// Fault is returned instead of the next answer on a route.
+// Body defaults to alpaca's JSON error for Status. Set it to
+// something else for errors from in front of alpaca, e.g. an HTML 502.
+type Fault struct {
+	Status int
+	Body   string
+}
+
+// Server is a fake alpaca, with state scripted through its methods.
+// Placed orders are accepted, and stay open until filled with FillOrders
+// or moved along with SetOrderStatus. Each of those is streamed as a trade
+// update to clients subscribed to its websocket at /stream.
+type Server struct {
+	*httptest.Server
+
+	keyID, secretKey string
+
+	mu        sync.Mutex
+	cash      decimal.Decimal
+	quotes    map[string]alpaca.LastQuote
+	positions map[string]*alpaca.Position
+	orders    []*alpaca.Order
+
+	requests map[string]int
+	faults   map[string][]Fault // route -> faults for its next requests
+
+	streamDown  bool
+	subscribers map[*websocket.Conn]bool
+}
+
+// NewServer starts a fake alpaca that only answers requests with the key
+func NewServer(keyID, secretKey string) *Server {
+	s := &Server{
+		keyID:     keyID,
+		secretKey: secretKey,
+		quotes:    map[string]alpaca.LastQuote{},
+		positions: map[string]*alpaca.Position{},
+		requests:  map[string]int{},
+		faults:    map[string][]Fault{},
+
+		subscribers: map[*websocket.Conn]bool{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Install points the alpaca client at the server until the returned func is called.
+// The base URL is set directly. The market data URL is only read from APCA_DATA_URL
+// when the alpaca client loads, so requests to it are rerouted by http.DefaultClient,
+// which the alpaca client sends everything through.
+func (s *Server) Install() (restore func()) {
+	transport := http.DefaultClient.Transport
+	server, _ := url.Parse(s.URL)
+
+	alpaca.SetBaseUrl(s.URL)
+	http.DefaultClient.Transport = &reroute{from: dataHost(), to: server, next: transport}
+	return func() {
+		alpaca.SetBaseUrl(baseURL())
+		http.DefaultClient.Transport = transport
+	}
+}
+
+// baseURL is where the alpaca client sends requests by default
+func baseURL() string {
+	if s := os.Getenv("APCA_API_BASE_URL"); s != "" {
+		return s
+	} else if s := os.Getenv("ALPACA_BASE_URL"); s != "" {
+		return s
+	}
+	return "https://api.alpaca.markets"
+}
+
+// dataHost is where the alpaca client sends market data requests
+func dataHost() string {
+	dataURL := "https://data.alpaca.markets"
+	if s := os.Getenv("APCA_DATA_URL"); s != "" {
+		dataURL = s
+	}
+	u, err := url.Parse(dataURL)
+	if err != nil {
+		return dataURL
+	}
+	return u.Host
+}
+
+// reroute sends requests for one host to another
+type reroute struct {
+	from string
+	to   *url.URL
+	next http.RoundTripper
+}
+
+func (r *reroute) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := r.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if req.URL.Host != r.from {
+		return next.RoundTrip(req)
+	}
+
+	rerouted := req.Clone(req.Context())
+	rerouted.URL.Scheme = r.to.Scheme
+	rerouted.URL.Host = r.to.Host
+	rerouted.Host = r.to.Host
+	return next.RoundTrip(rerouted)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	route, arg := routeOf(r)
+	if route == RouteStream {
+		// a long-lived connection, which can't hold the lock
+		s.stream(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[route]++
+	if faults := s.faults[route]; len(faults) > 0 {
+		s.faults[route] = faults[1:]
+		writeFault(w, faults[0])
+		return
+	}
+
+	if r.Header.Get("APCA-API-KEY-ID") != s.keyID || r.Header.Get("APCA-API-SECRET-KEY") != s.secretKey {
+		writeError(w, http.StatusUnauthorized, "request is not authorized")
+		return
+	}
+
+	switch route {
+	case RouteAccount:
+		writeJSON(w, alpaca.Account{
+			ID:          AccountID,
+			Status:      "ACTIVE",
+			Currency:    "USD",
+			Cash:        s.cash,
+			BuyingPower: s.buyingPower(),
+		})
+	case RoutePositions:
+		s.listPositions(w)
+	case RouteLastQuote:
+		s.getLastQuote(w, arg)
+	case RouteListOrders:
+		s.listOrders(w, r)
+	case RouteGetOrder:
+		s.getOrder(w, arg)
+	case RoutePlaceOrder:
+		s.placeOrder(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("endpoint not found: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// routeOf finds the route of a request, and the ID or symbol in its path
+func routeOf(r *http.Request) (route, arg string) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && path == "/v2/account":
+		return RouteAccount, ""
+	case r.Method == http.MethodGet && path == "/v2/positions":
+		return RoutePositions, ""
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v1/last_quote/stocks/"):
+		return RouteLastQuote, strings.TrimPrefix(path, "/v1/last_quote/stocks/")
+	case r.Method == http.MethodGet && path == "/v2/orders":
+		return RouteListOrders, ""
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v2/orders/"):
+		return RouteGetOrder, strings.TrimPrefix(path, "/v2/orders/")
+	case r.Method == http.MethodPost && path == "/v2/orders":
+		return RoutePlaceOrder, ""
+	case r.Method == http.MethodGet && path == "/stream":
+		return RouteStream, ""
+	}
+	return r.Method + " " + path, ""
+}
+
+func (s *Server) listPositions(w http.ResponseWriter) {
+	positions := []alpaca.Position{}
+	for _, position := range s.positions {
+		positions = append(positions, *position)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].Symbol < positions[j].Symbol
+	})
+	writeJSON(w, positions)
+}
+
+func (s *Server) getLastQuote(w http.ResponseWriter, symbol string) {
+	quote, ok := s.quotes[symbol]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no quote for %s", symbol))
+		return
+	}
+	writeJSON(w, alpaca.LastQuoteResponse{Status: "success", Symbol: symbol, Last: quote})
+}
+
+// listOrders filters the orders like alpaca does, newest first
+func (s *Server) listOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status == "" {
+		status = "open" // alpaca's default
+	}
+	var until time.Time
+	if s := query.Get("until"); s != "" {
+		var err error
+		until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid until: %v", err))
+			return
+		}
+	}
+	limit := 50 // alpaca's default
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid limit %q", s))
+			return
+		}
+	}
+
+	orders := []alpaca.Order{}
+	for _, order := range s.orders {
+		if !until.IsZero() && order.SubmittedAt.After(until) {
+			continue
+		}
+		open := isOpen(order.Status)
+		if (status == "open" && !open) || (status == "closed" && open) {
+			continue
+		}
+		orders = append(orders, *order)
+	}
+
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].SubmittedAt.After(orders[j].SubmittedAt)
+	})
+	if len(orders) > limit {
+		orders = orders[:limit]
+	}
+	writeJSON(w, orders)
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, id string) {
+	order := s.order(id)
+	if order == nil {
+		writeError(w, http.StatusNotFound, "order not found")
+		return
+	}
+	writeJSON(w, order)
+}
+
+func (s *Server) placeOrder(w http.ResponseWriter, r *http.Request) {
+	var req alpaca.PlaceOrderRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid order: %v", err))
+		return
+	}
+
+	if req.AssetKey == nil {
+		writeError(w, http.StatusUnprocessableEntity, "symbol is required")
+		return
+	}
+	symbol := *req.AssetKey
+	quote, ok := s.quotes[symbol]
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("asset %q not found", symbol))
+		return
+	}
+	if !req.Qty.IsPositive() {
+		writeError(w, http.StatusUnprocessableEntity, "qty must be > 0")
+		return
+	}
+	if req.Side == alpaca.Buy {
+		cost := req.Qty.Mul(decimal.NewFromFloat32(quote.AskPrice))
+		if cost.GreaterThan(s.buyingPower()) {
+			writeError(w, http.StatusForbidden, "insufficient buying power")
+			return
+		}
+	}
+
+	clientOrderID := req.ClientOrderID
+	if clientOrderID == "" {
+		clientOrderID = uuid.New().String()
+	}
+	for _, order := range s.orders {
+		if order.ClientOrderID == clientOrderID {
+			writeError(w, http.StatusUnprocessableEntity, "client_order_id must be unique")
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	order := &alpaca.Order{
+		ID:            uuid.New().String(),
+		ClientOrderID: clientOrderID,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		SubmittedAt:   now,
+		Symbol:        symbol,
+		Class:         "us_equity",
+		Qty:           req.Qty,
+		FilledQty:     decimal.Zero,
+		Type:          req.Type,
+		Side:          req.Side,
+		TimeInForce:   req.TimeInForce,
+		LimitPrice:    req.LimitPrice,
+		Status:        "accepted",
+	}
+	s.orders = append(s.orders, order)
+	s.publish("new", order)
+	writeJSON(w, order)
+}
+
+// buyingPower is the cash not set aside for open buys. callers must hold s.mu.
+func (s *Server) buyingPower() decimal.Decimal {
+	buyingPower := s.cash
+	for _, order := range s.orders {
+		if order.Side == alpaca.Buy && isOpen(order.Status) {
+			ask := decimal.NewFromFloat32(s.quotes[order.Symbol].AskPrice)
+			buyingPower = buyingPower.Sub(order.Qty.Sub(order.FilledQty).Mul(ask))
+		}
+	}
+	return buyingPower
+}
+
+// order finds an order by ID. callers must hold s.mu.
+func (s *Server) order(id string) *alpaca.Order {
+	for _, order := range s.orders {
+		if order.ID == id {
+			return order
+		}
+	}
+	return nil
+}
+
+func isOpen(status string) bool {
+	switch status {
+	case "filled", "canceled", "expired", "rejected", "replaced", "done_for_day":
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeError answers like alpaca, whose error codes start with the HTTP status
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(alpaca.APIError{Code: status * 100000, Message: message})
+}
+
+func writeFault(w http.ResponseWriter, fault Fault) {
+	if fault.Body == "" {
+		writeError(w, fault.Status, http.StatusText(fault.Status))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(fault.Status)
+	w.Write([]byte(fault.Body))
+}
+
+// SetCash sets the account's cash
+func (s *Server) SetCash(cash decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cash = cash
+}
+
+// Cash returns the account's cash
+func (s *Server) Cash() decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cash
+}
+
+// SetQuote sets the last quote for the symbol, which is also what orders fill at
+func (s *Server) SetQuote(symbol string, bid, ask decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bidPrice, _ := bid.Float64()
+	askPrice, _ := ask.Float64()
+	s.quotes[symbol] = alpaca.LastQuote{
+		BidPrice:  float32(bidPrice),
+		BidSize:   100,
+		AskPrice:  float32(askPrice),
+		AskSize:   100,
+		Timestamp: time.Now().UnixNano(),
+	}
+	if position, ok := s.positions[symbol]; ok {
+		s.value(position)
+	}
+}
+
+// SetPosition sets how much of the symbol the account holds, bought at entryPrice
+func (s *Server) SetPosition(symbol string, qty, entryPrice decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if qty.IsZero() {
+		delete(s.positions, symbol)
+		return
+	}
+	position := &alpaca.Position{
+		AssetID:    symbol,
+		Symbol:     symbol,
+		Class:      "us_equity",
+		AccountID:  AccountID,
+		EntryPrice: entryPrice,
+		Qty:        qty,
+		Side:       "long",
+		CostBasis:  qty.Mul(entryPrice),
+	}
+	s.value(position)
+	s.positions[symbol] = position
+}
+
+// value prices a position at the symbol's bid. callers must hold s.mu.
+func (s *Server) value(position *alpaca.Position) {
+	position.CurrentPrice = decimal.NewFromFloat32(s.quotes[position.Symbol].BidPrice)
+	position.MarketValue = position.Qty.Mul(position.CurrentPrice)
+	position.UnrealizedPL = position.MarketValue.Sub(position.CostBasis)
+}
+
+// Positions returns the account's positions, by symbol
+func (s *Server) Positions() map[string]decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	positions := map[string]decimal.Decimal{}
+	for symbol, position := range s.positions {
+		positions[symbol] = position.Qty
+	}
+	return positions
+}
+
+// AddOrder adds an order to the account, as if it were placed elsewhere
+func (s *Server) AddOrder(order alpaca.Order) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders = append(s.orders, &order)
+}
+
+// Orders returns every order on the account, in the order they were placed
+func (s *Server) Orders() []alpaca.Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := make([]alpaca.Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		orders = append(orders, *order)
+	}
+	return orders
+}
+
+// SetOrderStatus moves an order to status, without filling it
+func (s *Server) SetOrderStatus(id, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order := s.order(id)
+	if order == nil {
+		return fmt.Errorf("no order with ID %s", id)
+	}
+	order.Status = status
+	order.UpdatedAt = time.Now().UTC()
+	s.publish(status, order)
+	return nil
+}
+
+// FillOrders fills every open order at its symbol's quote, the ask for buys
+// and the bid for sells, moving cash and positions to match
+func (s *Server) FillOrders() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, order := range s.orders {
+		if !isOpen(order.Status) {
+			continue
+		}
+
+		quote := s.quotes[order.Symbol]
+		price := decimal.NewFromFloat32(quote.AskPrice)
+		qty := order.Qty.Sub(order.FilledQty)
+		if order.Side == alpaca.Sell {
+			price = decimal.NewFromFloat32(quote.BidPrice)
+			qty = qty.Neg()
+		}
+
+		position, ok := s.positions[order.Symbol]
+		if !ok {
+			position = &alpaca.Position{
+				AssetID:   order.Symbol,
+				Symbol:    order.Symbol,
+				Class:     "us_equity",
+				AccountID: AccountID,
+				Side:      "long",
+			}
+			s.positions[order.Symbol] = position
+		}
+		position.Qty = position.Qty.Add(qty)
+		position.CostBasis = position.CostBasis.Add(qty.Mul(price))
+		if position.Qty.IsZero() {
+			delete(s.positions, order.Symbol)
+		} else {
+			position.EntryPrice = position.CostBasis.Div(position.Qty)
+			s.value(position)
+		}
+		s.cash = s.cash.Sub(qty.Mul(price))
+
+		order.FilledQty = order.Qty
+		order.FilledAvgPrice = &price
+		order.FilledAt = &now
+		order.UpdatedAt = now
+		order.Status = "filled"
+		s.publish("fill", order)
+	}
+}
+
+// Fail answers the next request on the route with fault, after any faults already queued
+func (s *Server) Fail(route string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[route] = append(s.faults[route], fault)
+}
+
+// Requests counts the requests made on the route
+func (s *Server) Requests(route string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[route]
+}
+
+// streamMessage is a message on alpaca's stream, in either direction
+type streamMessage struct {
+	Stream string      `json:"stream,omitempty"`
+	Action string      `json:"action,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+var upgrader = websocket.Upgrader{}
+
+// stream speaks alpaca's streaming protocol: authenticate, listen, then trade updates
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[RouteStream]++
+	down := s.streamDown
+	s.mu.Unlock()
+	if down {
+		writeError(w, http.StatusServiceUnavailable, "stream unavailable")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader already answered
+	}
+	defer conn.Close()
+
+	var auth struct {
+		Data struct {
+			KeyID     string `json:"key_id"`
+			SecretKey string `json:"secret_key"`
+		} `json:"data"`
+	}
+	if err := conn.ReadJSON(&auth); err != nil {
+		return
+	}
+	if auth.Data.KeyID != s.keyID || auth.Data.SecretKey != s.secretKey {
+		conn.WriteJSON(streamMessage{Stream: "authorization", Data: map[string]string{"status": "unauthorized", "action": "authenticate"}})
+		return
+	}
+	err = conn.WriteJSON(streamMessage{Stream: "authorization", Data: map[string]string{"status": "authorized", "action": "authenticate"}})
+	if err != nil {
+		return
+	}
+
+	var listen struct {
+		Data struct {
+			Streams []string `json:"streams"`
+		} `json:"data"`
+	}
+	if err := conn.ReadJSON(&listen); err != nil {
+		return
+	}
+	var streams []string
+	for _, stream := range listen.Data.Streams {
+		if stream == alpaca.TradeUpdates {
+			streams = append(streams, stream)
+		}
+	}
+
+	// subscribed once the reply is sent, so no update can go out before it
+	s.mu.Lock()
+	err = conn.WriteJSON(streamMessage{Stream: "listening", Data: map[string][]string{"streams": streams}})
+	if err == nil && len(streams) > 0 {
+		s.subscribers[conn] = true
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	// clients don't send anything more, reading just notices them leave
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	s.mu.Lock()
+	delete(s.subscribers, conn)
+	s.mu.Unlock()
+}
+
+// publish sends a trade update to every subscriber. callers must hold s.mu.
+func (s *Server) publish(event string, order *alpaca.Order) {
+	msg := streamMessage{
+		Stream: alpaca.TradeUpdates,
+		Data:   alpaca.TradeUpdate{Event: event, Order: *order},
+	}
+	for conn := range s.subscribers {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := conn.WriteJSON(msg); err != nil {
+			conn.Close()
+			delete(s.subscribers, conn)
+		}
+	}
+}
+
+// SetStreamDown drops every stream connection, and refuses new ones until set back up
+func (s *Server) SetStreamDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streamDown = down
+	if down {
+		for conn := range s.subscribers {
+			conn.Close()
+			delete(s.subscribers, conn)
+		}
+	}
+}
+
+// Subscribers counts the clients subscribed to trade updates
+func (s *Server) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
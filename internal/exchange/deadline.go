@@ -0,0 +1,104 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRunDeadline is returned instead of starting a call too close to the
+// caller's deadline, leaving it time to record what it did
+var ErrRunDeadline = errors.New("too close to the run deadline")
+
+// Deadlines bound how long calls to a broker can take
+type Deadlines struct {
+	// Call is how long any one call can take, 0 for no limit
+	Call time.Duration
+	// Reserve is how much of the run's time to leave, once the context
+	// passed to a call has a deadline. Calls starting later than
+	// Reserve before the deadline fail with ErrRunDeadline.
+	Reserve time.Duration
+}
+
+type deadlineClient struct {
+	client    Client
+	deadlines Deadlines
+}
+
+// WithDeadlines wraps client so that each call gets its own deadline,
+// and no call starts within deadlines.Reserve of the run's deadline
+func WithDeadlines(client Client, deadlines Deadlines) Client {
+	return &deadlineClient{client, deadlines}
+}
+
+// call runs fn with the call's deadline applied to ctx
+func (c *deadlineClient) call(ctx context.Context, method string, fn func(context.Context) error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < c.deadlines.Reserve {
+			return fmt.Errorf("not calling %s with %s left: %w", method, remaining.Round(time.Millisecond), ErrRunDeadline)
+		}
+	}
+
+	if c.deadlines.Call <= 0 {
+		return fn(ctx)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, c.deadlines.Call)
+	defer cancel()
+
+	err := fn(callCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		// the call's own deadline, not the caller's
+		return fmt.Errorf("%s timed out after %s: %w", method, c.deadlines.Call, err)
+	}
+	return err
+}
+
+func (c *deadlineClient) GetAccount(ctx context.Context) (account *Account, err error) {
+	err = c.call(ctx, "GetAccount", func(ctx context.Context) (err error) {
+		account, err = c.client.GetAccount(ctx)
+		return err
+	})
+	return account, err
+}
+
+func (c *deadlineClient) GetLastQuote(ctx context.Context, symbol string) (quote *Quote, err error) {
+	err = c.call(ctx, "GetLastQuote", func(ctx context.Context) (err error) {
+		quote, err = c.client.GetLastQuote(ctx, symbol)
+		return err
+	})
+	return quote, err
+}
+
+func (c *deadlineClient) GetOrder(ctx context.Context, id string) (order *Order, err error) {
+	err = c.call(ctx, "GetOrder", func(ctx context.Context) (err error) {
+		order, err = c.client.GetOrder(ctx, id)
+		return err
+	})
+	return order, err
+}
+
+func (c *deadlineClient) ListOrders(ctx context.Context, req ListOrdersRequest) (orders []Order, err error) {
+	err = c.call(ctx, "ListOrders", func(ctx context.Context) (err error) {
+		orders, err = c.client.ListOrders(ctx, req)
+		return err
+	})
+	return orders, err
+}
+
+func (c *deadlineClient) PlaceOrder(ctx context.Context, req OrderRequest) (order *Order, err error) {
+	err = c.call(ctx, "PlaceOrder", func(ctx context.Context) (err error) {
+		order, err = c.client.PlaceOrder(ctx, req)
+		return err
+	})
+	return order, err
+}
+
+func (c *deadlineClient) ListPositions(ctx context.Context) (positions []Position, err error) {
+	err = c.call(ctx, "ListPositions", func(ctx context.Context) (err error) {
+		positions, err = c.client.ListPositions(ctx)
+		return err
+	})
+	return positions, err
+}
@@ -0,0 +1,121 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+// slowClient takes latency to answer GetAccount, unless ctx is done first
+type slowClient struct {
+	Client // panics on anything but GetAccount
+
+	latency time.Duration
+	calls   int
+}
+
+func (c *slowClient) GetAccount(ctx context.Context) (*Account, error) {
+	c.calls++
+	select {
+	case <-time.After(c.latency):
+		return &Account{ID: "account", Cash: decimal.NewFromInt(100)}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestWithDeadlines(t *testing.T) {
+	testCases := []struct {
+		name        string
+		deadlines   Deadlines
+		latency     time.Duration
+		runDeadline time.Duration // 0 for none
+		cancelled   bool
+
+		expectedCalls int
+		expectedErr   error
+		expectedMsg   string
+	}{
+		{
+			name:          "in time",
+			deadlines:     Deadlines{Call: time.Second, Reserve: time.Second},
+			latency:       time.Millisecond,
+			runDeadline:   time.Minute,
+			expectedCalls: 1,
+		},
+		{
+			name:          "no deadlines",
+			latency:       time.Millisecond,
+			expectedCalls: 1,
+		},
+		{
+			name:          "call times out",
+			deadlines:     Deadlines{Call: 10 * time.Millisecond},
+			latency:       time.Minute,
+			expectedCalls: 1,
+			expectedErr:   context.DeadlineExceeded,
+			expectedMsg:   "GetAccount timed out after 10ms: context deadline exceeded",
+		},
+		{
+			name:        "too close to the run deadline",
+			deadlines:   Deadlines{Call: time.Second, Reserve: time.Minute},
+			latency:     time.Millisecond,
+			runDeadline: time.Second,
+			expectedErr: ErrRunDeadline,
+		},
+		{
+			name:          "run deadline passes mid-call",
+			deadlines:     Deadlines{Call: time.Minute},
+			latency:       time.Minute,
+			runDeadline:   10 * time.Millisecond,
+			expectedCalls: 1,
+			expectedErr:   context.DeadlineExceeded,
+			expectedMsg:   "context deadline exceeded",
+		},
+		{
+			name:        "run cancelled",
+			deadlines:   Deadlines{Call: time.Second},
+			latency:     time.Millisecond,
+			cancelled:   true,
+			expectedErr: context.Canceled,
+			expectedMsg: "context canceled",
+			// the client is still called, it's up to it to give up
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.runDeadline > 0 {
+				ctx, cancel = context.WithTimeout(ctx, tc.runDeadline)
+				defer cancel()
+			}
+			if tc.cancelled {
+				cancel()
+			}
+
+			slow := &slowClient{latency: tc.latency}
+			client := WithDeadlines(slow, tc.deadlines)
+
+			account, err := client.GetAccount(ctx)
+			require.Equal(t, tc.expectedCalls, slow.calls)
+			if tc.expectedErr == nil {
+				require.NoError(t, err)
+				require.Equal(t, "account", account.ID)
+				return
+			}
+
+			require.True(t, errors.Is(err, tc.expectedErr), "expected %v, got %v", tc.expectedErr, err)
+			if tc.expectedMsg != "" {
+				require.Equal(t, tc.expectedMsg, err.Error())
+			}
+		})
+	}
+}
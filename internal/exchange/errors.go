@@ -0,0 +1,57 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrNoOrderHistory is returned by ListOrders when the broker can't list
+// orders as far back as ListOrdersRequest.Since, e.g. tradier only lists the
+// current session's. Checks that need the history can't be made against it.
+var ErrNoOrderHistory = errors.New("the broker can't list orders that old")
+
+// Error is a call a broker answered with an error, classified by its adapter
+type Error struct {
+	StatusCode int // the HTTP status, if known
+	Retryable  bool
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RateLimited says whether the broker turned the call away for making too many
+func (e *Error) RateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// retryableStatus says whether a call answered with an HTTP status is worth trying again
+func retryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// IsRetryable says whether a failed call might succeed if tried again.
+// Errors that can't be classified aren't.
+func IsRetryable(err error) bool {
+	var exchangeErr *Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrRunDeadline), errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &exchangeErr):
+		return exchangeErr.Retryable
+	case errors.Is(err, context.DeadlineExceeded):
+		// the call's own deadline, whoever retries must check their own
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
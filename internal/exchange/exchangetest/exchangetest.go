@@ -1,10 +1,14 @@
 package exchangetest
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
@@ -13,30 +17,90 @@ import (
 
 var _ exchange.Client = (*MockClient)(nil)
 
+// method names, for use with InjectFault and CallsTo
+const (
+	MethodGetAccount    = "GetAccount"
+	MethodGetLastQuote  = "GetLastQuote"
+	MethodGetOrder      = "GetOrder"
+	MethodListOrders    = "ListOrders"
+	MethodListPositions = "ListPositions"
+	MethodPlaceOrder    = "PlaceOrder"
+)
+
+// canned errors, classified like the alpaca adapter does
+var (
+	ErrInsufficientBuyingPower = &exchange.Error{StatusCode: http.StatusForbidden, Err: errors.New("insufficient buying power")}
+	ErrAssetNotTradable        = &exchange.Error{StatusCode: http.StatusUnprocessableEntity, Err: errors.New("asset is not tradable")}
+	ErrRateLimited             = &exchange.Error{StatusCode: http.StatusTooManyRequests, Retryable: true, Err: errors.New("rate limit exceeded")}
+	ErrUnavailable             = &exchange.Error{StatusCode: http.StatusServiceUnavailable, Retryable: true, Err: errors.New("service unavailable")}
+)
+
+// Call is a single call made to the MockClient
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Fault is injected into a call to the MockClient.
+// Latency is applied first, then Err is returned if set.
+// OrderStatus overrides the status of the order returned by
+// GetOrder or PlaceOrder, without touching the stored order.
+type Fault struct {
+	Err         error
+	Latency     time.Duration
+	OrderStatus exchange.OrderStatus
+}
+
 type MockClient struct {
+	mu sync.Mutex
+
 	accountID string
 	cash      decimal.Decimal
-	quotes    map[string]*alpaca.LastQuoteResponse
-	orderReqs []alpaca.PlaceOrderRequest
-	orders    []*alpaca.Order
-	positions []alpaca.Position
+	quotes    map[string]*exchange.Quote
+	orderReqs []exchange.OrderRequest
+	orders    []*exchange.Order
+	positions []exchange.Position
+
+	calls       []Call
+	callCounts  map[string]int
+	faults      map[string]map[int]Fault        // method -> nth call (1-indexed, 0 for every call) -> fault
+	orderStatus map[string]exchange.OrderStatus // order ID -> status override
 }
 
 func NewMockClient(accountID string) *MockClient {
 	return &MockClient{
-		accountID: accountID,
-		quotes:    map[string]*alpaca.LastQuoteResponse{},
+		accountID:   accountID,
+		quotes:      map[string]*exchange.Quote{},
+		callCounts:  map[string]int{},
+		faults:      map[string]map[int]Fault{},
+		orderStatus: map[string]exchange.OrderStatus{},
 	}
 }
 
-func (c *MockClient) GetAccount() (*alpaca.Account, error) {
-	return &alpaca.Account{
+func (c *MockClient) GetAccount(ctx context.Context) (*exchange.Account, error) {
+	_, err := c.call(ctx, MethodGetAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &exchange.Account{
 		ID:   c.accountID,
 		Cash: c.cash,
 	}, nil
 }
 
-func (c *MockClient) GetLastQuote(ticker string) (*alpaca.LastQuoteResponse, error) {
+func (c *MockClient) GetLastQuote(ctx context.Context, ticker string) (*exchange.Quote, error) {
+	_, err := c.call(ctx, MethodGetLastQuote, ticker)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if quote, ok := c.quotes[ticker]; ok {
 		return quote, nil
 	}
@@ -44,66 +108,240 @@ func (c *MockClient) GetLastQuote(ticker string) (*alpaca.LastQuoteResponse, err
 	return nil, fmt.Errorf("quote not found for %s", ticker)
 }
 
-func (c *MockClient) GetOrder(orderID string) (*alpaca.Order, error) {
+func (c *MockClient) GetOrder(ctx context.Context, orderID string) (*exchange.Order, error) {
+	fault, err := c.call(ctx, MethodGetOrder, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	for _, order := range c.orders {
 		if order.ID == orderID {
-			return order, nil
+			return c.withStatus(order, fault), nil
 		}
 	}
 
 	return nil, fmt.Errorf("no order found with ID %s", orderID)
 }
 
-func (c *MockClient) ListPositions() ([]alpaca.Position, error) {
+// ListOrders filters the orders like alpaca does, newest first
+func (c *MockClient) ListOrders(ctx context.Context, req exchange.ListOrdersRequest) ([]exchange.Order, error) {
+	fault, err := c.call(ctx, MethodListOrders, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var orders []exchange.Order
+	for _, order := range c.orders {
+		order := c.withStatus(order, fault)
+		if req.Until != nil && order.SubmittedAt.After(*req.Until) {
+			continue
+		}
+
+		open := !isClosed(order.Status)
+		if (req.Status == "open" && !open) || (req.Status == "closed" && open) {
+			continue
+		} else if req.Status == "" && !open {
+			// alpaca only lists open orders by default
+			continue
+		}
+
+		orders = append(orders, *order)
+	}
+
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].SubmittedAt.After(orders[j].SubmittedAt)
+	})
+
+	max := 50 // alpaca's default
+	if req.Limit > 0 {
+		max = req.Limit
+	}
+	if len(orders) > max {
+		orders = orders[:max]
+	}
+
+	return orders, nil
+}
+
+func isClosed(status exchange.OrderStatus) bool {
+	switch status {
+	case exchange.OrderFilled, exchange.OrderCanceled, exchange.OrderExpired, exchange.OrderRejected, exchange.OrderReplaced, exchange.OrderDoneForDay:
+		return true
+	}
+	return false
+}
+
+func (c *MockClient) ListPositions(ctx context.Context) ([]exchange.Position, error) {
+	_, err := c.call(ctx, MethodListPositions)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	return c.positions, nil
 }
 
-func (c *MockClient) PlaceOrder(req alpaca.PlaceOrderRequest) (*alpaca.Order, error) {
+func (c *MockClient) PlaceOrder(ctx context.Context, req exchange.OrderRequest) (*exchange.Order, error) {
+	fault, err := c.call(ctx, MethodPlaceOrder, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.orderReqs = append(c.orderReqs, req)
-	order := &alpaca.Order{
+	clientOrderID := req.ClientOrderID
+	if clientOrderID == "" {
+		clientOrderID = uuid.New().String()
+	}
+	order := &exchange.Order{
 		ID:            uuid.New().String(),
-		ClientOrderID: uuid.New().String(),
+		ClientOrderID: clientOrderID,
 		CreatedAt:     time.Now(),
 		UpdatedAt:     time.Now(),
 		SubmittedAt:   time.Now(),
-		Symbol:        *req.AssetKey,
-		Exchange:      "Class:us_equity",
+		Symbol:        req.Symbol,
 		Qty:           req.Qty,
 		Type:          req.Type,
 		Side:          req.Side,
 		TimeInForce:   req.TimeInForce,
-		Status:        "accepted",
+		Status:        exchange.OrderAccepted,
 	}
 	c.orders = append(c.orders, order)
-	return order, nil
+	return c.withStatus(order, fault), nil
+}
+
+// call records the call and applies any fault registered for it.
+// Latency is cut short once ctx is done, like a real call would be.
+func (c *MockClient) call(ctx context.Context, method string, args ...interface{}) (Fault, error) {
+	c.mu.Lock()
+	c.calls = append(c.calls, Call{Method: method, Args: args})
+	c.callCounts[method]++
+	n := c.callCounts[method]
+
+	fault, ok := c.faults[method][n]
+	if !ok {
+		fault = c.faults[method][0]
+	}
+	c.mu.Unlock()
+
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-ctx.Done():
+			return fault, ctx.Err()
+		}
+	}
+
+	return fault, fault.Err
+}
+
+// withStatus returns a copy of the order with any status override applied.
+// callers must hold c.mu.
+func (c *MockClient) withStatus(order *exchange.Order, fault Fault) *exchange.Order {
+	cp := *order
+	if status, ok := c.orderStatus[order.ID]; ok {
+		cp.Status = status
+	}
+	if fault.OrderStatus != "" {
+		cp.Status = fault.OrderStatus
+	}
+	return &cp
 }
 
 // helpers, not part of the API
-func (c *MockClient) SetQuote(ticker string, resp *alpaca.LastQuoteResponse) {
-	c.quotes[ticker] = resp
+func (c *MockClient) SetQuote(ticker string, quote *exchange.Quote) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quotes[ticker] = quote
 }
 
-func (c *MockClient) AddOrder(order *alpaca.Order) {
+func (c *MockClient) AddOrder(order *exchange.Order) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.orders = append(c.orders, order)
 }
 
-func (c *MockClient) GetOrderReqs() []alpaca.PlaceOrderRequest {
+func (c *MockClient) GetOrderReqs() []exchange.OrderRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.orderReqs
 }
 
-func (c *MockClient) GetOrders() []*alpaca.Order {
+func (c *MockClient) GetOrders() []*exchange.Order {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.orders
 }
 
 func (c *MockClient) SetCash(cash decimal.Decimal) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.cash = cash
 }
 
-func (c *MockClient) SetPositions(positions []alpaca.Position) {
+func (c *MockClient) SetPositions(positions []exchange.Position) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.positions = positions
 }
 
-func NewFilledOrder(id string) *alpaca.Order {
+// SetOrderStatus makes every subsequent lookup of the order report status
+func (c *MockClient) SetOrderStatus(orderID string, status exchange.OrderStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orderStatus[orderID] = status
+}
+
+// InjectFault applies fault to the nth call (1-indexed) of method.
+// An nth of 0 applies the fault to every call without a more specific fault.
+func (c *MockClient) InjectFault(method string, nth int, fault Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.faults[method] == nil {
+		c.faults[method] = map[int]Fault{}
+	}
+	c.faults[method][nth] = fault
+}
+
+// ClearFaults removes all injected faults
+func (c *MockClient) ClearFaults() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = map[string]map[int]Fault{}
+}
+
+// Calls returns every call made to the client, in order
+func (c *MockClient) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// CallsTo returns every call made to method, in order
+func (c *MockClient) CallsTo(method string) []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var calls []Call
+	for _, call := range c.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func NewFilledOrder(id string) *exchange.Order {
 	fillPrice := decimal.NewFromFloat(298.45)
 	order := newOrder(id)
 
@@ -111,32 +349,29 @@ func NewFilledOrder(id string) *alpaca.Order {
 	order.FilledAt = &now
 	order.FilledQty = decimal.NewFromInt(3)
 	order.FilledAvgPrice = &fillPrice
-	order.Status = "filled"
+	order.Status = exchange.OrderFilled
 	return order
 }
 
-func NewUnfilledOrder(id string) *alpaca.Order {
+func NewUnfilledOrder(id string) *exchange.Order {
 	order := newOrder(id)
-	order.Status = "accepted"
+	order.Status = exchange.OrderAccepted
 	return order
 }
 
-func newOrder(id string) *alpaca.Order {
+func newOrder(id string) *exchange.Order {
 	now := time.Now()
-	return &alpaca.Order{
+	return &exchange.Order{
 		ID:            id,
 		ClientOrderID: uuid.New().String(),
 		CreatedAt:     now.Add(-time.Hour),
 		UpdatedAt:     now,
 		SubmittedAt:   now.Add(-time.Hour),
 		FilledAt:      &now,
-		AssetID:       "4f75ad35-b947-4717-87db-19aa3dbf637d",
 		Symbol:        "VOO",
-		Exchange:      "Class:us_equity",
 		Qty:           decimal.NewFromInt(3),
-		Type:          alpaca.Market,
-		Side:          alpaca.Buy,
-		TimeInForce:   alpaca.Day,
-		ExtendedHours: false,
+		Type:          exchange.Market,
+		Side:          exchange.Buy,
+		TimeInForce:   exchange.Day,
 	}
 }
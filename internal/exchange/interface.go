@@ -1,11 +1,31 @@
 package exchange
 
-import "github.com/alpacahq/alpaca-trade-api-go/alpaca"
+import "context"
 
+// Client is a broker. Adapters, e.g. NewAlpacaClient, translate to and from
+// each broker's API. Calls return once ctx is done, though a call the broker
+// already received may still take effect, e.g. an order may still be placed.
 type Client interface {
-	GetAccount() (*alpaca.Account, error)
-	GetLastQuote(string) (*alpaca.LastQuoteResponse, error)
-	GetOrder(string) (*alpaca.Order, error)
-	PlaceOrder(alpaca.PlaceOrderRequest) (*alpaca.Order, error)
-	ListPositions() ([]alpaca.Position, error)
+	GetAccount(ctx context.Context) (*Account, error)
+	GetLastQuote(ctx context.Context, symbol string) (*Quote, error)
+	GetOrder(ctx context.Context, id string) (*Order, error)
+	// ListOrders lists orders, newest first
+	ListOrders(context.Context, ListOrdersRequest) ([]Order, error)
+	PlaceOrder(context.Context, OrderRequest) (*Order, error)
+	ListPositions(ctx context.Context) ([]Position, error)
+}
+
+// TradeStream is a broker that pushes updates to the account's orders as they happen
+type TradeStream interface {
+	// SubscribeTradeUpdates returns once updates are flowing.
+	// Anything that happened before then isn't sent.
+	SubscribeTradeUpdates(ctx context.Context) (TradeSubscription, error)
+}
+
+// TradeSubscription is a live stream of updates to the account's orders
+type TradeSubscription interface {
+	// Next waits for the next update. Once the stream drops, or ctx is done,
+	// it returns an error, and the subscription is over.
+	Next() (*TradeUpdate, error)
+	Close() error
 }
@@ -1,5 +0,0 @@
-package exchange
-
-import "github.com/alpacahq/alpaca-trade-api-go/alpaca"
-
-var _ Client = (*alpaca.Client)(nil)
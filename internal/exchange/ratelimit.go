@@ -0,0 +1,210 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EndpointClass groups calls that share a broker's rate limit
+type EndpointClass string
+
+const (
+	// AllEndpoints limits every call, on top of the limit of its own class
+	AllEndpoints EndpointClass = "all"
+
+	AccountEndpoints    EndpointClass = "account"     // GetAccount, ListPositions
+	OrderEndpoints      EndpointClass = "orders"      // GetOrder, ListOrders
+	TradingEndpoints    EndpointClass = "trading"     // PlaceOrder
+	MarketDataEndpoints EndpointClass = "market-data" // GetLastQuote
+)
+
+// RateLimit is a token bucket, refilling at PerMinute tokens a minute, up to Burst
+type RateLimit struct {
+	PerMinute float64 `json:"perMinute"` // 0 for no limit
+	Burst     int     `json:"burst"`     // defaults to 1
+}
+
+func (l RateLimit) String() string {
+	if l.PerMinute <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g/min", l.PerMinute)
+}
+
+// bucket is a token bucket. Callers take tokens before they're available,
+// and wait until then, so tokens can go negative.
+type bucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+
+	requests int
+	waited   time.Duration
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// take takes a token, returning how long to wait until it's available
+func (b *bucket) take(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.requests++
+	if b.limit.PerMinute <= 0 {
+		return 0
+	}
+
+	perSecond := b.limit.PerMinute / 60
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	wait := time.Duration(-b.tokens / perSecond * float64(time.Second))
+	b.waited += wait
+	return wait
+}
+
+// Usage is how much of its rate limit a class of endpoints used
+type Usage struct {
+	Class    EndpointClass
+	Limit    RateLimit
+	Requests int
+	Waited   time.Duration // waiting for the limit, across requests
+}
+
+// RateLimitedClient holds calls to a broker to rate limits, per class of endpoint
+type RateLimitedClient struct {
+	client  Client
+	buckets map[EndpointClass]*bucket
+}
+
+// WithRateLimits wraps client so that calls wait for the limit of their
+// class, and AllEndpoints, if set. Classes without a limit aren't limited,
+// but their requests are still counted.
+func WithRateLimits(client Client, limits map[EndpointClass]RateLimit) *RateLimitedClient {
+	now := time.Now()
+	buckets := map[EndpointClass]*bucket{}
+	for _, class := range []EndpointClass{AllEndpoints, AccountEndpoints, OrderEndpoints, TradingEndpoints, MarketDataEndpoints} {
+		buckets[class] = newBucket(limits[class], now)
+	}
+	return &RateLimitedClient{client, buckets}
+}
+
+// BrokerDefaults are how calls to a broker are limited and retried, unless configured otherwise
+type BrokerDefaults struct {
+	RateLimits map[EndpointClass]RateLimit
+	Retries    RetryPolicy
+}
+
+// ParseRateLimits parses limits by endpoint class, e.g. {"all": {"perMinute": 180, "burst": 10}}
+func ParseRateLimits(data []byte) (map[EndpointClass]RateLimit, error) {
+	limits := map[EndpointClass]RateLimit{}
+	err := json.Unmarshal(data, &limits)
+	if err != nil {
+		return nil, err
+	}
+
+	for class, limit := range limits {
+		switch class {
+		case AllEndpoints, AccountEndpoints, OrderEndpoints, TradingEndpoints, MarketDataEndpoints:
+		default:
+			return nil, fmt.Errorf("unknown endpoint class %q", class)
+		}
+		if limit.PerMinute < 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("limit of %s can't be negative", class)
+		}
+	}
+	return limits, nil
+}
+
+// wait blocks until a call of the class is within its limits
+func (c *RateLimitedClient) wait(ctx context.Context, class EndpointClass) error {
+	now := time.Now()
+	wait := c.buckets[AllEndpoints].take(now)
+	if classWait := c.buckets[class].take(now); classWait > wait {
+		wait = classWait
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Usage reports the requests made so far, by class
+func (c *RateLimitedClient) Usage() []Usage {
+	var usage []Usage
+	for class, b := range c.buckets {
+		b.mu.Lock()
+		usage = append(usage, Usage{Class: class, Limit: b.limit, Requests: b.requests, Waited: b.waited})
+		b.mu.Unlock()
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Class < usage[j].Class
+	})
+	return usage
+}
+
+func (c *RateLimitedClient) GetAccount(ctx context.Context) (*Account, error) {
+	if err := c.wait(ctx, AccountEndpoints); err != nil {
+		return nil, err
+	}
+	return c.client.GetAccount(ctx)
+}
+
+func (c *RateLimitedClient) GetLastQuote(ctx context.Context, symbol string) (*Quote, error) {
+	if err := c.wait(ctx, MarketDataEndpoints); err != nil {
+		return nil, err
+	}
+	return c.client.GetLastQuote(ctx, symbol)
+}
+
+func (c *RateLimitedClient) GetOrder(ctx context.Context, id string) (*Order, error) {
+	if err := c.wait(ctx, OrderEndpoints); err != nil {
+		return nil, err
+	}
+	return c.client.GetOrder(ctx, id)
+}
+
+func (c *RateLimitedClient) ListOrders(ctx context.Context, req ListOrdersRequest) ([]Order, error) {
+	if err := c.wait(ctx, OrderEndpoints); err != nil {
+		return nil, err
+	}
+	return c.client.ListOrders(ctx, req)
+}
+
+func (c *RateLimitedClient) PlaceOrder(ctx context.Context, req OrderRequest) (*Order, error) {
+	if err := c.wait(ctx, TradingEndpoints); err != nil {
+		return nil, err
+	}
+	return c.client.PlaceOrder(ctx, req)
+}
+
+func (c *RateLimitedClient) ListPositions(ctx context.Context) ([]Position, error) {
+	if err := c.wait(ctx, AccountEndpoints); err != nil {
+		return nil, err
+	}
+	return c.client.ListPositions(ctx)
+}
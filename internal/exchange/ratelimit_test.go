@@ -0,0 +1,115 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+	// a token a second
+	b := newBucket(RateLimit{PerMinute: 60, Burst: 2}, start)
+
+	require.Equal(t, time.Duration(0), b.take(start))
+	require.Equal(t, time.Duration(0), b.take(start))
+	require.Equal(t, time.Second, b.take(start))
+	require.Equal(t, 2*time.Second, b.take(start))
+
+	// refilled, less the two taken ahead of time
+	require.Equal(t, time.Second, b.take(start.Add(2*time.Second)))
+
+	// refills only up to the burst
+	require.Equal(t, time.Duration(0), b.take(start.Add(time.Hour)))
+	require.Equal(t, time.Duration(0), b.take(start.Add(time.Hour)))
+	require.Equal(t, time.Second, b.take(start.Add(time.Hour)))
+
+	require.Equal(t, 8, b.requests)
+	require.Equal(t, 5*time.Second, b.waited)
+}
+
+func TestBucket_Unlimited(t *testing.T) {
+	b := newBucket(RateLimit{}, time.Now())
+	for i := 0; i < 100; i++ {
+		require.Equal(t, time.Duration(0), b.take(time.Now()))
+	}
+	require.Equal(t, 100, b.requests)
+}
+
+func TestWithRateLimits(t *testing.T) {
+	flaky := newFlakyClient(nil)
+	client := WithRateLimits(flaky, map[EndpointClass]RateLimit{
+		// 100 a second
+		AllEndpoints:   {PerMinute: 6000, Burst: 1},
+		OrderEndpoints: {PerMinute: 60},
+	})
+	ctx := context.TODO()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := client.GetAccount(ctx)
+		require.NoError(t, err)
+	}
+	require.True(t, time.Since(start) >= 20*time.Millisecond, "made 3 calls in %s", time.Since(start))
+
+	_, err := client.ListOrders(ctx, ListOrdersRequest{})
+	require.NoError(t, err)
+
+	// the next is a second off, longer than the caller will wait
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = client.ListOrders(ctx, ListOrdersRequest{})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, 1, flaky.calls["ListOrders"])
+
+	usage := map[EndpointClass]Usage{}
+	for _, u := range client.Usage() {
+		usage[u.Class] = u
+	}
+	require.Len(t, usage, 5)
+	require.Equal(t, 5, usage[AllEndpoints].Requests)
+	require.Equal(t, 3, usage[AccountEndpoints].Requests)
+	require.Equal(t, 2, usage[OrderEndpoints].Requests)
+	require.Equal(t, 0, usage[TradingEndpoints].Requests)
+	// less what refilled while the account calls were made
+	require.InDelta(t, float64(time.Second), float64(usage[OrderEndpoints].Waited), float64(100*time.Millisecond))
+	require.Equal(t, "60/min", usage[OrderEndpoints].Limit.String())
+	require.Equal(t, "unlimited", usage[TradingEndpoints].Limit.String())
+}
+
+func TestParseRateLimits(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        string
+		expected    map[EndpointClass]RateLimit
+		expectedErr bool
+	}{
+		{
+			name: "valid",
+			data: `{"all": {"perMinute": 180, "burst": 10}, "market-data": {"perMinute": 200}}`,
+			expected: map[EndpointClass]RateLimit{
+				AllEndpoints:        {PerMinute: 180, Burst: 10},
+				MarketDataEndpoints: {PerMinute: 200},
+			},
+		},
+		{name: "empty", data: `{}`, expected: map[EndpointClass]RateLimit{}},
+		{name: "unknown class", data: `{"quotes": {"perMinute": 200}}`, expectedErr: true},
+		{name: "negative", data: `{"orders": {"perMinute": -1}}`, expectedErr: true},
+		{name: "not json", data: `200`, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			limits, err := ParseRateLimits([]byte(tc.data))
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, limits)
+		})
+	}
+}
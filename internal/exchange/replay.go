@@ -0,0 +1,319 @@
+package exchange
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrNotRecorded is returned by a Replayer for calls the recording has no answer for
+var ErrNotRecorded = errors.New("no recorded call matches")
+
+// Interaction is one call to a broker, and how it answered
+type Interaction struct {
+	Method   string          `json:"method"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Err      *recordedError  `json:"error,omitempty"`
+}
+
+// recordedError keeps enough of an error to classify it the same on replay
+type recordedError struct {
+	Message    string `json:"message"`
+	Kind       string `json:"kind,omitempty"` // "exchange", "deadline", "canceled", "no-history", or empty for anything else
+	StatusCode int    `json:"statusCode,omitempty"`
+	Retryable  bool   `json:"retryable,omitempty"`
+}
+
+func newRecordedError(err error) *recordedError {
+	if err == nil {
+		return nil
+	}
+
+	recorded := &recordedError{Message: err.Error()}
+	var exchangeErr *Error
+	switch {
+	case errors.As(err, &exchangeErr):
+		recorded.Kind = "exchange"
+		recorded.StatusCode = exchangeErr.StatusCode
+		recorded.Retryable = exchangeErr.Retryable
+	case errors.Is(err, context.DeadlineExceeded):
+		recorded.Kind = "deadline"
+	case errors.Is(err, context.Canceled):
+		recorded.Kind = "canceled"
+	case errors.Is(err, ErrNoOrderHistory):
+		recorded.Kind = "no-history"
+	}
+	return recorded
+}
+
+func (e *recordedError) err() error {
+	switch e.Kind {
+	case "exchange":
+		return &Error{StatusCode: e.StatusCode, Retryable: e.Retryable, Err: errors.New(e.Message)}
+	case "deadline":
+		return context.DeadlineExceeded
+	case "canceled":
+		return context.Canceled
+	case "no-history":
+		return ErrNoOrderHistory
+	}
+	return errors.New(e.Message)
+}
+
+// Recorder keeps every call made through it, to replay later
+type Recorder struct {
+	client Client
+
+	mu           sync.Mutex
+	interactions []Interaction
+}
+
+// NewRecorder records calls to client. It belongs right above the broker's
+// adapter, so that replays go through the same retries and limits.
+func NewRecorder(client Client) *Recorder {
+	return &Recorder{client: client}
+}
+
+// record keeps a call. Failing to encode one shouldn't fail the run,
+// so it's kept without the parts that failed, and won't replay.
+func (r *Recorder) record(method string, req, resp interface{}, err error) {
+	interaction := Interaction{Method: method, Err: newRecordedError(err)}
+	if req != nil {
+		interaction.Request, _ = json.Marshal(req)
+	}
+	if err == nil {
+		interaction.Response, _ = json.Marshal(resp)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, interaction)
+}
+
+// WriteTo writes the calls recorded so far, one JSON object per line
+func (r *Recorder) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, interaction := range r.interactions {
+		err := enc.Encode(interaction)
+		if err != nil {
+			return 0, fmt.Errorf("encoding %s call: %w", interaction.Method, err)
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+func (r *Recorder) GetAccount(ctx context.Context) (*Account, error) {
+	account, err := r.client.GetAccount(ctx)
+	r.record("GetAccount", nil, account, err)
+	return account, err
+}
+
+func (r *Recorder) GetLastQuote(ctx context.Context, symbol string) (*Quote, error) {
+	quote, err := r.client.GetLastQuote(ctx, symbol)
+	r.record("GetLastQuote", symbol, quote, err)
+	return quote, err
+}
+
+func (r *Recorder) GetOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := r.client.GetOrder(ctx, id)
+	r.record("GetOrder", id, order, err)
+	return order, err
+}
+
+func (r *Recorder) ListOrders(ctx context.Context, req ListOrdersRequest) ([]Order, error) {
+	orders, err := r.client.ListOrders(ctx, req)
+	r.record("ListOrders", req, orders, err)
+	return orders, err
+}
+
+func (r *Recorder) PlaceOrder(ctx context.Context, req OrderRequest) (*Order, error) {
+	order, err := r.client.PlaceOrder(ctx, req)
+	r.record("PlaceOrder", req, order, err)
+	return order, err
+}
+
+func (r *Recorder) ListPositions(ctx context.Context) ([]Position, error) {
+	positions, err := r.client.ListPositions(ctx)
+	r.record("ListPositions", nil, positions, err)
+	return positions, err
+}
+
+// Replayer answers calls as a recording says the broker did. Calls are matched
+// by method and request, and identical calls are answered in the order they
+// were recorded, so concurrent calls for different things replay the same.
+type Replayer struct {
+	mu             sync.Mutex
+	answers        map[string][]Interaction // replayKey -> answers left
+	clientOrderIDs map[string]string        // recorded -> replayed, for orders placed during the replay
+}
+
+// NewReplayer reads a recording written by Recorder.WriteTo
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{
+		answers:        map[string][]Interaction{},
+		clientOrderIDs: map[string]string{},
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024) // list responses can be long lines
+	for line := 1; scanner.Scan(); line++ {
+		var interaction Interaction
+		err := json.Unmarshal(scanner.Bytes(), &interaction)
+		if err != nil {
+			return nil, fmt.Errorf("decoding line %d: %w", line, err)
+		}
+
+		key, err := replayKey(interaction.Method, interaction.Request)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		p.answers[key] = append(p.answers[key], interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// replayKey identifies calls that are answered the same
+func replayKey(method string, req json.RawMessage) (string, error) {
+	var key bytes.Buffer
+	key.WriteString(method)
+	key.WriteByte(' ')
+	if len(req) == 0 {
+		return key.String(), nil
+	}
+
+	if method == "PlaceOrder" {
+		// client order IDs are random, so any would do
+		var orderReq OrderRequest
+		err := json.Unmarshal(req, &orderReq)
+		if err != nil {
+			return "", fmt.Errorf("decoding order request: %w", err)
+		}
+		orderReq.ClientOrderID = ""
+		req, _ = json.Marshal(orderReq)
+	} else if method == "ListOrders" {
+		// how far back to look depends on when the run was
+		var listReq ListOrdersRequest
+		err := json.Unmarshal(req, &listReq)
+		if err != nil {
+			return "", fmt.Errorf("decoding list orders request: %w", err)
+		}
+		listReq.Since = nil
+		req, _ = json.Marshal(listReq)
+	}
+
+	err := json.Compact(&key, req)
+	if err != nil {
+		return "", fmt.Errorf("compacting %s request: %w", method, err)
+	}
+	return key.String(), nil
+}
+
+// replay decodes the next recorded answer to the call into resp
+func (p *Replayer) replay(method string, req, resp interface{}) error {
+	var rawReq json.RawMessage
+	if req != nil {
+		var err error
+		rawReq, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	}
+	key, err := replayKey(method, rawReq)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	answers := p.answers[key]
+	if len(answers) == 0 {
+		p.mu.Unlock()
+		return fmt.Errorf("%s %s: %w", method, rawReq, ErrNotRecorded)
+	}
+	answer := answers[0]
+	p.answers[key] = answers[1:]
+	p.mu.Unlock()
+
+	if answer.Err != nil {
+		return answer.Err.err()
+	}
+	return json.Unmarshal(answer.Response, resp)
+}
+
+// Remaining counts the recorded calls not yet replayed
+func (p *Replayer) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	remaining := 0
+	for _, answers := range p.answers {
+		remaining += len(answers)
+	}
+	return remaining
+}
+
+func (p *Replayer) GetAccount(ctx context.Context) (account *Account, err error) {
+	err = p.replay("GetAccount", nil, &account)
+	return account, err
+}
+
+func (p *Replayer) GetLastQuote(ctx context.Context, symbol string) (quote *Quote, err error) {
+	err = p.replay("GetLastQuote", symbol, &quote)
+	return quote, err
+}
+
+// renameOrder gives an order placed during the replay the client order ID it was placed with
+func (p *Replayer) renameOrder(order *Order) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if replayed, ok := p.clientOrderIDs[order.ClientOrderID]; ok {
+		order.ClientOrderID = replayed
+	}
+}
+
+func (p *Replayer) GetOrder(ctx context.Context, id string) (order *Order, err error) {
+	err = p.replay("GetOrder", id, &order)
+	if order != nil {
+		p.renameOrder(order)
+	}
+	return order, err
+}
+
+func (p *Replayer) ListOrders(ctx context.Context, req ListOrdersRequest) (orders []Order, err error) {
+	err = p.replay("ListOrders", req, &orders)
+	for i := range orders {
+		p.renameOrder(&orders[i])
+	}
+	return orders, err
+}
+
+// PlaceOrder answers with the recorded order, under the new client order ID,
+// which later answers about the order use too
+func (p *Replayer) PlaceOrder(ctx context.Context, req OrderRequest) (order *Order, err error) {
+	err = p.replay("PlaceOrder", req, &order)
+	if order != nil {
+		p.mu.Lock()
+		p.clientOrderIDs[order.ClientOrderID] = req.ClientOrderID
+		p.mu.Unlock()
+		order.ClientOrderID = req.ClientOrderID
+	}
+	return order, err
+}
+
+func (p *Replayer) ListPositions(ctx context.Context) (positions []Position, err error) {
+	err = p.replay("ListPositions", nil, &positions)
+	return positions, err
+}
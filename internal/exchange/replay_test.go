@@ -0,0 +1,106 @@
+package exchange
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.TODO()
+	flaky := newFlakyClient(map[string][]error{
+		"GetAccount": {errUnavailable, context.DeadlineExceeded},
+	})
+	recorder := NewRecorder(flaky)
+
+	// the run being recorded
+	_, err := recorder.GetAccount(ctx)
+	require.Error(t, err)
+	_, err = recorder.GetAccount(ctx)
+	require.Error(t, err)
+	account, err := recorder.GetAccount(ctx)
+	require.NoError(t, err)
+	placed, err := recorder.PlaceOrder(ctx, OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(3), Side: Buy, ClientOrderID: "trade1"})
+	require.NoError(t, err)
+	_, err = recorder.PlaceOrder(ctx, OrderRequest{Symbol: "BND", Qty: decimal.NewFromInt(2), Side: Buy, ClientOrderID: "trade2"})
+	require.NoError(t, err)
+	orders, err := recorder.ListOrders(ctx, ListOrdersRequest{Status: "all"})
+	require.NoError(t, err)
+
+	var recording bytes.Buffer
+	_, err = recorder.WriteTo(&recording)
+	require.NoError(t, err)
+
+	replayer, err := NewReplayer(&recording)
+	require.NoError(t, err)
+	require.Equal(t, 6, replayer.Remaining())
+
+	// different calls replay regardless of order
+	replayedBND, err := replayer.PlaceOrder(ctx, OrderRequest{Symbol: "BND", Qty: decimal.NewFromInt(2), Side: Buy, ClientOrderID: "replayed2"})
+	require.NoError(t, err)
+	require.Equal(t, "replayed2", replayedBND.ClientOrderID)
+
+	// the same calls replay in order, errors classified as they were
+	_, err = replayer.GetAccount(ctx)
+	require.True(t, IsRetryable(err))
+	var exchangeErr *Error
+	require.True(t, errors.As(err, &exchangeErr))
+	require.Equal(t, errUnavailable.StatusCode, exchangeErr.StatusCode)
+	require.Equal(t, "service unavailable", err.Error())
+	_, err = replayer.GetAccount(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	replayedAccount, err := replayer.GetAccount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, account.ID, replayedAccount.ID)
+	require.True(t, account.Cash.Equal(replayedAccount.Cash))
+
+	replayed, err := replayer.PlaceOrder(ctx, OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(3), Side: Buy, ClientOrderID: "replayed1"})
+	require.NoError(t, err)
+	require.Equal(t, placed.ID, replayed.ID)
+	require.Equal(t, "replayed1", replayed.ClientOrderID)
+
+	// orders placed during the replay keep their new client order IDs
+	replayedOrders, err := replayer.ListOrders(ctx, ListOrdersRequest{Status: "all"})
+	require.NoError(t, err)
+	require.Len(t, replayedOrders, len(orders))
+	require.Equal(t, "replayed2", replayedOrders[0].ClientOrderID)
+	require.Equal(t, "replayed1", replayedOrders[1].ClientOrderID)
+
+	require.Equal(t, 0, replayer.Remaining())
+	_, err = replayer.GetAccount(ctx)
+	require.True(t, errors.Is(err, ErrNotRecorded))
+	_, err = replayer.ListOrders(ctx, ListOrdersRequest{Status: "open"})
+	require.True(t, errors.Is(err, ErrNotRecorded))
+}
+
+func TestRecordReplay_ListOrdersSince(t *testing.T) {
+	ctx := context.TODO()
+	recorder := NewRecorder(newFlakyClient(map[string][]error{
+		"ListOrders": {ErrNoOrderHistory},
+	}))
+
+	since := time.Now().AddDate(0, 0, -7)
+	_, err := recorder.ListOrders(ctx, ListOrdersRequest{Status: "all", Since: &since})
+	require.Equal(t, ErrNoOrderHistory, err)
+
+	var recording bytes.Buffer
+	_, err = recorder.WriteTo(&recording)
+	require.NoError(t, err)
+	replayer, err := NewReplayer(&recording)
+	require.NoError(t, err)
+
+	// a replay looks back from when it runs
+	since = time.Now().AddDate(0, 0, -7)
+	_, err = replayer.ListOrders(ctx, ListOrdersRequest{Status: "all", Since: &since})
+	require.Equal(t, ErrNoOrderHistory, err)
+}
+
+func TestNewReplayer_Errors(t *testing.T) {
+	_, err := NewReplayer(bytes.NewBufferString("{\"method\": \"GetAccount\"}\nnot json\n"))
+	require.EqualError(t, err, "decoding line 2: invalid character 'o' in literal null (expecting 'u')")
+}
@@ -0,0 +1,166 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// recentOrdersLimit is how many of the latest orders are searched for one
+// that may have been placed without hearing back. It's alpaca's max page size.
+const recentOrdersLimit = 500
+
+// RetryPolicy is how failed calls to a broker are retried
+type RetryPolicy struct {
+	// Attempts is how many times a call is tried, including the first
+	Attempts int
+	// BaseDelay is the most to wait before the first retry, doubling each retry after.
+	// Waits are jittered, anywhere from none up to the most.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts
+	MaxDelay time.Duration
+	// RateLimitDelay is the least to wait after being rate limited
+	RateLimitDelay time.Duration
+}
+
+type retryClient struct {
+	client Client
+	policy RetryPolicy
+}
+
+// WithRetries wraps client so that calls failing with retryable errors, e.g.
+// timeouts, rate limits and server errors, are tried again with backoff.
+// Orders are only placed again once it's clear the last attempt didn't go
+// through, so orders without a client order ID aren't retried.
+func WithRetries(client Client, policy RetryPolicy) Client {
+	return &retryClient{client, policy}
+}
+
+// retry calls fn until it succeeds, fails with an error not worth retrying,
+// or runs out of attempts. fn is passed which attempt it is, starting from 1.
+func (c *retryClient) retry(ctx context.Context, method string, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || ctx.Err() != nil || !IsRetryable(err) {
+			return err
+		} else if attempt >= c.policy.Attempts {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("%s failed after %d attempts: %w", method, attempt, err)
+		}
+
+		delay := c.backoff(attempt, err)
+		glog.Warningf("%s failed, retrying in %s (attempt %d of %d): %v", method, delay.Round(time.Millisecond), attempt, c.policy.Attempts, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff is how long to wait after the given attempt failed with err
+func (c *retryClient) backoff(attempt int, err error) time.Duration {
+	most := c.policy.BaseDelay << (attempt - 1)
+	if most > c.policy.MaxDelay || most <= 0 {
+		most = c.policy.MaxDelay
+	}
+
+	var delay time.Duration
+	if most > 0 {
+		delay = time.Duration(rand.Int63n(int64(most) + 1))
+	}
+
+	var exchangeErr *Error
+	if errors.As(err, &exchangeErr) && exchangeErr.RateLimited() && delay < c.policy.RateLimitDelay {
+		delay = c.policy.RateLimitDelay
+	}
+	return delay
+}
+
+func (c *retryClient) GetAccount(ctx context.Context) (account *Account, err error) {
+	err = c.retry(ctx, "GetAccount", func(int) (err error) {
+		account, err = c.client.GetAccount(ctx)
+		return err
+	})
+	return account, err
+}
+
+func (c *retryClient) GetLastQuote(ctx context.Context, symbol string) (quote *Quote, err error) {
+	err = c.retry(ctx, "GetLastQuote", func(int) (err error) {
+		quote, err = c.client.GetLastQuote(ctx, symbol)
+		return err
+	})
+	return quote, err
+}
+
+func (c *retryClient) GetOrder(ctx context.Context, id string) (order *Order, err error) {
+	err = c.retry(ctx, "GetOrder", func(int) (err error) {
+		order, err = c.client.GetOrder(ctx, id)
+		return err
+	})
+	return order, err
+}
+
+func (c *retryClient) ListOrders(ctx context.Context, req ListOrdersRequest) (orders []Order, err error) {
+	err = c.retry(ctx, "ListOrders", func(int) (err error) {
+		orders, err = c.client.ListOrders(ctx, req)
+		return err
+	})
+	return orders, err
+}
+
+// PlaceOrder retries only after checking the failed attempt didn't place the
+// order anyway, e.g. if it timed out after the broker accepted it.
+func (c *retryClient) PlaceOrder(ctx context.Context, req OrderRequest) (order *Order, err error) {
+	if req.ClientOrderID == "" {
+		// no way to tell whether a failed attempt went through
+		return c.client.PlaceOrder(ctx, req)
+	}
+
+	err = c.retry(ctx, "PlaceOrder", func(attempt int) (err error) {
+		if attempt > 1 {
+			placed, err := c.findOrder(ctx, req.ClientOrderID)
+			if err != nil {
+				return fmt.Errorf("checking whether order %s was placed: %w", req.ClientOrderID, err)
+			} else if placed != nil {
+				glog.Warningf("order %s was placed by a failed attempt, not placing it again", req.ClientOrderID)
+				order = placed
+				return nil
+			}
+		}
+
+		order, err = c.client.PlaceOrder(ctx, req)
+		return err
+	})
+	return order, err
+}
+
+// findOrder looks through the latest orders for the one with the given client order ID,
+// returning nil if there isn't one
+func (c *retryClient) findOrder(ctx context.Context, clientOrderID string) (*Order, error) {
+	orders, err := c.client.ListOrders(ctx, ListOrdersRequest{Status: "all", Limit: recentOrdersLimit})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range orders {
+		if orders[i].ClientOrderID == clientOrderID {
+			return &orders[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *retryClient) ListPositions(ctx context.Context) (positions []Position, err error) {
+	err = c.retry(ctx, "ListPositions", func(int) (err error) {
+		positions, err = c.client.ListPositions(ctx)
+		return err
+	})
+	return positions, err
+}
@@ -0,0 +1,300 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errUnavailable = &Error{StatusCode: http.StatusServiceUnavailable, Retryable: true, Err: errors.New("service unavailable")}
+	errRateLimited = &Error{StatusCode: http.StatusTooManyRequests, Retryable: true, Err: errors.New("rate limit exceeded")}
+	errNotTradable = &Error{StatusCode: http.StatusUnprocessableEntity, Err: errors.New("asset is not tradable")}
+)
+
+// flakyClient fails each method with its errs in turn, then succeeds
+type flakyClient struct {
+	Client // panics on anything not faked
+
+	errs  map[string][]error
+	calls map[string]int
+	// placeAnyway places orders even when failing, like a timeout after the broker accepted it
+	placeAnyway bool
+	orders      []Order
+}
+
+func newFlakyClient(errs map[string][]error) *flakyClient {
+	return &flakyClient{errs: errs, calls: map[string]int{}}
+}
+
+func (c *flakyClient) fail(method string) error {
+	c.calls[method]++
+	if len(c.errs[method]) == 0 {
+		return nil
+	}
+	err := c.errs[method][0]
+	c.errs[method] = c.errs[method][1:]
+	return err
+}
+
+func (c *flakyClient) GetAccount(ctx context.Context) (*Account, error) {
+	if err := c.fail("GetAccount"); err != nil {
+		return nil, err
+	}
+	return &Account{ID: "account"}, nil
+}
+
+func (c *flakyClient) ListOrders(ctx context.Context, req ListOrdersRequest) ([]Order, error) {
+	if err := c.fail("ListOrders"); err != nil {
+		return nil, err
+	}
+	return c.orders, nil
+}
+
+func (c *flakyClient) PlaceOrder(ctx context.Context, req OrderRequest) (*Order, error) {
+	err := c.fail("PlaceOrder")
+	if err != nil && !c.placeAnyway {
+		return nil, err
+	}
+
+	order := Order{ID: fmt.Sprintf("order%d", len(c.orders)+1), ClientOrderID: req.ClientOrderID, Symbol: req.Symbol, Qty: req.Qty}
+	c.orders = append([]Order{order}, c.orders...)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+var testRetryPolicy = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func TestWithRetries(t *testing.T) {
+	testCases := []struct {
+		name          string
+		errs          []error
+		expectedCalls int
+		expectedErr   error
+		expectedMsg   string
+	}{
+		{
+			name:          "no errors",
+			expectedCalls: 1,
+		},
+		{
+			name:          "transient errors",
+			errs:          []error{errUnavailable, fmt.Errorf("GetAccount timed out after 10s: %w", context.DeadlineExceeded)},
+			expectedCalls: 3,
+		},
+		{
+			name:          "terminal error",
+			errs:          []error{errNotTradable},
+			expectedCalls: 1,
+			expectedErr:   errNotTradable,
+			expectedMsg:   "asset is not tradable",
+		},
+		{
+			name:          "unclassified error",
+			errs:          []error{errors.New("something else")},
+			expectedCalls: 1,
+			expectedMsg:   "something else",
+		},
+		{
+			name:          "out of attempts",
+			errs:          []error{errUnavailable, errRateLimited, errUnavailable, errUnavailable},
+			expectedCalls: 3,
+			expectedErr:   errUnavailable,
+			expectedMsg:   "GetAccount failed after 3 attempts: service unavailable",
+		},
+		{
+			name:          "run deadline",
+			errs:          []error{fmt.Errorf("not calling GetAccount with 1s left: %w", ErrRunDeadline)},
+			expectedCalls: 1,
+			expectedErr:   ErrRunDeadline,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			flaky := newFlakyClient(map[string][]error{"GetAccount": tc.errs})
+			client := WithRetries(flaky, testRetryPolicy)
+
+			account, err := client.GetAccount(context.TODO())
+			require.Equal(t, tc.expectedCalls, flaky.calls["GetAccount"])
+			if tc.expectedMsg == "" && tc.expectedErr == nil {
+				require.NoError(t, err)
+				require.Equal(t, "account", account.ID)
+				return
+			}
+
+			require.Error(t, err)
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "expected %v, got %v", tc.expectedErr, err)
+			}
+			if tc.expectedMsg != "" {
+				require.Equal(t, tc.expectedMsg, err.Error())
+			}
+		})
+	}
+}
+
+func TestWithRetries_RateLimited(t *testing.T) {
+	flaky := newFlakyClient(map[string][]error{"GetAccount": {errRateLimited}})
+	policy := testRetryPolicy
+	policy.RateLimitDelay = 50 * time.Millisecond
+	client := WithRetries(flaky, policy)
+
+	start := time.Now()
+	_, err := client.GetAccount(context.TODO())
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= policy.RateLimitDelay, "retried after %s", time.Since(start))
+}
+
+func TestWithRetries_Cancelled(t *testing.T) {
+	flaky := newFlakyClient(map[string][]error{"GetAccount": {errUnavailable, errUnavailable}})
+	policy := testRetryPolicy
+	policy.BaseDelay, policy.MaxDelay = time.Minute, time.Minute
+	client := WithRetries(flaky, policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.GetAccount(ctx)
+	require.True(t, errors.Is(err, errUnavailable))
+	require.Equal(t, 1, flaky.calls["GetAccount"])
+}
+
+func TestWithRetries_PlaceOrder(t *testing.T) {
+	testCases := []struct {
+		name          string
+		clientOrderID string
+		errs          map[string][]error
+		placeAnyway   bool
+
+		expectedPlaceCalls int
+		expectedListCalls  int
+		expectedOrders     int
+		expectedErr        error
+	}{
+		{
+			name:               "placed on retry",
+			clientOrderID:      "trade1",
+			errs:               map[string][]error{"PlaceOrder": {errUnavailable}},
+			expectedPlaceCalls: 2,
+			expectedListCalls:  1,
+			expectedOrders:     1,
+		},
+		{
+			name:               "placed by the failed attempt",
+			clientOrderID:      "trade1",
+			errs:               map[string][]error{"PlaceOrder": {errUnavailable}},
+			placeAnyway:        true,
+			expectedPlaceCalls: 1,
+			expectedListCalls:  1,
+			expectedOrders:     1,
+		},
+		{
+			name:               "check fails, then succeeds",
+			clientOrderID:      "trade1",
+			errs:               map[string][]error{"PlaceOrder": {errUnavailable}, "ListOrders": {errUnavailable}},
+			expectedPlaceCalls: 2,
+			expectedListCalls:  2,
+			expectedOrders:     1,
+		},
+		{
+			name:               "terminal error",
+			clientOrderID:      "trade1",
+			errs:               map[string][]error{"PlaceOrder": {errNotTradable}},
+			expectedPlaceCalls: 1,
+			expectedErr:        errNotTradable,
+		},
+		{
+			name:               "no client order ID",
+			errs:               map[string][]error{"PlaceOrder": {errUnavailable}},
+			expectedPlaceCalls: 1,
+			expectedErr:        errUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			flaky := newFlakyClient(tc.errs)
+			flaky.placeAnyway = tc.placeAnyway
+			// an older order, to look past
+			flaky.orders = []Order{{ID: "order0", ClientOrderID: "trade0"}}
+			client := WithRetries(flaky, testRetryPolicy)
+
+			order, err := client.PlaceOrder(context.TODO(), OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(3), ClientOrderID: tc.clientOrderID})
+			require.Equal(t, tc.expectedPlaceCalls, flaky.calls["PlaceOrder"])
+			require.Equal(t, tc.expectedListCalls, flaky.calls["ListOrders"])
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "expected %v, got %v", tc.expectedErr, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.clientOrderID, order.ClientOrderID)
+			require.Len(t, flaky.orders, 1+tc.expectedOrders)
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "server error", err: errUnavailable, expected: true},
+		{name: "rate limited", err: errRateLimited, expected: true},
+		{name: "wrapped", err: fmt.Errorf("GetOrder: %w", errUnavailable), expected: true},
+		{name: "terminal", err: errNotTradable, expected: false},
+		{name: "call timed out", err: context.DeadlineExceeded, expected: true},
+		{name: "cancelled", err: context.Canceled, expected: false},
+		{name: "run deadline", err: fmt.Errorf("GetOrder: %w", ErrRunDeadline), expected: false},
+		{name: "unknown", err: errors.New("unknown"), expected: false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, IsRetryable(tc.err))
+		})
+	}
+}
+
+func TestFromAlpacaError(t *testing.T) {
+	testCases := []struct {
+		name               string
+		err                error
+		expectedStatusCode int
+		expectedRetryable  bool
+	}{
+		{name: "insufficient buying power", err: &alpaca.APIError{Code: 40310000, Message: "insufficient buying power"}, expectedStatusCode: 403},
+		{name: "not tradable", err: &alpaca.APIError{Code: 42210000, Message: "asset is not tradable"}, expectedStatusCode: 422},
+		{name: "invalid qty", err: &alpaca.APIError{Code: 40010001, Message: "qty must be > 0"}, expectedStatusCode: 400},
+		{name: "rate limited", err: &alpaca.APIError{Code: 42900000, Message: "rate limit exceeded"}, expectedStatusCode: 429, expectedRetryable: true},
+		{name: "server error", err: &alpaca.APIError{Code: 50010000, Message: "internal server error"}, expectedStatusCode: 500, expectedRetryable: true},
+		{name: "not json", err: json.Unmarshal([]byte("<html>502 Bad Gateway</html>"), &alpaca.APIError{}), expectedRetryable: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var exchangeErr *Error
+			require.True(t, errors.As(fromAlpacaError(tc.err), &exchangeErr))
+			require.Equal(t, tc.expectedStatusCode, exchangeErr.StatusCode)
+			require.Equal(t, tc.expectedRetryable, exchangeErr.Retryable)
+			require.True(t, errors.Is(exchangeErr, tc.err))
+		})
+	}
+
+	require.Nil(t, fromAlpacaError(nil))
+}
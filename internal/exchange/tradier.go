@@ -0,0 +1,516 @@
+package exchange
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// DefaultTradierURL is tradier's production API
+const DefaultTradierURL = "https://api.tradier.com/v1"
+
+type tradierClient struct {
+	baseURL     string
+	accessToken string
+	accountID   string
+	httpClient  *http.Client
+}
+
+// TradierDefaults stay under tradier's sandbox limit of 60 requests a minute
+// per class of endpoint, half of production's 120
+func TradierDefaults() BrokerDefaults {
+	return BrokerDefaults{
+		RateLimits: map[EndpointClass]RateLimit{
+			AllEndpoints: {PerMinute: 60, Burst: 10},
+		},
+		Retries: RetryPolicy{
+			Attempts:  3,
+			BaseDelay: 500 * time.Millisecond,
+			MaxDelay:  5 * time.Second,
+			// a request frees up every second, wait for a few
+			RateLimitDelay: 5 * time.Second,
+		},
+	}
+}
+
+// NewTradierClient trades in a tradier account through the API at baseURL,
+// e.g. DefaultTradierURL or https://sandbox.tradier.com/v1
+func NewTradierClient(baseURL, accessToken, accountID string) Client {
+	return &tradierClient{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		accessToken: accessToken,
+		accountID:   accountID,
+		httpClient:  http.DefaultClient,
+	}
+}
+
+// tradierOrder is an order as tradier sends it
+type tradierOrder struct {
+	ID                json.Number     `json:"id"`
+	Type              string          `json:"type"`
+	Symbol            string          `json:"symbol"`
+	Side              string          `json:"side"`
+	Quantity          decimal.Decimal `json:"quantity"`
+	Status            string          `json:"status"`
+	Duration          string          `json:"duration"`
+	Price             decimal.Decimal `json:"price"`
+	AvgFillPrice      decimal.Decimal `json:"avg_fill_price"`
+	ExecQuantity      decimal.Decimal `json:"exec_quantity"`
+	RemainingQuantity decimal.Decimal `json:"remaining_quantity"`
+	CreateDate        time.Time       `json:"create_date"`
+	TransactionDate   time.Time       `json:"transaction_date"`
+	Class             string          `json:"class"`
+	Tag               string          `json:"tag"`
+}
+
+type tradierQuote struct {
+	Symbol  string          `json:"symbol"`
+	Bid     decimal.Decimal `json:"bid"`
+	Ask     decimal.Decimal `json:"ask"`
+	BidDate int64           `json:"bid_date"` // ms since the epoch
+	AskDate int64           `json:"ask_date"`
+}
+
+type tradierPosition struct {
+	Symbol    string          `json:"symbol"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	CostBasis decimal.Decimal `json:"cost_basis"`
+}
+
+// tradierList decodes one of tradier's lists, which are sent as an array,
+// a bare object when there's one item, or the string "null" when there are none
+type tradierList []json.RawMessage
+
+func (l *tradierList) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(trimmed, []byte("null")), bytes.Equal(trimmed, []byte(`"null"`)):
+		*l = nil
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return err
+		}
+		*l = items
+	default:
+		*l = tradierList{json.RawMessage(trimmed)}
+	}
+	return nil
+}
+
+// tradierOptional decodes an object into v, unless tradier sent "null" for it because it's empty
+type tradierOptional struct {
+	v interface{}
+}
+
+func (o *tradierOptional) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte(`"null"`)) {
+		return nil
+	}
+	return json.Unmarshal(data, o.v)
+}
+
+// decode decodes each item into a new element of the slice v points to
+func (l tradierList) decode(v interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, item := range l {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(item)
+	}
+	buf.WriteByte(']')
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+// tradierBalances are an account's balances. Only the block for the account's type is sent.
+type tradierBalances struct {
+	AccountNumber string `json:"account_number"`
+	AccountType   string `json:"account_type"` // "cash", "margin" or "pdt"
+	Cash          struct {
+		CashAvailable decimal.Decimal `json:"cash_available"`
+	} `json:"cash"`
+	Margin tradierBuyingPower `json:"margin"`
+	PDT    tradierBuyingPower `json:"pdt"`
+}
+
+type tradierBuyingPower struct {
+	StockBuyingPower decimal.Decimal `json:"stock_buying_power"`
+}
+
+// GetAccount reports the cash that's free to spend, like alpaca does, rather than
+// tradier's total cash, which counts unsettled funds and cash held for open orders
+func (c *tradierClient) GetAccount(ctx context.Context) (*Account, error) {
+	var resp struct {
+		Balances tradierBalances `json:"balances"`
+	}
+	err := c.do(ctx, http.MethodGet, c.accountPath("balances"), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := resp.Balances
+	account := &Account{ID: balances.AccountNumber}
+	switch balances.AccountType {
+	case "cash":
+		account.Cash = balances.Cash.CashAvailable
+	case "margin":
+		account.Cash = balances.Margin.StockBuyingPower
+	case "pdt":
+		account.Cash = balances.PDT.StockBuyingPower
+	default:
+		return nil, fmt.Errorf("unknown tradier account type %q", balances.AccountType)
+	}
+	return account, nil
+}
+
+func (c *tradierClient) GetLastQuote(ctx context.Context, symbol string) (*Quote, error) {
+	quotes, err := c.getQuotes(ctx, []string{symbol})
+	if err != nil {
+		return nil, err
+	}
+
+	quote, ok := quotes[symbol]
+	if !ok {
+		return nil, &Error{StatusCode: http.StatusNotFound, Err: fmt.Errorf("no quote for %s", symbol)}
+	}
+	return quote, nil
+}
+
+// getQuotes quotes the symbols in one call, leaving out any tradier doesn't know
+func (c *tradierClient) getQuotes(ctx context.Context, symbols []string) (map[string]*Quote, error) {
+	var resp struct {
+		Quotes struct {
+			Quote tradierList `json:"quote"`
+		} `json:"quotes"`
+	}
+	query := url.Values{"symbols": {strings.Join(symbols, ",")}}
+	err := c.do(ctx, http.MethodGet, "/markets/quotes?"+query.Encode(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotes []tradierQuote
+	err = resp.Quotes.Quote.decode(&quotes)
+	if err != nil {
+		return nil, fmt.Errorf("decoding quotes: %w", err)
+	}
+
+	converted := map[string]*Quote{}
+	for _, quote := range quotes {
+		at := quote.BidDate
+		if quote.AskDate > at {
+			at = quote.AskDate
+		}
+		converted[quote.Symbol] = &Quote{
+			Symbol:    quote.Symbol,
+			BidPrice:  quote.Bid,
+			AskPrice:  quote.Ask,
+			Timestamp: time.Unix(0, at*int64(time.Millisecond)),
+		}
+	}
+	return converted, nil
+}
+
+func (c *tradierClient) GetOrder(ctx context.Context, id string) (*Order, error) {
+	var resp struct {
+		Order tradierOrder `json:"order"`
+	}
+	err := c.do(ctx, http.MethodGet, c.accountPath("orders/"+url.PathEscape(id))+"?includeTags=true", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := fromTradierOrder(&resp.Order)
+	return &converted, nil
+}
+
+// ListOrders filters tradier's orders like alpaca would, since tradier only
+// lists them all. That's only the current session's, so it returns
+// ErrNoOrderHistory if asked for orders from before it.
+func (c *tradierClient) ListOrders(ctx context.Context, req ListOrdersRequest) ([]Order, error) {
+	if req.Since != nil && req.Since.Before(tradierSessionStart(time.Now())) {
+		return nil, ErrNoOrderHistory
+	}
+
+	var list struct {
+		Order tradierList `json:"order"`
+	}
+	resp := struct {
+		Orders tradierOptional `json:"orders"`
+	}{tradierOptional{&list}}
+	err := c.do(ctx, http.MethodGet, c.accountPath("orders")+"?includeTags=true", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var orders []tradierOrder
+	err = list.Order.decode(&orders)
+	if err != nil {
+		return nil, fmt.Errorf("decoding orders: %w", err)
+	}
+
+	status := req.Status
+	if status == "" {
+		status = "open"
+	}
+	var converted []Order
+	for i := range orders {
+		order := fromTradierOrder(&orders[i])
+		if req.Until != nil && order.SubmittedAt.After(*req.Until) {
+			continue
+		}
+		open := !isClosedStatus(order.Status)
+		if (status == "open" && !open) || (status == "closed" && open) {
+			continue
+		}
+		converted = append(converted, order)
+	}
+
+	sort.SliceStable(converted, func(i, j int) bool {
+		return converted[i].SubmittedAt.After(converted[j].SubmittedAt)
+	})
+	if req.Limit > 0 && len(converted) > req.Limit {
+		converted = converted[:req.Limit]
+	}
+	return converted, nil
+}
+
+// tradierSessionStart is the latest tradier's current session could have
+// started, midnight in New York. It's worked out from fixed offsets, as the
+// zone database may be missing, so it's up to an hour late in the winter.
+func tradierSessionStart(now time.Time) time.Time {
+	edt := time.FixedZone("EDT", -4*60*60)
+	y, m, d := now.In(edt).Date()
+	// midnight EST is an hour after midnight EDT
+	return time.Date(y, m, d, 1, 0, 0, 0, edt)
+}
+
+// isClosedStatus is whether an order with the status is no longer open at the broker
+func isClosedStatus(status OrderStatus) bool {
+	switch status {
+	case OrderFilled, OrderCanceled, OrderExpired, OrderRejected, OrderReplaced, OrderDoneForDay:
+		return true
+	}
+	return false
+}
+
+// PlaceOrder places the order, tagged with its client order ID. Tradier only
+// answers with the new order's ID, so the rest is filled in from the request.
+func (c *tradierClient) PlaceOrder(ctx context.Context, req OrderRequest) (*Order, error) {
+	form := url.Values{
+		"class":    {"equity"},
+		"symbol":   {req.Symbol},
+		"side":     {string(req.Side)},
+		"quantity": {req.Qty.String()},
+		"type":     {string(req.Type)},
+		"duration": {string(req.TimeInForce)},
+	}
+	if req.LimitPrice != nil {
+		form.Set("price", req.LimitPrice.String())
+	}
+	if req.ClientOrderID != "" {
+		form.Set("tag", req.ClientOrderID)
+	}
+
+	var resp struct {
+		Order struct {
+			ID     json.Number `json:"id"`
+			Status string      `json:"status"`
+		} `json:"order"`
+	}
+	err := c.do(ctx, http.MethodPost, c.accountPath("orders"), form, &resp)
+	if err != nil {
+		return nil, err
+	} else if resp.Order.Status != "ok" {
+		return nil, &Error{Err: fmt.Errorf("placing order: tradier answered %q", resp.Order.Status)}
+	}
+
+	now := time.Now()
+	return &Order{
+		ID:            resp.Order.ID.String(),
+		ClientOrderID: req.ClientOrderID,
+		Symbol:        req.Symbol,
+		Side:          req.Side,
+		Type:          req.Type,
+		TimeInForce:   req.TimeInForce,
+		Qty:           req.Qty,
+		Status:        OrderPendingNew,
+		CreatedAt:     now,
+		SubmittedAt:   now,
+		UpdatedAt:     now,
+	}, nil
+}
+
+// ListPositions values the positions at their bids, which tradier leaves out
+func (c *tradierClient) ListPositions(ctx context.Context) ([]Position, error) {
+	var list struct {
+		Position tradierList `json:"position"`
+	}
+	resp := struct {
+		Positions tradierOptional `json:"positions"`
+	}{tradierOptional{&list}}
+	err := c.do(ctx, http.MethodGet, c.accountPath("positions"), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions []tradierPosition
+	err = list.Position.decode(&positions)
+	if err != nil {
+		return nil, fmt.Errorf("decoding positions: %w", err)
+	} else if len(positions) == 0 {
+		return nil, nil
+	}
+
+	symbols := make([]string, 0, len(positions))
+	for _, position := range positions {
+		symbols = append(symbols, position.Symbol)
+	}
+	quotes, err := c.getQuotes(ctx, symbols)
+	if err != nil {
+		return nil, fmt.Errorf("pricing positions: %w", err)
+	}
+
+	converted := make([]Position, 0, len(positions))
+	for _, position := range positions {
+		quote, ok := quotes[position.Symbol]
+		if !ok {
+			return nil, fmt.Errorf("pricing positions: no quote for %s", position.Symbol)
+		}
+		converted = append(converted, Position{
+			Symbol:       position.Symbol,
+			Qty:          position.Quantity,
+			MarketValue:  position.Quantity.Mul(quote.BidPrice),
+			CurrentPrice: quote.BidPrice,
+		})
+	}
+	return converted, nil
+}
+
+func (c *tradierClient) accountPath(path string) string {
+	return "/accounts/" + url.PathEscape(c.accountID) + "/" + path
+}
+
+// do makes a call to tradier, form encoding any form, and decodes the JSON answer into resp
+func (c *tradierClient) do(ctx context.Context, method, path string, form url.Values, resp interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	req.Header.Set("Accept", "application/json")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// cut short by ctx, which callers check for
+			return ctx.Err()
+		}
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	raw, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode >= http.StatusMultipleChoices {
+		return fromTradierError(httpResp.StatusCode, raw)
+	}
+
+	err = json.Unmarshal(raw, resp)
+	if err != nil {
+		return fmt.Errorf("decoding %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// fromTradierError classifies an error answer. Tradier explains errors as
+// {"errors": {"error": [...]}}, or {"fault": {"faultstring": ...}} from its gateway.
+func fromTradierError(status int, body []byte) error {
+	var explained struct {
+		Errors struct {
+			Error tradierList `json:"error"`
+		} `json:"errors"`
+		Fault struct {
+			FaultString string `json:"faultstring"`
+		} `json:"fault"`
+	}
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &explained) == nil {
+		var messages []string
+		if explained.Errors.Error.decode(&messages) == nil && len(messages) > 0 {
+			message = strings.Join(messages, "; ")
+		} else if explained.Fault.FaultString != "" {
+			message = explained.Fault.FaultString
+		}
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	return &Error{StatusCode: status, Retryable: retryableStatus(status), Err: errors.New(message)}
+}
+
+// tradierStatuses maps tradier's order statuses onto ours. Anything
+// else is passed through, and treated as still open.
+var tradierStatuses = map[string]OrderStatus{
+	"pending":              OrderPendingNew,
+	"calculated":           OrderPendingNew,
+	"accepted_for_bidding": OrderPendingNew,
+	"open":                 OrderNew,
+	"held":                 OrderNew,
+	"partially_filled":     OrderPartiallyFilled,
+	"filled":               OrderFilled,
+	"canceled":             OrderCanceled,
+	"expired":              OrderExpired,
+	"rejected":             OrderRejected,
+	// an order tradier failed to route, it's not going to fill
+	"error": OrderRejected,
+}
+
+func fromTradierOrder(order *tradierOrder) Order {
+	status, ok := tradierStatuses[order.Status]
+	if !ok {
+		status = OrderStatus(order.Status)
+	}
+
+	converted := Order{
+		ID:            order.ID.String(),
+		ClientOrderID: order.Tag,
+		Symbol:        order.Symbol,
+		Side:          Side(order.Side),
+		Type:          OrderType(order.Type),
+		TimeInForce:   TimeInForce(order.Duration),
+		Qty:           order.Quantity,
+		FilledQty:     order.ExecQuantity,
+		Status:        status,
+		CreatedAt:     order.CreateDate,
+		SubmittedAt:   order.CreateDate,
+		UpdatedAt:     order.TransactionDate,
+	}
+	if order.ExecQuantity.IsPositive() {
+		avgFillPrice := order.AvgFillPrice
+		converted.FilledAvgPrice = &avgFillPrice
+	}
+	if status == OrderFilled {
+		filledAt := order.TransactionDate
+		converted.FilledAt = &filledAt
+	}
+	return converted
+}
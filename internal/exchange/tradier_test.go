@@ -0,0 +1,250 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange/tradiertest"
+)
+
+func TestTradierClient(t *testing.T) {
+	server := tradiertest.NewServer("token", "VA000001")
+	defer server.Close()
+	server.SetCash(decimal.NewFromInt(1000))
+	server.SetQuote("VOO", decimal.RequireFromString("326.35"), decimal.RequireFromString("326.5"))
+	server.SetQuote("BND", decimal.RequireFromString("80"), decimal.RequireFromString("80.2"))
+
+	client := NewTradierClient(server.BaseURL(), "token", "VA000001")
+	ctx := context.TODO()
+
+	account, err := client.GetAccount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "VA000001", account.ID)
+	require.True(t, decimal.NewFromInt(1000).Equal(account.Cash))
+
+	quote, err := client.GetLastQuote(ctx, "VOO")
+	require.NoError(t, err)
+	require.Equal(t, "VOO", quote.Symbol)
+	require.True(t, decimal.RequireFromString("326.35").Equal(quote.BidPrice))
+	require.True(t, decimal.RequireFromString("326.5").Equal(quote.AskPrice))
+	require.WithinDuration(t, time.Now(), quote.Timestamp, time.Minute)
+
+	_, err = client.GetLastQuote(ctx, "NOPE")
+	require.EqualError(t, err, "no quote for NOPE")
+
+	// tradier sends "null" for no positions or orders
+	positions, err := client.ListPositions(ctx)
+	require.NoError(t, err)
+	require.Empty(t, positions)
+	orders, err := client.ListOrders(ctx, ListOrdersRequest{Status: "all"})
+	require.NoError(t, err)
+	require.Empty(t, orders)
+
+	placed, err := client.PlaceOrder(ctx, OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(2), Side: Buy, Type: Market, TimeInForce: Day, ClientOrderID: "1b4e28ba-2fa1-11d2-883f-0016d3cca427"})
+	require.NoError(t, err)
+	require.Equal(t, "1001", placed.ID)
+	require.Equal(t, "1b4e28ba-2fa1-11d2-883f-0016d3cca427", placed.ClientOrderID)
+	require.Equal(t, OrderPendingNew, placed.Status)
+
+	// a bare object for one order
+	order, err := client.GetOrder(ctx, placed.ID)
+	require.NoError(t, err)
+	require.Equal(t, OrderNew, order.Status)
+	require.Equal(t, "1b4e28ba-2fa1-11d2-883f-0016d3cca427", order.ClientOrderID)
+	require.Equal(t, Market, order.Type)
+	require.Equal(t, Day, order.TimeInForce)
+	require.Nil(t, order.FilledAvgPrice)
+	orders, err = client.ListOrders(ctx, ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+
+	// cash held for the open buy isn't free to spend, in cash or margin accounts
+	account, err = client.GetAccount(ctx)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(347).Equal(account.Cash), "cash %s", account.Cash)
+	server.SetMargin(true)
+	account, err = client.GetAccount(ctx)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(347).Equal(account.Cash), "cash %s", account.Cash)
+	server.SetMargin(false)
+
+	server.FillOrders()
+	order, err = client.GetOrder(ctx, placed.ID)
+	require.NoError(t, err)
+	require.Equal(t, OrderFilled, order.Status)
+	require.True(t, decimal.NewFromInt(2).Equal(order.FilledQty))
+	require.True(t, decimal.RequireFromString("326.5").Equal(*order.FilledAvgPrice))
+	require.NotNil(t, order.FilledAt)
+
+	// positions are valued at their bids
+	server.SetPosition("BND", decimal.NewFromInt(5), decimal.NewFromInt(75))
+	positions, err = client.ListPositions(ctx)
+	require.NoError(t, err)
+	require.Len(t, positions, 2)
+	require.Equal(t, "BND", positions[0].Symbol)
+	require.True(t, decimal.NewFromInt(400).Equal(positions[0].MarketValue))
+	require.True(t, decimal.RequireFromString("652.7").Equal(positions[1].MarketValue))
+
+	second, err := client.PlaceOrder(ctx, OrderRequest{Symbol: "BND", Qty: decimal.NewFromInt(1), Side: Buy, Type: Market, TimeInForce: Day, ClientOrderID: "trade2"})
+	require.NoError(t, err)
+	require.NoError(t, server.SetOrderStatus(1002, "canceled"))
+
+	// arrays for more, filtered and sorted here since tradier lists them all
+	orders, err = client.ListOrders(ctx, ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Empty(t, orders)
+	orders, err = client.ListOrders(ctx, ListOrdersRequest{Status: "closed"})
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	require.Equal(t, second.ID, orders[0].ID)
+	require.Equal(t, OrderCanceled, orders[0].Status)
+	orders, err = client.ListOrders(ctx, ListOrdersRequest{Status: "all", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+
+	// tradier only lists the current session's orders, so older ones can't be looked for
+	lastWeek := time.Now().AddDate(0, 0, -7)
+	_, err = client.ListOrders(ctx, ListOrdersRequest{Status: "all", Since: &lastWeek})
+	require.Equal(t, ErrNoOrderHistory, err)
+}
+
+func TestTradierSessionStart(t *testing.T) {
+	cases := []struct {
+		name     string
+		now      string
+		expected string
+	}{
+		{name: "summer", now: "2020-08-03T14:30:00Z", expected: "2020-08-03T05:00:00Z"},
+		{name: "winter", now: "2020-12-03T14:30:00Z", expected: "2020-12-03T05:00:00Z"},
+		{name: "before midnight in new york", now: "2020-08-04T03:30:00Z", expected: "2020-08-03T05:00:00Z"},
+		// it's still the 3rd in new york, but it could be the 4th
+		{name: "the hour it could be either day", now: "2020-12-04T04:30:00Z", expected: "2020-12-04T05:00:00Z"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tc.now)
+			require.NoError(t, err)
+			expected, err := time.Parse(time.RFC3339, tc.expected)
+			require.NoError(t, err)
+			require.True(t, expected.Equal(tradierSessionStart(now)), "expected %s, got %s", expected, tradierSessionStart(now).UTC())
+		})
+	}
+}
+
+func TestTradierClient_Errors(t *testing.T) {
+	server := tradiertest.NewServer("token", "VA000001")
+	defer server.Close()
+	server.SetCash(decimal.NewFromInt(100))
+	server.SetQuote("VOO", decimal.RequireFromString("326.35"), decimal.RequireFromString("326.5"))
+
+	client := NewTradierClient(server.BaseURL(), "token", "VA000001")
+	ctx := context.TODO()
+	buy := OrderRequest{Symbol: "VOO", Qty: decimal.NewFromInt(3), Side: Buy, Type: Market, TimeInForce: Day}
+
+	testCases := []struct {
+		name      string
+		fault     *tradiertest.Fault
+		call      func() error
+		status    int
+		retryable bool
+		message   string
+	}{
+		{
+			name:    "insufficient buying power",
+			call:    func() error { _, err := client.PlaceOrder(ctx, buy); return err },
+			status:  http.StatusBadRequest,
+			message: "You do not have enough buying power for this trade.",
+		},
+		{
+			name:      "rate limited",
+			fault:     &tradiertest.Fault{Status: http.StatusTooManyRequests},
+			call:      func() error { _, err := client.GetAccount(ctx); return err },
+			status:    http.StatusTooManyRequests,
+			retryable: true,
+			message:   "Too Many Requests",
+		},
+		{
+			name:      "gateway fault",
+			fault:     &tradiertest.Fault{Status: http.StatusBadGateway, Body: `{"fault":{"faultstring":"Backend service unavailable","detail":{"errorcode":"messaging.adaptors.http.flow.ServiceUnavailable"}}}`},
+			call:      func() error { _, err := client.GetAccount(ctx); return err },
+			status:    http.StatusBadGateway,
+			retryable: true,
+			message:   "Backend service unavailable",
+		},
+		{
+			name: "wrong token",
+			call: func() error {
+				_, err := NewTradierClient(server.BaseURL(), "wrong", "VA000001").GetAccount(ctx)
+				return err
+			},
+			status:  http.StatusUnauthorized,
+			message: "Invalid Access Token",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.fault != nil {
+				server.Fail(tradiertest.RouteBalances, *tc.fault)
+			}
+
+			err := tc.call()
+			var exchangeErr *Error
+			require.True(t, errors.As(err, &exchangeErr), "got %v", err)
+			require.Equal(t, tc.status, exchangeErr.StatusCode)
+			require.Equal(t, tc.retryable, IsRetryable(err))
+			require.EqualError(t, err, tc.message)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := client.GetAccount(ctx)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestFromTradierOrder(t *testing.T) {
+	testCases := []struct {
+		status   string
+		expected OrderStatus
+		terminal bool
+	}{
+		{"pending", OrderPendingNew, false},
+		{"open", OrderNew, false},
+		{"partially_filled", OrderPartiallyFilled, false},
+		{"filled", OrderFilled, true},
+		{"canceled", OrderCanceled, true},
+		{"expired", OrderExpired, true},
+		{"rejected", OrderRejected, true},
+		{"error", OrderRejected, true},
+		{"something_new", OrderStatus("something_new"), false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.status, func(t *testing.T) {
+			var order tradierOrder
+			raw := `{"id": 228175, "type": "market", "symbol": "VOO", "side": "buy", "quantity": 3.00000000, "status": "` + tc.status + `",
+				"duration": "day", "avg_fill_price": 0.00000000, "exec_quantity": 0.00000000, "create_date": "2020-08-03T14:30:00.000Z",
+				"transaction_date": "2020-08-03T14:30:01.000Z", "class": "equity", "tag": "trade1"}`
+			require.NoError(t, json.Unmarshal([]byte(raw), &order))
+
+			converted := fromTradierOrder(&order)
+			require.Equal(t, tc.expected, converted.Status)
+			require.Equal(t, tc.terminal, isClosedStatus(converted.Status))
+			require.Equal(t, "228175", converted.ID)
+			require.Equal(t, "trade1", converted.ClientOrderID)
+			require.True(t, decimal.NewFromInt(3).Equal(converted.Qty))
+		})
+	}
+}
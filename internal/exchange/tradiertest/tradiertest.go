@@ -0,0 +1,515 @@
+// Package tradiertest fakes tradier's brokerage API over HTTP, so that the
+// tradier adapter can be tested offline.
+package tradiertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// routes the server answers, for use with Fail and Requests
+const (
+	RouteBalances   = "GET /v1/accounts/{id}/balances"
+	RoutePositions  = "GET /v1/accounts/{id}/positions"
+	RouteQuotes     = "GET /v1/markets/quotes"
+	RouteListOrders = "GET /v1/accounts/{id}/orders"
+	RouteGetOrder   = "GET /v1/accounts/{id}/orders/{order}"
+	RoutePlaceOrder = "POST /v1/accounts/{id}/orders"
+)
+
+// Fault is returned instead of the next answer on a route.
+// Body defaults to tradier's JSON error for Status.
+type Fault struct {
+	Status int
+	Body   string
+}
+
+// Order is an order as tradier keeps it
+type Order struct {
+	ID                int             `json:"id"`
+	Type              string          `json:"type"`
+	Symbol            string          `json:"symbol"`
+	Side              string          `json:"side"`
+	Quantity          decimal.Decimal `json:"quantity"`
+	Status            string          `json:"status"`
+	Duration          string          `json:"duration"`
+	Price             decimal.Decimal `json:"price"`
+	AvgFillPrice      decimal.Decimal `json:"avg_fill_price"`
+	ExecQuantity      decimal.Decimal `json:"exec_quantity"`
+	RemainingQuantity decimal.Decimal `json:"remaining_quantity"`
+	CreateDate        time.Time       `json:"create_date"`
+	TransactionDate   time.Time       `json:"transaction_date"`
+	Class             string          `json:"class"`
+	Tag               string          `json:"tag,omitempty"`
+}
+
+type quote struct {
+	Symbol  string          `json:"symbol"`
+	Bid     decimal.Decimal `json:"bid"`
+	Ask     decimal.Decimal `json:"ask"`
+	BidDate int64           `json:"bid_date"`
+	AskDate int64           `json:"ask_date"`
+}
+
+type position struct {
+	Symbol       string          `json:"symbol"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	CostBasis    decimal.Decimal `json:"cost_basis"`
+	DateAcquired time.Time       `json:"date_acquired"`
+}
+
+// tags can only have letters, numbers and dashes
+var validTag = regexp.MustCompile(`^[A-Za-z0-9-]{1,255}$`)
+
+// Server is a fake tradier with one account, with state scripted through its
+// methods. Placed orders are open until filled with FillOrders or moved along
+// with SetOrderStatus. Lists are sent the way tradier does: an array, a bare
+// object when there's one item, or "null" when there are none.
+type Server struct {
+	*httptest.Server
+
+	accessToken, accountID string
+
+	mu          sync.Mutex
+	margin      bool
+	cash        decimal.Decimal
+	quotes      map[string]quote
+	positions   map[string]*position
+	orders      []*Order
+	lastOrderID int
+
+	requests map[string]int
+	faults   map[string][]Fault // route -> faults for its next requests
+}
+
+// NewServer starts a fake tradier that only answers requests with the token, for the account
+func NewServer(accessToken, accountID string) *Server {
+	s := &Server{
+		accessToken: accessToken,
+		accountID:   accountID,
+		quotes:      map[string]quote{},
+		positions:   map[string]*position{},
+		lastOrderID: 1000,
+		requests:    map[string]int{},
+		faults:      map[string][]Fault{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// BaseURL is the server's equivalent of tradier's https://api.tradier.com/v1
+func (s *Server) BaseURL() string {
+	return s.URL + "/v1"
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	route, account, orderID := routeOf(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[route]++
+	if faults := s.faults[route]; len(faults) > 0 {
+		s.faults[route] = faults[1:]
+		writeFault(w, faults[0])
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+s.accessToken {
+		// tradier's gateway doesn't answer in JSON
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid Access Token"))
+		return
+	}
+	if account != "" && account != s.accountID {
+		writeError(w, http.StatusBadRequest, "Invalid account")
+		return
+	}
+
+	switch route {
+	case RouteBalances:
+		balances := map[string]interface{}{
+			"account_number": s.accountID,
+			"account_type":   "cash",
+			"total_cash":     s.cash,
+			"cash":           map[string]interface{}{"cash_available": s.buyingPower()},
+		}
+		if s.margin {
+			balances["account_type"] = "margin"
+			balances["margin"] = map[string]interface{}{"stock_buying_power": s.buyingPower()}
+			delete(balances, "cash")
+		}
+		writeJSON(w, map[string]interface{}{"balances": balances})
+	case RoutePositions:
+		s.listPositions(w)
+	case RouteQuotes:
+		s.getQuotes(w, r)
+	case RouteListOrders:
+		s.listOrders(w)
+	case RouteGetOrder:
+		s.getOrder(w, orderID)
+	case RoutePlaceOrder:
+		s.placeOrder(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Resource not found: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// routeOf finds the route of a request, and the account and order in its path
+func routeOf(r *http.Request) (route, account, orderID string) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "v1/markets/quotes" && r.Method == http.MethodGet {
+		return RouteQuotes, "", ""
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "accounts" {
+		return r.Method + " /" + path, "", ""
+	}
+	account = parts[2]
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[3] == "balances":
+		return RouteBalances, account, ""
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[3] == "positions":
+		return RoutePositions, account, ""
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[3] == "orders":
+		return RouteListOrders, account, ""
+	case r.Method == http.MethodGet && len(parts) == 5 && parts[3] == "orders":
+		return RouteGetOrder, account, parts[4]
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[3] == "orders":
+		return RoutePlaceOrder, account, ""
+	}
+	return r.Method + " /" + path, "", ""
+}
+
+// list renders items the way tradier does
+func list(items []interface{}) interface{} {
+	switch len(items) {
+	case 0:
+		return "null"
+	case 1:
+		return items[0]
+	}
+	return items
+}
+
+func (s *Server) listPositions(w http.ResponseWriter) {
+	var symbols []string
+	for symbol := range s.positions {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	var positions []interface{}
+	for _, symbol := range symbols {
+		positions = append(positions, s.positions[symbol])
+	}
+	if len(positions) == 0 {
+		writeJSON(w, map[string]interface{}{"positions": "null"})
+		return
+	}
+	writeJSON(w, map[string]interface{}{"positions": map[string]interface{}{"position": list(positions)}})
+}
+
+func (s *Server) getQuotes(w http.ResponseWriter, r *http.Request) {
+	var quotes, unmatched []interface{}
+	for _, symbol := range strings.Split(r.URL.Query().Get("symbols"), ",") {
+		if quote, ok := s.quotes[symbol]; ok {
+			quotes = append(quotes, quote)
+		} else {
+			unmatched = append(unmatched, symbol)
+		}
+	}
+
+	body := map[string]interface{}{}
+	if len(quotes) > 0 {
+		body["quote"] = list(quotes)
+	}
+	if len(unmatched) > 0 {
+		body["unmatched_symbols"] = map[string]interface{}{"symbol": list(unmatched)}
+	}
+	writeJSON(w, map[string]interface{}{"quotes": body})
+}
+
+func (s *Server) listOrders(w http.ResponseWriter) {
+	var orders []interface{}
+	for _, order := range s.orders {
+		orders = append(orders, order)
+	}
+	if len(orders) == 0 {
+		writeJSON(w, map[string]interface{}{"orders": "null"})
+		return
+	}
+	writeJSON(w, map[string]interface{}{"orders": map[string]interface{}{"order": list(orders)}})
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, id string) {
+	order := s.order(id)
+	if order == nil {
+		writeError(w, http.StatusBadRequest, "Order not found")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"order": order})
+}
+
+func (s *Server) placeOrder(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	symbol := r.PostForm.Get("symbol")
+	quote, ok := s.quotes[symbol]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid symbol %q", symbol))
+		return
+	}
+	if class := r.PostForm.Get("class"); class != "equity" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid order class %q", class))
+		return
+	}
+	qty, err := decimal.NewFromString(r.PostForm.Get("quantity"))
+	if err != nil || !qty.IsPositive() {
+		writeError(w, http.StatusBadRequest, "Invalid quantity")
+		return
+	}
+	side := r.PostForm.Get("side")
+	if side != "buy" && side != "sell" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid side %q", side))
+		return
+	}
+	tag := r.PostForm.Get("tag")
+	if tag != "" && !validTag.MatchString(tag) {
+		writeError(w, http.StatusBadRequest, "Invalid tag")
+		return
+	}
+	if side == "buy" && qty.Mul(quote.Ask).GreaterThan(s.buyingPower()) {
+		writeError(w, http.StatusBadRequest, "You do not have enough buying power for this trade.")
+		return
+	}
+
+	s.lastOrderID++
+	now := time.Now().UTC()
+	order := &Order{
+		ID:                s.lastOrderID,
+		Type:              r.PostForm.Get("type"),
+		Symbol:            symbol,
+		Side:              side,
+		Quantity:          qty,
+		Status:            "open",
+		Duration:          r.PostForm.Get("duration"),
+		RemainingQuantity: qty,
+		CreateDate:        now,
+		TransactionDate:   now,
+		Class:             "equity",
+		Tag:               tag,
+	}
+	if price := r.PostForm.Get("price"); price != "" {
+		order.Price, _ = decimal.NewFromString(price)
+	}
+	s.orders = append(s.orders, order)
+	writeJSON(w, map[string]interface{}{"order": map[string]interface{}{"id": order.ID, "status": "ok"}})
+}
+
+// buyingPower is the cash not set aside for open buys. callers must hold s.mu.
+func (s *Server) buyingPower() decimal.Decimal {
+	buyingPower := s.cash
+	for _, order := range s.orders {
+		if order.Side == "buy" && isOpen(order.Status) {
+			buyingPower = buyingPower.Sub(order.RemainingQuantity.Mul(s.quotes[order.Symbol].Ask))
+		}
+	}
+	return buyingPower
+}
+
+// order finds an order by ID. callers must hold s.mu.
+func (s *Server) order(id string) *Order {
+	for _, order := range s.orders {
+		if strconv.Itoa(order.ID) == id {
+			return order
+		}
+	}
+	return nil
+}
+
+func isOpen(status string) bool {
+	switch status {
+	case "filled", "canceled", "expired", "rejected", "error":
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeError answers like tradier's API
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": map[string]interface{}{"error": []string{message}}})
+}
+
+func writeFault(w http.ResponseWriter, fault Fault) {
+	if fault.Body == "" {
+		writeError(w, fault.Status, http.StatusText(fault.Status))
+		return
+	}
+	w.WriteHeader(fault.Status)
+	w.Write([]byte(fault.Body))
+}
+
+// SetCash sets the account's cash
+func (s *Server) SetCash(cash decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cash = cash
+}
+
+// SetMargin makes it a margin account, whose balances report buying power rather than cash available
+func (s *Server) SetMargin(margin bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.margin = margin
+}
+
+// Cash returns the account's cash
+func (s *Server) Cash() decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cash
+}
+
+// SetQuote sets the quote for the symbol, which is also what orders fill at
+func (s *Server) SetQuote(symbol string, bid, ask decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	s.quotes[symbol] = quote{Symbol: symbol, Bid: bid, Ask: ask, BidDate: now, AskDate: now}
+}
+
+// SetPosition sets how much of the symbol the account holds, bought at entryPrice
+func (s *Server) SetPosition(symbol string, qty, entryPrice decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if qty.IsZero() {
+		delete(s.positions, symbol)
+		return
+	}
+	s.positions[symbol] = &position{
+		Symbol:       symbol,
+		Quantity:     qty,
+		CostBasis:    qty.Mul(entryPrice),
+		DateAcquired: time.Now().UTC(),
+	}
+}
+
+// Positions returns the account's positions, by symbol
+func (s *Server) Positions() map[string]decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	positions := map[string]decimal.Decimal{}
+	for symbol, position := range s.positions {
+		positions[symbol] = position.Quantity
+	}
+	return positions
+}
+
+// Orders returns every order on the account, in the order they were placed
+func (s *Server) Orders() []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := make([]Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		orders = append(orders, *order)
+	}
+	return orders
+}
+
+// SetOrderStatus moves an order to status, without filling it
+func (s *Server) SetOrderStatus(id int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order := s.order(strconv.Itoa(id))
+	if order == nil {
+		return fmt.Errorf("no order with ID %d", id)
+	}
+	order.Status = status
+	order.TransactionDate = time.Now().UTC()
+	return nil
+}
+
+// FillOrders fills every open order at its symbol's quote, the ask for buys
+// and the bid for sells, moving cash and positions to match
+func (s *Server) FillOrders() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, order := range s.orders {
+		if !isOpen(order.Status) {
+			continue
+		}
+
+		quote := s.quotes[order.Symbol]
+		price := quote.Ask
+		qty := order.RemainingQuantity
+		if order.Side == "sell" {
+			price = quote.Bid
+			qty = qty.Neg()
+		}
+
+		held, ok := s.positions[order.Symbol]
+		if !ok {
+			held = &position{Symbol: order.Symbol, DateAcquired: now}
+			s.positions[order.Symbol] = held
+		}
+		held.Quantity = held.Quantity.Add(qty)
+		held.CostBasis = held.CostBasis.Add(qty.Mul(price))
+		if held.Quantity.IsZero() {
+			delete(s.positions, order.Symbol)
+		}
+		s.cash = s.cash.Sub(qty.Mul(price))
+
+		order.AvgFillPrice = price
+		order.ExecQuantity = order.Quantity
+		order.RemainingQuantity = decimal.Zero
+		order.TransactionDate = now
+		order.Status = "filled"
+	}
+}
+
+// Fail answers the next request on the route with fault, after any faults already queued
+func (s *Server) Fail(route string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[route] = append(s.faults[route], fault)
+}
+
+// Requests counts the requests made on the route
+func (s *Server) Requests(route string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[route]
+}
@@ -0,0 +1,124 @@
+package exchange
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Side is which way an order trades
+type Side string
+
+const (
+	Buy  Side = "buy"
+	Sell Side = "sell"
+)
+
+// OrderType is how an order is priced
+type OrderType string
+
+const (
+	Market OrderType = "market"
+	Limit  OrderType = "limit"
+)
+
+// TimeInForce is how long an order stays open
+type TimeInForce string
+
+const (
+	Day TimeInForce = "day"
+	GTC TimeInForce = "gtc"
+)
+
+// OrderStatus is where an order is at the broker. Adapters map their broker's
+// statuses onto these, which follow alpaca's names.
+type OrderStatus string
+
+const (
+	OrderNew             OrderStatus = "new"
+	OrderAccepted        OrderStatus = "accepted"
+	OrderPendingNew      OrderStatus = "pending_new"
+	OrderPartiallyFilled OrderStatus = "partially_filled"
+	OrderPendingCancel   OrderStatus = "pending_cancel"
+	OrderPendingReplace  OrderStatus = "pending_replace"
+	OrderFilled          OrderStatus = "filled"
+	OrderCanceled        OrderStatus = "canceled"
+	OrderExpired         OrderStatus = "expired"
+	OrderRejected        OrderStatus = "rejected"
+	OrderReplaced        OrderStatus = "replaced"
+	OrderDoneForDay      OrderStatus = "done_for_day"
+)
+
+// Account is the brokerage account trades are made in
+type Account struct {
+	ID   string
+	Cash decimal.Decimal
+}
+
+// Order is an order as the broker sees it
+type Order struct {
+	ID string
+	// set by camelid when placing the order, see OrderRequest
+	ClientOrderID  string
+	Symbol         string
+	Side           Side
+	Type           OrderType
+	TimeInForce    TimeInForce
+	Qty            decimal.Decimal
+	FilledQty      decimal.Decimal
+	FilledAvgPrice *decimal.Decimal
+	Status         OrderStatus
+
+	CreatedAt   time.Time
+	SubmittedAt time.Time
+	UpdatedAt   time.Time
+	FilledAt    *time.Time
+}
+
+// Position is a holding of one symbol
+type Position struct {
+	Symbol       string
+	Qty          decimal.Decimal
+	MarketValue  decimal.Decimal
+	CurrentPrice decimal.Decimal
+}
+
+// Quote is the latest bid and ask for a symbol
+type Quote struct {
+	Symbol    string
+	BidPrice  decimal.Decimal
+	AskPrice  decimal.Decimal
+	Timestamp time.Time
+}
+
+// OrderRequest is an order to place
+type OrderRequest struct {
+	Symbol      string
+	Qty         decimal.Decimal
+	Side        Side
+	Type        OrderType
+	TimeInForce TimeInForce
+	LimitPrice  *decimal.Decimal
+	// lets the order be matched to its record, brokers must keep it unique
+	ClientOrderID string
+}
+
+// ListOrdersRequest picks out orders to list. Zero fields use the broker's defaults.
+type ListOrdersRequest struct {
+	// "open", "closed" or "all"
+	Status string
+	// excludes orders submitted after it
+	Until *time.Time
+	// caps the number of orders returned
+	Limit int
+	// the oldest orders the caller is after, if it's paging back. Brokers that
+	// can't list orders that old return ErrNoOrderHistory rather than leave them out.
+	Since *time.Time
+}
+
+// TradeUpdate is an event on an order, with the order as it is after the event
+type TradeUpdate struct {
+	// e.g. "new", "fill", "partial_fill", "canceled", "expired" or "rejected"
+	Event string
+	Order Order
+}
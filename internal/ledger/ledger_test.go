@@ -0,0 +1,130 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/db/dbtest"
+)
+
+// newTestStore returns an empty ledger, in dynamo unless given a directory for the file store
+func newTestStore(t *testing.T, dir string) Store {
+	if dir == "" {
+		return NewDynamoStore(dbtest.NewMockClient(DefaultDynamoTable), DefaultDynamoTable)
+	}
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	return store
+}
+
+func TestStore(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+
+		run := NewRun(false, map[string]decimal.Decimal{
+			"VOO":  decimal.NewFromInt(3),
+			"VXUS": decimal.NewFromInt(1),
+		}, decimal.NewFromInt(1000))
+
+		_, err := store.GetRun(ctx, run.ID)
+		require.Equal(t, ErrNotFound, err)
+
+		require.NoError(t, store.PutRun(ctx, run))
+		got, err := store.GetRun(ctx, run.ID)
+		require.NoError(t, err)
+		require.Equal(t, RunStatusRunning, got.Status)
+		require.Nil(t, got.FinishedAt)
+
+		run.SetAccountCash(map[string]decimal.Decimal{"": decimal.RequireFromString("1523.17"), "ira": decimal.NewFromInt(40)})
+		run.SetHoldings(map[string]decimal.Decimal{"VOO": decimal.RequireFromString("2984.50")})
+		run.SetPlan(decimal.NewFromInt(1000), map[string]decimal.Decimal{
+			"VOO":  decimal.RequireFromString("612.5"),
+			"VXUS": decimal.RequireFromString("387.5"),
+		})
+		run.AddOrder(Order{RecordID: "trade1", AlpacaOrderID: "alpaca11", Symbol: "VOO"})
+		run.Skip("VXUS", "too little to buy a share")
+		run.Finish(errors.New("placing order: insufficient buying power"))
+		require.NoError(t, store.PutRun(ctx, run))
+
+		got, err = store.GetRun(ctx, run.ID)
+		require.NoError(t, err)
+		require.Equal(t, RunStatusFailed, got.Status)
+		require.Equal(t, "placing order: insufficient buying power", got.Error)
+		require.NotNil(t, got.FinishedAt)
+		require.True(t, run.StartedAt.Equal(got.StartedAt))
+		require.False(t, got.DryRun)
+		require.True(t, decimal.NewFromInt(3).Equal(got.Ratios["VOO"].Decimal))
+		require.True(t, decimal.NewFromInt(1000).Equal(got.MaxInvestment.Decimal))
+		require.True(t, decimal.RequireFromString("1523.17").Equal(got.AccountCash[DefaultAccount].Decimal))
+		require.True(t, decimal.NewFromInt(40).Equal(got.AccountCash["ira"].Decimal))
+		require.True(t, decimal.RequireFromString("2984.5").Equal(got.Holdings["VOO"].Decimal))
+		require.True(t, decimal.NewFromInt(1000).Equal(got.AmountToInvest.Decimal))
+		require.True(t, decimal.RequireFromString("387.5").Equal(got.Deltas["VXUS"].Decimal))
+		require.Equal(t, []Order{{RecordID: "trade1", AlpacaOrderID: "alpaca11", Symbol: "VOO"}}, got.Orders)
+		require.Equal(t, map[string]string{"VXUS": "too little to buy a share"}, got.Skipped)
+	})
+}
+
+func TestStore_StoresNumbers(t *testing.T) {
+	ctx := context.TODO()
+	client := dbtest.NewMockClient(DefaultDynamoTable)
+	store := NewDynamoStore(client, DefaultDynamoTable)
+
+	run := NewRun(true, map[string]decimal.Decimal{"VOO": decimal.NewFromInt(1)}, decimal.NewFromInt(500))
+	require.NoError(t, store.PutRun(ctx, run))
+
+	// amounts should be numbers in dynamo, so they can be queried
+	resp, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(DefaultDynamoTable),
+		Key:       map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(run.ID)}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "500", aws.StringValue(resp.Item["MaxInvestment"].N))
+	require.Equal(t, "1", aws.StringValue(resp.Item["Ratios"].M["VOO"].N))
+}
+
+func TestFinish(t *testing.T) {
+	run := NewRun(false, nil, decimal.Zero)
+	run.Finish(nil)
+	require.Equal(t, RunStatusSucceeded, run.Status)
+	require.Empty(t, run.Error)
+	require.NotNil(t, run.FinishedAt)
+}
+
+func TestFinish_Partial(t *testing.T) {
+	run := NewRun(false, nil, decimal.Zero)
+	run.Finish(fmt.Errorf("trading: %w", &PartialError{Remaining: []string{"VTI", "VXUS"}, Err: errors.New("out of time")}))
+	require.Equal(t, RunStatusPartial, run.Status)
+	require.Equal(t, "trading: stopped before trading VTI, VXUS: out of time", run.Error)
+}
+
+func TestStore_SingleAccountCash(t *testing.T) {
+	ctx := context.TODO()
+	client := dbtest.NewMockClient(DefaultDynamoTable)
+	store := NewDynamoStore(client, DefaultDynamoTable)
+
+	// runs from before multiple accounts stored the total
+	_, err := client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(DefaultDynamoTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"ID":          {S: aws.String("run1")},
+			"Status":      {S: aws.String(string(RunStatusSucceeded))},
+			"AccountCash": {N: aws.String("1523.17")},
+		},
+	})
+	require.NoError(t, err)
+
+	got, err := store.GetRun(ctx, "run1")
+	require.NoError(t, err)
+	require.Equal(t, RunStatusSucceeded, got.Status)
+	require.Nil(t, got.AccountCash)
+}
@@ -0,0 +1,143 @@
+// Package ledger keeps a record of what each run decided and did,
+// so that any day's behavior can be audited later.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/jchorl/camelid/internal/db"
+)
+
+type RunStatus string
+
+const (
+	RunStatusRunning   RunStatus = "running"
+	RunStatusSucceeded RunStatus = "succeeded"
+	RunStatusFailed    RunStatus = "failed"
+	// RunStatusPartial is a run that stopped partway through trading,
+	// keeping the orders it placed
+	RunStatusPartial RunStatus = "partial"
+)
+
+// PartialError ends a run that placed some of its orders, but not all
+type PartialError struct {
+	Remaining []string // tickers not traded
+	Err       error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("stopped before trading %s: %v", strings.Join(e.Remaining, ", "), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultAccount keys the default account in per-account maps, since dynamo
+// doesn't allow empty keys. Account names start with a letter, so it can't clash.
+const DefaultAccount = "(default)"
+
+// Order is an order placed by a run
+type Order struct {
+	RecordID      string // also the client order ID
+	AlpacaOrderID string
+	Symbol        string
+	Account       string `dynamodbav:",omitempty" json:",omitempty"` // empty for the default account
+}
+
+type Run struct {
+	// need exported fields for the dynamo marshaler
+	ID     string
+	Status RunStatus
+	Error  string
+
+	StartedAt  time.Time
+	FinishedAt *time.Time
+
+	// config
+	DryRun        bool
+	Ratios        map[string]db.Decimal
+	MaxInvestment db.Decimal
+
+	// inputs
+	// by account, see DefaultAccount. runs from before multiple accounts
+	// stored a single AccountCash, so the attribute is named apart
+	AccountCash map[string]db.Decimal `dynamodbav:"CashByAccount" json:"CashByAccount"`
+	Holdings    map[string]db.Decimal // value at Prices, by ticker
+	Prices      map[string]db.Decimal // what holdings were valued and orders sized at, by ticker
+
+	// plan
+	AmountToInvest db.Decimal
+	Deltas         map[string]db.Decimal // dollars, by ticker
+
+	// outcomes
+	Orders  []Order
+	Skipped map[string]string // ticker -> why it wasn't traded
+}
+
+func NewRun(dryRun bool, ratios map[string]decimal.Decimal, maxInvestment decimal.Decimal) *Run {
+	return &Run{
+		ID:            uuid.New().String(),
+		Status:        RunStatusRunning,
+		StartedAt:     time.Now(),
+		DryRun:        dryRun,
+		Ratios:        db.DecimalMap(ratios),
+		MaxInvestment: db.NewDecimal(maxInvestment),
+		Skipped:       map[string]string{},
+	}
+}
+
+// SetAccountCash takes cash by account, "" for the default account
+func (r *Run) SetAccountCash(cash map[string]decimal.Decimal) {
+	r.AccountCash = map[string]db.Decimal{}
+	for account, c := range cash {
+		if account == "" {
+			account = DefaultAccount
+		}
+		r.AccountCash[account] = db.NewDecimal(c)
+	}
+}
+
+func (r *Run) SetHoldings(holdings map[string]decimal.Decimal) {
+	r.Holdings = db.DecimalMap(holdings)
+}
+
+func (r *Run) SetPrices(prices map[string]decimal.Decimal) {
+	r.Prices = db.DecimalMap(prices)
+}
+
+func (r *Run) SetPlan(amountToInvest decimal.Decimal, deltas map[string]decimal.Decimal) {
+	r.AmountToInvest = db.NewDecimal(amountToInvest)
+	r.Deltas = db.DecimalMap(deltas)
+}
+
+func (r *Run) AddOrder(order Order) {
+	r.Orders = append(r.Orders, order)
+}
+
+func (r *Run) Skip(ticker, reason string) {
+	r.Skipped[ticker] = reason
+}
+
+// Finish marks the run as done, failed if err is non-nil,
+// or partial if err is a *PartialError
+func (r *Run) Finish(err error) {
+	now := time.Now()
+	r.FinishedAt = &now
+	r.Status = RunStatusSucceeded
+	if err != nil {
+		r.Status = RunStatusFailed
+		r.Error = err.Error()
+	}
+
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		r.Status = RunStatusPartial
+	}
+}
@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"github.com/jchorl/camelid/internal/db/filedb"
+)
+
+// DefaultDynamoTable is the dynamo table runs are stored in, unless configured otherwise
+const DefaultDynamoTable = "CamelidRunsTest"
+
+var ErrNotFound = errors.New("run not found")
+
+type Store interface {
+	PutRun(ctx context.Context, run *Run) error
+	// GetRun returns ErrNotFound if there is no run with the ID
+	GetRun(ctx context.Context, id string) (*Run, error)
+}
+
+type dynamoStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func NewDynamoStore(db dynamodbiface.DynamoDBAPI, table string) Store {
+	return &dynamoStore{db, table}
+}
+
+func (s *dynamoStore) PutRun(ctx context.Context, run *Run) error {
+	av, err := dynamodbattribute.MarshalMap(run)
+	if err != nil {
+		return fmt.Errorf("marshaling run (%+v): %w", run, err)
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("put item: %w", err)
+	}
+
+	return nil
+}
+
+func (s *dynamoStore) GetRun(ctx context.Context, id string) (*Run, error) {
+	resp, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem(%s) from dynamo: %w", id, err)
+	} else if resp.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	run := Run{}
+	err = dynamodbattribute.UnmarshalMap(resp.Item, &run)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling item from dynamo: %w", err)
+	}
+
+	return &run, nil
+}
+
+// fileStore keeps each run in a file named by its ID. Only the run
+// itself writes it, so a put just replaces the file.
+type fileStore struct {
+	table *filedb.Table
+}
+
+func NewFileStore(dir string) (Store, error) {
+	table, err := filedb.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStore{table}, nil
+}
+
+func (s *fileStore) PutRun(ctx context.Context, run *Run) error {
+	return s.table.Put(run.ID, run)
+}
+
+func (s *fileStore) GetRun(ctx context.Context, id string) (*Run, error) {
+	run := Run{}
+	err := s.table.Get(id, &run)
+	if errors.Is(err, filedb.ErrNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
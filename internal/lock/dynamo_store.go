@@ -0,0 +1,147 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+type dynamoStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// NewDynamoStore keeps leases in table, keyed by their name under the ID attribute.
+// The table can be shared with other items as long as their IDs don't collide.
+func NewDynamoStore(db dynamodbiface.DynamoDBAPI, table string) Store {
+	return &dynamoStore{db, table}
+}
+
+func (s *dynamoStore) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (*Lease, error) {
+	now := time.Now()
+	lease := Lease{
+		Name:       name,
+		Owner:      owner,
+		AcquiredAt: now,
+		ExpiresAt:  expiresAt(now, ttl),
+	}
+
+	av, err := dynamodbattribute.MarshalMap(lease)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling lease (%+v): %w", lease, err)
+	}
+
+	cond := expression.AttributeNotExists(expression.Name("ID")).
+		Or(expression.Name("ExpiresAt").LessThan(expression.Value(unixMillis(now)))).
+		Or(expression.Name("Owner").Equal(expression.Value(owner)))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return nil, fmt.Errorf("building condition: %w", err)
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.table),
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionFailed(err) {
+		held, err := s.get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &HeldError{Lease: *held}
+	} else if err != nil {
+		return nil, fmt.Errorf("put item: %w", err)
+	}
+
+	return &lease, nil
+}
+
+func (s *dynamoStore) Renew(ctx context.Context, name, owner string, ttl time.Duration) error {
+	update := expression.Set(expression.Name("ExpiresAt"), expression.Value(expiresAt(time.Now(), ttl)))
+	cond := expression.Name("Owner").Equal(expression.Value(owner))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("building update: %w", err)
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       key(name),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionFailed(err) {
+		return ErrLost
+	} else if err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (s *dynamoStore) Release(ctx context.Context, name, owner string) error {
+	cond := expression.Name("Owner").Equal(expression.Value(owner))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("building condition: %w", err)
+	}
+
+	_, err = s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       key(name),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionFailed(err) {
+		return ErrLost
+	} else if err != nil {
+		return fmt.Errorf("delete item: %w", err)
+	}
+
+	return nil
+}
+
+func (s *dynamoStore) get(ctx context.Context, name string) (*Lease, error) {
+	resp, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key:       key(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem(%s) from dynamo: %w", name, err)
+	}
+
+	lease := Lease{}
+	err = dynamodbattribute.UnmarshalMap(resp.Item, &lease)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling item from dynamo: %w", err)
+	}
+
+	return &lease, nil
+}
+
+func key(name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ID": {
+			S: aws.String(name),
+		},
+	}
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,72 @@
+package lock
+
+import (
+	"context"
+	"time"
+
+	"github.com/jchorl/camelid/internal/db/filedb"
+)
+
+// fileStore keeps each lease in a file named after its lock. Leases are
+// only changed under filedb's lock on the file, so processes sharing the
+// directory contend for them like they would for the dynamo item.
+type fileStore struct {
+	table *filedb.Table
+}
+
+func NewFileStore(dir string) (Store, error) {
+	table, err := filedb.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStore{table}, nil
+}
+
+func (s *fileStore) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (*Lease, error) {
+	now := time.Now()
+	lease := Lease{}
+	err := s.table.Update(name, &lease, func(found bool) error {
+		if found && lease.Owner != "" && lease.Owner != owner && lease.ExpiresAt >= unixMillis(now) {
+			return &HeldError{Lease: lease}
+		}
+
+		lease = Lease{
+			Name:       name,
+			Owner:      owner,
+			AcquiredAt: now,
+			ExpiresAt:  expiresAt(now, ttl),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+func (s *fileStore) Renew(ctx context.Context, name, owner string, ttl time.Duration) error {
+	lease := Lease{}
+	return s.table.Update(name, &lease, func(found bool) error {
+		if !found || lease.Owner != owner {
+			return ErrLost
+		}
+
+		lease.ExpiresAt = expiresAt(time.Now(), ttl)
+		return nil
+	})
+}
+
+func (s *fileStore) Release(ctx context.Context, name, owner string) error {
+	lease := Lease{}
+	return s.table.Update(name, &lease, func(found bool) error {
+		if !found || lease.Owner != owner {
+			return ErrLost
+		}
+
+		// the file is kept to lock on, a lease without an owner is free
+		lease = Lease{Name: name}
+		return nil
+	})
+}
@@ -0,0 +1,54 @@
+// Package lock is a lease-based lock, so that only one run trades at a time.
+// A lease has an owner and an expiry, the owner keeps it alive with a heartbeat,
+// and anyone can take it over once it expires.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLost is returned when renewing or releasing a lease the owner no longer holds
+var ErrLost = errors.New("lease lost")
+
+type Lease struct {
+	// need exported fields for the dynamo marshaler
+	Name       string `dynamodbav:"ID"`
+	Owner      string
+	AcquiredAt time.Time
+	ExpiresAt  int64 // unix millis, a number so dynamo can compare it
+}
+
+func (l Lease) Expiry() time.Time {
+	return time.Unix(0, l.ExpiresAt*int64(time.Millisecond))
+}
+
+// HeldError is returned when acquiring a lease someone else holds
+type HeldError struct {
+	Lease Lease
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("lease %s held by %s since %s, expires %s", e.Lease.Name, e.Lease.Owner, e.Lease.AcquiredAt.Format(time.RFC3339), e.Lease.Expiry().Format(time.RFC3339))
+}
+
+// Store keeps leases, using conditional writes so only one owner holds each
+type Store interface {
+	// Acquire takes the lease if it's free, expired or already held by owner.
+	// It returns a *HeldError if someone else holds it.
+	Acquire(ctx context.Context, name, owner string, ttl time.Duration) (*Lease, error)
+	// Renew extends a lease held by owner, or returns ErrLost
+	Renew(ctx context.Context, name, owner string, ttl time.Duration) error
+	// Release gives up a lease held by owner, or returns ErrLost
+	Release(ctx context.Context, name, owner string) error
+}
+
+func expiresAt(now time.Time, ttl time.Duration) int64 {
+	return unixMillis(now.Add(ttl))
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,122 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Lock is a held lease, renewed in the background until released
+type Lock struct {
+	store Store
+	lease Lease
+	ttl   time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.Mutex
+	lost bool
+}
+
+// Acquire takes the lease called name for owner and keeps it alive with a
+// heartbeat every third of ttl. It returns a *HeldError if someone else holds it.
+// If the lease is lost, e.g. because a heartbeat stalled past the expiry, or
+// may be about to lapse because renewals keep failing, the context returned by
+// Context is cancelled.
+func Acquire(ctx context.Context, store Store, name, owner string, ttl time.Duration) (*Lock, error) {
+	lease, err := store.Acquire(ctx, name, owner, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	l := &Lock{
+		store:  store,
+		lease:  *lease,
+		ttl:    ttl,
+		ctx:    lockCtx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go l.heartbeat()
+
+	return l, nil
+}
+
+// Context is cancelled once the lock is released or lost.
+// Work that needs the lock should be done with it.
+func (l *Lock) Context() context.Context {
+	return l.ctx
+}
+
+func (l *Lock) Lease() Lease {
+	return l.lease
+}
+
+// Lost reports whether the lease was taken away before being released
+func (l *Lock) Lost() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Release stops the heartbeat and gives up the lease
+func (l *Lock) Release(ctx context.Context) error {
+	l.cancel()
+	<-l.done
+
+	if l.Lost() {
+		return ErrLost
+	}
+
+	return l.store.Release(ctx, l.lease.Name, l.lease.Owner)
+}
+
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+
+	beat := l.ttl / 3
+	ticker := time.NewTicker(beat)
+	defer ticker.Stop()
+
+	// the lease lasts ttl from the start of the last renewal that went through, at the latest
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		err := l.store.Renew(l.ctx, l.lease.Name, l.lease.Owner, l.ttl)
+		if errors.Is(err, ErrLost) {
+			glog.Errorf("lost lease %s held by %s", l.lease.Name, l.lease.Owner)
+			l.lose()
+			return
+		} else if err != nil && time.Since(renewedAt) >= l.ttl-beat {
+			// it could expire before the next beat, and be taken by someone else
+			glog.Errorf("giving up lease %s held by %s, it couldn't be renewed since %s: %v", l.lease.Name, l.lease.Owner, renewedAt.Format(time.RFC3339Nano), err)
+			l.lose()
+			return
+		} else if err != nil {
+			// try again next beat, the lease lasts a few beats
+			glog.Warningf("renewing lease %s: %v", l.lease.Name, err)
+			continue
+		}
+		renewedAt = start
+	}
+}
+
+// lose marks the lease lost, cancelling work done under it
+func (l *Lock) lose() {
+	l.mu.Lock()
+	l.lost = true
+	l.mu.Unlock()
+	l.cancel()
+}
@@ -0,0 +1,155 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/db/dbtest"
+)
+
+const testTable = "CamelidLocksTest"
+
+// newTestStore returns a store holding no locks, in dir if it's set, otherwise in dynamo
+func newTestStore(t *testing.T, dir string) Store {
+	if dir == "" {
+		return NewDynamoStore(dbtest.NewMockClient(testTable), testTable)
+	}
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	return store
+}
+
+func TestStore(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+
+		lease, err := store.Acquire(ctx, "run", "alice", time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, "alice", lease.Owner)
+		require.True(t, lease.Expiry().After(time.Now()))
+
+		// reentrant for the same owner
+		_, err = store.Acquire(ctx, "run", "alice", time.Minute)
+		require.NoError(t, err)
+
+		_, err = store.Acquire(ctx, "run", "bob", time.Minute)
+		var held *HeldError
+		require.True(t, errors.As(err, &held), "expected HeldError, got %v", err)
+		require.Equal(t, "alice", held.Lease.Owner)
+
+		// other leases are independent
+		_, err = store.Acquire(ctx, "other", "bob", time.Minute)
+		require.NoError(t, err)
+
+		require.Equal(t, ErrLost, store.Renew(ctx, "run", "bob", time.Minute))
+		require.NoError(t, store.Renew(ctx, "run", "alice", time.Minute))
+
+		require.Equal(t, ErrLost, store.Release(ctx, "run", "bob"))
+		require.NoError(t, store.Release(ctx, "run", "alice"))
+		require.Equal(t, ErrLost, store.Renew(ctx, "run", "alice", time.Minute))
+
+		lease, err = store.Acquire(ctx, "run", "bob", time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, "bob", lease.Owner)
+	})
+}
+
+func TestStore_TakesOverExpiredLease(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+
+		_, err := store.Acquire(ctx, "run", "alice", 10*time.Millisecond)
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+
+		lease, err := store.Acquire(ctx, "run", "bob", time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, "bob", lease.Owner)
+
+		require.Equal(t, ErrLost, store.Renew(ctx, "run", "alice", time.Minute))
+	})
+}
+
+func TestLock_Heartbeat(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+		ttl := 60 * time.Millisecond
+
+		l, err := Acquire(ctx, store, "run", "alice", ttl)
+		require.NoError(t, err)
+
+		// outlive the original expiry, the heartbeat keeps the lease
+		time.Sleep(3 * ttl)
+		_, err = Acquire(ctx, store, "run", "bob", ttl)
+		var held *HeldError
+		require.True(t, errors.As(err, &held), "expected HeldError, got %v", err)
+		require.NoError(t, l.Context().Err())
+
+		require.NoError(t, l.Release(ctx))
+		require.Error(t, l.Context().Err())
+
+		l, err = Acquire(ctx, store, "run", "bob", ttl)
+		require.NoError(t, err)
+		require.NoError(t, l.Release(ctx))
+	})
+}
+
+func TestLock_Lost(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+		ttl := 60 * time.Millisecond
+
+		l, err := Acquire(ctx, store, "run", "alice", ttl)
+		require.NoError(t, err)
+
+		// someone steals the lease, e.g. after alice stalled past the expiry
+		require.NoError(t, store.Release(ctx, "run", "alice"))
+		_, err = store.Acquire(ctx, "run", "bob", time.Minute)
+		require.NoError(t, err)
+
+		select {
+		case <-l.Context().Done():
+		case <-time.After(10 * ttl):
+			t.Fatal("lock context wasn't cancelled after losing the lease")
+		}
+		require.True(t, l.Lost())
+		require.Equal(t, ErrLost, l.Release(ctx))
+	})
+}
+
+// flakyStore fails every renewal, without saying the lease is lost
+type flakyStore struct {
+	Store
+}
+
+func (s flakyStore) Renew(ctx context.Context, name, owner string, ttl time.Duration) error {
+	return errors.New("throttled")
+}
+
+func TestLock_RenewalsFail(t *testing.T) {
+	ctx := context.TODO()
+	ttl := 60 * time.Millisecond
+	store := flakyStore{NewDynamoStore(dbtest.NewMockClient(testTable), testTable)}
+
+	start := time.Now()
+	l, err := Acquire(ctx, store, "run", "alice", ttl)
+	require.NoError(t, err)
+
+	select {
+	case <-l.Context().Done():
+	case <-time.After(10 * ttl):
+		t.Fatal("lock context wasn't cancelled when renewals kept failing")
+	}
+	require.True(t, time.Since(start) < ttl, "cancelled after %s, past the lease's expiry", time.Since(start))
+	require.True(t, l.Lost())
+	require.Equal(t, ErrLost, l.Release(ctx))
+}
@@ -5,22 +5,60 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/golang/glog"
+
 	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/prices"
 	"github.com/shopspring/decimal"
 )
 
+// Account is a brokerage account the portfolio is held across
+type Account struct {
+	Name           string // empty for the default account
+	ExchangeClient exchange.Client
+}
+
 type Portfolio struct {
-	exchangeClient exchange.Client
-	ratios         map[string]decimal.Decimal // ownership ratios, ticker -> shares
+	accounts []Account
+	split    SplitRule
+	prices   *prices.Snapshot           // what holdings are valued at, the same as trades are sized at
+	ratios   map[string]decimal.Decimal // ownership ratios, ticker -> shares
+	blocked  map[string]decimal.Decimal // tickers not to trade, ticker -> dollars in flight
+	reserved map[string]decimal.Decimal // account -> cash in-flight buys will spend
 }
 
-func New(exchangeClient exchange.Client, ratios map[string]decimal.Decimal) Portfolio {
+// New is a portfolio held in a single account
+func New(exchangeClient exchange.Client, snapshot *prices.Snapshot, ratios map[string]decimal.Decimal) Portfolio {
+	return NewMultiAccount([]Account{{ExchangeClient: exchangeClient}}, snapshot, ratios, SplitMostCash)
+}
+
+// NewMultiAccount is one portfolio held across accounts. Holdings and cash
+// are summed across them, and deltas are split between them by rule, see SplitDeltas.
+func NewMultiAccount(accounts []Account, snapshot *prices.Snapshot, ratios map[string]decimal.Decimal, rule SplitRule) Portfolio {
 	return Portfolio{
-		exchangeClient: exchangeClient,
-		ratios:         ratios,
+		accounts: accounts,
+		split:    rule,
+		prices:   snapshot,
+		ratios:   ratios,
+		blocked:  map[string]decimal.Decimal{},
+		reserved: map[string]decimal.Decimal{},
 	}
 }
 
+// Block keeps a ticker out of the deltas to trade.
+// inFlight is what open buys of it are expected to spend, which is
+// counted as held, and set aside from the cash to invest.
+func (p *Portfolio) Block(ticker string, inFlight decimal.Decimal) {
+	p.BlockInAccount(p.accounts[0].Name, ticker, inFlight)
+}
+
+// BlockInAccount is Block for buys in flight in the named account, whose
+// cash they're set aside from. The ticker isn't traded in any account.
+func (p *Portfolio) BlockInAccount(account, ticker string, inFlight decimal.Decimal) {
+	p.blocked[ticker] = p.blocked[ticker].Add(inFlight)
+	p.reserved[account] = p.reserved[account].Add(inFlight)
+}
+
 func (p *Portfolio) GetDeltasWithoutSales(ctx context.Context, amountToInvest decimal.Decimal) (map[string]decimal.Decimal, error) {
 	deltas, err := p.GetDeltasWithSales(ctx, amountToInvest)
 	if err != nil {
@@ -33,11 +71,18 @@ func (p *Portfolio) GetDeltasWithoutSales(ctx context.Context, amountToInvest de
 		if !delta.IsPositive() {
 			continue
 		}
+		if _, ok := p.blocked[ticker]; ok {
+			continue
+		}
 
 		filteredDeltas[ticker] = delta
 	}
 
 	totalDesiredSpend := sumMapValuesDecimal(filteredDeltas)
+	if totalDesiredSpend.LessThanOrEqual(amountToInvest) {
+		// blocked tickers left money on the table, keep it for them
+		return filteredDeltas, nil
+	}
 
 	// total spend can easily be > amountToInvest, because it accounts for sales.
 	// it's the desired state, assuming you could reinvest every dollar today.
@@ -54,11 +99,16 @@ func (p *Portfolio) GetDeltasWithSales(ctx context.Context, amountToInvest decim
 		return nil, errors.New("cannot get deltas with no holding ratios defined")
 	}
 
-	holdings, err := p.getCurrentHoldingsInDollars(ctx)
+	holdings, err := p.GetHoldings(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	// in-flight buys will be held soon enough
+	for ticker, inFlight := range p.blocked {
+		holdings[ticker] = holdings[ticker].Add(inFlight)
+	}
+
 	total := sumMapValuesDecimal(holdings)
 	total = total.Add(amountToInvest)
 
@@ -90,29 +140,117 @@ func (p *Portfolio) GetDeltasWithSales(ctx context.Context, amountToInvest decim
 	return deltas, nil
 }
 
-func (p *Portfolio) GetAmountToInvest(maxAmount decimal.Decimal) (decimal.Decimal, error) {
-	acct, err := p.exchangeClient.GetAccount()
+// GetAmountToInvest returns the cash to invest, up to maxAmount.
+// Cash that in-flight buys will spend isn't available.
+func (p *Portfolio) GetAmountToInvest(ctx context.Context, maxAmount decimal.Decimal) (decimal.Decimal, error) {
+	available, err := p.getAvailableCash(ctx)
 	if err != nil {
 		return decimal.Decimal{}, err
 	}
 
-	return decimal.Min(maxAmount, acct.Cash), nil
+	return decimal.Max(decimal.Min(maxAmount, sumMapValuesDecimal(available)), decimal.Zero), nil
+}
+
+// getAvailableCash returns the cash each account can spend, by account.
+// Cash that in-flight buys will spend isn't available.
+func (p *Portfolio) getAvailableCash(ctx context.Context) (map[string]decimal.Decimal, error) {
+	cash, err := p.GetAccountCash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	available := map[string]decimal.Decimal{}
+	for account, c := range cash {
+		available[account] = decimal.Max(c.Sub(p.reserved[account]), decimal.Zero)
+	}
+	return available, nil
 }
 
-func (p *Portfolio) getCurrentHoldingsInDollars(ctx context.Context) (map[string]decimal.Decimal, error) {
-	positions, err := p.exchangeClient.ListPositions()
+// GetCash returns the cash across the accounts
+func (p *Portfolio) GetCash(ctx context.Context) (decimal.Decimal, error) {
+	cash, err := p.GetAccountCash(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("listing positions: %w", err)
+		return decimal.Decimal{}, err
+	}
+
+	return sumMapValuesDecimal(cash), nil
+}
+
+// GetAccountCash returns the cash in each account, by account
+func (p *Portfolio) GetAccountCash(ctx context.Context) (map[string]decimal.Decimal, error) {
+	cash := map[string]decimal.Decimal{}
+	for _, account := range p.accounts {
+		acct, err := account.ExchangeClient.GetAccount(ctx)
+		if err != nil {
+			return nil, p.accountErr(account, err)
+		}
+		cash[account.Name] = acct.Cash
+	}
+
+	return cash, nil
+}
+
+// GetHoldings returns the value of each position, by ticker, across the accounts.
+// Positions are valued at the run's prices, rather than the broker's market
+// value, so that buys are sized against the same prices they're planned with.
+func (p *Portfolio) GetHoldings(ctx context.Context) (map[string]decimal.Decimal, error) {
+	var positions []exchange.Position
+	for _, account := range p.accounts {
+		held, err := account.ExchangeClient.ListPositions(ctx)
+		if err != nil {
+			return nil, p.accountErr(account, fmt.Errorf("listing positions: %w", err))
+		}
+		positions = append(positions, held...)
+	}
+
+	// everything that will be priced, in one go. The ratio tickers are
+	// needed to trade, anything else held is only being valued.
+	var symbols []string
+	for ticker := range p.ratios {
+		symbols = append(symbols, ticker)
+	}
+	err := p.prices.Fetch(ctx, symbols)
+	if err != nil {
+		return nil, fmt.Errorf("getting prices: %w", err)
+	}
+	symbols = nil
+	for _, position := range positions {
+		symbols = append(symbols, position.Symbol)
+	}
+	err = p.prices.Fetch(ctx, symbols)
+	if err != nil {
+		glog.Warningf("getting prices of positions, those missing are valued at market value: %v", err)
 	}
 
 	holdings := map[string]decimal.Decimal{}
 	for _, position := range positions {
-		holdings[position.Symbol] = position.MarketValue
+		holdings[position.Symbol] = holdings[position.Symbol].Add(p.value(ctx, position))
 	}
 
 	return holdings, nil
 }
 
+// value is what the position is worth at the quoted price, or at the
+// broker's market value if there's no price quoted for it, e.g. if it's halted
+func (p *Portfolio) value(ctx context.Context, position exchange.Position) decimal.Decimal {
+	price, err := p.prices.Price(ctx, position.Symbol, exchange.Buy)
+	if err != nil {
+		glog.Warningf("valuing %s at its market value of %s: %v", position.Symbol, position.MarketValue, err)
+		return position.MarketValue
+	}
+	return position.Qty.Mul(price)
+}
+
+// accountErr says which account err came from, when there's more than one
+func (p *Portfolio) accountErr(account Account, err error) error {
+	if len(p.accounts) == 1 {
+		return err
+	} else if account.Name == "" {
+		return fmt.Errorf("default account: %w", err)
+	}
+	return fmt.Errorf("account %s: %w", account.Name, err)
+}
+
 func sumMapValuesDecimal(m map[string]decimal.Decimal) decimal.Decimal {
 	sum := decimal.Zero
 	for _, v := range m {
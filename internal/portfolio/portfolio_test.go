@@ -4,24 +4,26 @@ import (
 	"context"
 	"testing"
 
-	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 
+	"github.com/jchorl/camelid/internal/exchange"
 	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+	"github.com/jchorl/camelid/internal/prices"
 )
 
 func TestGetDeltasWithoutSales(t *testing.T) {
 	cases := []struct {
 		name             string
-		currentPositions []alpaca.Position
+		currentPositions []exchange.Position
 		desiredRatios    map[string]decimal.Decimal
+		blocked          map[string]decimal.Decimal
 		amountToInvest   decimal.Decimal
 		expectedDeltas   map[string]decimal.Decimal
 	}{
 		{
 			name:             "none held",
-			currentPositions: []alpaca.Position{},
+			currentPositions: []exchange.Position{},
 			desiredRatios: map[string]decimal.Decimal{
 				"SPY": decimal.NewFromInt(80),
 				"VBD": decimal.NewFromInt(20),
@@ -34,7 +36,7 @@ func TestGetDeltasWithoutSales(t *testing.T) {
 		},
 		{
 			name: "one held",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("VBD", decimal.NewFromInt(500)),
 			},
 			desiredRatios: map[string]decimal.Decimal{
@@ -49,7 +51,7 @@ func TestGetDeltasWithoutSales(t *testing.T) {
 		},
 		{
 			name: "not enough money",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("SPY", decimal.NewFromInt(1000)),
 			},
 			desiredRatios: map[string]decimal.Decimal{
@@ -63,7 +65,7 @@ func TestGetDeltasWithoutSales(t *testing.T) {
 		},
 		{
 			name: "unknown holding",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("VOO", decimal.NewFromInt(1000)),
 				newPosition("SPY", decimal.NewFromInt(1000)),
 				newPosition("VBD", decimal.NewFromInt(500)),
@@ -84,7 +86,7 @@ func TestGetDeltasWithoutSales(t *testing.T) {
 		},
 		{
 			name: "grab bag",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("VOO", decimal.NewFromInt(1000)),
 				newPosition("SPY", decimal.NewFromInt(1000)),
 				newPosition("VBD", decimal.NewFromInt(500)),
@@ -102,15 +104,50 @@ func TestGetDeltasWithoutSales(t *testing.T) {
 				"VTI": decimal.NewFromInt(1250).Mul(decimal.NewFromInt(2000)).Div(decimal.NewFromInt(3500)), // 1250*2000/3500=714.28
 			},
 		},
+		{
+			name:             "in flight",
+			currentPositions: []exchange.Position{},
+			desiredRatios: map[string]decimal.Decimal{
+				"SPY": decimal.NewFromInt(80),
+				"VBD": decimal.NewFromInt(20),
+			},
+			blocked: map[string]decimal.Decimal{
+				"SPY": decimal.NewFromInt(800),
+			},
+			amountToInvest: decimal.NewFromInt(200),
+			expectedDeltas: map[string]decimal.Decimal{
+				"VBD": decimal.NewFromInt(200),
+			},
+		},
+		{
+			name: "blocked",
+			currentPositions: []exchange.Position{
+				newPosition("VBD", decimal.NewFromInt(500)),
+			},
+			desiredRatios: map[string]decimal.Decimal{
+				"SPY": decimal.NewFromInt(80),
+				"VBD": decimal.NewFromInt(20),
+			},
+			blocked: map[string]decimal.Decimal{
+				"SPY": decimal.Zero,
+			},
+			amountToInvest: decimal.NewFromInt(10000),
+			// SPY's share is left uninvested, not piled onto VBD
+			expectedDeltas: map[string]decimal.Decimal{
+				"VBD": decimal.NewFromInt(1600),
+			},
+		},
 	}
 
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			alpacaClient := exchangetest.NewMockClient("6")
-			alpacaClient.SetPositions(tc.currentPositions)
+			alpacaClient := newMockClient(tc.currentPositions, tc.desiredRatios)
 
-			portfolio := New(alpacaClient, tc.desiredRatios)
+			portfolio := New(alpacaClient, prices.New(alpacaClient), tc.desiredRatios)
+			for ticker, inFlight := range tc.blocked {
+				portfolio.Block(ticker, inFlight)
+			}
 			deltas, err := portfolio.GetDeltasWithoutSales(context.TODO(), tc.amountToInvest)
 			require.NoError(t, err)
 			require.Equal(
@@ -129,14 +166,15 @@ func TestGetDeltasWithoutSales(t *testing.T) {
 func TestGetDeltasWithSales(t *testing.T) {
 	cases := []struct {
 		name             string
-		currentPositions []alpaca.Position
+		currentPositions []exchange.Position
 		desiredRatios    map[string]decimal.Decimal
+		blocked          map[string]decimal.Decimal
 		amountToInvest   decimal.Decimal
 		expectedDeltas   map[string]decimal.Decimal
 	}{
 		{
 			name:             "none held",
-			currentPositions: []alpaca.Position{},
+			currentPositions: []exchange.Position{},
 			desiredRatios: map[string]decimal.Decimal{
 				"SPY": decimal.NewFromInt(80),
 				"VBD": decimal.NewFromInt(20),
@@ -149,7 +187,7 @@ func TestGetDeltasWithSales(t *testing.T) {
 		},
 		{
 			name: "one held",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("VBD", decimal.NewFromInt(500)),
 			},
 			desiredRatios: map[string]decimal.Decimal{
@@ -164,7 +202,7 @@ func TestGetDeltasWithSales(t *testing.T) {
 		},
 		{
 			name: "not enough money",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("SPY", decimal.NewFromInt(1000)),
 			},
 			desiredRatios: map[string]decimal.Decimal{
@@ -179,7 +217,7 @@ func TestGetDeltasWithSales(t *testing.T) {
 		},
 		{
 			name: "unknown holding",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("VOO", decimal.NewFromInt(1000)),
 				newPosition("SPY", decimal.NewFromInt(1000)),
 				newPosition("VBD", decimal.NewFromInt(500)),
@@ -197,7 +235,7 @@ func TestGetDeltasWithSales(t *testing.T) {
 		},
 		{
 			name: "grab bag",
-			currentPositions: []alpaca.Position{
+			currentPositions: []exchange.Position{
 				newPosition("VOO", decimal.NewFromInt(1000)),
 				newPosition("SPY", decimal.NewFromInt(1000)),
 				newPosition("VBD", decimal.NewFromInt(500)),
@@ -217,15 +255,35 @@ func TestGetDeltasWithSales(t *testing.T) {
 				"VTI":  decimal.NewFromInt(1250),  // 1250/5000=100/400
 			},
 		},
+		{
+			name: "in flight",
+			currentPositions: []exchange.Position{
+				newPosition("SPY", decimal.NewFromInt(1000)),
+			},
+			desiredRatios: map[string]decimal.Decimal{
+				"SPY": decimal.NewFromInt(80),
+				"VBD": decimal.NewFromInt(20),
+			},
+			blocked: map[string]decimal.Decimal{
+				"SPY": decimal.NewFromInt(600),
+			},
+			amountToInvest: decimal.NewFromInt(400),
+			expectedDeltas: map[string]decimal.Decimal{ // counts SPY as 1600 held, 1600/2000=0.8
+				"SPY": decimal.Zero,
+				"VBD": decimal.NewFromInt(400),
+			},
+		},
 	}
 
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			alpacaClient := exchangetest.NewMockClient("6")
-			alpacaClient.SetPositions(tc.currentPositions)
+			alpacaClient := newMockClient(tc.currentPositions, tc.desiredRatios)
 
-			portfolio := New(alpacaClient, tc.desiredRatios)
+			portfolio := New(alpacaClient, prices.New(alpacaClient), tc.desiredRatios)
+			for ticker, inFlight := range tc.blocked {
+				portfolio.Block(ticker, inFlight)
+			}
 			deltas, err := portfolio.GetDeltasWithSales(context.TODO(), tc.amountToInvest)
 			require.NoError(t, err)
 			require.Equal(
@@ -244,16 +302,56 @@ func TestGetDeltasWithSales(t *testing.T) {
 func TestGetDeltasWithSales_ErrorsWithNoRatios(t *testing.T) {
 	alpacaClient := exchangetest.NewMockClient("6")
 
-	portfolio := New(alpacaClient, map[string]decimal.Decimal{})
+	portfolio := New(alpacaClient, prices.New(alpacaClient), map[string]decimal.Decimal{})
 	_, err := portfolio.GetDeltasWithSales(context.TODO(), decimal.NewFromInt(300))
 	require.Error(t, err)
 }
 
+func TestGetHoldings(t *testing.T) {
+	ctx := context.TODO()
+	ratios := map[string]decimal.Decimal{"VOO": decimal.NewFromInt(1), "BND": decimal.NewFromInt(1)}
+	alpacaClient := newMockClient([]exchange.Position{
+		// the broker's market value is stale next to the quote
+		{Symbol: "VOO", Qty: decimal.NewFromInt(10), MarketValue: decimal.NewFromInt(1000)},
+	}, ratios)
+	alpacaClient.SetQuote("VOO", &exchange.Quote{Symbol: "VOO", BidPrice: decimal.NewFromInt(150), AskPrice: decimal.NewFromInt(151)})
+
+	snapshot := prices.New(alpacaClient)
+	pfolio := New(alpacaClient, snapshot, ratios)
+	holdings, err := pfolio.GetHoldings(ctx)
+	require.NoError(t, err)
+	require.Len(t, holdings, 1)
+	require.True(t, decimal.NewFromInt(1500).Equal(holdings["VOO"]), "VOO held at %s", holdings["VOO"])
+
+	// every ticker was priced at once, for trading to use
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodGetLastQuote), 2)
+	_, err = snapshot.Price(ctx, "BND", exchange.Buy)
+	require.NoError(t, err)
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodGetLastQuote), 2)
+
+	// positions with no price are valued at the broker's market value, rather than failing the run
+	alpacaClient.SetPositions([]exchange.Position{
+		{Symbol: "VOO", Qty: decimal.NewFromInt(10), MarketValue: decimal.NewFromInt(1000)},
+		{Symbol: "ZZZ", Qty: decimal.NewFromInt(1), MarketValue: decimal.NewFromInt(40)},
+	})
+	holdings, err = pfolio.GetHoldings(ctx)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(1500).Equal(holdings["VOO"]), "VOO held at %s", holdings["VOO"])
+	require.True(t, decimal.NewFromInt(40).Equal(holdings["ZZZ"]), "ZZZ held at %s", holdings["ZZZ"])
+
+	// the ratio tickers are still needed to trade
+	alpacaClient.InjectFault(exchangetest.MethodGetLastQuote, 0, exchangetest.Fault{Err: exchangetest.ErrUnavailable})
+	pfolio = New(alpacaClient, prices.New(alpacaClient), ratios)
+	_, err = pfolio.GetHoldings(ctx)
+	require.Error(t, err)
+}
+
 func TestGetAmountToInvest(t *testing.T) {
 	cases := []struct {
 		name          string
 		maxInvestment decimal.Decimal
 		cash          decimal.Decimal
+		inFlight      decimal.Decimal
 		expected      decimal.Decimal
 	}{
 		{
@@ -268,6 +366,20 @@ func TestGetAmountToInvest(t *testing.T) {
 			cash:          decimal.NewFromInt(2),
 			expected:      decimal.NewFromInt(2),
 		},
+		{
+			name:          "reserved for in flight",
+			maxInvestment: decimal.NewFromInt(12),
+			cash:          decimal.NewFromInt(10),
+			inFlight:      decimal.NewFromInt(4),
+			expected:      decimal.NewFromInt(6),
+		},
+		{
+			name:          "in flight exceeds cash",
+			maxInvestment: decimal.NewFromInt(12),
+			cash:          decimal.NewFromInt(2),
+			inFlight:      decimal.NewFromInt(4),
+			expected:      decimal.Zero,
+		},
 	}
 
 	for _, tc := range cases {
@@ -275,22 +387,40 @@ func TestGetAmountToInvest(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			alpacaClient := exchangetest.NewMockClient("6")
 			alpacaClient.SetCash(tc.cash)
-			pfolio := New(alpacaClient, nil)
-			toInvest, err := pfolio.GetAmountToInvest(tc.maxInvestment)
+			pfolio := New(alpacaClient, prices.New(alpacaClient), nil)
+			pfolio.Block("SPY", tc.inFlight)
+			toInvest, err := pfolio.GetAmountToInvest(context.TODO(), tc.maxInvestment)
 			require.NoError(t, err)
 			require.True(t, toInvest.Equal(tc.expected), "expected %s to equal %s", tc.expected.String(), toInvest.String())
 		})
 	}
 }
 
-func newPosition(ticker string, marketValue decimal.Decimal) alpaca.Position {
-	return alpaca.Position{
-		AssetID:     "4f75ad35-b947-4717-87db-19aa3dbf637d",
+// testPrice is what every ticker is quoted at by newMockClient
+var testPrice = decimal.NewFromInt(100)
+
+func newPosition(ticker string, marketValue decimal.Decimal) exchange.Position {
+	return exchange.Position{
 		Symbol:      ticker,
-		Exchange:    "ARCA",
-		Class:       "us_equity",
-		AccountID:   "",
-		Side:        "long",
+		Qty:         marketValue.Div(testPrice),
 		MarketValue: marketValue,
 	}
 }
+
+// newMockClient holds the positions, and quotes them and the ratios at testPrice
+func newMockClient(positions []exchange.Position, ratios map[string]decimal.Decimal) *exchangetest.MockClient {
+	client := exchangetest.NewMockClient("6")
+	client.SetPositions(positions)
+
+	var symbols []string
+	for ticker := range ratios {
+		symbols = append(symbols, ticker)
+	}
+	for _, position := range positions {
+		symbols = append(symbols, position.Symbol)
+	}
+	for _, symbol := range symbols {
+		client.SetQuote(symbol, &exchange.Quote{Symbol: symbol, BidPrice: testPrice, AskPrice: testPrice})
+	}
+	return client
+}
@@ -0,0 +1,129 @@
+package portfolio
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// SplitRule says how buys are split between the accounts a portfolio is held across
+type SplitRule string
+
+const (
+	// SplitMostCash buys each ticker in the account with the most cash left,
+	// spilling into the next when it runs out, so tickers are split as little as possible
+	SplitMostCash SplitRule = "most-cash"
+	// SplitProportional buys each ticker in every account, in proportion to their cash
+	SplitProportional SplitRule = "proportional"
+	// SplitInOrder spends the cash of each account before moving on to the next, in the order they're listed
+	SplitInOrder SplitRule = "in-order"
+)
+
+func ParseSplitRule(s string) (SplitRule, error) {
+	switch rule := SplitRule(s); rule {
+	case SplitMostCash, SplitProportional, SplitInOrder:
+		return rule, nil
+	}
+	return "", fmt.Errorf("unknown split rule %q, expected %q, %q or %q", s, SplitMostCash, SplitProportional, SplitInOrder)
+}
+
+// SplitDeltas splits the buys in deltas between the accounts, per the
+// portfolio's split rule. It returns the dollars to buy in each account, by
+// account, then ticker. Each account only buys with its own cash, less what
+// its in-flight buys will spend. Tickers are split biggest first, and whatever
+// doesn't fit in the accounts' cash is left out.
+//
+// Sales are left out too, they'd have to come from the accounts holding the ticker.
+// Splitting a ticker between accounts can cost a share to rounding in each.
+func (p *Portfolio) SplitDeltas(ctx context.Context, deltas map[string]decimal.Decimal) (map[string]map[string]decimal.Decimal, error) {
+	available, err := p.getAvailableCash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tickers []string
+	for ticker, delta := range deltas {
+		if delta.IsPositive() {
+			tickers = append(tickers, ticker)
+		}
+	}
+	sort.Slice(tickers, func(i, j int) bool {
+		if cmp := deltas[tickers[i]].Cmp(deltas[tickers[j]]); cmp != 0 {
+			return cmp > 0
+		}
+		return tickers[i] < tickers[j]
+	})
+
+	split := map[string]map[string]decimal.Decimal{}
+	buy := func(account, ticker string, dollars decimal.Decimal) {
+		if !dollars.IsPositive() {
+			return
+		}
+		if _, ok := split[account]; !ok {
+			split[account] = map[string]decimal.Decimal{}
+		}
+		split[account][ticker] = split[account][ticker].Add(dollars)
+		available[account] = available[account].Sub(dollars)
+	}
+
+	if p.split == SplitProportional {
+		total := sumMapValuesDecimal(available)
+		if total.IsZero() {
+			return split, nil
+		}
+
+		shares := map[string]decimal.Decimal{}
+		for account, cash := range available {
+			shares[account] = cash.Div(total)
+		}
+		for _, ticker := range tickers {
+			delta := decimal.Min(deltas[ticker], total)
+			for _, account := range p.accounts {
+				buy(account.Name, ticker, delta.Mul(shares[account.Name]))
+			}
+			total = total.Sub(delta)
+		}
+		return split, nil
+	}
+
+	for _, ticker := range tickers {
+		remaining := deltas[ticker]
+		for remaining.IsPositive() {
+			account, ok := p.nextAccount(available)
+			if !ok {
+				// out of cash everywhere
+				break
+			}
+
+			dollars := decimal.Min(remaining, available[account])
+			buy(account, ticker, dollars)
+			remaining = remaining.Sub(dollars)
+		}
+	}
+
+	return split, nil
+}
+
+// nextAccount picks the account to buy in next, of those with cash left
+func (p *Portfolio) nextAccount(available map[string]decimal.Decimal) (string, bool) {
+	var next *Account
+	for i, account := range p.accounts {
+		cash := available[account.Name]
+		if !cash.IsPositive() {
+			continue
+		}
+
+		if p.split == SplitInOrder {
+			return account.Name, true
+		} else if next == nil || cash.GreaterThan(available[next.Name]) {
+			next = &p.accounts[i]
+		}
+	}
+
+	if next == nil {
+		return "", false
+	}
+	return next.Name, true
+}
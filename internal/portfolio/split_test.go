@@ -0,0 +1,152 @@
+package portfolio
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+	"github.com/jchorl/camelid/internal/prices"
+)
+
+func TestSplitDeltas(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     SplitRule
+		cash     map[string]int64 // account -> cash, in the order accounts are listed
+		inFlight map[string]int64 // account -> in-flight buys of BND
+		deltas   map[string]int64
+		expected map[string]map[string]int64
+	}{
+		{
+			name:   "most cash",
+			rule:   SplitMostCash,
+			cash:   map[string]int64{"taxable": 500, "ira": 1000},
+			deltas: map[string]int64{"VOO": 800, "VXUS": 400, "BND": 100},
+			expected: map[string]map[string]int64{
+				"ira":     {"VOO": 800, "BND": 100},
+				"taxable": {"VXUS": 400},
+			},
+		},
+		{
+			name:   "most cash spills over",
+			rule:   SplitMostCash,
+			cash:   map[string]int64{"taxable": 500, "ira": 700},
+			deltas: map[string]int64{"VOO": 1000, "BND": 200},
+			expected: map[string]map[string]int64{
+				"ira":     {"VOO": 700},
+				"taxable": {"VOO": 300, "BND": 200},
+			},
+		},
+		{
+			name:     "most cash after in flight",
+			rule:     SplitMostCash,
+			cash:     map[string]int64{"taxable": 500, "ira": 1000},
+			inFlight: map[string]int64{"ira": 600},
+			deltas:   map[string]int64{"VOO": 300},
+			expected: map[string]map[string]int64{
+				"taxable": {"VOO": 300},
+			},
+		},
+		{
+			name:   "proportional",
+			rule:   SplitProportional,
+			cash:   map[string]int64{"taxable": 250, "ira": 750},
+			deltas: map[string]int64{"VOO": 800, "BND": 200},
+			expected: map[string]map[string]int64{
+				"ira":     {"VOO": 600, "BND": 150},
+				"taxable": {"VOO": 200, "BND": 50},
+			},
+		},
+		{
+			name:   "in order",
+			rule:   SplitInOrder,
+			cash:   map[string]int64{"taxable": 500, "ira": 1000},
+			deltas: map[string]int64{"VOO": 800, "BND": 100},
+			expected: map[string]map[string]int64{
+				"taxable": {"VOO": 500},
+				"ira":     {"VOO": 300, "BND": 100},
+			},
+		},
+		{
+			name:   "not enough cash",
+			rule:   SplitInOrder,
+			cash:   map[string]int64{"taxable": 100, "ira": 100},
+			deltas: map[string]int64{"VOO": 300, "BND": -50},
+			expected: map[string]map[string]int64{
+				"taxable": {"VOO": 100},
+				"ira":     {"VOO": 100},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var accounts []Account
+			for _, name := range []string{"taxable", "ira"} {
+				client := exchangetest.NewMockClient(name)
+				client.SetCash(decimal.NewFromInt(tc.cash[name]))
+				accounts = append(accounts, Account{Name: name, ExchangeClient: client})
+			}
+			pfolio := NewMultiAccount(accounts, prices.New(accounts[0].ExchangeClient), nil, tc.rule)
+			for account, inFlight := range tc.inFlight {
+				pfolio.BlockInAccount(account, "BND", decimal.NewFromInt(inFlight))
+			}
+
+			deltas := map[string]decimal.Decimal{}
+			for ticker, delta := range tc.deltas {
+				deltas[ticker] = decimal.NewFromInt(delta)
+			}
+
+			split, err := pfolio.SplitDeltas(context.TODO(), deltas)
+			require.NoError(t, err)
+			require.Len(t, split, len(tc.expected))
+			for account, expected := range tc.expected {
+				require.Len(t, split[account], len(expected), "buys in %s: %v", account, split[account])
+				for ticker, dollars := range expected {
+					require.True(t, decimal.NewFromInt(dollars).Equal(split[account][ticker]), "expected $%d of %s in %s, got $%s", dollars, ticker, account, split[account][ticker])
+				}
+			}
+		})
+	}
+}
+
+func TestMultiAccount(t *testing.T) {
+	ctx := context.TODO()
+	ratios := map[string]decimal.Decimal{"VOO": decimal.NewFromInt(1), "BND": decimal.NewFromInt(1)}
+
+	taxable := newMockClient([]exchange.Position{newPosition("VOO", decimal.NewFromInt(500))}, ratios)
+	taxable.SetCash(decimal.NewFromInt(300))
+	ira := newMockClient([]exchange.Position{
+		newPosition("VOO", decimal.NewFromInt(1000)),
+		newPosition("BND", decimal.NewFromInt(700)),
+	}, ratios)
+	ira.SetCash(decimal.NewFromInt(200))
+
+	pfolio := NewMultiAccount([]Account{
+		{Name: "taxable", ExchangeClient: taxable},
+		{Name: "ira", ExchangeClient: ira},
+	}, prices.New(taxable), ratios, SplitMostCash)
+	pfolio.BlockInAccount("ira", "VXUS", decimal.NewFromInt(50))
+
+	holdings, err := pfolio.GetHoldings(ctx)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(1500).Equal(holdings["VOO"]), "VOO held at %s", holdings["VOO"])
+	require.True(t, decimal.NewFromInt(700).Equal(holdings["BND"]), "BND held at %s", holdings["BND"])
+
+	cash, err := pfolio.GetCash(ctx)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(500).Equal(cash))
+
+	toInvest, err := pfolio.GetAmountToInvest(ctx, decimal.NewFromInt(1000))
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(450).Equal(toInvest), "expected 450 to invest, got %s", toInvest)
+
+	ira.InjectFault(exchangetest.MethodGetAccount, 0, exchangetest.Fault{Err: exchangetest.ErrUnavailable})
+	_, err = pfolio.GetCash(ctx)
+	require.EqualError(t, err, "account ira: service unavailable")
+}
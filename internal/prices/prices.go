@@ -0,0 +1,123 @@
+// Package prices quotes each symbol once per run, so that planning
+// and trading see the same prices.
+package prices
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/jchorl/camelid/internal/exchange"
+)
+
+// maxConcurrentQuotes bounds how many quotes are fetched at once
+const maxConcurrentQuotes = 4
+
+// Snapshot is the quote of each symbol, as first fetched during the run
+type Snapshot struct {
+	exchangeClient exchange.Client
+
+	mu     sync.Mutex
+	quotes map[string]*exchange.Quote
+}
+
+func New(exchangeClient exchange.Client) *Snapshot {
+	return &Snapshot{
+		exchangeClient: exchangeClient,
+		quotes:         map[string]*exchange.Quote{},
+	}
+}
+
+// Fetch quotes the symbols that haven't been yet, concurrently.
+// Quotes fetched are kept even if others fail.
+func (s *Snapshot) Fetch(ctx context.Context, symbols []string) error {
+	s.mu.Lock()
+	var missing []string
+	seen := map[string]bool{}
+	for _, symbol := range symbols {
+		if _, ok := s.quotes[symbol]; !ok && !seen[symbol] {
+			missing = append(missing, symbol)
+			seen[symbol] = true
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(missing)
+
+	errs := make([]error, len(missing))
+	sem := make(chan struct{}, maxConcurrentQuotes)
+	var wg sync.WaitGroup
+	for i, symbol := range missing {
+		wg.Add(1)
+		go func(i int, symbol string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			quote, err := s.exchangeClient.GetLastQuote(ctx, symbol)
+			if err != nil {
+				errs[i] = fmt.Errorf("GetLastQuote(%s): %w", symbol, err)
+				return
+			}
+
+			s.mu.Lock()
+			// a concurrent fetch may have quoted it first, which stands
+			if _, ok := s.quotes[symbol]; !ok {
+				s.quotes[symbol] = quote
+			}
+			s.mu.Unlock()
+		}(i, symbol)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quote returns the symbol's quote, fetching it if it hasn't been yet
+func (s *Snapshot) Quote(ctx context.Context, symbol string) (*exchange.Quote, error) {
+	err := s.Fetch(ctx, []string{symbol})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quotes[symbol], nil
+}
+
+// Price is what an order for the symbol on side is sized at,
+// the bid for buys and the ask for sells
+func (s *Snapshot) Price(ctx context.Context, symbol string, side exchange.Side) (decimal.Decimal, error) {
+	quote, err := s.Quote(ctx, symbol)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	price := quote.BidPrice
+	if side == exchange.Sell {
+		price = quote.AskPrice
+	}
+	if !price.IsPositive() {
+		return decimal.Decimal{}, fmt.Errorf("no %s price quoted for %s", side, symbol)
+	}
+	return price, nil
+}
+
+// Prices returns the buy price of every symbol quoted so far
+func (s *Snapshot) Prices() map[string]decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prices := map[string]decimal.Decimal{}
+	for symbol, quote := range s.quotes {
+		prices[symbol] = quote.BidPrice
+	}
+	return prices
+}
@@ -0,0 +1,78 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+)
+
+func newQuote(symbol string, bid, ask float64) *exchange.Quote {
+	return &exchange.Quote{
+		Symbol:    symbol,
+		BidPrice:  decimal.NewFromFloat(bid),
+		AskPrice:  decimal.NewFromFloat(ask),
+		Timestamp: time.Now(),
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.TODO()
+	client := exchangetest.NewMockClient("6")
+	client.SetQuote("VOO", newQuote("VOO", 326.35, 326.41))
+	client.SetQuote("VXUS", newQuote("VXUS", 52.1, 52.15))
+	client.SetQuote("BND", newQuote("BND", 88.2, 88.25))
+	// slow enough that fetching one at a time would be obvious
+	client.InjectFault(exchangetest.MethodGetLastQuote, 0, exchangetest.Fault{Latency: 50 * time.Millisecond})
+
+	snapshot := New(client)
+	start := time.Now()
+	require.NoError(t, snapshot.Fetch(ctx, []string{"VOO", "VXUS", "BND", "VOO"}))
+	require.True(t, time.Since(start) < 150*time.Millisecond, "fetched in %s", time.Since(start))
+	require.Len(t, client.CallsTo(exchangetest.MethodGetLastQuote), 3)
+
+	// the price doesn't move once quoted
+	client.SetQuote("VOO", newQuote("VOO", 400, 401))
+	price, err := snapshot.Price(ctx, "VOO", exchange.Buy)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromFloat(326.35).Equal(price))
+	price, err = snapshot.Price(ctx, "VOO", exchange.Sell)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromFloat(326.41).Equal(price))
+	require.NoError(t, snapshot.Fetch(ctx, []string{"VOO", "BND"}))
+	require.Len(t, client.CallsTo(exchangetest.MethodGetLastQuote), 3)
+
+	prices := snapshot.Prices()
+	require.Len(t, prices, 3)
+	require.True(t, decimal.NewFromFloat(52.1).Equal(prices["VXUS"]))
+}
+
+func TestSnapshot_Errors(t *testing.T) {
+	ctx := context.TODO()
+	client := exchangetest.NewMockClient("6")
+	client.SetQuote("VOO", newQuote("VOO", 326.35, 326.41))
+	client.SetQuote("HALT", newQuote("HALT", 0, 0))
+
+	snapshot := New(client)
+	err := snapshot.Fetch(ctx, []string{"VOO", "MISSING"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "MISSING")
+
+	// what was quoted is kept
+	_, err = snapshot.Price(ctx, "VOO", exchange.Buy)
+	require.NoError(t, err)
+	require.Len(t, client.CallsTo(exchangetest.MethodGetLastQuote), 2)
+
+	_, err = snapshot.Price(ctx, "HALT", exchange.Buy)
+	require.EqualError(t, err, "no buy price quoted for HALT")
+
+	client.InjectFault(exchangetest.MethodGetLastQuote, 0, exchangetest.Fault{Err: exchangetest.ErrRateLimited})
+	_, err = snapshot.Quote(ctx, "VXUS")
+	require.True(t, errors.Is(err, exchangetest.ErrRateLimited))
+}
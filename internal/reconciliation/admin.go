@@ -0,0 +1,130 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jchorl/camelid/internal/exchange"
+)
+
+// Filter picks out records. Zero fields match every record.
+type Filter struct {
+	Statuses []Status
+	Symbol   string
+	RunID    string
+	// records created at or after Since, and before Until
+	Since time.Time
+	Until time.Time
+}
+
+func (f Filter) matches(rec *record) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			found = found || rec.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Symbol != "" && rec.Symbol != f.Symbol {
+		return false
+	}
+	if f.RunID != "" && rec.RunID != f.RunID {
+		return false
+	}
+	if !f.Since.IsZero() && rec.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.CreatedAt.Before(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// List returns the records matching the filter, oldest first
+func List(ctx context.Context, store RecordStore, filter Filter) ([]Record, error) {
+	all, err := listAllRecords(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for i := range all {
+		if filter.matches(&all[i]) {
+			records = append(records, &all[i])
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].GetCreatedAt().Before(records[j].GetCreatedAt())
+	})
+	return records, nil
+}
+
+// Get returns the record with the ID, or ErrNotFound
+func Get(ctx context.Context, store RecordStore, id string) (Record, error) {
+	rec, err := getRecord(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// ForceReconcile closes an open record by hand. If the broker order is done,
+// the record takes its status, otherwise it's marked StatusForceReconciled.
+// Either way, whatever was filled so far is captured.
+// It returns the status the record was closed with.
+func ForceReconcile(ctx context.Context, store RecordStore, exchangeClient exchange.Client, id, reason string) (Status, error) {
+	rec, err := getRecord(ctx, store, id)
+	if err != nil {
+		return 0, err
+	} else if rec.AlpacaOrderID == "" {
+		return 0, fmt.Errorf("record %s was never submitted to alpaca, abandon it instead", id)
+	}
+
+	order, err := exchangeClient.GetOrder(ctx, rec.AlpacaOrderID)
+	if err != nil {
+		return 0, fmt.Errorf("getting order from alpaca (%s): %w", rec.AlpacaOrderID, err)
+	}
+
+	status := StatusForceReconciled
+	if isTerminalState(order.Status) {
+		status = statusFromOrder(order)
+	}
+
+	return status, forceClose(ctx, store, id, status, reason, order)
+}
+
+// Abandon closes an open record by hand, without looking at the broker
+func Abandon(ctx context.Context, store RecordStore, id, reason string) error {
+	return forceClose(ctx, store, id, StatusAbandoned, reason, nil)
+}
+
+// forceClose closes an open record, noting why on it
+func forceClose(ctx context.Context, store RecordStore, id string, status Status, reason string, order *exchange.Order) error {
+	if reason == "" {
+		return errors.New("a reason is required to close a record by hand")
+	}
+
+	return update(ctx, store, id, func(rec *record) error {
+		if !rec.Status.IsOpen() {
+			return fmt.Errorf("record %s is already %s", id, rec.Status)
+		}
+
+		now := time.Now()
+		rec.ReconciledAt = &now
+		rec.Status = status
+		rec.ForceReason = reason
+		if order != nil {
+			rec.setFill(order)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package reconciliation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+)
+
+func TestList(t *testing.T) {
+	ctx := context.TODO()
+	day := time.Date(2020, 8, 3, 0, 0, 0, 0, time.UTC)
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	for _, rec := range []record{
+		{ID: "trade3", Symbol: "VOO", RunID: "run2", Status: StatusSubmitted, CreatedAt: day.AddDate(0, 0, 2)},
+		{ID: "trade1", Symbol: "VOO", RunID: "run1", Status: StatusFilled, CreatedAt: day},
+		{ID: "trade2", Symbol: "BND", RunID: "run1", Status: StatusCancelled, CreatedAt: day.AddDate(0, 0, 1)},
+	} {
+		rec := rec
+		require.NoError(t, putRecord(ctx, store, &rec))
+	}
+
+	cases := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{
+			name:     "everything, oldest first",
+			expected: []string{"trade1", "trade2", "trade3"},
+		},
+		{
+			name:     "statuses",
+			filter:   Filter{Statuses: []Status{StatusFilled, StatusSubmitted}},
+			expected: []string{"trade1", "trade3"},
+		},
+		{
+			name:     "symbol",
+			filter:   Filter{Symbol: "BND"},
+			expected: []string{"trade2"},
+		},
+		{
+			name:     "run",
+			filter:   Filter{RunID: "run1"},
+			expected: []string{"trade1", "trade2"},
+		},
+		{
+			name:     "date range",
+			filter:   Filter{Since: day.AddDate(0, 0, 1), Until: day.AddDate(0, 0, 2)},
+			expected: []string{"trade2"},
+		},
+		{
+			name:   "nothing",
+			filter: Filter{Symbol: "VOO", Statuses: []Status{StatusCancelled}},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := List(ctx, store, tc.filter)
+			require.NoError(t, err)
+
+			var ids []string
+			for _, rec := range records {
+				ids = append(ids, rec.GetID())
+			}
+			require.Equal(t, tc.expected, ids)
+		})
+	}
+}
+
+func TestForceReconcile(t *testing.T) {
+	cases := []struct {
+		name           string
+		orderStatus    exchange.OrderStatus
+		dbRecord       record
+		expectedErr    bool
+		expectedStatus Status
+	}{
+		{
+			name:           "order still open",
+			orderStatus:    "new",
+			dbRecord:       record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted},
+			expectedStatus: StatusForceReconciled,
+		},
+		{
+			name:           "order done",
+			orderStatus:    "filled",
+			dbRecord:       record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted},
+			expectedStatus: StatusFilled,
+		},
+		{
+			name:        "never submitted",
+			dbRecord:    record{ID: "trade1", Status: StatusPendingSubmit},
+			expectedErr: true,
+		},
+		{
+			name:        "already closed",
+			orderStatus: "filled",
+			dbRecord:    record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusCancelled},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+			alpacaClient := exchangetest.NewMockClient("6")
+			alpacaClient.AddOrder(exchangetest.NewFilledOrder("alpaca11"))
+			if tc.orderStatus != "" {
+				alpacaClient.SetOrderStatus("alpaca11", tc.orderStatus)
+			}
+			require.NoError(t, putRecord(ctx, store, &tc.dbRecord))
+
+			status, err := ForceReconcile(ctx, store, alpacaClient, "trade1", "stuck in the broker's queue")
+			got, getErr := getRecord(ctx, store, "trade1")
+			require.NoError(t, getErr)
+			if tc.expectedErr {
+				require.Error(t, err)
+				require.Equal(t, tc.dbRecord.Status, got.Status)
+				require.Empty(t, got.ForceReason)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedStatus, status)
+			require.Equal(t, tc.expectedStatus, got.Status)
+			require.Equal(t, "stuck in the broker's queue", got.GetForceReason())
+			require.NotNil(t, got.ReconciledAt)
+			require.Equal(t, "VOO", got.Symbol)
+		})
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	ctx := context.TODO()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	require.NoError(t, putRecord(ctx, store, &record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted}))
+
+	require.Error(t, Abandon(ctx, store, "trade1", ""), "a reason is required")
+	require.NoError(t, Abandon(ctx, store, "trade1", "order was placed against the wrong account"))
+
+	got, err := getRecord(ctx, store, "trade1")
+	require.NoError(t, err)
+	require.Equal(t, StatusAbandoned, got.Status)
+	require.Equal(t, "order was placed against the wrong account", got.ForceReason)
+
+	unreconciled, err := listUnreconciledRecords(ctx, store)
+	require.NoError(t, err)
+	require.Empty(t, unreconciled)
+}
@@ -0,0 +1,211 @@
+package reconciliation
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/jchorl/camelid/internal/archive"
+)
+
+// ArchiveOptions configures which records Archive moves out, and what happens to them
+type ArchiveOptions struct {
+	// closed records reconciled before this are archived
+	Before time.Time
+	// if positive, archived records expire this long after archiving,
+	// via the dynamo TTL. The file store keeps them regardless.
+	Expire time.Duration
+}
+
+// Archive copies closed records reconciled before opts.Before to the sink as
+// compressed JSONL, then marks them archived so later runs skip them.
+// It returns the name of the archive written, if any, and the number of records in it.
+func Archive(ctx context.Context, store RecordStore, sink archive.Sink, opts ArchiveOptions) (string, int, error) {
+	all, err := listAllRecords(ctx, store)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var records []record
+	for _, rec := range all {
+		if rec.Status.IsOpen() || rec.ArchivedAt != nil {
+			continue
+		}
+
+		// legacy records may not know when they were reconciled
+		closedAt := rec.CreatedAt
+		if rec.ReconciledAt != nil {
+			closedAt = *rec.ReconciledAt
+		}
+		if closedAt.Before(opts.Before) {
+			records = append(records, rec)
+		}
+	}
+
+	if len(records) == 0 {
+		return "", 0, nil
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("records-archive-%s.jsonl.gz", now.UTC().Format("20060102T150405Z"))
+	err = writeArchive(ctx, sink, name, records)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the archive is safely written, only now is it ok to let records expire
+	for _, rec := range records {
+		err := update(ctx, store, rec.ID, func(rec *record) error {
+			rec.ArchivedAt = &now
+			if opts.Expire > 0 {
+				rec.ExpiresAt = now.Add(opts.Expire).Unix()
+			}
+			return nil
+		})
+		if err != nil {
+			return name, len(records), fmt.Errorf("marking record %s archived: %w", rec.ID, err)
+		}
+	}
+
+	return name, len(records), nil
+}
+
+// Export writes every record to the sink under name, as compressed JSONL.
+// It returns the number of records exported.
+func Export(ctx context.Context, store RecordStore, sink archive.Sink, name string) (int, error) {
+	records, err := listAllRecords(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeArchive(ctx, sink, name, records)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
+
+// Import restores every record in the named archive exactly as exported.
+// Records already stored identically are skipped, so an import can be rerun,
+// but a stored record that differs from the archived one is an ErrConflict.
+// Archiving a record after it's written out doesn't count as a difference.
+// It returns the number of records restored.
+func Import(ctx context.Context, store RecordStore, sink archive.Sink, name string) (int, error) {
+	records, err := readArchive(ctx, sink, name)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, rec := range records {
+		rec := rec
+		err := restoreRecord(ctx, store, &rec)
+		if errors.Is(err, ErrConflict) {
+			stored, getErr := getRecord(ctx, store, rec.ID)
+			if getErr != nil {
+				return restored, fmt.Errorf("getting record %s: %w", rec.ID, getErr)
+			}
+
+			same, cmpErr := sameRecord(*stored, rec)
+			if cmpErr != nil {
+				return restored, cmpErr
+			} else if same {
+				continue
+			}
+			return restored, fmt.Errorf("record %s differs from the stored one: %w", rec.ID, err)
+		} else if err != nil {
+			return restored, err
+		}
+		restored++
+	}
+
+	return restored, nil
+}
+
+// writeArchive writes the records to the sink, one JSON object per line, gzipped.
+// records are sorted by ID, so the same records always make the same archive.
+func writeArchive(ctx context.Context, sink archive.Sink, name string, records []record) error {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, rec := range records {
+		err := enc.Encode(rec)
+		if err != nil {
+			return fmt.Errorf("encoding record %s: %w", rec.ID, err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		return fmt.Errorf("compressing %s: %w", name, err)
+	}
+
+	return sink.Write(ctx, name, buf.Bytes())
+}
+
+func readArchive(ctx context.Context, sink archive.Sink, name string) ([]record, error) {
+	data, err := sink.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", name, err)
+	}
+	defer zr.Close()
+
+	var records []record
+	r := bufio.NewReader(zr)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+
+		rec, err := decodeJSONRecord(data)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s line %d: %w", name, line, err)
+		}
+		records = append(records, *rec)
+	}
+
+	return records, nil
+}
+
+// sameRecord compares records by their serialized form, which is what an
+// archive preserves. Archive marks records archived, and so bumps their
+// version, only after writing them out, so those fields are left out.
+func sameRecord(a, b record) (bool, error) {
+	for _, rec := range []*record{&a, &b} {
+		rec.ArchivedAt = nil
+		rec.ExpiresAt = 0
+		rec.Version = 0
+	}
+
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false, fmt.Errorf("encoding record %s: %w", a.ID, err)
+	}
+
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false, fmt.Errorf("encoding record %s: %w", b.ID, err)
+	}
+
+	return bytes.Equal(aJSON, bJSON), nil
+}
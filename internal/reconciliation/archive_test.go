@@ -0,0 +1,187 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/archive"
+	"github.com/jchorl/camelid/internal/db"
+	"github.com/jchorl/camelid/internal/db/dbtest"
+)
+
+func newTestSink(t *testing.T) archive.Sink {
+	dir, err := ioutil.TempDir("", "camelid-archive")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sink, err := archive.NewDirSink(dir)
+	require.NoError(t, err)
+	return sink
+}
+
+// putTestRecords stores records covering every kind of field
+func putTestRecords(t *testing.T, store RecordStore, now time.Time) {
+	old := now.AddDate(0, -7, 0)
+	recent := now.AddDate(0, -1, 0)
+	fillPrice := db.NewDecimal(decimal.RequireFromString("57.295"))
+	for _, rec := range []record{
+		{
+			ID: "old-filled", RunID: "run1", AlpacaOrderID: "alpaca11", Status: StatusFilled,
+			Symbol: "VXUS", Side: "buy", RequestedQty: db.NewDecimal(decimal.NewFromInt(4)), RequestedDollars: db.NewDecimal(decimal.RequireFromString("250.10")),
+			EstimatedPrice: db.NewDecimal(decimal.RequireFromString("57.31")), FilledQty: db.NewDecimal(decimal.NewFromInt(4)), FilledAvgPrice: &fillPrice,
+			CreatedAt: old, SubmittedAt: &old, ReconciledAt: &old,
+		},
+		{ID: "old-legacy", AlpacaOrderID: "alpaca12", Status: StatusReconciled, CreatedAt: old},
+		{ID: "old-open", AlpacaOrderID: "alpaca13", Status: StatusSubmitted, CreatedAt: old, SubmittedAt: &old},
+		{ID: "recent-cancelled", AlpacaOrderID: "alpaca14", Status: StatusCancelled, CreatedAt: recent, SubmittedAt: &recent, ReconciledAt: &recent},
+	} {
+		rec := rec
+		require.NoError(t, putRecord(context.TODO(), store, &rec))
+	}
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	dbtest.ForEachBackend(t, func(t *testing.T, fromDir string) {
+		// then to each kind of store, as subtests of the kind it's from
+		dbtest.ForEachBackend(t, func(t *testing.T, toDir string) {
+			ctx := context.TODO()
+			// each pairing starts from its own empty store
+			dir := fromDir
+			if dir != "" {
+				var err error
+				dir, err = ioutil.TempDir(fromDir, "from")
+				require.NoError(t, err)
+			}
+			from := newTestStore(t, dir)
+			to := newTestStore(t, toDir)
+			sink := newTestSink(t)
+			putTestRecords(t, from, now)
+
+			exported, err := Export(ctx, from, sink, "export.jsonl.gz")
+			require.NoError(t, err)
+			require.Equal(t, 4, exported)
+
+			imported, err := Import(ctx, to, sink, "export.jsonl.gz")
+			require.NoError(t, err)
+			require.Equal(t, 4, imported)
+
+			// importing again is a no-op
+			imported, err = Import(ctx, to, sink, "export.jsonl.gz")
+			require.NoError(t, err)
+			require.Equal(t, 0, imported)
+
+			// exporting the imported records gives back the same archive, byte for byte
+			_, err = Export(ctx, to, sink, "reexport.jsonl.gz")
+			require.NoError(t, err)
+			original, err := sink.Read(ctx, "export.jsonl.gz")
+			require.NoError(t, err)
+			reexported, err := sink.Read(ctx, "reexport.jsonl.gz")
+			require.NoError(t, err)
+			require.Equal(t, original, reexported)
+
+			// versions survive, so writers holding a record read before the export still conflict
+			got, err := getRecord(ctx, to, "old-filled")
+			require.NoError(t, err)
+			require.Equal(t, 1, got.Version)
+			require.Equal(t, "run1", got.RunID)
+			require.Equal(t, "57.295", got.GetFilledAvgPrice().String())
+			unreconciled, err := listUnreconciledRecords(ctx, to)
+			require.NoError(t, err)
+			require.Len(t, unreconciled, 1)
+			require.Equal(t, "old-open", unreconciled[0].ID)
+		})
+	})
+}
+
+func TestImport_Conflict(t *testing.T) {
+	ctx := context.TODO()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	sink := newTestSink(t)
+	putTestRecords(t, store, time.Now())
+
+	_, err := Export(ctx, store, sink, "export.jsonl.gz")
+	require.NoError(t, err)
+
+	err = update(ctx, store, "old-open", func(rec *record) error {
+		rec.Status = StatusFilled
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = Import(ctx, store, sink, "export.jsonl.gz")
+	require.True(t, errors.Is(err, ErrConflict), "expected ErrConflict, got %v", err)
+
+	_, err = Import(ctx, store, sink, "nope.jsonl.gz")
+	require.Equal(t, archive.ErrNotFound, err)
+}
+
+func TestArchive_Import(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+		now := time.Now()
+		sink := newTestSink(t)
+		putTestRecords(t, store, now)
+
+		archiveName, archived, err := Archive(ctx, store, sink, ArchiveOptions{Before: now.AddDate(0, -6, 0), Expire: 30 * 24 * time.Hour})
+		require.NoError(t, err)
+		require.Equal(t, 2, archived)
+
+		// the archived records are still stored, marked archived, so there's nothing to restore
+		restored, err := Import(ctx, store, sink, archiveName)
+		require.NoError(t, err)
+		require.Equal(t, 0, restored)
+
+		rec, err := getRecord(ctx, store, "old-filled")
+		require.NoError(t, err)
+		require.NotNil(t, rec.ArchivedAt)
+	})
+}
+
+func TestArchive(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+		now := time.Now()
+		sink := newTestSink(t)
+		putTestRecords(t, store, now)
+
+		opts := ArchiveOptions{Before: now.AddDate(0, -6, 0), Expire: 30 * 24 * time.Hour}
+		archiveName, archived, err := Archive(ctx, store, sink, opts)
+		require.NoError(t, err)
+		require.Equal(t, 2, archived)
+
+		records, err := readArchive(ctx, sink, archiveName)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		require.Equal(t, "old-filled", records[0].ID)
+		require.Equal(t, "old-legacy", records[1].ID)
+
+		for _, id := range []string{"old-filled", "old-legacy"} {
+			got, err := getRecord(ctx, store, id)
+			require.NoError(t, err)
+			require.NotNil(t, got.ArchivedAt)
+			require.InDelta(t, now.Add(opts.Expire).Unix(), got.ExpiresAt, 5)
+		}
+		for _, id := range []string{"old-open", "recent-cancelled"} {
+			got, err := getRecord(ctx, store, id)
+			require.NoError(t, err)
+			require.Nil(t, got.ArchivedAt)
+			require.Zero(t, got.ExpiresAt)
+		}
+
+		// archived records aren't archived twice
+		archiveName, archived, err = Archive(ctx, store, sink, opts)
+		require.NoError(t, err)
+		require.Equal(t, 0, archived)
+		require.Empty(t, archiveName)
+	})
+}
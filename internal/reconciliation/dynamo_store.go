@@ -0,0 +1,227 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// open records carry this attribute, so that OpenIndex only holds records
+// that still need reconciling. Reconciling queries the index instead of
+// scanning the whole history.
+const (
+	openAttribute = "Open"
+	openIndex     = "OpenIndex"
+)
+
+type dynamoStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func NewDynamoStore(db dynamodbiface.DynamoDBAPI, table string) RecordStore {
+	return &dynamoStore{db, table}
+}
+
+// CreateDynamoTable creates a table for records, with the open index.
+// Deployed tables are made by terraform, this is for standing in for them.
+func CreateDynamoTable(ctx context.Context, db dynamodbiface.DynamoDBAPI, table string) error {
+	_, err := db.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(openIndex),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String(openAttribute), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+				},
+			},
+		},
+	})
+	return err
+}
+
+func (s *dynamoStore) Put(ctx context.Context, r Record) error {
+	rec, err := asRecord(r)
+	if err != nil {
+		return err
+	}
+
+	cond := expression.Name("Version").Equal(expression.Value(rec.Version - 1))
+	if rec.Version == 1 {
+		// records written before versioning have no Version, the same as new records
+		cond = cond.Or(expression.AttributeNotExists(expression.Name("Version")))
+	}
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("building condition: %w", err)
+	}
+
+	err = s.putItem(ctx, rec, expr)
+	if errors.Is(err, ErrConflict) {
+		return fmt.Errorf("put record %s at version %d: %w", rec.ID, rec.Version, err)
+	}
+	return err
+}
+
+func (s *dynamoStore) Restore(ctx context.Context, r Record) error {
+	rec, err := asRecord(r)
+	if err != nil {
+		return err
+	}
+
+	cond := expression.AttributeNotExists(expression.Name("ID"))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("building condition: %w", err)
+	}
+
+	err = s.putItem(ctx, rec, expr)
+	if errors.Is(err, ErrConflict) {
+		return fmt.Errorf("restore record %s: %w", rec.ID, err)
+	}
+	return err
+}
+
+// putItem writes the record if the condition in expr holds, or returns ErrConflict
+func (s *dynamoStore) putItem(ctx context.Context, rec *record, expr expression.Expression) error {
+	av, err := dynamodbattribute.MarshalMap(rec)
+	if err != nil {
+		return fmt.Errorf("marshaling record (%+v): %w", rec, err)
+	}
+
+	if rec.Status.IsOpen() {
+		av[openAttribute] = &dynamodb.AttributeValue{N: aws.String("1")}
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.table),
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrConflict
+	} else if err != nil {
+		return fmt.Errorf("put item: %w", err)
+	}
+
+	return nil
+}
+
+func (s *dynamoStore) Get(ctx context.Context, id string) (Record, error) {
+	resp, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem(%s) from dynamo: %w", id, err)
+	} else if resp.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	rec, err := decodeDynamoRecord(resp.Item)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling item from dynamo: %w", err)
+	}
+
+	return rec, nil
+}
+
+func (s *dynamoStore) ListUnreconciled(ctx context.Context) ([]Record, error) {
+	keyCond := expression.Key(openAttribute).Equal(expression.Value(1))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, fmt.Errorf("building unreconciled query: %w", err)
+	}
+
+	var records []Record
+
+	var unmarshalErr error
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		TableName:                 aws.String(s.table),
+		IndexName:                 aws.String(openIndex),
+	}, func(page *dynamodb.QueryOutput, last bool) bool {
+		for _, av := range page.Items {
+			rec, err := decodeDynamoRecord(av)
+			if err != nil {
+				unmarshalErr = err
+				return false
+			}
+			records = append(records, rec)
+		}
+
+		return true // keep paging
+	})
+	if err != nil {
+		return nil, fmt.Errorf("QueryPages: %w", err)
+	} else if unmarshalErr != nil {
+		return nil, fmt.Errorf("unmarshaling dynamo results: %w", unmarshalErr)
+	}
+
+	return records, nil
+}
+
+func (s *dynamoStore) ListAll(ctx context.Context) ([]Record, error) {
+	var records []Record
+
+	var unmarshalErr error
+	err := s.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(s.table),
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, av := range page.Items {
+			rec, err := decodeDynamoRecord(av)
+			if err != nil {
+				unmarshalErr = err
+				return false
+			}
+			records = append(records, rec)
+		}
+
+		return true // keep paging
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ScanPages: %w", err)
+	} else if unmarshalErr != nil {
+		return nil, fmt.Errorf("unmarshaling dynamo results: %w", unmarshalErr)
+	}
+
+	return records, nil
+}
+
+func (s *dynamoStore) Delete(ctx context.Context, id string) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteItem(%s) from dynamo: %w", id, err)
+	}
+
+	return nil
+}
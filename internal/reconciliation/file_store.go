@@ -0,0 +1,131 @@
+package reconciliation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jchorl/camelid/internal/db/filedb"
+)
+
+// fileStore keeps each record in a file named by its ID. Puts check the
+// stored version as the dynamo store's conditional writes do, and records
+// stored in older schemas are upgraded as they're read.
+type fileStore struct {
+	table *filedb.Table
+}
+
+func NewFileStore(dir string) (RecordStore, error) {
+	table, err := filedb.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStore{table}, nil
+}
+
+func (s *fileStore) Put(ctx context.Context, r Record) error {
+	rec, err := asRecord(r)
+	if err != nil {
+		return err
+	}
+
+	// the stored record may be in an older schema, so only its version is read
+	var stored json.RawMessage
+	return s.table.Update(rec.ID, &stored, func(found bool) error {
+		version := struct{ Version int }{}
+		if found {
+			err := json.Unmarshal(stored, &version)
+			if err != nil {
+				return fmt.Errorf("unmarshaling %s: %w", rec.ID, err)
+			}
+		}
+		if version.Version != rec.Version-1 {
+			return fmt.Errorf("put record %s at version %d, stored version is %d: %w", rec.ID, rec.Version, version.Version, ErrConflict)
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("marshaling %s: %w", rec.ID, err)
+		}
+		stored = data
+		return nil
+	})
+}
+
+func (s *fileStore) Restore(ctx context.Context, r Record) error {
+	rec, err := asRecord(r)
+	if err != nil {
+		return err
+	}
+
+	var stored json.RawMessage
+	return s.table.Update(rec.ID, &stored, func(found bool) error {
+		if found {
+			return fmt.Errorf("restore record %s: %w", rec.ID, ErrConflict)
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("marshaling %s: %w", rec.ID, err)
+		}
+		stored = data
+		return nil
+	})
+}
+
+func (s *fileStore) Get(ctx context.Context, id string) (Record, error) {
+	var data json.RawMessage
+	err := s.table.Get(id, &data)
+	if errors.Is(err, filedb.ErrNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rec, err := decodeJSONRecord(data)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling %s: %w", id, err)
+	}
+
+	return rec, nil
+}
+
+func (s *fileStore) ListUnreconciled(ctx context.Context) ([]Record, error) {
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, rec := range all {
+		if rec.GetStatus().IsOpen() {
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
+
+func (s *fileStore) ListAll(ctx context.Context) ([]Record, error) {
+	var records []Record
+	err := s.table.Scan(func(key string, data []byte) error {
+		rec, err := decodeJSONRecord(data)
+		if err != nil {
+			return fmt.Errorf("unmarshaling %s: %w", key, err)
+		}
+
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string) error {
+	return s.table.Delete(id)
+}
@@ -0,0 +1,69 @@
+package reconciliation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jchorl/camelid/internal/exchange"
+)
+
+// MigrateStatuses moves reconciled records onto the full lifecycle, looking
+// their orders up in alpaca to tell fills from cancellations. The other legacy
+// statuses are upgraded as records are read, see foldLegacyStatuses.
+// It returns the number of records migrated.
+func MigrateStatuses(ctx context.Context, store RecordStore, exchangeClient exchange.Client) (int, error) {
+	records, err := listAllRecords(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, rec := range records {
+		rec := rec
+		if rec.Status != StatusReconciled {
+			continue
+		}
+
+		order, err := exchangeClient.GetOrder(ctx, rec.AlpacaOrderID)
+		if err != nil {
+			return migrated, fmt.Errorf("getting order from alpaca (%s): %w", rec.AlpacaOrderID, err)
+		}
+		rec.Status = statusFromOrder(order)
+		rec.setFill(order)
+
+		err = putRecord(ctx, store, &rec)
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// MigrateOpenIndex rewrites every open record, so that the dynamo store tags
+// it for OpenIndex. Records written before the index existed are invisible to
+// Reconcile until this runs.
+// It returns the number of records rewritten.
+func MigrateOpenIndex(ctx context.Context, store RecordStore) (int, error) {
+	records, err := listAllRecords(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, rec := range records {
+		rec := rec
+		if !rec.Status.IsOpen() {
+			continue
+		}
+
+		err := putRecord(ctx, store, &rec)
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
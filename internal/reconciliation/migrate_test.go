@@ -0,0 +1,102 @@
+package reconciliation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+)
+
+func TestMigrateStatuses(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	db := newTestDB(t)
+	store := NewDynamoStore(db, DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+	alpacaClient.AddOrder(exchangetest.NewFilledOrder("alpaca12"))
+	alpacaClient.AddOrder(exchangetest.NewUnfilledOrder("alpaca13"))
+	alpacaClient.SetOrderStatus("alpaca13", "canceled")
+
+	// write items the way they were before the lifecycle existed
+	for _, rec := range []record{
+		{ID: "trade1", Status: StatusUnreconciled, CreatedAt: now},
+		{ID: "trade2", AlpacaOrderID: "alpaca12", Status: StatusReconciled, CreatedAt: now, SubmittedAt: &now, ReconciledAt: &now},
+		{ID: "trade3", AlpacaOrderID: "alpaca13", Status: StatusReconciled, CreatedAt: now, SubmittedAt: &now, ReconciledAt: &now},
+		{ID: "trade4", AlpacaOrderID: "alpaca14", Status: StatusUnreconciled, CreatedAt: now, SubmittedAt: &now},
+		{ID: "trade5", Status: StatusReconciled, CreatedAt: now, ReconciledAt: &now},
+	} {
+		av, err := dynamodbattribute.MarshalMap(rec)
+		require.NoError(t, err)
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(DefaultDynamoTable), Item: av})
+		require.NoError(t, err)
+	}
+
+	// only the reconciled records with orders need alpaca, the rest are upgraded on read
+	migrated, err := MigrateStatuses(ctx, store, alpacaClient)
+	require.NoError(t, err)
+	require.Equal(t, 2, migrated)
+
+	expected := map[string]Status{
+		"trade1": StatusPendingSubmit,
+		"trade2": StatusFilled,
+		"trade3": StatusCancelled,
+		"trade4": StatusSubmitted,
+		"trade5": StatusAbandoned,
+	}
+	for id, status := range expected {
+		rec, err := getRecord(ctx, store, id)
+		require.NoError(t, err)
+		require.Equal(t, status, rec.Status, "record %s is %s, expected %s", id, rec.Status, status)
+	}
+
+	rec, err := getRecord(ctx, store, "trade2")
+	require.NoError(t, err)
+	require.Equal(t, "VOO", rec.Symbol)
+	require.True(t, decimal.NewFromInt(3).Equal(rec.GetFilledQty()))
+	require.Equal(t, CurrentSchemaVersion, rec.SchemaVersion)
+
+	// migrating is idempotent
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodGetOrder), 2)
+	migrated, err = MigrateStatuses(ctx, store, alpacaClient)
+	require.NoError(t, err)
+	require.Equal(t, 0, migrated)
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodGetOrder), 2)
+}
+
+func TestMigrateOpenIndex(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	db := newTestDB(t)
+	store := NewDynamoStore(db, DefaultDynamoTable)
+
+	// write items the way they were before OpenIndex existed
+	for _, rec := range []record{
+		{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+		{ID: "trade2", AlpacaOrderID: "alpaca12", Status: StatusFilled, CreatedAt: now, SubmittedAt: &now, ReconciledAt: &now},
+		{ID: "trade3", Status: StatusPendingSubmit, CreatedAt: now},
+	} {
+		av, err := dynamodbattribute.MarshalMap(rec)
+		require.NoError(t, err)
+		_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(DefaultDynamoTable), Item: av})
+		require.NoError(t, err)
+	}
+
+	unreconciled, err := listUnreconciledRecords(ctx, store)
+	require.NoError(t, err)
+	require.Empty(t, unreconciled)
+
+	migrated, err := MigrateOpenIndex(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, 2, migrated)
+
+	unreconciled, err = listUnreconciledRecords(ctx, store)
+	require.NoError(t, err)
+	require.Len(t, unreconciled, 2)
+}
@@ -0,0 +1,163 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jchorl/camelid/internal/exchange"
+)
+
+// OrphanPolicy says what to do with orders at the broker that have no record
+type OrphanPolicy string
+
+const (
+	// OrphanFlag reports orphans as an *OrphanError, so trading stops until someone looks
+	OrphanFlag OrphanPolicy = "flag"
+	// OrphanImport creates records for orphans, so they're reconciled like any other order
+	OrphanImport OrphanPolicy = "import"
+)
+
+func ParseOrphanPolicy(s string) (OrphanPolicy, error) {
+	switch policy := OrphanPolicy(s); policy {
+	case OrphanFlag, OrphanImport:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown orphan policy %q, expected %q or %q", s, OrphanFlag, OrphanImport)
+}
+
+// OrphanError lists orders at the broker that have no record
+type OrphanError struct {
+	Orders []exchange.Order
+}
+
+func (e *OrphanError) Error() string {
+	var descs []string
+	for _, order := range e.Orders {
+		descs = append(descs, fmt.Sprintf("%s (client order ID %s, %s %s %s, %s)", order.ID, order.ClientOrderID, order.Side, order.Qty, order.Symbol, order.Status))
+	}
+	return fmt.Sprintf("%d orders at the broker have no record: %s", len(e.Orders), strings.Join(descs, "; "))
+}
+
+// listOrdersPageSize is the most orders alpaca returns at once
+const listOrdersPageSize = 500
+
+// CheckOrphans finds orders submitted to the broker since the given time that
+// have no record, e.g. orders placed by hand, or by a run that crashed before
+// recording them. Orders are matched to records by client order ID, which
+// camelid sets to the record ID. Orphans are imported or flagged per policy,
+// imported as orders in the named account, which exchangeClient trades in.
+// Brokers that can't list orders back to since aren't checked.
+// It returns the number of orphans imported.
+func CheckOrphans(ctx context.Context, store RecordStore, exchangeClient exchange.Client, account string, since time.Time, policy OrphanPolicy) (int, error) {
+	orders, err := listOrdersSince(ctx, exchangeClient, since)
+	if errors.Is(err, exchange.ErrNoOrderHistory) {
+		glog.Warningf("not checking for orphan orders, %v", err)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var orphans []exchange.Order
+	for _, order := range orders {
+		_, err := getRecord(ctx, store, recordIDForOrder(&order))
+		if errors.Is(err, ErrNotFound) {
+			orphans = append(orphans, order)
+		} else if err != nil {
+			return 0, fmt.Errorf("getting record for order %s: %w", order.ID, err)
+		}
+	}
+
+	if len(orphans) == 0 {
+		return 0, nil
+	} else if policy != OrphanImport {
+		return 0, &OrphanError{Orders: orphans}
+	}
+
+	imported := 0
+	for _, order := range orphans {
+		order := order
+		rec := recordFromOrphan(&order)
+		rec.Account = account
+		err := putRecord(ctx, store, rec)
+		if err != nil {
+			return imported, fmt.Errorf("importing order %s: %w", order.ID, err)
+		}
+		glog.Warningf("imported order %s (%s %s %s) with no record as %s", order.ID, order.Side, order.Qty, order.Symbol, rec.Status)
+		imported++
+	}
+
+	return imported, nil
+}
+
+// listOrdersSince pages back through every order submitted since the given time.
+// alpaca only pages with until, so orders submitted in the same instant as the
+// oldest in a page come back again on the next, and are deduped.
+func listOrdersSince(ctx context.Context, exchangeClient exchange.Client, since time.Time) ([]exchange.Order, error) {
+	req := exchange.ListOrdersRequest{Status: "all", Limit: listOrdersPageSize, Since: &since}
+	seen := map[string]bool{}
+
+	var orders []exchange.Order
+	for {
+		page, err := exchangeClient.ListOrders(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("listing orders: %w", err)
+		}
+
+		added := 0
+		for _, order := range page {
+			if seen[order.ID] || order.SubmittedAt.Before(since) {
+				continue
+			}
+			seen[order.ID] = true
+			orders = append(orders, order)
+			added++
+		}
+
+		if len(page) < req.Limit || added == 0 {
+			return orders, nil
+		}
+
+		oldest := page[len(page)-1].SubmittedAt
+		if oldest.Before(since) {
+			return orders, nil
+		}
+		req.Until = &oldest
+	}
+}
+
+// recordFromOrphan creates a record of an order that camelid didn't place,
+// closed already if the order is done
+func recordFromOrphan(order *exchange.Order) *record {
+	submittedAt := order.SubmittedAt
+	rec := &record{
+		ID:            recordIDForOrder(order),
+		AlpacaOrderID: order.ID,
+		Status:        StatusSubmitted,
+		Imported:      true,
+		CreatedAt:     order.CreatedAt,
+		SubmittedAt:   &submittedAt,
+	}
+	rec.setFill(order)
+
+	if isTerminalState(order.Status) {
+		reconciledAt := order.UpdatedAt
+		rec.Status = statusFromOrder(order)
+		rec.ReconciledAt = &reconciledAt
+	}
+
+	return rec
+}
+
+// recordIDForOrder is the ID of the record an order should have.
+// alpaca always sets a client order ID, but fall back to the order ID just in case.
+func recordIDForOrder(order *exchange.Order) string {
+	if order.ClientOrderID == "" {
+		return order.ID
+	}
+	return order.ClientOrderID
+}
@@ -0,0 +1,214 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+)
+
+func TestCheckOrphans(t *testing.T) {
+	cases := []struct {
+		name             string
+		policy           OrphanPolicy
+		expectedImported int
+		expectedOrphans  []string // alpaca IDs
+	}{
+		{
+			name:            "flag",
+			policy:          OrphanFlag,
+			expectedOrphans: []string{"manual-filled", "crashed-open"},
+		},
+		{
+			name:             "import",
+			policy:           OrphanImport,
+			expectedImported: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			now := time.Now()
+			store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+			alpacaClient := exchangetest.NewMockClient("6")
+
+			recorded := exchangetest.NewFilledOrder("recorded")
+			recorded.ClientOrderID = "trade1"
+			recorded.SubmittedAt = now.Add(-2 * time.Hour)
+			alpacaClient.AddOrder(recorded)
+			require.NoError(t, putRecord(ctx, store, &record{ID: "trade1", AlpacaOrderID: "recorded", Status: StatusFilled}))
+
+			manual := exchangetest.NewFilledOrder("manual-filled")
+			manual.SubmittedAt = now.Add(-time.Hour)
+			alpacaClient.AddOrder(manual)
+
+			// a run crashed between placing the order and recording it
+			crashed := exchangetest.NewUnfilledOrder("crashed-open")
+			crashed.Symbol = "BND"
+			crashed.SubmittedAt = now.Add(-30 * time.Minute)
+			alpacaClient.AddOrder(crashed)
+
+			// too old to care about
+			old := exchangetest.NewFilledOrder("old")
+			old.SubmittedAt = now.AddDate(0, 0, -30)
+			alpacaClient.AddOrder(old)
+
+			imported, err := CheckOrphans(ctx, store, alpacaClient, "", now.AddDate(0, 0, -7), tc.policy)
+			require.Equal(t, tc.expectedImported, imported)
+			if len(tc.expectedOrphans) > 0 {
+				var orphanErr *OrphanError
+				require.True(t, errors.As(err, &orphanErr), "expected OrphanError, got %v", err)
+				var ids []string
+				for _, order := range orphanErr.Orders {
+					ids = append(ids, order.ID)
+				}
+				require.ElementsMatch(t, tc.expectedOrphans, ids)
+
+				_, err := getRecord(ctx, store, manual.ClientOrderID)
+				require.Equal(t, ErrNotFound, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := getRecord(ctx, store, manual.ClientOrderID)
+			require.NoError(t, err)
+			require.True(t, got.Imported)
+			require.Equal(t, "manual-filled", got.AlpacaOrderID)
+			require.Equal(t, StatusFilled, got.Status)
+			require.Equal(t, "VOO", got.Symbol)
+			require.True(t, manual.FilledQty.Equal(got.GetFilledQty()))
+			require.NotNil(t, got.ReconciledAt)
+
+			got, err = getRecord(ctx, store, crashed.ClientOrderID)
+			require.NoError(t, err)
+			require.Equal(t, StatusSubmitted, got.Status)
+			require.Equal(t, "BND", got.Symbol)
+			require.Nil(t, got.ReconciledAt)
+
+			// imported open orders get reconciled like any other
+			unreconciled, err := listUnreconciledRecords(ctx, store)
+			require.NoError(t, err)
+			require.Len(t, unreconciled, 1)
+
+			// nothing is orphaned anymore
+			imported, err = CheckOrphans(ctx, store, alpacaClient, "", now.AddDate(0, 0, -7), OrphanFlag)
+			require.NoError(t, err)
+			require.Zero(t, imported)
+		})
+	}
+}
+
+func TestCheckOrphans_UnsubmittedRecord(t *testing.T) {
+	ctx := context.TODO()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+
+	// the order reached the broker, but the run never marked its record submitted
+	rec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromInt(300)).(*record)
+	rec.ID = "trade1"
+	rec.CreatedAt = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, putRecord(ctx, store, rec))
+	order := exchangetest.NewUnfilledOrder("alpaca11")
+	order.ClientOrderID = "trade1"
+	alpacaClient.AddOrder(order)
+
+	result, err := New(store, alpacaClient).Reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"VOO"}, result.Blocked())
+	require.True(t, decimal.NewFromInt(900).Equal(result.Reserved()), "reserved %s", result.Reserved())
+
+	imported, err := CheckOrphans(ctx, store, alpacaClient, "", time.Now().AddDate(0, 0, -7), OrphanFlag)
+	require.NoError(t, err)
+	require.Equal(t, 0, imported)
+
+	got, err := getRecord(ctx, store, "trade1")
+	require.NoError(t, err)
+	require.Equal(t, StatusSubmitted, got.Status)
+	require.Equal(t, "alpaca11", got.AlpacaOrderID)
+	require.True(t, order.SubmittedAt.Equal(*got.SubmittedAt))
+
+	// and once it fills, it's reconciled like any other
+	alpacaClient.SetOrderStatus("alpaca11", exchange.OrderFilled)
+	_, err = New(store, alpacaClient).Reconcile(ctx)
+	require.NoError(t, err)
+	got, err = getRecord(ctx, store, "trade1")
+	require.NoError(t, err)
+	require.Equal(t, StatusFilled, got.Status)
+}
+
+func TestNoOrderHistory(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	client := exchangetest.NewMockClient("6")
+	client.InjectFault(exchangetest.MethodListOrders, 0, exchangetest.Fault{Err: exchange.ErrNoOrderHistory})
+
+	// the broker can't say whether the order of a record from days ago reached it
+	rec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromInt(300)).(*record)
+	rec.ID = "trade1"
+	rec.CreatedAt = now.AddDate(0, 0, -3)
+	require.NoError(t, putRecord(ctx, store, rec))
+	order := exchangetest.NewFilledOrder("alpaca11")
+	order.ClientOrderID = "trade1"
+	client.AddOrder(order)
+
+	// so the record is left alone, blocking its symbol, rather than abandoned
+	result, err := New(store, client).Reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"VOO"}, result.Blocked())
+	got, err := getRecord(ctx, store, "trade1")
+	require.NoError(t, err)
+	require.Equal(t, StatusPendingSubmit, got.Status)
+
+	// and the checks that need the history are skipped, or say why they can't be made
+	imported, err := CheckOrphans(ctx, store, client, "", now.AddDate(0, 0, -7), OrphanFlag)
+	require.NoError(t, err)
+	require.Equal(t, 0, imported)
+	_, err = Verify(ctx, store, []exchange.Client{client}, Snapshot{AsOf: now.AddDate(0, 0, -7)})
+	require.True(t, errors.Is(err, exchange.ErrNoOrderHistory), "expected ErrNoOrderHistory, got %v", err)
+}
+
+func TestCheckOrphans_Pages(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+
+	// more than a page of orders, some submitted in the same instant
+	total := listOrdersPageSize + 20
+	for i := 0; i < total; i++ {
+		order := exchangetest.NewFilledOrder(fmt.Sprintf("order%d", i))
+		order.SubmittedAt = now.Add(-time.Duration(i/2) * time.Minute)
+		order.Qty = decimal.NewFromInt(1)
+		alpacaClient.AddOrder(order)
+	}
+
+	imported, err := CheckOrphans(ctx, store, alpacaClient, "ira", now.AddDate(0, 0, -7), OrphanImport)
+	require.NoError(t, err)
+	require.Equal(t, total, imported)
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodListOrders), 2)
+
+	all, err := listAllRecords(ctx, store)
+	require.NoError(t, err)
+	require.Len(t, all, total)
+	for _, rec := range all {
+		require.Equal(t, "ira", rec.Account)
+	}
+}
+
+func TestOrphanError(t *testing.T) {
+	order := exchangetest.NewUnfilledOrder("alpaca11")
+	order.ClientOrderID = "manual1"
+	order.Side = exchange.Sell
+	err := &OrphanError{Orders: []exchange.Order{*order}}
+	require.Equal(t, "1 orders at the broker have no record: alpaca11 (client order ID manual1, sell 3 VOO, accepted)", err.Error())
+}
@@ -2,160 +2,309 @@ package reconciliation
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/golang/glog"
+	"github.com/shopspring/decimal"
 
 	"github.com/jchorl/camelid/internal/exchange"
 )
 
 type Client interface {
 	Record(context.Context, Record) error
-	Reconcile(context.Context) error
+	Reconcile(context.Context) (Result, error)
 }
 
-const dynamoTable = "CamelidRecordsTest"
-
 type client struct {
-	db             dynamodbiface.DynamoDBAPI
+	store          RecordStore
 	exchangeClient exchange.Client
+	account        string // the brokerage account exchangeClient trades in, empty for the default account
+}
+
+func New(store RecordStore, exchangeClient exchange.Client) Client {
+	return NewForAccount(store, exchangeClient, "")
 }
 
-func New(db dynamodbiface.DynamoDBAPI, exchangeClient exchange.Client) Client {
-	return &client{db, exchangeClient}
+// NewForAccount is a client for the records of orders in the named brokerage
+// account, which exchangeClient trades in. Records of other accounts are left alone.
+func NewForAccount(store RecordStore, exchangeClient exchange.Client, account string) Client {
+	return &client{store, exchangeClient, account}
 }
 
+// maxWriteAttempts bounds how many times a write is retried after conflicting with another writer
+const maxWriteAttempts = 5
+
+// errAlreadyClosed aborts an update of a record someone else closed
+var errAlreadyClosed = errors.New("record already closed")
+
+// Record writes the record. If someone else wrote it since, but left it open,
+// the caller's view still stands and overwrites theirs. If they closed it,
+// the caller is out of date and Record returns ErrConflict.
+// New records are of orders in the client's account.
 func (c *client) Record(ctx context.Context, rec Record) error {
-	av, err := dynamodbattribute.MarshalMap(rec)
-	if err != nil {
-		return fmt.Errorf("marshaling record (%+v): %w", rec, err)
+	r, ok := rec.(*record)
+	if !ok {
+		return fmt.Errorf("unsupported record type %T", rec)
+	}
+	if r.Version == 0 {
+		r.Account = c.account
 	}
 
-	_, err = c.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(dynamoTable),
-		Item:      av,
-	})
-	if err != nil {
-		return fmt.Errorf("put item: %w", err)
+	for attempt := 1; ; attempt++ {
+		err := putRecord(ctx, c.store, r)
+		if !errors.Is(err, ErrConflict) || attempt == maxWriteAttempts {
+			return err
+		}
+
+		latest, err := getRecord(ctx, c.store, r.ID)
+		if err != nil {
+			return fmt.Errorf("getting record %s after conflict: %w", r.ID, err)
+		} else if !latest.Status.IsOpen() {
+			return fmt.Errorf("record %s was concurrently closed as %s: %w", r.ID, latest.Status, ErrConflict)
+		}
+
+		glog.Warningf("record %s was modified concurrently, overwriting version %d", r.ID, latest.Version)
+		r.Version = latest.Version
 	}
+}
+
+// update applies fn to the latest stored version of the record and writes it,
+// starting over from a fresh read if someone else writes it first.
+// An error from fn aborts the update and is returned.
+func update(ctx context.Context, store RecordStore, id string, fn func(rec *record) error) error {
+	for attempt := 1; ; attempt++ {
+		rec, err := getRecord(ctx, store, id)
+		if err != nil {
+			return fmt.Errorf("getting record %s: %w", id, err)
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		err = putRecord(ctx, store, rec)
+		if !errors.Is(err, ErrConflict) || attempt == maxWriteAttempts {
+			return err
+		}
+		glog.Warningf("record %s was modified concurrently, retrying", id)
+	}
 }
 
-func (c *client) Reconcile(ctx context.Context) error {
+// Reconcile closes out records of orders that are done. Records of orders
+// still in flight, or that couldn't be checked, block their symbol, so the
+// rest can keep trading. It only returns an error if it couldn't tell which
+// symbols to block.
+func (c *client) Reconcile(ctx context.Context) (Result, error) {
+	result := Result{Symbols: map[string]*SymbolResult{}}
+
 	// query all unreconciled
-	unreconciled, err := c.getUnreconciled(ctx)
+	unreconciled, err := listUnreconciledRecords(ctx, c.store)
 	if err != nil {
-		return err
-	} else if len(unreconciled) == 0 {
-		return nil
+		return Result{}, err
 	}
 
-	// loop through and check status
-	var stillUnreconciledIDs []string
+	var mine []record
 	for _, rec := range unreconciled {
-		order, err := c.exchangeClient.GetOrder(rec.AlpacaOrderID)
-		if err != nil {
-			return fmt.Errorf("getting order from alpaca (%s): %w", rec.AlpacaOrderID, err)
+		if rec.Account == c.account {
+			mine = append(mine, rec)
+		}
+	}
+
+	// orders can reach the broker without their records being marked submitted,
+	// e.g. when a run crashes, or placing them times out after the broker took them
+	unsubmitted, lookupErr := c.findUnsubmitted(ctx, mine)
+
+	// loop through and check status
+	for _, rec := range mine {
+		var order *exchange.Order
+		if rec.AlpacaOrderID == "" {
+			if lookupErr != nil {
+				err := fmt.Errorf("looking for the order of unsubmitted record %s: %w", rec.ID, lookupErr)
+				if rec.Symbol == "" {
+					return Result{}, err
+				}
+				glog.Warningf("blocking %s: %v", rec.Symbol, err)
+				result.symbol(rec.Symbol).Errs = append(result.symbol(rec.Symbol).Errs, err)
+				continue
+			}
+
+			order = unsubmitted[rec.ID]
+			if order == nil {
+				// no order has its ID as client order ID, so the run that created it never got the order accepted
+				glog.Warningf("abandoning record %s, it was never submitted to alpaca", rec.ID)
+				err := c.setStatus(ctx, rec.ID, StatusAbandoned, nil)
+				if err != nil {
+					return Result{}, err
+				}
+				if rec.Symbol != "" {
+					symbolResult := result.symbol(rec.Symbol)
+					symbolResult.Closed = append(symbolResult.Closed, rec.ID)
+				}
+				continue
+			}
+
+			glog.Warningf("record %s was never marked submitted, but its order %s is at the broker, adopting it", rec.ID, order.ID)
+			err := c.adopt(ctx, rec.ID, order)
+			if err != nil {
+				return Result{}, err
+			}
+			rec.AlpacaOrderID = order.ID
+		}
+
+		if order == nil {
+			var err error
+			order, err = c.exchangeClient.GetOrder(ctx, rec.AlpacaOrderID)
+			if err != nil {
+				err = fmt.Errorf("getting order from alpaca (%s): %w", rec.AlpacaOrderID, err)
+				if rec.Symbol == "" {
+					// a legacy record, no telling what it would block
+					return Result{}, err
+				}
+				glog.Warningf("blocking %s: %v", rec.Symbol, err)
+				result.symbol(rec.Symbol).Errs = append(result.symbol(rec.Symbol).Errs, err)
+				continue
+			}
 		}
 
+		symbol := rec.Symbol
+		if symbol == "" {
+			symbol = order.Symbol
+		}
+		symbolResult := result.symbol(symbol)
+
 		if isTerminalState(order.Status) {
-			err := c.setReconciled(ctx, rec.ID, order.UpdatedAt)
+			err := c.setStatus(ctx, rec.ID, statusFromOrder(order), order)
 			if err != nil {
-				return err
+				return Result{}, err
 			}
+			symbolResult.Closed = append(symbolResult.Closed, rec.ID)
 			continue
 		}
 
-		stillUnreconciledIDs = append(stillUnreconciledIDs, rec.AlpacaOrderID)
-	}
-
-	if len(stillUnreconciledIDs) > 0 {
-		return fmt.Errorf("some orders could not be reconciled, alpaca IDs: %v", stillUnreconciledIDs)
+		symbolResult.InFlight = append(symbolResult.InFlight, rec.ID)
+		if rec.Side != string(exchange.Sell) {
+			symbolResult.InFlightDollars = symbolResult.InFlightDollars.Add(inFlightDollars(&rec, order))
+		}
 	}
 
-	return nil
+	return result, nil
 }
 
-func isTerminalState(status string) bool {
-	terminalStates := []string{"filled", "canceled", "expired", "rejected"}
-	for _, state := range terminalStates {
-		if status == state {
-			return true
+// findUnsubmitted looks for the orders of records never marked submitted, by
+// client order ID, which camelid sets to the record ID. It returns the orders
+// found, by record ID.
+func (c *client) findUnsubmitted(ctx context.Context, recs []record) (map[string]*exchange.Order, error) {
+	var since time.Time
+	unsubmitted := map[string]bool{}
+	for _, rec := range recs {
+		if rec.AlpacaOrderID != "" {
+			continue
 		}
+		unsubmitted[rec.ID] = true
+		if since.IsZero() || rec.CreatedAt.Before(since) {
+			since = rec.CreatedAt
+		}
+	}
+	if len(unsubmitted) == 0 {
+		return nil, nil
 	}
 
-	return false
+	// the broker's clock may be a little behind
+	orders, err := listOrdersSince(ctx, c.exchangeClient, since.Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]*exchange.Order{}
+	for i := range orders {
+		if id := recordIDForOrder(&orders[i]); unsubmitted[id] {
+			found[id] = &orders[i]
+		}
+	}
+	return found, nil
 }
 
-func (c *client) setReconciled(ctx context.Context, id string, reconciledAt time.Time) error {
-	resp, err := c.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"ID": {
-				S: aws.String(id),
-			},
-		},
-		TableName: aws.String(dynamoTable),
+// adopt marks the record submitted as the order found for it at the broker
+func (c *client) adopt(ctx context.Context, id string, order *exchange.Order) error {
+	return update(ctx, c.store, id, func(rec *record) error {
+		submittedAt := order.SubmittedAt
+		rec.AlpacaOrderID = order.ID
+		rec.SubmittedAt = &submittedAt
+		if rec.Status == StatusPendingSubmit {
+			rec.Status = StatusSubmitted
+		}
+		return nil
 	})
-	if err != nil {
-		return fmt.Errorf("GetItem(%s) from dynamo: %w", id, err)
-	}
+}
 
-	rec := record{}
-	err = dynamodbattribute.UnmarshalMap(resp.Item, &rec)
-	if err != nil {
-		return fmt.Errorf("unmarshaling item from dynamo: %w", err)
+// inFlightDollars estimates how much an open buy order will still spend
+func inFlightDollars(rec *record, order *exchange.Order) decimal.Decimal {
+	requested := rec.RequestedDollars.Decimal
+	if requested.IsZero() {
+		// records from before dollars were captured
+		requested = order.Qty.Mul(rec.EstimatedPrice.Decimal)
+	}
+	if order.FilledAvgPrice != nil {
+		// partial fills are already out of cash
+		requested = requested.Sub(order.FilledQty.Mul(*order.FilledAvgPrice))
 	}
+	return decimal.Max(requested, decimal.Zero)
+}
 
-	rec.ReconciledAt = &reconciledAt
-	rec.Status = StatusReconciled
-	err = c.Record(ctx, &rec)
-	if err != nil {
-		return err
+func isTerminalState(status exchange.OrderStatus) bool {
+	terminalStates := []exchange.OrderStatus{exchange.OrderFilled, exchange.OrderCanceled, exchange.OrderExpired, exchange.OrderRejected}
+	for _, state := range terminalStates {
+		if status == state {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-func (c *client) getUnreconciled(ctx context.Context) ([]record, error) {
-	filt := expression.Name("Status").NotEqual(expression.Value(StatusReconciled))
-	expr, err := expression.NewBuilder().WithFilter(filt).Build()
-	if err != nil {
-		return nil, fmt.Errorf("building unreconciled query: %w", err)
+// statusFromOrder maps an order in a terminal state to a record status
+func statusFromOrder(order *exchange.Order) Status {
+	if order.Status == exchange.OrderFilled {
+		return StatusFilled
+	} else if order.FilledQty.IsPositive() {
+		return StatusPartiallyFilledClosed
 	}
 
-	var records []record
-
-	var unmarshalErr error
-	err = c.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		FilterExpression:          expr.Filter(),
-		TableName:                 aws.String(dynamoTable),
-		IndexName:                 aws.String("StatusIndex"),
-	}, func(page *dynamodb.ScanOutput, last bool) bool {
-		recs := []record{}
+	switch order.Status {
+	case exchange.OrderCanceled:
+		return StatusCancelled
+	case exchange.OrderExpired:
+		return StatusExpired
+	default:
+		return StatusRejected
+	}
+}
 
-		err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &recs)
-		if err != nil {
-			unmarshalErr = err
-			return false
+// setStatus closes out the record, capturing how the order was filled, if there was one.
+// A record someone else already closed is left as is.
+func (c *client) setStatus(ctx context.Context, id string, status Status, order *exchange.Order) error {
+	err := update(ctx, c.store, id, func(rec *record) error {
+		if !rec.Status.IsOpen() {
+			return errAlreadyClosed
 		}
 
-		records = append(records, recs...)
-
-		return true // keep paging
+		now := time.Now()
+		rec.ReconciledAt = &now
+		rec.Status = status
+		if order != nil {
+			reconciledAt := order.UpdatedAt
+			rec.ReconciledAt = &reconciledAt
+			rec.setFill(order)
+		}
+		return nil
 	})
-	if err != nil {
-		return nil, fmt.Errorf("ScanPages: %w", err)
-	} else if unmarshalErr != nil {
-		return nil, fmt.Errorf("unmarshaling dynamo results: %w", err)
+	if errors.Is(err, errAlreadyClosed) {
+		glog.Infof("record %s was already closed, not marking it %s", id, status)
+		return nil
 	}
 
-	return records, nil
+	return err
 }
@@ -2,18 +2,22 @@ package reconciliation
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
-	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/shopspring/decimal"
+
+	"github.com/jchorl/camelid/internal/db"
 	"github.com/jchorl/camelid/internal/db/dbtest"
+	"github.com/jchorl/camelid/internal/exchange"
 	"github.com/jchorl/camelid/internal/exchange/exchangetest"
 	"github.com/stretchr/testify/require"
 )
 
 func TestRecord(t *testing.T) {
-	dynamoClient := dbtest.NewMockClient(dynamoTable)
-	reconciler := New(dynamoClient, nil)
+	reconciler := New(NewDynamoStore(newTestDB(t), DefaultDynamoTable), nil)
 	rec := &record{
 		ID:            "123",
 		AlpacaOrderID: "alpaca_111",
@@ -23,13 +27,80 @@ func TestRecord(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestReconcile_CapturesFill(t *testing.T) {
+	ctx := context.TODO()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+	order := exchangetest.NewFilledOrder("alpaca11")
+	alpacaClient.AddOrder(order)
+	reconciler := New(store, alpacaClient)
+
+	rec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromFloat(299.5))
+	rec.SetAccepted("alpaca11")
+	require.NoError(t, reconciler.Record(ctx, rec))
+	_, err := reconciler.Reconcile(ctx)
+	require.NoError(t, err)
+
+	got, err := getRecord(ctx, store, rec.GetID())
+	require.NoError(t, err)
+	require.Equal(t, StatusFilled, got.GetStatus())
+	require.Equal(t, "test-run", got.GetRunID())
+	require.Equal(t, "VOO", got.GetSymbol())
+	require.True(t, decimal.NewFromFloat(299.5).Equal(got.GetEstimatedPrice()))
+	require.True(t, order.FilledQty.Equal(got.GetFilledQty()))
+	require.True(t, order.FilledAvgPrice.Equal(*got.GetFilledAvgPrice()))
+	require.True(t, order.UpdatedAt.Equal(*got.GetReconciledAt()))
+}
+
+func TestReconcile_Accounts(t *testing.T) {
+	ctx := context.TODO()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	defaultClient := exchangetest.NewMockClient("6")
+	defaultClient.AddOrder(exchangetest.NewFilledOrder("alpaca11"))
+	iraClient := exchangetest.NewMockClient("7")
+	iraClient.AddOrder(exchangetest.NewFilledOrder("tradier22"))
+
+	defaultRec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromFloat(299.5))
+	defaultRec.SetAccepted("alpaca11")
+	require.NoError(t, New(store, defaultClient).Record(ctx, defaultRec))
+	iraRec := NewRecord("test-run", "BND", "buy", decimal.NewFromInt(3), decimal.NewFromInt(240), decimal.NewFromInt(80))
+	iraRec.SetAccepted("tradier22")
+	iraReconciler := NewForAccount(store, iraClient, "ira")
+	require.NoError(t, iraReconciler.Record(ctx, iraRec))
+	require.Equal(t, "ira", iraRec.GetAccount())
+
+	// each account's records are only checked against its own broker
+	result, err := iraReconciler.Reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{iraRec.GetID()}, result.Symbols["BND"].Closed)
+	require.NotContains(t, result.Symbols, "VOO")
+	require.Empty(t, defaultClient.CallsTo(exchangetest.MethodGetOrder))
+
+	got, err := getRecord(ctx, store, defaultRec.GetID())
+	require.NoError(t, err)
+	require.Equal(t, StatusSubmitted, got.GetStatus())
+	require.Equal(t, "", got.GetAccount())
+
+	_, err = New(store, defaultClient).Reconcile(ctx)
+	require.NoError(t, err)
+	got, err = getRecord(ctx, store, defaultRec.GetID())
+	require.NoError(t, err)
+	require.Equal(t, StatusFilled, got.GetStatus())
+	require.Len(t, iraClient.CallsTo(exchangetest.MethodGetOrder), 1)
+}
+
 func TestReconcile(t *testing.T) {
 	now := time.Now()
 	cases := []struct {
 		name        string
-		orders      []*alpaca.Order
+		orders      []*exchange.Order
+		faults      []exchangetest.Fault // applied to the nth GetOrder call
 		dbRecords   []record
 		expectedErr bool
+		// expected statuses after reconciling, by record ID
+		expectedStatuses map[string]Status
+		expectedBlocked  []string
+		expectedInFlight map[string]decimal.Decimal
 	}{
 		{
 			name:        "no data",
@@ -41,7 +112,7 @@ func TestReconcile(t *testing.T) {
 				{
 					ID:            "trade1",
 					AlpacaOrderID: "alpaca11",
-					Status:        StatusReconciled,
+					Status:        StatusFilled,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 					ReconciledAt:  &now,
@@ -55,7 +126,7 @@ func TestReconcile(t *testing.T) {
 				{
 					ID:            "trade1",
 					AlpacaOrderID: "alpaca11",
-					Status:        StatusUnreconciled,
+					Status:        StatusSubmitted,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
@@ -64,12 +135,42 @@ func TestReconcile(t *testing.T) {
 		},
 		{
 			name:   "unreconciled and unfilled",
-			orders: []*alpaca.Order{exchangetest.NewUnfilledOrder("alpaca11")},
+			orders: []*exchange.Order{exchangetest.NewUnfilledOrder("alpaca11")},
 			dbRecords: []record{
 				{
 					ID:            "trade1",
 					AlpacaOrderID: "alpaca11",
-					Status:        StatusUnreconciled,
+					Status:        StatusSubmitted,
+					CreatedAt:     now,
+					SubmittedAt:   &now,
+				},
+			},
+			expectedBlocked: []string{"VOO"},
+		},
+		{
+			name:   "unreconciled and pending cancel",
+			orders: []*exchange.Order{exchangetest.NewFilledOrder("alpaca11")},
+			faults: []exchangetest.Fault{{OrderStatus: "pending_cancel"}},
+			dbRecords: []record{
+				{
+					ID:            "trade1",
+					AlpacaOrderID: "alpaca11",
+					Status:        StatusSubmitted,
+					CreatedAt:     now,
+					SubmittedAt:   &now,
+				},
+			},
+			expectedBlocked: []string{"VOO"},
+		},
+		{
+			name:   "exchange error",
+			orders: []*exchange.Order{exchangetest.NewFilledOrder("alpaca11")},
+			faults: []exchangetest.Fault{{Err: exchangetest.ErrRateLimited}},
+			dbRecords: []record{
+				{
+					ID:            "trade1",
+					AlpacaOrderID: "alpaca11",
+					Status:        StatusSubmitted,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
@@ -78,7 +179,22 @@ func TestReconcile(t *testing.T) {
 		},
 		{
 			name:   "unreconciled and filled",
-			orders: []*alpaca.Order{exchangetest.NewFilledOrder("alpaca11")},
+			orders: []*exchange.Order{exchangetest.NewFilledOrder("alpaca11")},
+			dbRecords: []record{
+				{
+					ID:            "trade1",
+					AlpacaOrderID: "alpaca11",
+					Status:        StatusSubmitted,
+					CreatedAt:     now,
+					SubmittedAt:   &now,
+				},
+			},
+			expectedErr:      false,
+			expectedStatuses: map[string]Status{"trade1": StatusFilled},
+		},
+		{
+			name:   "legacy unreconciled and filled",
+			orders: []*exchange.Order{exchangetest.NewFilledOrder("alpaca11")},
 			dbRecords: []record{
 				{
 					ID:            "trade1",
@@ -88,11 +204,49 @@ func TestReconcile(t *testing.T) {
 					SubmittedAt:   &now,
 				},
 			},
+			expectedErr:      false,
+			expectedStatuses: map[string]Status{"trade1": StatusFilled},
+		},
+		{
+			name: "closed without filling",
+			orders: []*exchange.Order{
+				exchangetest.NewUnfilledOrder("alpaca11"),
+				exchangetest.NewUnfilledOrder("alpaca12"),
+				exchangetest.NewFilledOrder("alpaca13"),
+			},
+			faults: []exchangetest.Fault{
+				{OrderStatus: "canceled"},
+				{OrderStatus: "rejected"},
+				{OrderStatus: "expired"},
+			},
+			dbRecords: []record{
+				{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+				{ID: "trade2", AlpacaOrderID: "alpaca12", Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+				{ID: "trade3", AlpacaOrderID: "alpaca13", Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+			},
 			expectedErr: false,
+			expectedStatuses: map[string]Status{
+				"trade1": StatusCancelled,
+				"trade2": StatusRejected,
+				// some shares were filled before expiring
+				"trade3": StatusPartiallyFilledClosed,
+			},
+		},
+		{
+			name: "never submitted",
+			dbRecords: []record{
+				{
+					ID:        "trade1",
+					Status:    StatusPendingSubmit,
+					CreatedAt: now,
+				},
+			},
+			expectedErr:      false,
+			expectedStatuses: map[string]Status{"trade1": StatusAbandoned},
 		},
 		{
 			name: "grab bag, unreconciled",
-			orders: []*alpaca.Order{
+			orders: []*exchange.Order{
 				exchangetest.NewFilledOrder("alpaca11"),
 				exchangetest.NewFilledOrder("alpaca12"),
 				exchangetest.NewUnfilledOrder("alpaca13"),
@@ -101,30 +255,53 @@ func TestReconcile(t *testing.T) {
 				{
 					ID:            "trade1",
 					AlpacaOrderID: "alpaca11",
-					Status:        StatusUnreconciled,
+					Status:        StatusSubmitted,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
 				{
 					ID:            "trade2",
 					AlpacaOrderID: "alpaca12",
-					Status:        StatusUnreconciled,
+					Status:        StatusSubmitted,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
 				{
 					ID:            "trade3",
 					AlpacaOrderID: "alpaca13",
-					Status:        StatusUnreconciled,
+					Status:        StatusSubmitted,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
 			},
-			expectedErr: true,
+			expectedBlocked: []string{"VOO"},
+		},
+		{
+			name:   "exchange error, known symbol",
+			orders: []*exchange.Order{exchangetest.NewFilledOrder("alpaca11"), exchangetest.NewFilledOrder("alpaca12")},
+			faults: []exchangetest.Fault{{Err: exchangetest.ErrRateLimited}},
+			dbRecords: []record{
+				{ID: "trade1", AlpacaOrderID: "alpaca11", Symbol: "VXUS", Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+				{ID: "trade2", AlpacaOrderID: "alpaca12", Symbol: "VOO", Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+			},
+			expectedStatuses: map[string]Status{"trade1": StatusSubmitted, "trade2": StatusFilled},
+			expectedBlocked:  []string{"VXUS"},
+		},
+		{
+			name:   "in flight buys",
+			orders: []*exchange.Order{exchangetest.NewUnfilledOrder("alpaca11"), exchangetest.NewUnfilledOrder("alpaca12")},
+			dbRecords: []record{
+				{ID: "trade1", AlpacaOrderID: "alpaca11", Symbol: "VOO", Side: "buy", RequestedDollars: db.NewDecimal(decimal.NewFromInt(900)), Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+				// from before dollars were recorded
+				{ID: "trade2", AlpacaOrderID: "alpaca12", Symbol: "VOO", Side: "buy", EstimatedPrice: db.NewDecimal(decimal.NewFromInt(100)), Status: StatusSubmitted, CreatedAt: now, SubmittedAt: &now},
+			},
+			expectedStatuses: map[string]Status{"trade1": StatusSubmitted, "trade2": StatusSubmitted},
+			expectedBlocked:  []string{"VOO"},
+			expectedInFlight: map[string]decimal.Decimal{"VOO": decimal.NewFromInt(1200)},
 		},
 		{
 			name: "grab bag, reconciled",
-			orders: []*alpaca.Order{
+			orders: []*exchange.Order{
 				exchangetest.NewFilledOrder("alpaca11"),
 				exchangetest.NewFilledOrder("alpaca12"),
 				exchangetest.NewFilledOrder("alpaca13"),
@@ -133,21 +310,21 @@ func TestReconcile(t *testing.T) {
 				{
 					ID:            "trade1",
 					AlpacaOrderID: "alpaca11",
-					Status:        StatusReconciled,
+					Status:        StatusFilled,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
 				{
 					ID:            "trade2",
 					AlpacaOrderID: "alpaca12",
-					Status:        StatusReconciled,
+					Status:        StatusFilled,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
 				{
 					ID:            "trade3",
 					AlpacaOrderID: "alpaca13",
-					Status:        StatusUnreconciled,
+					Status:        StatusSubmitted,
 					CreatedAt:     now,
 					SubmittedAt:   &now,
 				},
@@ -159,24 +336,137 @@ func TestReconcile(t *testing.T) {
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			dbClient := dbtest.NewMockClient(dynamoTable)
 			alpacaClient := exchangetest.NewMockClient("6")
-			reconciler := New(dbClient, alpacaClient)
+			store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+			reconciler := New(store, alpacaClient)
 
 			for _, order := range tc.orders {
 				alpacaClient.AddOrder(order)
 			}
 
+			for i, fault := range tc.faults {
+				alpacaClient.InjectFault(exchangetest.MethodGetOrder, i+1, fault)
+			}
+
 			for _, rec := range tc.dbRecords {
 				reconciler.Record(context.TODO(), &rec)
 			}
 
-			err := reconciler.Reconcile(context.TODO())
+			result, err := reconciler.Reconcile(context.TODO())
 			if tc.expectedErr {
 				require.Error(t, err)
-			} else {
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedBlocked, result.Blocked())
+			require.Equal(t, len(tc.expectedInFlight), len(result.InFlightDollars()))
+			for symbol, dollars := range tc.expectedInFlight {
+				require.True(t, dollars.Equal(result.InFlightDollars()[symbol]), "expected %s in flight for %s, got %s", dollars, symbol, result.InFlightDollars()[symbol])
+			}
+
+			for id, status := range tc.expectedStatuses {
+				rec, err := getRecord(context.TODO(), store, id)
 				require.NoError(t, err)
+				require.Equal(t, status, rec.Status, "record %s is %s, expected %s", id, rec.Status, status)
 			}
 		})
 	}
 }
+
+func TestStatusString(t *testing.T) {
+	require.Equal(t, "partially-filled-closed", StatusPartiallyFilledClosed.String())
+	for status := StatusUnreconciled; status <= StatusForceReconciled; status++ {
+		parsed, err := ParseStatus(status.String())
+		require.NoError(t, err)
+		require.Equal(t, status, parsed)
+	}
+	_, err := ParseStatus("nope")
+	require.Error(t, err)
+}
+
+func TestReconcile_ConcurrentWrites(t *testing.T) {
+	cases := []struct {
+		name string
+		// concurrent is written just before the reconciler writes the record
+		concurrent     record
+		expectedStatus Status
+	}{
+		{
+			name:           "record rewritten but still open",
+			concurrent:     record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted, Version: 1},
+			expectedStatus: StatusFilled,
+		},
+		{
+			name:           "record closed by someone else",
+			concurrent:     record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusCancelled, Version: 1},
+			expectedStatus: StatusCancelled,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			db := newTestDB(t)
+			store := NewDynamoStore(db, DefaultDynamoTable)
+			alpacaClient := exchangetest.NewMockClient("6")
+			alpacaClient.AddOrder(exchangetest.NewFilledOrder("alpaca11"))
+			reconciler := New(store, alpacaClient)
+
+			require.NoError(t, putRecord(ctx, store, &record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted}))
+
+			db.OnWrite(DefaultDynamoTable, func(map[string]*dynamodb.AttributeValue) {
+				concurrent := tc.concurrent
+				require.NoError(t, putRecord(ctx, store, &concurrent))
+				db.OnWrite(DefaultDynamoTable, nil)
+			})
+
+			_, err := reconciler.Reconcile(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 1, db.ConditionFailures())
+
+			got, err := getRecord(ctx, store, "trade1")
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedStatus, got.Status)
+		})
+	}
+}
+
+func TestRecord_Conflict(t *testing.T) {
+	ctx := context.TODO()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	reconciler := New(store, nil)
+
+	rec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromFloat(299.5))
+	require.NoError(t, reconciler.Record(ctx, rec))
+
+	// someone else touches the record but leaves it open, our write still stands
+	other, err := getRecord(ctx, store, rec.GetID())
+	require.NoError(t, err)
+	require.NoError(t, putRecord(ctx, store, other))
+
+	rec.SetAccepted("alpaca11")
+	require.NoError(t, reconciler.Record(ctx, rec))
+	got, err := getRecord(ctx, store, rec.GetID())
+	require.NoError(t, err)
+	require.Equal(t, StatusSubmitted, got.Status)
+	require.Equal(t, "alpaca11", got.AlpacaOrderID)
+
+	// once someone else closes the record, our copy is out of date
+	got.Status = StatusCancelled
+	require.NoError(t, putRecord(ctx, store, got))
+
+	rec.(*record).Status = StatusFilled
+	err = reconciler.Record(ctx, rec)
+	require.True(t, errors.Is(err, ErrConflict), "expected ErrConflict, got %v", err)
+	got, err = getRecord(ctx, store, rec.GetID())
+	require.NoError(t, err)
+	require.Equal(t, StatusCancelled, got.Status)
+}
+
+// newTestDB creates the records table the way terraform/main.tf does
+func newTestDB(t *testing.T) *dbtest.MockClient {
+	db := dbtest.NewMockClient()
+	require.NoError(t, CreateDynamoTable(context.TODO(), db, DefaultDynamoTable))
+	return db
+}
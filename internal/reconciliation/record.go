@@ -1,30 +1,106 @@
 package reconciliation
 
 import (
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/jchorl/camelid/internal/db"
+	"github.com/jchorl/camelid/internal/exchange"
 )
 
+// Status is where a record is in its lifecycle.
+// It's stored as a number, so values must never be reordered.
 type Status int
 
-func (s Status) String() string {
-	return strconv.Itoa(int(s))
-}
-
 const (
+	// StatusUnreconciled and StatusReconciled predate the full lifecycle.
+	// They're only found on old items, see foldLegacyStatuses and MigrateStatuses.
 	StatusUnreconciled Status = iota
 	StatusReconciled
+
+	StatusPendingSubmit         // recorded, but not yet accepted by the exchange
+	StatusSubmitted             // accepted by the exchange, not yet closed
+	StatusFilled                // completely filled
+	StatusPartiallyFilledClosed // closed (canceled, expired, etc) after filling some shares
+	StatusCancelled
+	StatusExpired
+	StatusRejected
+	StatusAbandoned       // never made it to the exchange
+	StatusForceReconciled // closed by hand while the order was still open, see ForceReconcile
 )
 
+var statusNames = map[Status]string{
+	StatusUnreconciled:          "unreconciled",
+	StatusReconciled:            "reconciled",
+	StatusPendingSubmit:         "pending-submit",
+	StatusSubmitted:             "submitted",
+	StatusFilled:                "filled",
+	StatusPartiallyFilledClosed: "partially-filled-closed",
+	StatusCancelled:             "cancelled",
+	StatusExpired:               "expired",
+	StatusRejected:              "rejected",
+	StatusAbandoned:             "abandoned",
+	StatusForceReconciled:       "force-reconciled",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return strconv.Itoa(int(s))
+}
+
+// ParseStatus is the inverse of Status.String
+func ParseStatus(name string) (Status, error) {
+	for status, n := range statusNames {
+		if n == name {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", name)
+}
+
+// openStatuses still need reconciling
+var openStatuses = []Status{StatusUnreconciled, StatusPendingSubmit, StatusSubmitted}
+
+// IsOpen reports whether the record still needs reconciling
+func (s Status) IsOpen() bool {
+	for _, open := range openStatuses {
+		if s == open {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLegacy reports whether the status predates the full lifecycle
+func (s Status) IsLegacy() bool {
+	return s == StatusUnreconciled || s == StatusReconciled
+}
+
 type Record interface {
 	GetID() string
 	GetAlpacaOrderID() string
 	GetStatus() Status
+	GetRunID() string
 	GetCreatedAt() time.Time
 	GetSubmittedAt() *time.Time
 	GetReconciledAt() *time.Time
+	GetSymbol() string
+	GetSide() string
+	GetRequestedQty() decimal.Decimal
+	GetRequestedDollars() decimal.Decimal
+	GetEstimatedPrice() decimal.Decimal
+	GetFilledQty() decimal.Decimal
+	GetFilledAvgPrice() *decimal.Decimal
+	GetForceReason() string
+	GetAccount() string
+	// bumped on every write, see RecordStore
+	GetVersion() int
 	SetAccepted(alpacaOrderID string)
 }
 
@@ -33,17 +109,53 @@ type record struct {
 	ID            string
 	AlpacaOrderID string
 	Status        Status
+	RunID         string // the ledger run that placed the order
+	Imported      bool   `dynamodbav:",omitempty" json:",omitempty"` // placed outside camelid, see CheckOrphans
+	// why the record was closed by hand, see ForceReconcile and Abandon
+	ForceReason string `dynamodbav:",omitempty" json:",omitempty"`
+	// the brokerage account the order was placed in, empty for the default account
+	Account string `dynamodbav:",omitempty" json:",omitempty"`
+	// bumped on every write, a write only succeeds against the version it read.
+	// 0 means the record was never stored.
+	Version int
+
+	Symbol           string
+	Side             string
+	RequestedQty     db.Decimal
+	RequestedDollars db.Decimal
+	EstimatedPrice   db.Decimal
+	FilledQty        db.Decimal
+	FilledAvgPrice   *db.Decimal
 
 	CreatedAt    time.Time
 	SubmittedAt  *time.Time
 	ReconciledAt *time.Time
+
+	// set once the record is copied to the archive, see Archive
+	ArchivedAt *time.Time
+	// unix seconds after which dynamo's TTL deletes the record, 0 to keep it
+	ExpiresAt int64 `dynamodbav:",omitempty" json:",omitempty"`
+
+	// the shape the record is stored in, see CurrentSchemaVersion
+	SchemaVersion int
+	// set if the record was read in an older schema, and upgraded on the way
+	upgrade *Upgrade
 }
 
-func NewRecord() Record {
+// NewRecord creates a record of an order about to be placed.
+// side is the alpaca order side, i.e. "buy" or "sell".
+// runID links the record to the ledger run placing the order.
+func NewRecord(runID, symbol, side string, qty, dollars, estimatedPrice decimal.Decimal) Record {
 	return &record{
-		ID:        uuid.New().String(),
-		CreatedAt: time.Now(),
-		Status:    StatusUnreconciled,
+		ID:               uuid.New().String(),
+		RunID:            runID,
+		CreatedAt:        time.Now(),
+		Status:           StatusPendingSubmit,
+		Symbol:           symbol,
+		Side:             side,
+		RequestedQty:     db.NewDecimal(qty),
+		RequestedDollars: db.NewDecimal(dollars),
+		EstimatedPrice:   db.NewDecimal(estimatedPrice),
 	}
 }
 
@@ -55,6 +167,10 @@ func (r *record) GetAlpacaOrderID() string {
 	return r.AlpacaOrderID
 }
 
+func (r *record) GetRunID() string {
+	return r.RunID
+}
+
 func (r *record) GetStatus() Status {
 	return r.Status
 }
@@ -71,8 +187,67 @@ func (r *record) GetReconciledAt() *time.Time {
 	return r.ReconciledAt
 }
 
+func (r *record) GetSymbol() string {
+	return r.Symbol
+}
+
+func (r *record) GetSide() string {
+	return r.Side
+}
+
+func (r *record) GetRequestedQty() decimal.Decimal {
+	return r.RequestedQty.Decimal
+}
+
+func (r *record) GetRequestedDollars() decimal.Decimal {
+	return r.RequestedDollars.Decimal
+}
+
+func (r *record) GetEstimatedPrice() decimal.Decimal {
+	return r.EstimatedPrice.Decimal
+}
+
+func (r *record) GetFilledQty() decimal.Decimal {
+	return r.FilledQty.Decimal
+}
+
+func (r *record) GetFilledAvgPrice() *decimal.Decimal {
+	if r.FilledAvgPrice == nil {
+		return nil
+	}
+	return &r.FilledAvgPrice.Decimal
+}
+
+func (r *record) GetForceReason() string {
+	return r.ForceReason
+}
+
+func (r *record) GetAccount() string {
+	return r.Account
+}
+
+func (r *record) GetVersion() int {
+	return r.Version
+}
+
 func (r *record) SetAccepted(alpacaOrderID string) {
 	r.AlpacaOrderID = alpacaOrderID
+	r.Status = StatusSubmitted
 	now := time.Now()
 	r.SubmittedAt = &now
 }
+
+// setFill captures how the order was filled
+func (r *record) setFill(order *exchange.Order) {
+	r.FilledQty = db.NewDecimal(order.FilledQty)
+	if order.FilledAvgPrice != nil {
+		r.FilledAvgPrice = &db.Decimal{Decimal: *order.FilledAvgPrice}
+	}
+
+	if r.Symbol == "" {
+		// records from before symbols were captured
+		r.Symbol = order.Symbol
+		r.Side = string(order.Side)
+		r.RequestedQty = db.NewDecimal(order.Qty)
+	}
+}
@@ -0,0 +1,71 @@
+package reconciliation
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// SymbolResult is how reconciling went for one symbol
+type SymbolResult struct {
+	Symbol string
+	// IDs of records closed out
+	Closed []string
+	// IDs of records whose orders are still open
+	InFlight []string
+	// what in-flight buys are still expected to spend
+	InFlightDollars decimal.Decimal
+	// orders that couldn't be checked
+	Errs []error
+}
+
+// Blocked reports whether the symbol shouldn't be traded, because it has
+// orders in flight, or orders whose state is unknown
+func (r SymbolResult) Blocked() bool {
+	return len(r.InFlight) > 0 || len(r.Errs) > 0
+}
+
+// Result is how reconciling went, by symbol.
+// Symbols without open records don't appear.
+type Result struct {
+	Symbols map[string]*SymbolResult
+}
+
+func (r Result) symbol(symbol string) *SymbolResult {
+	if _, ok := r.Symbols[symbol]; !ok {
+		r.Symbols[symbol] = &SymbolResult{Symbol: symbol}
+	}
+	return r.Symbols[symbol]
+}
+
+// Blocked returns the symbols that shouldn't be traded, sorted
+func (r Result) Blocked() []string {
+	var blocked []string
+	for symbol, result := range r.Symbols {
+		if result.Blocked() {
+			blocked = append(blocked, symbol)
+		}
+	}
+	sort.Strings(blocked)
+	return blocked
+}
+
+// InFlightDollars returns what in-flight buys are still expected to spend, by symbol
+func (r Result) InFlightDollars() map[string]decimal.Decimal {
+	inFlight := map[string]decimal.Decimal{}
+	for symbol, result := range r.Symbols {
+		if result.InFlightDollars.IsPositive() {
+			inFlight[symbol] = result.InFlightDollars
+		}
+	}
+	return inFlight
+}
+
+// Reserved is the cash spoken for by in-flight buys
+func (r Result) Reserved() decimal.Decimal {
+	reserved := decimal.Zero
+	for _, result := range r.Symbols {
+		reserved = reserved.Add(result.InFlightDollars)
+	}
+	return reserved
+}
@@ -0,0 +1,316 @@
+package reconciliation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// CurrentSchemaVersion is the shape records are written in.
+// Items stored in an older shape are upgraded by schemaMigrations as they're read,
+// and rewritten by MigrateSchema.
+const CurrentSchemaVersion = 1
+
+// schemaVersionAttribute holds the shape an item was stored in. Items without it are version 0.
+const schemaVersionAttribute = "SchemaVersion"
+
+// item is a stored record before unmarshaling, attribute name -> value.
+// Numbers are json.Number, whichever store the item came from.
+type item map[string]interface{}
+
+// schemaMigration upgrades an item from version to-1 to version to
+type schemaMigration struct {
+	to          int
+	description string
+	apply       func(item) error
+}
+
+// schemaMigrations must be in order, one per version
+var schemaMigrations = []schemaMigration{
+	{
+		to:          1,
+		description: "move legacy statuses that don't need alpaca onto the lifecycle",
+		apply:       foldLegacyStatuses,
+	},
+}
+
+// foldLegacyStatuses moves the legacy statuses that don't need alpaca onto the lifecycle.
+// Reconciled orders are left for MigrateStatuses, since only alpaca knows if they filled.
+func foldLegacyStatuses(it item) error {
+	n, ok := it["Status"].(json.Number)
+	if !ok {
+		return fmt.Errorf("status is %T, expected a number", it["Status"])
+	}
+	status, err := n.Int64()
+	if err != nil {
+		return fmt.Errorf("parsing status: %w", err)
+	}
+
+	orderID, _ := it["AlpacaOrderID"].(string)
+	switch {
+	case Status(status) == StatusUnreconciled && orderID == "":
+		it.setStatus(StatusPendingSubmit)
+	case Status(status) == StatusUnreconciled:
+		it.setStatus(StatusSubmitted)
+	case Status(status) == StatusReconciled && orderID == "":
+		it.setStatus(StatusAbandoned)
+	}
+	return nil
+}
+
+func (it item) setStatus(status Status) {
+	it["Status"] = json.Number(fmt.Sprint(int(status)))
+}
+
+// Change is an attribute changed by upgrading an item. nil means the attribute is absent.
+type Change struct {
+	Attribute string
+	From      interface{}
+	To        interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Attribute, c.From, c.To)
+}
+
+// Upgrade is how a stored record was brought up to the current schema
+type Upgrade struct {
+	ID          string
+	FromVersion int
+	Migrations  []string
+	Changes     []Change
+}
+
+// schemaVersion returns the version the item was stored in
+func (it item) schemaVersion() (int, error) {
+	v, ok := it[schemaVersionAttribute]
+	if !ok || v == nil {
+		return 0, nil
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s is %T, expected a number", schemaVersionAttribute, v)
+	}
+	version, err := n.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", schemaVersionAttribute, err)
+	}
+	return int(version), nil
+}
+
+// upgrade brings the item up to the current schema in place.
+// It returns nil if the item was already current.
+func (it item) upgrade() (*Upgrade, error) {
+	id, _ := it["ID"].(string)
+	from, err := it.schemaVersion()
+	if err != nil {
+		return nil, fmt.Errorf("record %s: %w", id, err)
+	} else if from > CurrentSchemaVersion {
+		return nil, fmt.Errorf("record %s has schema version %d, this version of camelid only understands up to %d", id, from, CurrentSchemaVersion)
+	} else if from == CurrentSchemaVersion {
+		return nil, nil
+	}
+
+	before := item{}
+	for k, v := range it {
+		before[k] = v
+	}
+
+	upgrade := &Upgrade{ID: id, FromVersion: from}
+	for _, migration := range schemaMigrations {
+		if migration.to <= from {
+			continue
+		}
+
+		err := migration.apply(it)
+		if err != nil {
+			return nil, fmt.Errorf("migrating record %s to schema version %d: %w", id, migration.to, err)
+		}
+		upgrade.Migrations = append(upgrade.Migrations, migration.description)
+	}
+	it[schemaVersionAttribute] = json.Number(fmt.Sprint(CurrentSchemaVersion))
+
+	upgrade.Changes = diffItems(before, it)
+	return upgrade, nil
+}
+
+// diffItems lists the attributes that differ, sorted by name
+func diffItems(before, after item) []Change {
+	var changes []Change
+	for k, v := range after {
+		if prev, ok := before[k]; !ok || !reflect.DeepEqual(prev, v) {
+			changes = append(changes, Change{Attribute: k, From: prev, To: v})
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, Change{Attribute: k, From: v})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Attribute < changes[j].Attribute
+	})
+	return changes
+}
+
+// EncodeRecord marshals a record to JSON, for stores to keep, see DecodeRecord
+func EncodeRecord(r Record) ([]byte, error) {
+	rec, err := asRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rec)
+}
+
+// DecodeRecord unmarshals a record from EncodeRecord's JSON,
+// upgrading it if it was encoded in an older schema
+func DecodeRecord(data []byte) (Record, error) {
+	return decodeJSONRecord(data)
+}
+
+// decodeJSONRecord unmarshals a record as stored by the file store, or in an archive,
+// upgrading it if it was stored in an older schema
+func decodeJSONRecord(data []byte) (*record, error) {
+	it := item{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&it)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrade, err := it.upgrade()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := record{}
+	if upgrade == nil {
+		err = json.Unmarshal(data, &rec)
+		return &rec, err
+	}
+
+	upgraded, err := json.Marshal(it)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(upgraded, &rec)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.upgrade = upgrade
+	return &rec, nil
+}
+
+// decodeDynamoRecord unmarshals a record as stored in dynamo,
+// upgrading it if it was stored in an older schema
+func decodeDynamoRecord(av map[string]*dynamodb.AttributeValue) (*record, error) {
+	it := item{}
+	dec := dynamodbattribute.NewDecoder(func(d *dynamodbattribute.Decoder) {
+		d.UseNumber = true
+	})
+	err := dec.Decode(&dynamodb.AttributeValue{M: av}, &it)
+	if err != nil {
+		return nil, err
+	}
+	convertNumbers(it, func(v interface{}) interface{} {
+		if n, ok := v.(dynamodbattribute.Number); ok {
+			return json.Number(n)
+		}
+		return v
+	})
+
+	upgrade, err := it.upgrade()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := record{}
+	if upgrade == nil {
+		err = dynamodbattribute.UnmarshalMap(av, &rec)
+		return &rec, err
+	}
+
+	convertNumbers(it, func(v interface{}) interface{} {
+		if n, ok := v.(json.Number); ok {
+			return dynamodbattribute.Number(n)
+		}
+		return v
+	})
+	upgraded, err := dynamodbattribute.MarshalMap(it)
+	if err != nil {
+		return nil, err
+	}
+	err = dynamodbattribute.UnmarshalMap(upgraded, &rec)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.upgrade = upgrade
+	return &rec, nil
+}
+
+// convertNumbers replaces every value in the item, nested or not, with convert(value)
+func convertNumbers(it item, convert func(interface{}) interface{}) {
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, nested := range v {
+				v[k] = walk(nested)
+			}
+			return v
+		case []interface{}:
+			for i, nested := range v {
+				v[i] = walk(nested)
+			}
+			return v
+		default:
+			return convert(v)
+		}
+	}
+
+	for k, v := range it {
+		it[k] = walk(v)
+	}
+}
+
+// MigrateSchema rewrites every record stored in an older schema in the current one.
+// With dryRun, nothing is written. Either way it returns what changed, or would have.
+func MigrateSchema(ctx context.Context, store RecordStore, dryRun bool) ([]Upgrade, error) {
+	records, err := listAllRecords(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var upgrades []Upgrade
+	for _, rec := range records {
+		rec := rec
+		upgrade := rec.upgrade
+		if upgrade == nil {
+			continue
+		}
+
+		if !dryRun {
+			err := putRecord(ctx, store, &rec)
+			if err != nil {
+				return upgrades, fmt.Errorf("rewriting record %s: %w", rec.ID, err)
+			}
+		}
+		upgrades = append(upgrades, *upgrade)
+	}
+
+	sort.Slice(upgrades, func(i, j int) bool {
+		return upgrades[i].ID < upgrades[j].ID
+	})
+	return upgrades, nil
+}
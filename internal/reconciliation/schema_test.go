@@ -0,0 +1,178 @@
+package reconciliation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/db/filedb"
+)
+
+// legacyRecord is how records were stored before schema versions
+type legacyRecord struct {
+	ID            string
+	AlpacaOrderID string
+	Status        Status
+	CreatedAt     time.Time
+}
+
+// rawStore is a record store, along with raw access to the items underneath it
+type rawStore struct {
+	store RecordStore
+	put   func(t *testing.T, id string, v interface{})
+	// schemaVersion returns the SchemaVersion attribute of the stored item, or nil
+	schemaVersion func(t *testing.T, id string) interface{}
+}
+
+func newRawStores(t *testing.T) map[string]rawStore {
+	db := newTestDB(t)
+
+	dir, err := ioutil.TempDir("", "camelid-records")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	table, err := filedb.Open(dir)
+	require.NoError(t, err)
+	fileStore, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	return map[string]rawStore{
+		"dynamo": {
+			store: NewDynamoStore(db, DefaultDynamoTable),
+			put: func(t *testing.T, id string, v interface{}) {
+				av, err := dynamodbattribute.MarshalMap(v)
+				require.NoError(t, err)
+				_, err = db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(DefaultDynamoTable), Item: av})
+				require.NoError(t, err)
+			},
+			schemaVersion: func(t *testing.T, id string) interface{} {
+				resp, err := db.GetItem(&dynamodb.GetItemInput{
+					TableName: aws.String(DefaultDynamoTable),
+					Key:       map[string]*dynamodb.AttributeValue{"ID": {S: aws.String(id)}},
+				})
+				require.NoError(t, err)
+				if av, ok := resp.Item[schemaVersionAttribute]; ok {
+					return aws.StringValue(av.N)
+				}
+				return nil
+			},
+		},
+		"file": {
+			store: fileStore,
+			put: func(t *testing.T, id string, v interface{}) {
+				require.NoError(t, table.Put(id, v))
+			},
+			schemaVersion: func(t *testing.T, id string) interface{} {
+				stored := map[string]interface{}{}
+				require.NoError(t, table.Get(id, &stored))
+				if v, ok := stored[schemaVersionAttribute]; ok {
+					return v
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	for i, migration := range schemaMigrations {
+		require.Equal(t, i+1, migration.to, "migrations must be in order, one per version")
+		require.NotEmpty(t, migration.description)
+	}
+	require.Equal(t, CurrentSchemaVersion, schemaMigrations[len(schemaMigrations)-1].to)
+}
+
+func TestMigrateSchema(t *testing.T) {
+	for name, raw := range newRawStores(t) {
+		raw := raw
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			now := time.Now().UTC().Truncate(time.Second)
+
+			for _, rec := range []legacyRecord{
+				{ID: "trade1", Status: StatusUnreconciled, CreatedAt: now},
+				{ID: "trade2", AlpacaOrderID: "alpaca12", Status: StatusUnreconciled, CreatedAt: now},
+				{ID: "trade3", Status: StatusReconciled, CreatedAt: now},
+				{ID: "trade4", AlpacaOrderID: "alpaca14", Status: StatusReconciled, CreatedAt: now},
+			} {
+				raw.put(t, rec.ID, rec)
+			}
+			require.NoError(t, putRecord(ctx, raw.store, &record{ID: "trade5", AlpacaOrderID: "alpaca15", Status: StatusFilled, CreatedAt: now}))
+
+			// upgraded lazily on read, without writing
+			got, err := getRecord(ctx, raw.store, "trade1")
+			require.NoError(t, err)
+			require.Equal(t, StatusPendingSubmit, got.Status)
+			require.Equal(t, CurrentSchemaVersion, got.SchemaVersion)
+			require.True(t, now.Equal(got.CreatedAt))
+			require.Nil(t, raw.schemaVersion(t, "trade1"))
+
+			upgrades, err := MigrateSchema(ctx, raw.store, true)
+			require.NoError(t, err)
+			require.Len(t, upgrades, 4)
+			require.Equal(t, "trade1", upgrades[0].ID)
+			require.Equal(t, 0, upgrades[0].FromVersion)
+			require.Len(t, upgrades[0].Migrations, 1)
+			var changed []string
+			for _, change := range upgrades[0].Changes {
+				changed = append(changed, change.Attribute)
+			}
+			require.Equal(t, []string{"SchemaVersion", "Status"}, changed)
+			require.Equal(t, "Status: 0 -> 2", upgrades[0].Changes[1].String())
+			require.Nil(t, raw.schemaVersion(t, "trade1"), "dry runs must not write")
+
+			upgrades, err = MigrateSchema(ctx, raw.store, false)
+			require.NoError(t, err)
+			require.Len(t, upgrades, 4)
+
+			expected := map[string]Status{
+				"trade1": StatusPendingSubmit,
+				"trade2": StatusSubmitted,
+				"trade3": StatusAbandoned,
+				// only alpaca knows, see MigrateStatuses
+				"trade4": StatusReconciled,
+				"trade5": StatusFilled,
+			}
+			for id, status := range expected {
+				require.NotNil(t, raw.schemaVersion(t, id))
+				rec, err := getRecord(ctx, raw.store, id)
+				require.NoError(t, err)
+				require.Equal(t, status, rec.Status, "record %s is %s, expected %s", id, rec.Status, status)
+				require.Nil(t, rec.upgrade)
+			}
+
+			// migrated records are open to the open index like any other
+			unreconciled, err := listUnreconciledRecords(ctx, raw.store)
+			require.NoError(t, err)
+			require.Len(t, unreconciled, 2)
+
+			upgrades, err = MigrateSchema(ctx, raw.store, false)
+			require.NoError(t, err)
+			require.Empty(t, upgrades)
+		})
+	}
+}
+
+func TestSchema_NewerVersion(t *testing.T) {
+	for name, raw := range newRawStores(t) {
+		raw := raw
+		t.Run(name, func(t *testing.T) {
+			raw.put(t, "trade1", map[string]interface{}{
+				"ID":                   "trade1",
+				"Status":               int(StatusSubmitted),
+				schemaVersionAttribute: CurrentSchemaVersion + 1,
+			})
+
+			_, err := getRecord(context.TODO(), raw.store, "trade1")
+			require.Error(t, err)
+			_, err = listAllRecords(context.TODO(), raw.store)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// DefaultDynamoTable is the dynamo table records are stored in, unless configured otherwise
+const DefaultDynamoTable = "CamelidRecordsTest"
+
+var (
+	ErrNotFound = errors.New("record not found")
+	// ErrConflict is returned when a record was written by someone else since it was read
+	ErrConflict = errors.New("record was modified concurrently")
+)
+
+// RecordStore persists trade records. NewDynamoStore and NewFileStore are the
+// backends in this package. Others can keep records however they like, e.g. as
+// EncodeRecord's JSON, so long as they hand back what DecodeRecord makes of it.
+type RecordStore interface {
+	// Put writes the record if the stored record is at the version before
+	// rec.GetVersion(), or there is no stored record and rec is at version 1.
+	// Records stored before versioning count as at version 0.
+	// Otherwise it returns ErrConflict.
+	Put(ctx context.Context, rec Record) error
+	// Restore writes the record exactly as given, version included,
+	// if there is no stored record with its ID. Otherwise it returns ErrConflict.
+	Restore(ctx context.Context, rec Record) error
+	// Get returns ErrNotFound if there is no record with the ID
+	Get(ctx context.Context, id string) (Record, error)
+	// ListUnreconciled returns records with open statuses
+	ListUnreconciled(ctx context.Context) ([]Record, error)
+	ListAll(ctx context.Context) ([]Record, error)
+	// Delete removes the record with the ID, if there is one
+	Delete(ctx context.Context, id string) error
+}
+
+// asRecord gets at the record behind a Record, which a store must have got
+// from NewRecord or DecodeRecord
+func asRecord(r Record) (*record, error) {
+	rec, ok := r.(*record)
+	if !ok {
+		return nil, fmt.Errorf("record %s is a %T, not one made by NewRecord or DecodeRecord", r.GetID(), r)
+	}
+	return rec, nil
+}
+
+// putRecord writes the record at its next version, in the current schema.
+// On success rec.Version is bumped, otherwise it returns ErrConflict.
+func putRecord(ctx context.Context, store RecordStore, rec *record) error {
+	next := *rec
+	next.Version++
+	next.SchemaVersion = CurrentSchemaVersion
+	next.upgrade = nil
+	err := store.Put(ctx, &next)
+	if err != nil {
+		return err
+	}
+
+	rec.Version = next.Version
+	rec.SchemaVersion = next.SchemaVersion
+	rec.upgrade = nil
+	return nil
+}
+
+// restoreRecord writes the record as given, but in the current schema,
+// if there is no stored record with its ID
+func restoreRecord(ctx context.Context, store RecordStore, rec *record) error {
+	restored := *rec
+	restored.SchemaVersion = CurrentSchemaVersion
+	restored.upgrade = nil
+	return store.Restore(ctx, &restored)
+}
+
+func getRecord(ctx context.Context, store RecordStore, id string) (*record, error) {
+	r, err := store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return asRecord(r)
+}
+
+func listAllRecords(ctx context.Context, store RecordStore) ([]record, error) {
+	all, err := store.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return asRecords(all)
+}
+
+func listUnreconciledRecords(ctx context.Context, store RecordStore) ([]record, error) {
+	unreconciled, err := store.ListUnreconciled(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return asRecords(unreconciled)
+}
+
+func asRecords(rs []Record) ([]record, error) {
+	records := make([]record, 0, len(rs))
+	for _, r := range rs {
+		rec, err := asRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, nil
+}
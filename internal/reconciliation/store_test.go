@@ -0,0 +1,168 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/db"
+	"github.com/jchorl/camelid/internal/db/dbtest"
+)
+
+// newTestStore returns an empty record store, on disk in dir if it's set,
+// otherwise in dynamo
+func newTestStore(t *testing.T, dir string) RecordStore {
+	if dir == "" {
+		return NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	}
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	return store
+}
+
+func TestStore(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+		now := time.Now().UTC().Truncate(time.Second)
+
+		_, err := getRecord(ctx, store, "trade1")
+		require.Equal(t, ErrNotFound, err)
+
+		recs := []record{
+			{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusUnreconciled, CreatedAt: now, SubmittedAt: &now},
+			{
+				ID: "trade2", AlpacaOrderID: "alpaca12", Status: StatusReconciled, CreatedAt: now, SubmittedAt: &now, ReconciledAt: &now,
+				Symbol: "VXUS", Side: "buy", RequestedQty: db.NewDecimal(decimal.NewFromInt(4)), RequestedDollars: db.NewDecimal(decimal.NewFromInt(250)),
+				EstimatedPrice: db.NewDecimal(decimal.RequireFromString("57.31")), FilledQty: db.NewDecimal(decimal.NewFromInt(4)), FilledAvgPrice: &db.Decimal{Decimal: decimal.RequireFromString("57.295")},
+			},
+			{ID: "trade3", Status: StatusUnreconciled, CreatedAt: now},
+		}
+		for _, rec := range recs {
+			rec := rec
+			require.NoError(t, putRecord(ctx, store, &rec))
+		}
+
+		got, err := getRecord(ctx, store, "trade2")
+		require.NoError(t, err)
+		require.Equal(t, "alpaca12", got.AlpacaOrderID)
+		require.Equal(t, StatusReconciled, got.Status)
+		require.True(t, now.Equal(*got.ReconciledAt))
+		require.Equal(t, "VXUS", got.Symbol)
+		require.Equal(t, "buy", got.Side)
+		require.True(t, decimal.NewFromInt(4).Equal(got.GetRequestedQty()))
+		require.True(t, decimal.NewFromInt(250).Equal(got.GetRequestedDollars()))
+		require.True(t, decimal.RequireFromString("57.31").Equal(got.GetEstimatedPrice()))
+		require.True(t, decimal.NewFromInt(4).Equal(got.GetFilledQty()))
+		require.True(t, decimal.RequireFromString("57.295").Equal(*got.GetFilledAvgPrice()))
+
+		unreconciled, err := listUnreconciledRecords(ctx, store)
+		require.NoError(t, err)
+		var ids []string
+		for _, rec := range unreconciled {
+			ids = append(ids, rec.ID)
+		}
+		require.ElementsMatch(t, []string{"trade1", "trade3"}, ids)
+
+		// overwrite, moving records in and out of the open set
+		got.Status = StatusSubmitted
+		require.NoError(t, putRecord(ctx, store, got))
+		closed, err := getRecord(ctx, store, "trade1")
+		require.NoError(t, err)
+		closed.Status = StatusCancelled
+		require.NoError(t, putRecord(ctx, store, closed))
+
+		unreconciled, err = listUnreconciledRecords(ctx, store)
+		require.NoError(t, err)
+		ids = nil
+		for _, rec := range unreconciled {
+			ids = append(ids, rec.ID)
+		}
+		require.ElementsMatch(t, []string{"trade2", "trade3"}, ids)
+
+		all, err := listAllRecords(ctx, store)
+		require.NoError(t, err)
+		require.Len(t, all, 3)
+
+		// deleting is idempotent
+		require.NoError(t, store.Delete(ctx, "trade3"))
+		require.NoError(t, store.Delete(ctx, "trade3"))
+		_, err = getRecord(ctx, store, "trade3")
+		require.Equal(t, ErrNotFound, err)
+		all, err = listAllRecords(ctx, store)
+		require.NoError(t, err)
+		require.Len(t, all, 2)
+	})
+}
+
+func TestStore_Conflict(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+
+		rec := &record{ID: "trade1", Status: StatusPendingSubmit, CreatedAt: time.Now()}
+		require.NoError(t, putRecord(ctx, store, rec))
+		require.Equal(t, 1, rec.Version)
+
+		// another writer read version 1 too
+		stale, err := getRecord(ctx, store, "trade1")
+		require.NoError(t, err)
+		require.Equal(t, 1, stale.Version)
+
+		rec.Status = StatusSubmitted
+		require.NoError(t, putRecord(ctx, store, rec))
+		require.Equal(t, 2, rec.Version)
+
+		stale.Status = StatusAbandoned
+		err = putRecord(ctx, store, stale)
+		require.True(t, errors.Is(err, ErrConflict), "expected ErrConflict, got %v", err)
+		require.Equal(t, 1, stale.Version)
+
+		// creating a record that already exists conflicts too
+		err = putRecord(ctx, store, &record{ID: "trade1", Status: StatusPendingSubmit})
+		require.True(t, errors.Is(err, ErrConflict), "expected ErrConflict, got %v", err)
+
+		got, err := getRecord(ctx, store, "trade1")
+		require.NoError(t, err)
+		require.Equal(t, StatusSubmitted, got.Status)
+		require.Equal(t, 2, got.Version)
+	})
+}
+
+// foreignRecord is a Record this package didn't make
+type foreignRecord struct {
+	Record
+}
+
+func TestStore_Exported(t *testing.T) {
+	dbtest.ForEachBackend(t, func(t *testing.T, dir string) {
+		store := newTestStore(t, dir)
+		ctx := context.TODO()
+
+		rec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromInt(300))
+		data, err := EncodeRecord(rec)
+		require.NoError(t, err)
+		decoded, err := DecodeRecord(data)
+		require.NoError(t, err)
+		require.Equal(t, rec.GetID(), decoded.GetID())
+
+		// Put writes at the record's version, which callers bump
+		err = store.Put(ctx, rec)
+		require.True(t, errors.Is(err, ErrConflict), "expected ErrConflict at version 0, got %v", err)
+		rec.(*record).Version = 1
+		require.NoError(t, store.Put(ctx, rec))
+		got, err := store.Get(ctx, rec.GetID())
+		require.NoError(t, err)
+		require.Equal(t, 1, got.GetVersion())
+		require.True(t, errors.Is(store.Restore(ctx, rec), ErrConflict))
+
+		require.Error(t, store.Put(ctx, foreignRecord{rec}))
+		_, err = EncodeRecord(foreignRecord{rec})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,198 @@
+package reconciliation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/jchorl/camelid/internal/exchange"
+)
+
+// Snapshot declares the positions held at a point in time.
+// Verify rebuilds positions from it, so fills from before it don't need records.
+type Snapshot struct {
+	AsOf      time.Time                  `json:"asOf"`
+	Positions map[string]decimal.Decimal `json:"positions"` // symbol -> shares
+}
+
+// ParseSnapshot reads a snapshot like {"asOf": "2020-08-03T00:00:00Z", "positions": {"VOO": "12"}}
+func ParseSnapshot(data []byte) (Snapshot, error) {
+	snapshot := Snapshot{}
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("parsing snapshot: %w", err)
+	} else if snapshot.AsOf.IsZero() {
+		return Snapshot{}, fmt.Errorf("snapshot has no asOf time")
+	}
+
+	return snapshot, nil
+}
+
+// SymbolCheck compares three views of how many shares of a symbol are held
+type SymbolCheck struct {
+	Symbol string
+
+	Starting decimal.Decimal // per the snapshot
+	Recorded decimal.Decimal // net shares filled since the snapshot, per trade records
+	Ordered  decimal.Decimal // net shares filled since the snapshot, per broker orders
+	Held     decimal.Decimal // per broker positions
+
+	// orders are still open, so fills may land any moment
+	Pending bool
+	// per share, to value discrepancies
+	Price decimal.Decimal
+	// what looks wrong, in words
+	Problems []string
+}
+
+// Mismatch is the larger of the shares records are missing relative to
+// broker orders, and the shares held that broker orders don't account for,
+// the same two discrepancies as Problems describes
+func (c SymbolCheck) Mismatch() decimal.Decimal {
+	return decimal.Max(
+		c.Held.Sub(c.Starting.Add(c.Ordered)).Abs(),
+		c.Ordered.Sub(c.Recorded).Abs(),
+	)
+}
+
+// MismatchValue is the mismatch in dollars
+func (c SymbolCheck) MismatchValue() decimal.Decimal {
+	return c.Mismatch().Mul(c.Price)
+}
+
+type VerifyReport struct {
+	Snapshot Snapshot
+	Symbols  []SymbolCheck // sorted by symbol
+}
+
+// Mismatched returns the symbols whose mismatch is worth more than maxValue dollars
+func (r VerifyReport) Mismatched(maxValue decimal.Decimal) []SymbolCheck {
+	var mismatched []SymbolCheck
+	for _, check := range r.Symbols {
+		if check.MismatchValue().GreaterThan(maxValue) {
+			mismatched = append(mismatched, check)
+		}
+	}
+	return mismatched
+}
+
+// MismatchError is returned when positions disagree by more than was tolerated
+type MismatchError struct {
+	Max    decimal.Decimal
+	Checks []SymbolCheck
+}
+
+func (e *MismatchError) Error() string {
+	var descs []string
+	for _, check := range e.Checks {
+		descs = append(descs, fmt.Sprintf("%s off by %s shares ($%s): %s", check.Symbol, check.Mismatch(), check.MismatchValue().StringFixed(2), strings.Join(check.Problems, ", ")))
+	}
+	return fmt.Sprintf("positions mismatch by more than $%s: %s", e.Max.StringFixed(2), strings.Join(descs, "; "))
+}
+
+// Verify rebuilds positions from the snapshot plus filled trade records, and
+// compares them to broker orders and positions, symbol by symbol. It catches
+// missing fills, orders placed outside camelid, and splits or transfers.
+// Orders and positions are summed across the accounts exchangeClients trade in,
+// so the snapshot is of them all. If any of their brokers can't list orders
+// back to the snapshot, it returns an error wrapping exchange.ErrNoOrderHistory.
+func Verify(ctx context.Context, store RecordStore, exchangeClients []exchange.Client, snapshot Snapshot) (VerifyReport, error) {
+	checks := map[string]*SymbolCheck{}
+	check := func(symbol string) *SymbolCheck {
+		if _, ok := checks[symbol]; !ok {
+			checks[symbol] = &SymbolCheck{Symbol: symbol}
+		}
+		return checks[symbol]
+	}
+
+	for symbol, qty := range snapshot.Positions {
+		check(symbol).Starting = qty
+	}
+
+	records, err := listAllRecords(ctx, store)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	for _, rec := range records {
+		placedAt := rec.CreatedAt
+		if rec.SubmittedAt != nil {
+			placedAt = *rec.SubmittedAt
+		}
+		if rec.Symbol == "" || placedAt.Before(snapshot.AsOf) {
+			continue
+		}
+
+		c := check(rec.Symbol)
+		if rec.Status.IsOpen() {
+			c.Pending = true
+			continue
+		}
+
+		c.Recorded = c.Recorded.Add(signed(rec.Side, rec.FilledQty.Decimal))
+		if rec.FilledAvgPrice != nil && c.Price.IsZero() {
+			c.Price = rec.FilledAvgPrice.Decimal
+		}
+	}
+
+	for _, exchangeClient := range exchangeClients {
+		orders, err := listOrdersSince(ctx, exchangeClient, snapshot.AsOf)
+		if err != nil {
+			return VerifyReport{}, fmt.Errorf("totaling orders since the snapshot: %w", err)
+		}
+		for _, order := range orders {
+			c := check(order.Symbol)
+			if !isTerminalState(order.Status) {
+				c.Pending = true
+			}
+
+			c.Ordered = c.Ordered.Add(signed(string(order.Side), order.FilledQty))
+			if order.FilledAvgPrice != nil && c.Price.IsZero() {
+				c.Price = *order.FilledAvgPrice
+			}
+		}
+
+		positions, err := exchangeClient.ListPositions(ctx)
+		if err != nil {
+			return VerifyReport{}, fmt.Errorf("listing positions: %w", err)
+		}
+		for _, position := range positions {
+			c := check(position.Symbol)
+			c.Held = c.Held.Add(position.Qty)
+			// the current price beats a fill price
+			c.Price = position.CurrentPrice
+		}
+	}
+
+	report := VerifyReport{Snapshot: snapshot}
+	for _, c := range checks {
+		if !c.Recorded.Equal(c.Ordered) {
+			c.Problems = append(c.Problems, fmt.Sprintf("records show %s shares filled but broker orders show %s, a missing fill or an order placed outside camelid", c.Recorded, c.Ordered))
+		}
+		if expected := c.Starting.Add(c.Ordered); !expected.Equal(c.Held) {
+			c.Problems = append(c.Problems, fmt.Sprintf("the snapshot and broker orders add up to %s shares but %s are held, a split, transfer or trade before the snapshot", expected, c.Held))
+		}
+		if c.Pending && len(c.Problems) > 0 {
+			c.Problems = append(c.Problems, "orders are still open, so fills may still land")
+		}
+		report.Symbols = append(report.Symbols, *c)
+	}
+
+	sort.Slice(report.Symbols, func(i, j int) bool {
+		return report.Symbols[i].Symbol < report.Symbols[j].Symbol
+	})
+
+	return report, nil
+}
+
+// signed makes sold shares negative
+func signed(side string, qty decimal.Decimal) decimal.Decimal {
+	if side == string(exchange.Sell) {
+		return qty.Neg()
+	}
+	return qty
+}
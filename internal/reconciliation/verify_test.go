@@ -0,0 +1,149 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/db"
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+
+	snapshot, err := ParseSnapshot([]byte(`{"asOf": "` + now.AddDate(0, 0, -7).Format(time.RFC3339) + `", "positions": {"VOO": "10", "BND": "5"}}`))
+	require.NoError(t, err)
+
+	// VOO: bought 3 through camelid, all consistent
+	voo := exchangetest.NewFilledOrder("alpaca-voo")
+	voo.ClientOrderID = "trade-voo"
+	alpacaClient.AddOrder(voo)
+	fillPrice := db.NewDecimal(*voo.FilledAvgPrice)
+	require.NoError(t, putRecord(ctx, store, &record{
+		ID: "trade-voo", AlpacaOrderID: "alpaca-voo", Status: StatusFilled, Symbol: "VOO", Side: "buy",
+		FilledQty: db.NewDecimal(voo.FilledQty), FilledAvgPrice: &fillPrice, CreatedAt: now, SubmittedAt: &now,
+	}))
+
+	// VXUS: bought by hand, no record
+	vxus := exchangetest.NewFilledOrder("alpaca-vxus")
+	vxus.Symbol = "VXUS"
+	alpacaClient.AddOrder(vxus)
+
+	// from before the snapshot, doesn't count
+	old := now.AddDate(0, 0, -30)
+	require.NoError(t, putRecord(ctx, store, &record{
+		ID: "trade-old", AlpacaOrderID: "alpaca-old", Status: StatusFilled, Symbol: "VOO", Side: "buy",
+		FilledQty: db.NewDecimal(decimal.NewFromInt(100)), CreatedAt: old, SubmittedAt: &old,
+	}))
+
+	alpacaClient.SetPositions([]exchange.Position{
+		{Symbol: "VOO", Qty: decimal.NewFromInt(13), CurrentPrice: decimal.NewFromInt(300)},
+		{Symbol: "VXUS", Qty: decimal.NewFromInt(3), CurrentPrice: decimal.NewFromInt(50)},
+		// BND split 2 for 1
+		{Symbol: "BND", Qty: decimal.NewFromInt(10), CurrentPrice: decimal.NewFromInt(40)},
+	})
+
+	report, err := Verify(ctx, store, []exchange.Client{alpacaClient}, snapshot)
+	require.NoError(t, err)
+	require.Len(t, report.Symbols, 3)
+
+	bnd, vooCheck, vxusCheck := report.Symbols[0], report.Symbols[1], report.Symbols[2]
+	require.Equal(t, "BND", bnd.Symbol)
+	require.True(t, decimal.NewFromInt(5).Equal(bnd.Mismatch()))
+	require.True(t, decimal.NewFromInt(200).Equal(bnd.MismatchValue()))
+	require.Len(t, bnd.Problems, 1)
+	require.Contains(t, bnd.Problems[0], "split")
+
+	require.Equal(t, "VOO", vooCheck.Symbol)
+	require.True(t, decimal.NewFromInt(3).Equal(vooCheck.Recorded))
+	require.True(t, decimal.NewFromInt(3).Equal(vooCheck.Ordered))
+	require.True(t, vooCheck.Mismatch().IsZero())
+	require.Empty(t, vooCheck.Problems)
+
+	require.Equal(t, "VXUS", vxusCheck.Symbol)
+	require.True(t, vxusCheck.Recorded.IsZero())
+	require.True(t, decimal.NewFromInt(3).Equal(vxusCheck.Ordered))
+	require.True(t, decimal.NewFromInt(3).Equal(vxusCheck.Mismatch()))
+	require.Len(t, vxusCheck.Problems, 1)
+	require.Contains(t, vxusCheck.Problems[0], "outside camelid")
+
+	mismatched := report.Mismatched(decimal.NewFromInt(160))
+	require.Len(t, mismatched, 1)
+	require.Equal(t, "BND", mismatched[0].Symbol)
+	require.Len(t, report.Mismatched(decimal.NewFromInt(100)), 2)
+}
+
+func TestVerify_Pending(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+
+	order := exchangetest.NewUnfilledOrder("alpaca11")
+	order.ClientOrderID = "trade1"
+	alpacaClient.AddOrder(order)
+	require.NoError(t, putRecord(ctx, store, &record{ID: "trade1", AlpacaOrderID: "alpaca11", Status: StatusSubmitted, Symbol: "VOO", Side: "buy", CreatedAt: now}))
+
+	report, err := Verify(ctx, store, []exchange.Client{alpacaClient}, Snapshot{AsOf: now.Add(-time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, report.Symbols, 1)
+	require.True(t, report.Symbols[0].Pending)
+	require.Empty(t, report.Symbols[0].Problems)
+}
+
+func TestParseSnapshot(t *testing.T) {
+	_, err := ParseSnapshot([]byte(`{"positions": {"VOO": "1"}}`))
+	require.Error(t, err)
+
+	_, err = ParseSnapshot([]byte(`not json`))
+	require.Error(t, err)
+}
+
+func TestMismatchError(t *testing.T) {
+	err := error(&MismatchError{
+		Max: decimal.NewFromInt(100),
+		Checks: []SymbolCheck{{
+			Symbol: "BND", Starting: decimal.NewFromInt(5), Held: decimal.NewFromInt(10), Price: decimal.NewFromInt(40),
+			Problems: []string{"a split"},
+		}},
+	})
+	var mismatchErr *MismatchError
+	require.True(t, errors.As(err, &mismatchErr))
+	require.Equal(t, "positions mismatch by more than $100.00: BND off by 5 shares ($200.00): a split", err.Error())
+}
+
+func TestSymbolCheck_Mismatch(t *testing.T) {
+	cases := []struct {
+		name                              string
+		starting, recorded, ordered, held int64
+		expected                          int64
+	}{
+		{name: "consistent", starting: 10, recorded: 3, ordered: 3, held: 13, expected: 0},
+		{name: "missing record", starting: 0, recorded: 0, ordered: 3, held: 3, expected: 3},
+		{name: "transfer in", starting: 5, recorded: 2, ordered: 2, held: 10, expected: 3},
+		// orders account for 3 of the 5 held, records for none
+		{name: "both", starting: 0, recorded: 0, ordered: 3, held: 5, expected: 3},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			check := SymbolCheck{
+				Starting: decimal.NewFromInt(tc.starting),
+				Recorded: decimal.NewFromInt(tc.recorded),
+				Ordered:  decimal.NewFromInt(tc.ordered),
+				Held:     decimal.NewFromInt(tc.held),
+			}
+			require.True(t, decimal.NewFromInt(tc.expected).Equal(check.Mismatch()), "expected a mismatch of %d, got %s", tc.expected, check.Mismatch())
+		})
+	}
+}
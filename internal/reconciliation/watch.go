@@ -0,0 +1,205 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jchorl/camelid/internal/exchange"
+)
+
+// submitRetryDelay is how long an update waits for the run placing its order to mark the record submitted
+var submitRetryDelay = 5 * time.Second
+
+// submitGracePeriod is how long the run placing an order has to mark its record
+// submitted, longer than lambda lets a run last. After that, the run is taken to
+// have lost track of it, and the order is adopted like Reconcile would.
+var submitGracePeriod = 15 * time.Minute
+
+// errNotSubmitted defers an update until its record is marked submitted
+var errNotSubmitted = errors.New("record not yet marked submitted")
+
+type watcher struct {
+	client
+	waiting map[string]*exchange.TradeUpdate // record ID -> latest update deferred for it
+}
+
+// Watch keeps records up to date with their orders until ctx is done, closing
+// them as fills, cancels and rejections stream in. Each time it subscribes, it
+// polls open records to catch up on anything it missed, and while the stream
+// is down it polls every pollInterval instead.
+//
+// Records a run hasn't marked submitted yet are left to that run, which would
+// otherwise fail to mark them, so updates for them wait until it has, or
+// until submitGracePeriod is up.
+// Only records of the default account are watched.
+func Watch(ctx context.Context, store RecordStore, exchangeClient exchange.Client, stream exchange.TradeStream, pollInterval time.Duration) {
+	w := &watcher{
+		client:  client{store: store, exchangeClient: exchangeClient},
+		waiting: map[string]*exchange.TradeUpdate{},
+	}
+
+	for {
+		err := w.follow(ctx, stream)
+		if ctx.Err() != nil {
+			return
+		}
+
+		glog.Warningf("trade update stream is down, polling every %s until it's back: %v", pollInterval, err)
+		w.poll(ctx)
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies updates from a new subscription until it drops
+func (w *watcher) follow(ctx context.Context, stream exchange.TradeStream) error {
+	sub, err := stream.SubscribeTradeUpdates(ctx)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	glog.Info("streaming trade updates")
+
+	updates := make(chan *exchange.TradeUpdate)
+	errs := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			update, err := sub.Next()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case updates <- update:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// anything that happened before subscribing only shows up by polling
+	w.poll(ctx)
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case update := <-updates:
+			w.apply(ctx, update)
+		case <-retry:
+			retry = nil
+			waiting := w.waiting
+			w.waiting = map[string]*exchange.TradeUpdate{}
+			for _, update := range waiting {
+				w.apply(ctx, update)
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if len(w.waiting) > 0 && retry == nil {
+			retry = time.After(submitRetryDelay)
+		}
+	}
+}
+
+// apply closes the record of an order that's done
+func (w *watcher) apply(ctx context.Context, update *exchange.TradeUpdate) {
+	id := recordIDForOrder(&update.Order)
+	delete(w.waiting, id)
+
+	err := w.close(ctx, id, &update.Order)
+	if errors.Is(err, errNotSubmitted) {
+		w.waiting[id] = update
+	} else if errors.Is(err, ErrNotFound) {
+		glog.Warningf("%s update for order %s, which has no record, the next run will find it as an orphan", update.Event, update.Order.ID)
+	} else if err != nil {
+		glog.Errorf("applying %s update for order %s: %v", update.Event, update.Order.ID, err)
+	}
+}
+
+// poll closes records of orders that are done, like Reconcile
+func (w *watcher) poll(ctx context.Context) {
+	unreconciled, err := listUnreconciledRecords(ctx, w.store)
+	if err != nil {
+		glog.Errorf("polling open records: %v", err)
+		return
+	}
+
+	var submitted, lost []record
+	for _, rec := range unreconciled {
+		if rec.Account != w.account {
+			continue
+		} else if rec.AlpacaOrderID != "" {
+			submitted = append(submitted, rec)
+		} else if time.Since(rec.CreatedAt) > submitGracePeriod {
+			lost = append(lost, rec)
+		}
+	}
+
+	// orders of records their runs lost track of
+	orders, err := w.findUnsubmitted(ctx, lost)
+	if err != nil {
+		glog.Errorf("polling records never marked submitted: %v", err)
+	}
+	for id, order := range orders {
+		err := w.close(ctx, id, order)
+		if err != nil {
+			glog.Errorf("polling record %s: %v", id, err)
+		}
+	}
+
+	for _, rec := range submitted {
+		order, err := w.exchangeClient.GetOrder(ctx, rec.AlpacaOrderID)
+		if err != nil {
+			glog.Errorf("polling record %s: getting order %s: %v", rec.ID, rec.AlpacaOrderID, err)
+			continue
+		}
+
+		err = w.close(ctx, rec.ID, order)
+		if err != nil && !errors.Is(err, errNotSubmitted) {
+			glog.Errorf("polling record %s: %v", rec.ID, err)
+		}
+	}
+}
+
+// close closes the record if its order is done
+func (w *watcher) close(ctx context.Context, id string, order *exchange.Order) error {
+	if !isTerminalState(order.Status) {
+		return nil
+	}
+
+	rec, err := getRecord(ctx, w.store, id)
+	if err != nil {
+		return err
+	} else if !rec.Status.IsOpen() || rec.Account != w.account {
+		return nil
+	} else if rec.AlpacaOrderID == "" {
+		if time.Since(rec.CreatedAt) < submitGracePeriod {
+			return errNotSubmitted
+		}
+
+		glog.Warningf("record %s was never marked submitted, but its order %s is at the broker, adopting it", id, order.ID)
+		err := w.adopt(ctx, id, order)
+		if err != nil {
+			return err
+		}
+	}
+
+	status := statusFromOrder(order)
+	err = w.setStatus(ctx, id, status, order)
+	if err != nil {
+		return err
+	}
+	glog.Infof("closed record %s as %s", id, status)
+	return nil
+}
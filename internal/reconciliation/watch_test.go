@@ -0,0 +1,143 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+)
+
+// fakeStream hands out subscriptions fed by the test
+type fakeStream struct {
+	subs chan *fakeSubscription
+	down chan bool
+}
+
+type fakeSubscription struct {
+	updates chan *exchange.TradeUpdate
+	dropped chan struct{}
+}
+
+func (s *fakeStream) SubscribeTradeUpdates(ctx context.Context) (exchange.TradeSubscription, error) {
+	select {
+	case down := <-s.down:
+		if down {
+			return nil, errors.New("stream unavailable")
+		}
+	default:
+	}
+
+	sub := &fakeSubscription{updates: make(chan *exchange.TradeUpdate), dropped: make(chan struct{})}
+	s.subs <- sub
+	return sub, nil
+}
+
+func (s *fakeSubscription) Next() (*exchange.TradeUpdate, error) {
+	select {
+	case update := <-s.updates:
+		return update, nil
+	case <-s.dropped:
+		return nil, errors.New("connection dropped")
+	}
+}
+
+func (s *fakeSubscription) Close() error {
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	defer func(delay time.Duration) { submitRetryDelay = delay }(submitRetryDelay)
+	submitRetryDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewDynamoStore(newTestDB(t), DefaultDynamoTable)
+	alpacaClient := exchangetest.NewMockClient("6")
+
+	newSubmitted := func(id, alpacaID string) {
+		order := exchangetest.NewUnfilledOrder(alpacaID)
+		order.ClientOrderID = id
+		alpacaClient.AddOrder(order)
+		rec := NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(3), decimal.NewFromInt(900), decimal.NewFromInt(300)).(*record)
+		rec.ID = id
+		rec.SetAccepted(alpacaID)
+		require.NoError(t, putRecord(ctx, store, rec))
+	}
+	status := func(id string) Status {
+		rec, err := getRecord(ctx, store, id)
+		require.NoError(t, err)
+		return rec.Status
+	}
+	update := func(event, id, alpacaID string, status exchange.OrderStatus) *exchange.TradeUpdate {
+		order := exchangetest.NewUnfilledOrder(alpacaID)
+		order.ClientOrderID = id
+		order.Status = status
+		return &exchange.TradeUpdate{Event: event, Order: *order}
+	}
+
+	// filled before the watch started
+	newSubmitted("trade1", "alpaca1")
+	alpacaClient.SetOrderStatus("alpaca1", exchange.OrderFilled)
+	newSubmitted("trade2", "alpaca2")
+	// still being placed by a run
+	placing := NewRecord("test-run", "BND", "buy", decimal.NewFromInt(3), decimal.NewFromInt(240), decimal.NewFromInt(80)).(*record)
+	placing.ID = "trade3"
+	require.NoError(t, putRecord(ctx, store, placing))
+
+	stream := &fakeStream{subs: make(chan *fakeSubscription), down: make(chan bool, 1)}
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, store, alpacaClient, stream, 10*time.Millisecond)
+		close(done)
+	}()
+
+	sub := <-stream.subs
+	sub.updates <- update("canceled", "trade2", "alpaca2", exchange.OrderCanceled)
+	sub.updates <- update("fill", "trade3", "alpaca3", exchange.OrderFilled)
+	sub.updates <- update("fill", "manual", "alpaca4", exchange.OrderFilled) // no record, left for the orphan check
+	require.Eventually(t, func() bool { return status("trade2") == StatusCancelled }, time.Second, time.Millisecond)
+	require.Equal(t, StatusFilled, status("trade1"))
+	require.Equal(t, StatusPendingSubmit, status("trade3"))
+
+	// the run gets to marking it submitted, and the fill is applied
+	placing.SetAccepted("alpaca3")
+	require.NoError(t, putRecord(ctx, store, placing))
+	require.Eventually(t, func() bool { return status("trade3") == StatusFilled }, time.Second, time.Millisecond)
+
+	// a run that never marked its record submitted has long since ended, so its order is adopted
+	lost := NewRecord("test-run", "BND", "buy", decimal.NewFromInt(3), decimal.NewFromInt(240), decimal.NewFromInt(80)).(*record)
+	lost.ID = "trade4"
+	lost.CreatedAt = time.Now().Add(-submitGracePeriod - time.Minute)
+	require.NoError(t, putRecord(ctx, store, lost))
+	sub.updates <- update("fill", "trade4", "alpaca4b", exchange.OrderFilled)
+	require.Eventually(t, func() bool { return status("trade4") == StatusFilled }, time.Second, time.Millisecond)
+	adopted, err := getRecord(ctx, store, "trade4")
+	require.NoError(t, err)
+	require.Equal(t, "alpaca4b", adopted.AlpacaOrderID)
+
+	// while the stream is down, open records are polled
+	newSubmitted("trade5", "alpaca5")
+	stream.down <- true
+	close(sub.dropped)
+	alpacaClient.SetOrderStatus("alpaca5", exchange.OrderExpired)
+	require.Eventually(t, func() bool { return status("trade5") == StatusExpired }, time.Second, time.Millisecond)
+
+	// and it resubscribes once it's back
+	sub = <-stream.subs
+	newSubmitted("trade6", "alpaca6")
+	sub.updates <- update("rejected", "trade6", "alpaca6", exchange.OrderRejected)
+	require.Eventually(t, func() bool { return status("trade6") == StatusRejected }, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch didn't return once cancelled")
+	}
+}
@@ -4,84 +4,74 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/golang/glog"
 	"github.com/shopspring/decimal"
 
 	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/prices"
 	"github.com/jchorl/camelid/internal/reconciliation"
 )
 
 type Client struct {
 	exchangeClient exchange.Client
+	prices         *prices.Snapshot // what orders are sized at, the same as they're planned with
 	reconciler     reconciliation.Client
+	runID          string // the ledger run orders are placed for
 }
 
-func New(exchangeClient exchange.Client, reconciler reconciliation.Client) *Client {
-	return &Client{exchangeClient, reconciler}
+func New(exchangeClient exchange.Client, snapshot *prices.Snapshot, reconciler reconciliation.Client, runID string) *Client {
+	return &Client{exchangeClient, snapshot, reconciler, runID}
 }
 
-func (c *Client) Buy(ctx context.Context, ticker string, dollarAmount decimal.Decimal) error {
-	return c.trade(ctx, ticker, dollarAmount, alpaca.Buy)
+// Buy places an order for as many whole shares of ticker as dollarAmount buys.
+// It returns the record of the placed order, or nil if no order was placed.
+func (c *Client) Buy(ctx context.Context, ticker string, dollarAmount decimal.Decimal) (reconciliation.Record, error) {
+	return c.trade(ctx, ticker, dollarAmount, exchange.Buy)
 }
 
-func (c *Client) trade(ctx context.Context, ticker string, dollarAmount decimal.Decimal, side alpaca.Side) error {
-	account, err := c.exchangeClient.GetAccount()
+func (c *Client) trade(ctx context.Context, ticker string, dollarAmount decimal.Decimal, side exchange.Side) (reconciliation.Record, error) {
+	price, err := c.prices.Price(ctx, ticker, side)
 	if err != nil {
-		return fmt.Errorf("getting account: %w", err)
-	}
-
-	lastQuote, err := c.exchangeClient.GetLastQuote(ticker)
-	if err != nil {
-		return fmt.Errorf("GetLastQuote(%s): %w", ticker, err)
-	}
-
-	// depending on buy/sell, select for bid/ask
-	var price decimal.Decimal
-	if side == alpaca.Buy {
-		price = decimal.NewFromFloat32(lastQuote.Last.BidPrice)
-	} else {
-		price = decimal.NewFromFloat32(lastQuote.Last.AskPrice)
+		return nil, err
 	}
 
 	qty := dollarAmount.Div(price).Floor()
 
 	if qty.LessThan(decimal.NewFromInt(1)) {
 		glog.Infof("not buying %s at $%s, $%s is too little to buy even 1 share", ticker, price.StringFixed(2), dollarAmount.StringFixed(2))
-		return nil
+		return nil, nil
 	}
 
-	record := reconciliation.NewRecord()
+	record := reconciliation.NewRecord(c.runID, ticker, string(side), qty, dollarAmount, price)
 
 	err = c.reconciler.Record(ctx, record)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	request := alpaca.PlaceOrderRequest{
-		AccountID:     account.ID,
-		AssetKey:      &ticker,
+	request := exchange.OrderRequest{
+		Symbol:        ticker,
 		Qty:           qty,
 		Side:          side,
-		Type:          alpaca.Market,
-		TimeInForce:   alpaca.Day,
+		Type:          exchange.Market,
+		TimeInForce:   exchange.Day,
 		ClientOrderID: record.GetID(),
 	}
 
 	glog.Infof("placing order %+v, estimated price: %v", request, price)
 
-	order, err := c.exchangeClient.PlaceOrder(request)
+	order, err := c.exchangeClient.PlaceOrder(ctx, request)
 	if err != nil {
-		return fmt.Errorf("placing order %v: %w", request, err)
+		return nil, fmt.Errorf("placing order %v: %w", request, err)
 	}
 
 	record.SetAccepted(order.ID)
 	err = c.reconciler.Record(ctx, record)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	glog.Infof("order completed: %+v", order)
 
-	return nil
+	return record, nil
 }
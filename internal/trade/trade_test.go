@@ -4,77 +4,75 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
-	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 
+	"github.com/jchorl/camelid/internal/exchange"
 	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+	"github.com/jchorl/camelid/internal/prices"
 	"github.com/jchorl/camelid/internal/reconciliation"
 )
 
 func TestTrade(t *testing.T) {
 	alpacaClient := exchangetest.NewMockClient("6")
 	ticker := "SPY"
-	alpacaClient.SetQuote(ticker, &alpaca.LastQuoteResponse{
-		Status: "success",
-		Symbol: "SPY",
-		Last: alpaca.LastQuote{
-			AskPrice:    326.41,
-			AskSize:     5,
-			AskExchange: 2,
-			BidPrice:    326.35,
-			BidSize:     1,
-			BidExchange: 17,
-			Timestamp:   1596226084553000000,
-		},
+	alpacaClient.SetQuote(ticker, &exchange.Quote{
+		Symbol:    "SPY",
+		AskPrice:  decimal.NewFromFloat(326.41),
+		BidPrice:  decimal.NewFromFloat(326.35),
+		Timestamp: time.Unix(0, 1596226084553000000),
 	})
 
 	reconciler := &mockReconciler{}
 
-	c := New(alpacaClient, reconciler)
-	err := c.trade(context.TODO(), ticker, decimal.NewFromInt(3000), alpaca.Buy)
+	c := New(alpacaClient, prices.New(alpacaClient), reconciler, "test-run")
+	placed, err := c.trade(context.TODO(), ticker, decimal.NewFromInt(3000), exchange.Buy)
 	require.NoError(t, err)
 
 	require.Len(t, alpacaClient.GetOrderReqs(), 1)
 	receivedReq := alpacaClient.GetOrderReqs()[0]
-	require.Equal(t, "6", receivedReq.AccountID)
-	require.Equal(t, &ticker, receivedReq.AssetKey)
+	require.Equal(t, ticker, receivedReq.Symbol)
 	require.Equal(t, decimal.NewFromInt(9), receivedReq.Qty)
-	require.Equal(t, alpaca.Buy, receivedReq.Side)
-	require.Equal(t, alpaca.Market, receivedReq.Type)
-	require.Equal(t, alpaca.Day, receivedReq.TimeInForce)
+	require.Equal(t, exchange.Buy, receivedReq.Side)
+	require.Equal(t, exchange.Market, receivedReq.Type)
+	require.Equal(t, exchange.Day, receivedReq.TimeInForce)
 
 	require.Len(t, reconciler.records, 2)
 	require.Equal(t, receivedReq.ClientOrderID, reconciler.records[0].GetID())
-	require.Equal(t, reconciliation.StatusUnreconciled, reconciler.records[0].GetStatus())
+	require.Equal(t, reconciliation.StatusPendingSubmit, reconciler.statuses[0])
 	require.Equal(t, receivedReq.ClientOrderID, reconciler.records[1].GetID())
-	require.Equal(t, reconciliation.StatusUnreconciled, reconciler.records[1].GetStatus())
+	require.Equal(t, reconciliation.StatusSubmitted, reconciler.statuses[1])
 	require.Len(t, alpacaClient.GetOrders(), 1)
 	require.Equal(t, alpacaClient.GetOrders()[0].ID, reconciler.records[1].GetAlpacaOrderID())
+
+	rec := reconciler.records[1]
+	require.Equal(t, rec, placed)
+	require.Equal(t, "test-run", rec.GetRunID())
+	require.Equal(t, ticker, rec.GetSymbol())
+	require.Equal(t, "buy", rec.GetSide())
+	require.True(t, decimal.NewFromInt(9).Equal(rec.GetRequestedQty()))
+	require.True(t, decimal.NewFromInt(3000).Equal(rec.GetRequestedDollars()))
+	require.True(t, decimal.NewFromFloat(326.35).Equal(rec.GetEstimatedPrice()))
+	require.True(t, rec.GetFilledQty().IsZero())
+	require.Nil(t, rec.GetFilledAvgPrice())
 }
 
 func TestTrade_FailsNoRecording(t *testing.T) {
 	alpacaClient := exchangetest.NewMockClient("6")
 	ticker := "SPY"
-	alpacaClient.SetQuote(ticker, &alpaca.LastQuoteResponse{
-		Status: "success",
-		Symbol: "SPY",
-		Last: alpaca.LastQuote{
-			AskPrice:    326.41,
-			AskSize:     5,
-			AskExchange: 2,
-			BidPrice:    326.35,
-			BidSize:     1,
-			BidExchange: 17,
-			Timestamp:   1596226084553000000,
-		},
+	alpacaClient.SetQuote(ticker, &exchange.Quote{
+		Symbol:    "SPY",
+		AskPrice:  decimal.NewFromFloat(326.41),
+		BidPrice:  decimal.NewFromFloat(326.35),
+		Timestamp: time.Unix(0, 1596226084553000000),
 	})
 
 	reconciler := &mockReconciler{shouldFail: true}
 
-	c := New(alpacaClient, reconciler)
-	err := c.trade(context.TODO(), ticker, decimal.NewFromInt(3000), alpaca.Buy)
+	c := New(alpacaClient, prices.New(alpacaClient), reconciler, "test-run")
+	_, err := c.trade(context.TODO(), ticker, decimal.NewFromInt(3000), exchange.Buy)
 	require.Error(t, err)
 	require.Empty(t, alpacaClient.GetOrderReqs())
 	require.Empty(t, alpacaClient.GetOrders())
@@ -83,32 +81,108 @@ func TestTrade_FailsNoRecording(t *testing.T) {
 func TestTrade_NoTradeForZeroShares(t *testing.T) {
 	alpacaClient := exchangetest.NewMockClient("6")
 	ticker := "SPY"
-	alpacaClient.SetQuote(ticker, &alpaca.LastQuoteResponse{
-		Status: "success",
-		Symbol: "SPY",
-		Last: alpaca.LastQuote{
-			AskPrice:    326.41,
-			AskSize:     5,
-			AskExchange: 2,
-			BidPrice:    326.35,
-			BidSize:     1,
-			BidExchange: 17,
-			Timestamp:   1596226084553000000,
-		},
+	alpacaClient.SetQuote(ticker, &exchange.Quote{
+		Symbol:    "SPY",
+		AskPrice:  decimal.NewFromFloat(326.41),
+		BidPrice:  decimal.NewFromFloat(326.35),
+		Timestamp: time.Unix(0, 1596226084553000000),
 	})
 
 	reconciler := &mockReconciler{}
 
-	c := New(alpacaClient, reconciler)
-	err := c.trade(context.TODO(), ticker, decimal.NewFromInt(100), alpaca.Buy)
+	c := New(alpacaClient, prices.New(alpacaClient), reconciler, "test-run")
+	placed, err := c.trade(context.TODO(), ticker, decimal.NewFromInt(100), exchange.Buy)
 	require.NoError(t, err)
+	require.Nil(t, placed)
 	require.Empty(t, alpacaClient.GetOrderReqs())
 	require.Empty(t, alpacaClient.GetOrders())
 }
 
+func TestTrade_SnapshotPrice(t *testing.T) {
+	alpacaClient := exchangetest.NewMockClient("6")
+	alpacaClient.SetQuote("SPY", &exchange.Quote{Symbol: "SPY", AskPrice: decimal.NewFromInt(301), BidPrice: decimal.NewFromInt(300)})
+	snapshot := prices.New(alpacaClient)
+	require.NoError(t, snapshot.Fetch(context.TODO(), []string{"SPY"}))
+
+	// the price moved since the run was planned
+	alpacaClient.SetQuote("SPY", &exchange.Quote{Symbol: "SPY", AskPrice: decimal.NewFromInt(401), BidPrice: decimal.NewFromInt(400)})
+
+	c := New(alpacaClient, snapshot, &mockReconciler{}, "test-run")
+	placed, err := c.trade(context.TODO(), "SPY", decimal.NewFromInt(3000), exchange.Buy)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(10).Equal(placed.GetRequestedQty()))
+	require.True(t, decimal.NewFromInt(300).Equal(placed.GetEstimatedPrice()))
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodGetLastQuote), 1)
+}
+
+func TestTrade_PlaceOrderFails(t *testing.T) {
+	alpacaClient := exchangetest.NewMockClient("6")
+	ticker := "SPY"
+	alpacaClient.SetQuote(ticker, &exchange.Quote{
+		Symbol:    "SPY",
+		AskPrice:  decimal.NewFromFloat(326.41),
+		BidPrice:  decimal.NewFromFloat(326.35),
+		Timestamp: time.Unix(0, 1596226084553000000),
+	})
+	alpacaClient.InjectFault(exchangetest.MethodPlaceOrder, 2, exchangetest.Fault{Err: exchangetest.ErrInsufficientBuyingPower})
+
+	reconciler := &mockReconciler{}
+
+	c := New(alpacaClient, prices.New(alpacaClient), reconciler, "test-run")
+	_, err := c.trade(context.TODO(), ticker, decimal.NewFromInt(3000), exchange.Buy)
+	require.NoError(t, err)
+
+	_, err = c.trade(context.TODO(), ticker, decimal.NewFromInt(3000), exchange.Buy)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, exchangetest.ErrInsufficientBuyingPower))
+
+	// the failed order was recorded before placing, but never accepted
+	require.Len(t, alpacaClient.CallsTo(exchangetest.MethodPlaceOrder), 2)
+	require.Len(t, alpacaClient.GetOrders(), 1)
+	require.Len(t, reconciler.records, 3)
+	require.Empty(t, reconciler.records[2].GetAlpacaOrderID())
+	require.Nil(t, reconciler.records[2].GetSubmittedAt())
+	require.Equal(t, reconciliation.StatusPendingSubmit, reconciler.records[2].GetStatus())
+}
+
+func TestTrade_ExchangeErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		method string
+	}{
+		{
+			name:   "quote",
+			method: exchangetest.MethodGetLastQuote,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			alpacaClient := exchangetest.NewMockClient("6")
+			alpacaClient.SetQuote("SPY", &exchange.Quote{
+				Symbol:   "SPY",
+				AskPrice: decimal.NewFromFloat(326.41),
+				BidPrice: decimal.NewFromFloat(326.35),
+			})
+			alpacaClient.InjectFault(tc.method, 0, exchangetest.Fault{Err: exchangetest.ErrRateLimited})
+
+			reconciler := &mockReconciler{}
+
+			c := New(alpacaClient, prices.New(alpacaClient), reconciler, "test-run")
+			_, err := c.trade(context.TODO(), "SPY", decimal.NewFromInt(3000), exchange.Buy)
+			require.Error(t, err)
+			require.True(t, errors.Is(err, exchangetest.ErrRateLimited))
+			require.Empty(t, reconciler.records)
+			require.Empty(t, alpacaClient.CallsTo(exchangetest.MethodPlaceOrder))
+		})
+	}
+}
+
 type mockReconciler struct {
 	shouldFail bool
 	records    []reconciliation.Record
+	statuses   []reconciliation.Status // status of each record when it was recorded
 }
 
 func (r *mockReconciler) Record(_ context.Context, record reconciliation.Record) error {
@@ -117,9 +191,10 @@ func (r *mockReconciler) Record(_ context.Context, record reconciliation.Record)
 	}
 
 	r.records = append(r.records, record)
+	r.statuses = append(r.statuses, record.GetStatus())
 	return nil
 }
 
-func (r *mockReconciler) Reconcile(_ context.Context) error {
-	return nil
+func (r *mockReconciler) Reconcile(_ context.Context) (reconciliation.Result, error) {
+	return reconciliation.Result{}, nil
 }
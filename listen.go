@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alpacahq/alpaca-trade-api-go/common"
+	"github.com/golang/glog"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/reconciliation"
+)
+
+// defaultPollInterval is how often open records are polled while the trade update stream is down
+const defaultPollInterval = time.Minute
+
+// listen closes records of the default account as trade updates stream in from alpaca, until ctx is done.
+// While the stream is down, open records are polled every CAMELID_POLL_INTERVAL (default 1m).
+func listen(ctx context.Context) error {
+	if broker := os.Getenv("CAMELID_BROKER"); broker != "" && broker != "alpaca" {
+		return fmt.Errorf("-listen only streams trade updates from alpaca, not %s", broker)
+	}
+
+	pollInterval := defaultPollInterval
+	if s := os.Getenv("CAMELID_POLL_INTERVAL"); s != "" {
+		parsed, err := time.ParseDuration(s)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("CAMELID_POLL_INTERVAL must be a duration like 1m, got %q", s)
+		}
+		pollInterval = parsed
+	}
+
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	exchangeClient, _, err := newExchangeClient()
+	if err != nil {
+		return err
+	}
+
+	stream, err := exchange.NewAlpacaTradeStream(alpacaBaseURL(), common.Credentials())
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("listening for trade updates, polling every %s when the stream is down", pollInterval)
+	reconciliation.Watch(ctx, store, exchangeClient, stream, pollInterval)
+	return nil
+}
+
+// alpacaBaseURL is the alpaca endpoint the alpaca client hits, per APCA_API_BASE_URL
+func alpacaBaseURL() string {
+	if s := os.Getenv("APCA_API_BASE_URL"); s != "" {
+		return s
+	} else if s := os.Getenv("ALPACA_BASE_URL"); s != "" {
+		// the alpaca client still reads this legacy name
+		return s
+	}
+	return "https://api.alpaca.markets"
+}
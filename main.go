@@ -3,22 +3,47 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alpacahq/alpaca-trade-api-go/alpaca"
 	"github.com/alpacahq/alpaca-trade-api-go/common"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/golang/glog"
 	"github.com/shopspring/decimal"
 
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/ledger"
+	"github.com/jchorl/camelid/internal/lock"
 	"github.com/jchorl/camelid/internal/portfolio"
+	"github.com/jchorl/camelid/internal/prices"
 	"github.com/jchorl/camelid/internal/reconciliation"
 	"github.com/jchorl/camelid/internal/trade"
 )
 
+const (
+	runLockName = "lock:run" // lives in the runs table, so must not look like a run ID
+	// the lock is renewed every third of this, and taken over if not renewed in time
+	runLockTTL = time.Minute
+
+	defaultOrphanLookbackDays = 7
+
+	defaultExchangeTimeout = 10 * time.Second
+	defaultDeadlineReserve = 15 * time.Second
+)
+
 func HandleRequest(ctx context.Context) error {
 	dryRun := os.Getenv("CAMELID_DRY_RUN") != ""
 
@@ -51,47 +76,620 @@ func HandleRequest(ctx context.Context) error {
 }
 
 func run(ctx context.Context, dryRun bool, ratios map[string]decimal.Decimal, maxInvestment decimal.Decimal) error {
-	alpacaClient := alpaca.NewClient(common.Credentials())
+	broker, err := newBroker(ctx)
+	if err != nil {
+		return err
+	}
+	replayer, replaying := broker.(*exchange.Replayer)
+	var recorder *exchange.Recorder
+	if os.Getenv("CAMELID_RECORD") != "" {
+		recorder = exchange.NewRecorder(broker)
+		broker = recorder
+	}
+
+	exchangeClient, limiter, err := wrapExchangeClient(broker, "")
+	if err != nil {
+		return err
+	}
+	accounts := []account{{exchangeClient: exchangeClient, limiter: limiter}}
+
+	others, err := newAccounts()
+	if err != nil {
+		return err
+	} else if len(others) > 0 && (replaying || recorder != nil) {
+		return errors.New("CAMELID_RECORD and CAMELID_REPLAY only cover the default account, not CAMELID_ACCOUNTS")
+	}
+	accounts = append(accounts, others...)
+	defer func(start time.Time) {
+		for _, acct := range accounts {
+			logRequestBudget(acct, time.Since(start))
+		}
+	}(time.Now())
+
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	if replaying {
+		err := seedReplay(ctx, store)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			glog.Infof("replay done, %d recorded calls were not replayed", replayer.Remaining())
+		}()
+	}
+
+	runStore, err := newRunStore()
+	if err != nil {
+		return err
+	}
+
+	lockStore, err := newLockStore()
+	if err != nil {
+		return err
+	}
+
+	// two overlapping runs would both spend the same cash
+	runLock, err := lock.Acquire(ctx, lockStore, runLockName, lockOwner(ctx), runLockTTL)
+	var held *lock.HeldError
+	if errors.As(err, &held) {
+		glog.Warningf("another run is in progress, exiting: %v", held)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("acquiring run lock: %w", err)
+	}
+	defer func() {
+		err := runLock.Release(context.Background())
+		if err != nil {
+			glog.Errorf("releasing run lock: %v", err)
+		}
+	}()
+	// stop trading if the lock is lost
+	ctx = runLock.Context()
+
+	ledgerRun := ledger.NewRun(dryRun, ratios, maxInvestment)
+	err = runStore.PutRun(ctx, ledgerRun)
+	if err != nil {
+		return fmt.Errorf("recording start of run: %w", err)
+	}
+	glog.Infof("starting run %s", ledgerRun.ID)
+
+	if recorder != nil {
+		err := exportForReplay(ctx, store, ledgerRun.ID)
+		if err != nil {
+			return err
+		}
+		defer saveRecording(recorder, ledgerRun.ID)
+	}
+
+	err = execute(ctx, ledgerRun, store, accounts, ratios, maxInvestment)
+	ledgerRun.Finish(err)
+
+	// don't lose the outcome of the run if the context expired mid-run
+	putErr := runStore.PutRun(context.Background(), ledgerRun)
+	if putErr != nil {
+		glog.Errorf("recording outcome of run %s (%+v): %v", ledgerRun.ID, ledgerRun, putErr)
+		if err == nil {
+			err = fmt.Errorf("recording outcome of run: %w", putErr)
+		}
+	}
+
+	return err
+}
+
+// execute reconciles, plans and trades, noting everything it does on the run.
+// The portfolio is held across the accounts, the default account first.
+func execute(ctx context.Context, ledgerRun *ledger.Run, store reconciliation.RecordStore, accounts []account, ratios map[string]decimal.Decimal, maxInvestment decimal.Decimal) error {
+	policy, lookback, err := orphanOptions()
+	if err != nil {
+		return err
+	}
+	rule, err := splitRule()
+	if err != nil {
+		return err
+	}
+
+	// planning and trading see the same prices. Planning sums holdings across
+	// accounts, so each ticker needs the one price, quoted by the default
+	// account's broker, and buys in every account are sized at it.
+	snapshot := prices.New(accounts[0].exchangeClient)
+
+	reconciled := make([]reconciliation.Result, len(accounts))
+	tradingClients := map[string]*trade.Client{}
+	var exchangeClients []exchange.Client
+	var pfolioAccounts []portfolio.Account
+	for i, acct := range accounts {
+		reconciler := reconciliation.NewForAccount(store, acct.exchangeClient, acct.name)
+		tradingClients[acct.name] = trade.New(acct.exchangeClient, snapshot, reconciler, ledgerRun.ID)
+		exchangeClients = append(exchangeClients, acct.exchangeClient)
+		pfolioAccounts = append(pfolioAccounts, portfolio.Account{Name: acct.name, ExchangeClient: acct.exchangeClient})
+
+		reconciled[i], err = reconciler.Reconcile(ctx)
+		if err != nil {
+			return fmt.Errorf("reconciling %s: %w", acct, err)
+		}
+
+		// orders placed outside camelid would throw off what's left to spend
+		imported, err := reconciliation.CheckOrphans(ctx, store, acct.exchangeClient, acct.name, time.Now().Add(-lookback), policy)
+		if err != nil {
+			return fmt.Errorf("checking %s for orphan orders: %w", acct, err)
+		} else if imported > 0 {
+			glog.Warningf("imported %d orphan orders in %s", imported, acct)
+		}
+	}
+
+	err = verifyPositions(ctx, store, exchangeClients)
+	if err != nil {
+		return err
+	}
+
+	pfolio := portfolio.NewMultiAccount(pfolioAccounts, snapshot, ratios, rule)
 
-	dynamoClient := dynamodb.New(session.New())
+	// tickers with orders in flight sit this run out, the rest can trade
+	for i, acct := range accounts {
+		for _, ticker := range reconciled[i].Blocked() {
+			symbolResult := reconciled[i].Symbols[ticker]
+			pfolio.BlockInAccount(acct.name, ticker, symbolResult.InFlightDollars)
+			ledgerRun.Skip(ticker, blockedReason(symbolResult))
+			glog.Warningf("not trading %s: %s", ticker, blockedReason(symbolResult))
+		}
+	}
 
-	reconciler := reconciliation.New(dynamoClient, alpacaClient)
-	tradingClient := trade.New(alpacaClient, reconciler)
+	cash, err := pfolio.GetAccountCash(ctx)
+	if err != nil {
+		return fmt.Errorf("getting cash: %w", err)
+	}
+	ledgerRun.SetAccountCash(cash)
 
-	err := reconciler.Reconcile(ctx)
+	holdings, err := pfolio.GetHoldings(ctx)
 	if err != nil {
-		glog.Fatalf("failed to reconcile: %v", err)
+		return fmt.Errorf("getting holdings: %w", err)
 	}
+	ledgerRun.SetHoldings(holdings)
+	ledgerRun.SetPrices(snapshot.Prices())
 
-	pfolio := portfolio.New(alpacaClient, ratios)
-	amountToInvest, err := pfolio.GetAmountToInvest(maxInvestment)
+	amountToInvest, err := pfolio.GetAmountToInvest(ctx, maxInvestment)
 	if err != nil {
-		glog.Fatalf("getting amount to invest: %v", err)
+		return fmt.Errorf("getting amount to invest: %w", err)
 	}
 
 	deltas, err := pfolio.GetDeltasWithoutSales(ctx, amountToInvest)
 	if err != nil {
-		glog.Fatalf("getting deltas: %v", err)
+		return fmt.Errorf("getting deltas: %w", err)
+	}
+	ledgerRun.SetPlan(amountToInvest, deltas)
+
+	// a lone account buys it all
+	buys := map[string]map[string]decimal.Decimal{accounts[0].name: deltas}
+	if len(accounts) > 1 {
+		buys, err = pfolio.SplitDeltas(ctx, deltas)
+		if err != nil {
+			return fmt.Errorf("splitting deltas between accounts: %w", err)
+		}
+	}
+
+	// in a stable order, so a run cut short can say what it got to
+	tickers := make([]string, 0, len(deltas))
+	for ticker := range deltas {
+		tickers = append(tickers, ticker)
 	}
+	sort.Strings(tickers)
 
-	for ticker, delta := range deltas {
-		if dryRun {
+	for i, ticker := range tickers {
+		delta := deltas[ticker]
+		if ledgerRun.DryRun {
 			glog.Infof("DRY-RUN would have traded $%s of %s", delta.StringFixed(2), ticker)
+			for _, acct := range accounts {
+				if dollars, ok := buys[acct.name][ticker]; ok && len(accounts) > 1 {
+					glog.Infof("DRY-RUN would have bought $%s of %s in %s", dollars.StringFixed(2), ticker, acct)
+				}
+			}
+			ledgerRun.Skip(ticker, "dry run")
 		} else if delta.GreaterThan(decimal.Zero) {
-			err := tradingClient.Buy(ctx, ticker, delta)
-			if err != nil {
-				return err
+			placed := 0
+			for _, acct := range accounts {
+				dollars, ok := buys[acct.name][ticker]
+				if !ok {
+					continue
+				}
+
+				rec, err := tradingClients[acct.name].Buy(ctx, ticker, dollars)
+				if errors.Is(err, exchange.ErrRunDeadline) {
+					// keep what was placed, the rest can wait for the next run
+					remaining := tickers[i:]
+					for _, ticker := range remaining {
+						ledgerRun.Skip(ticker, "run deadline reached")
+					}
+					return &ledger.PartialError{Remaining: remaining, Err: err}
+				} else if err != nil {
+					return err
+				}
+				if rec == nil {
+					continue
+				}
+				placed++
+				ledgerRun.AddOrder(ledger.Order{
+					RecordID:      rec.GetID(),
+					AlpacaOrderID: rec.GetAlpacaOrderID(),
+					Symbol:        ticker,
+					Account:       acct.name,
+				})
+			}
+			if placed == 0 {
+				ledgerRun.Skip(ticker, fmt.Sprintf("$%s is too little to buy a share", delta.StringFixed(2)))
 			}
 		} else {
 			glog.Warningf("selling is not supported yet, not selling $%s of %s", delta.Abs().StringFixed(2), ticker)
+			ledgerRun.Skip(ticker, "selling is not supported")
 		}
 	}
 	return nil
 }
 
+// blockedReason says why a ticker isn't being traded
+func blockedReason(result *reconciliation.SymbolResult) string {
+	if len(result.Errs) > 0 {
+		return fmt.Sprintf("orders could not be checked: %v", result.Errs[0])
+	}
+	return fmt.Sprintf("%d orders in flight, $%s reserved", len(result.InFlight), result.InFlightDollars.StringFixed(2))
+}
+
+// orphanOptions reads what to do about orders at the broker without a record.
+// CAMELID_ORPHANS is "flag" (the default), which stops the run, or "import".
+// Orders submitted in the last CAMELID_ORPHAN_LOOKBACK_DAYS (default 7) are checked.
+func orphanOptions() (reconciliation.OrphanPolicy, time.Duration, error) {
+	policy := reconciliation.OrphanFlag
+	if s := os.Getenv("CAMELID_ORPHANS"); s != "" {
+		var err error
+		policy, err = reconciliation.ParseOrphanPolicy(s)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	days := defaultOrphanLookbackDays
+	if s := os.Getenv("CAMELID_ORPHAN_LOOKBACK_DAYS"); s != "" {
+		d, err := strconv.Atoi(s)
+		if err != nil || d < 1 {
+			return "", 0, fmt.Errorf("CAMELID_ORPHAN_LOOKBACK_DAYS must be a positive number of days, got %q", s)
+		}
+		days = d
+	}
+
+	return policy, time.Duration(days) * 24 * time.Hour, nil
+}
+
+// newExchangeClient connects to the default account's broker
+func newExchangeClient() (exchange.Client, *exchange.RateLimitedClient, error) {
+	return newAccountClient("")
+}
+
+// connectBroker connects to the CAMELID_BROKER (default alpaca). Alpaca is
+// configured by the APCA_* env vars, and tradier by TRADIER_ACCESS_TOKEN,
+// TRADIER_ACCOUNT_ID and optionally TRADIER_BASE_URL. Each env var is read
+// with the account's prefix, see envPrefix.
+func connectBroker(prefix string) (exchange.Client, error) {
+	switch broker := os.Getenv(prefix + "CAMELID_BROKER"); broker {
+	case "", "alpaca":
+		if prefix == "" {
+			return exchange.NewAlpacaClient(alpaca.NewClient(common.Credentials())), nil
+		}
+		// every alpaca client hits the same APCA_API_BASE_URL, only the keys differ
+		keyID, secretKey := os.Getenv(prefix+"APCA_API_KEY_ID"), os.Getenv(prefix+"APCA_API_SECRET_KEY")
+		if keyID == "" || secretKey == "" {
+			return nil, fmt.Errorf("alpaca requires %sAPCA_API_KEY_ID and %sAPCA_API_SECRET_KEY", prefix, prefix)
+		}
+		return exchange.NewAlpacaClient(alpaca.NewClient(&common.APIKey{ID: keyID, Secret: secretKey})), nil
+	case "tradier":
+		token, accountID := os.Getenv(prefix+"TRADIER_ACCESS_TOKEN"), os.Getenv(prefix+"TRADIER_ACCOUNT_ID")
+		if token == "" || accountID == "" {
+			return nil, fmt.Errorf("tradier requires %sTRADIER_ACCESS_TOKEN and %sTRADIER_ACCOUNT_ID", prefix, prefix)
+		}
+		baseURL := exchange.DefaultTradierURL
+		if s := os.Getenv(prefix + "TRADIER_BASE_URL"); s != "" {
+			baseURL = s
+		}
+		return exchange.NewTradierClient(baseURL, token, accountID), nil
+	default:
+		return nil, fmt.Errorf("%sCAMELID_BROKER must be alpaca or tradier, got %q", prefix, broker)
+	}
+}
+
+// wrapExchangeClient guards calls to the broker.
+// Each call can take up to CAMELID_EXCHANGE_TIMEOUT (default 10s), and
+// none start within CAMELID_DEADLINE_RESERVE (default 15s) of the run's
+// deadline, leaving time to record the outcome of the run. Calls that fail
+// with retryable errors are tried up to CAMELID_EXCHANGE_ATTEMPTS times, and
+// held to CAMELID_RATE_LIMITS, by endpoint class, through the returned limiter.
+// Both default to the broker's, see exchange.AlpacaDefaults and exchange.TradierDefaults.
+// prefix is the env var prefix of the account the broker is for, see envPrefix.
+// Each account can set its own of any of these, see accountEnv.
+func wrapExchangeClient(broker exchange.Client, prefix string) (exchange.Client, *exchange.RateLimitedClient, error) {
+	deadlines := exchange.Deadlines{
+		Call:    defaultExchangeTimeout,
+		Reserve: defaultDeadlineReserve,
+	}
+	for name, d := range map[string]*time.Duration{
+		"CAMELID_EXCHANGE_TIMEOUT": &deadlines.Call,
+		"CAMELID_DEADLINE_RESERVE": &deadlines.Reserve,
+	} {
+		if s, name := accountEnv(prefix, name); s != "" {
+			parsed, err := time.ParseDuration(s)
+			if err != nil || parsed < 0 {
+				return nil, nil, fmt.Errorf("%s must be a duration like 10s, got %q", name, s)
+			}
+			*d = parsed
+		}
+	}
+
+	defaults := exchange.AlpacaDefaults()
+	if os.Getenv(prefix+"CAMELID_BROKER") == "tradier" {
+		defaults = exchange.TradierDefaults()
+	}
+
+	limits := defaults.RateLimits
+	if s, name := accountEnv(prefix, "CAMELID_RATE_LIMITS"); s != "" {
+		configured, err := exchange.ParseRateLimits([]byte(s))
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+		for class, limit := range configured {
+			limits[class] = limit
+		}
+	}
+
+	retries := defaults.Retries
+	if s, name := accountEnv(prefix, "CAMELID_EXCHANGE_ATTEMPTS"); s != "" {
+		attempts, err := strconv.Atoi(s)
+		if err != nil || attempts < 1 {
+			return nil, nil, fmt.Errorf("%s must be a positive number, got %q", name, s)
+		}
+		retries.Attempts = attempts
+	}
+
+	// each attempt waits its turn, then gets its own deadline
+	limiter := exchange.WithRateLimits(exchange.WithDeadlines(broker, deadlines), limits)
+	return exchange.WithRetries(limiter, retries), limiter, nil
+}
+
+// logRequestBudget reports how much of each rate limit a run used in the account
+func logRequestBudget(acct account, elapsed time.Duration) {
+	label := "request budget"
+	if acct.name != "" {
+		label += " in " + acct.String()
+	}
+
+	for _, usage := range acct.limiter.Usage() {
+		if usage.Requests == 0 {
+			continue
+		}
+		glog.Infof("%s: %d %s requests in %s (limit %s), waited %s for the limit",
+			label, usage.Requests, usage.Class, elapsed.Round(time.Second), usage.Limit, usage.Waited.Round(time.Millisecond))
+	}
+}
+
+// newRecordStore picks where trade records are kept.
+// CAMELID_STORE=file keeps them on local disk under CAMELID_STORE_DIR,
+// CAMELID_STORE=memory keeps them on local disk for the run only, e.g. for replays,
+// otherwise they go to the dynamo table CAMELID_DYNAMO_TABLE.
+func newRecordStore() (reconciliation.RecordStore, error) {
+	switch backend := os.Getenv("CAMELID_STORE"); backend {
+	case "", "dynamodb":
+		table := os.Getenv("CAMELID_DYNAMO_TABLE")
+		if table == "" {
+			table = reconciliation.DefaultDynamoTable
+		}
+		return reconciliation.NewDynamoStore(dynamodb.New(session.New()), table), nil
+	case "file", "memory":
+		dir, err := storeDir("")
+		if err != nil {
+			return nil, err
+		}
+		return reconciliation.NewFileStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown CAMELID_STORE %q", backend)
+	}
+}
+
+// newRunStore picks where the ledger of runs is kept, alongside the trade records.
+// the file store keeps runs under CAMELID_STORE_DIR/runs,
+// otherwise they go to the dynamo table CAMELID_RUNS_TABLE.
+func newRunStore() (ledger.Store, error) {
+	switch backend := os.Getenv("CAMELID_STORE"); backend {
+	case "", "dynamodb":
+		table := os.Getenv("CAMELID_RUNS_TABLE")
+		if table == "" {
+			table = ledger.DefaultDynamoTable
+		}
+		return ledger.NewDynamoStore(dynamodb.New(session.New()), table), nil
+	case "file", "memory":
+		dir, err := storeDir("runs")
+		if err != nil {
+			return nil, err
+		}
+		return ledger.NewFileStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown CAMELID_STORE %q", backend)
+	}
+}
+
+// newLockStore picks where the run lock is kept, alongside the ledger of runs.
+// the file store keeps it under CAMELID_STORE_DIR/locks.
+func newLockStore() (lock.Store, error) {
+	switch backend := os.Getenv("CAMELID_STORE"); backend {
+	case "", "dynamodb":
+		table := os.Getenv("CAMELID_RUNS_TABLE")
+		if table == "" {
+			table = ledger.DefaultDynamoTable
+		}
+		return lock.NewDynamoStore(dynamodb.New(session.New()), table), nil
+	case "file", "memory":
+		dir, err := storeDir("locks")
+		if err != nil {
+			return nil, err
+		}
+		return lock.NewFileStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown CAMELID_STORE %q", backend)
+	}
+}
+
+// storeDir is where the file store keeps a kind of document, sub under CAMELID_STORE_DIR,
+// or under a scratch directory for CAMELID_STORE=memory. Records are kept at the top.
+func storeDir(sub string) (string, error) {
+	if os.Getenv("CAMELID_STORE") == "memory" {
+		dir, err := memoryStoreDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, sub), nil
+	}
+
+	dir := os.Getenv("CAMELID_STORE_DIR")
+	if dir == "" {
+		return "", errors.New("CAMELID_STORE_DIR is required for the file store")
+	}
+	return filepath.Join(dir, sub), nil
+}
+
+// lockOwner identifies this execution to anyone waiting on the run lock
+func lockOwner(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return "lambda/" + lc.AwsRequestID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+// migrate brings records written by older versions of camelid up to date.
+// With dryRun, it only reports what the schema migrations would change.
+func migrate(ctx context.Context, dryRun bool) error {
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	upgrades, err := reconciliation.MigrateSchema(ctx, store, dryRun)
+	for _, upgrade := range upgrades {
+		glog.Infof("record %s: schema version %d -> %d (%s)", upgrade.ID, upgrade.FromVersion, reconciliation.CurrentSchemaVersion, strings.Join(upgrade.Migrations, "; "))
+		for _, change := range upgrade.Changes {
+			glog.Infof("  %s", change)
+		}
+	}
+	if err != nil {
+		return err
+	} else if dryRun {
+		glog.Infof("would upgrade the schema of %d records, status and index migrations need a real run", len(upgrades))
+		return nil
+	}
+	glog.Infof("upgraded the schema of %d records", len(upgrades))
+
+	exchangeClient, _, err := newExchangeClient()
+	if err != nil {
+		return err
+	}
+
+	migrated, err := reconciliation.MigrateStatuses(ctx, store, exchangeClient)
+	glog.Infof("migrated statuses of %d records", migrated)
+	if err != nil {
+		return err
+	}
+
+	migrated, err = reconciliation.MigrateOpenIndex(ctx, store)
+	glog.Infof("added %d open records to the open index", migrated)
+	return err
+}
+
 func main() {
+	migrateOnly := flag.Bool("migrate", false, "migrate records written by older versions, then exit")
+	dryRun := flag.Bool("dry-run", false, "with -migrate, only report what would change")
+	archiveOnly := flag.Bool("archive", false, "archive reconciled records older than the retention period, then exit")
+	exportTo := flag.String("export", "", "export every record to the named archive, then exit")
+	importFrom := flag.String("import", "", "import the records in the named archive, then exit")
+	verifyOnly := flag.Bool("verify", false, "compare positions to trade records and broker orders, then exit")
+	listenOnly := flag.Bool("listen", false, "close records as trade updates stream in from alpaca, until interrupted")
 	flag.Parse()
 	flag.Set("logtostderr", "true") // lambda can't pass cli flags, so hack the flags
 
+	if flag.Arg(0) == "records" {
+		err := records(context.Background(), flag.Args()[1:])
+		if err != nil {
+			glog.Exitf("records: %v", err)
+		}
+		return
+	}
+
+	if *migrateOnly {
+		err := migrate(context.Background(), *dryRun)
+		if err != nil {
+			glog.Exitf("migrating: %v", err)
+		}
+		return
+	}
+
+	if *verifyOnly {
+		err := verify(context.Background())
+		if err != nil {
+			glog.Exitf("verifying: %v", err)
+		}
+		return
+	}
+
+	if *listenOnly {
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+
+		err := listen(ctx)
+		if err != nil {
+			glog.Exitf("listening: %v", err)
+		}
+		return
+	}
+
+	if *archiveOnly {
+		err := archiveRecords(context.Background())
+		if err != nil {
+			glog.Exitf("archiving: %v", err)
+		}
+		return
+	}
+
+	if *exportTo != "" {
+		err := exportRecords(context.Background(), *exportTo)
+		if err != nil {
+			glog.Exitf("exporting: %v", err)
+		}
+		return
+	}
+
+	if *importFrom != "" {
+		err := importRecords(context.Background(), *importFrom)
+		if err != nil {
+			glog.Exitf("importing: %v", err)
+		}
+		return
+	}
+
+	// outside of lambda (e.g. on a home server), just run once
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		err := HandleRequest(context.Background())
+		removeMemoryStore()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	lambda.Start(HandleRequest)
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/exchange/alpacatest"
+	"github.com/jchorl/camelid/internal/exchange/exchangetest"
+	"github.com/jchorl/camelid/internal/exchange/tradiertest"
+	"github.com/jchorl/camelid/internal/reconciliation"
+)
+
+// setenv sets env vars for the rest of the test
+func setenv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		name := name
+		old, ok := os.LookupEnv(name)
+		require.NoError(t, os.Setenv(name, value))
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+	defer server.Install()()
+	server.SetCash(decimal.NewFromInt(1100))
+	server.SetQuote("VOO", decimal.NewFromInt(300), decimal.RequireFromString("300.5"))
+	server.SetQuote("BND", decimal.NewFromInt(80), decimal.RequireFromString("80.2"))
+
+	dir, err := ioutil.TempDir("", "camelid")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setenv(t, map[string]string{
+		"APCA_API_KEY_ID":        "key",
+		"APCA_API_SECRET_KEY":    "secret",
+		"CAMELID_STORE":          "file",
+		"CAMELID_STORE_DIR":      dir,
+		"CAMELID_RATIOS":         `{"VOO": 60, "BND": 40}`,
+		"CAMELID_MAX_INVESTMENT": "1000",
+	})
+	ctx := context.TODO()
+
+	require.NoError(t, HandleRequest(ctx))
+
+	orders := server.Orders()
+	require.Len(t, orders, 2)
+	bought := map[string]decimal.Decimal{}
+	for _, order := range orders {
+		bought[order.Symbol] = order.Qty
+	}
+	require.True(t, decimal.NewFromInt(2).Equal(bought["VOO"]))
+	require.True(t, decimal.NewFromInt(5).Equal(bought["BND"]))
+
+	store, err := newRecordStore()
+	require.NoError(t, err)
+	recs, err := reconciliation.List(ctx, store, reconciliation.Filter{})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	for _, rec := range recs {
+		require.Equal(t, reconciliation.StatusSubmitted, rec.GetStatus())
+	}
+
+	// the next day, yesterday's orders have filled and more cash came in
+	server.FillOrders()
+	server.SetCash(server.Cash().Add(decimal.NewFromInt(1000)))
+
+	require.NoError(t, HandleRequest(ctx))
+
+	require.Len(t, server.Orders(), 4)
+	recs, err = reconciliation.List(ctx, store, reconciliation.Filter{})
+	require.NoError(t, err)
+	statuses := map[reconciliation.Status]int{}
+	for _, rec := range recs {
+		statuses[rec.GetStatus()]++
+	}
+	require.Equal(t, map[reconciliation.Status]int{
+		reconciliation.StatusFilled:    2,
+		reconciliation.StatusSubmitted: 2,
+	}, statuses)
+}
+
+func TestMemoryStore(t *testing.T) {
+	setenv(t, map[string]string{"CAMELID_STORE": "memory"})
+	ctx := context.TODO()
+
+	// every store opened during the run sees the same records
+	store, err := newRecordStore()
+	require.NoError(t, err)
+	rec := reconciliation.NewRecord("test-run", "VOO", "buy", decimal.NewFromInt(1), decimal.NewFromInt(300), decimal.NewFromInt(300))
+	require.NoError(t, store.Restore(ctx, rec))
+	reopened, err := newRecordStore()
+	require.NoError(t, err)
+	_, err = reopened.Get(ctx, rec.GetID())
+	require.NoError(t, err)
+
+	dir, err := memoryStoreDir()
+	require.NoError(t, err)
+	removeMemoryStore()
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err), "expected %s removed, got %v", dir, err)
+}
+
+func TestHandleRequest_Tradier(t *testing.T) {
+	server := tradiertest.NewServer("token", "VA000001")
+	defer server.Close()
+	server.SetCash(decimal.NewFromInt(1100))
+	server.SetQuote("VOO", decimal.NewFromInt(300), decimal.RequireFromString("300.5"))
+	server.SetQuote("BND", decimal.NewFromInt(80), decimal.RequireFromString("80.2"))
+
+	dir, err := ioutil.TempDir("", "camelid")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setenv(t, map[string]string{
+		"CAMELID_BROKER":         "tradier",
+		"TRADIER_ACCESS_TOKEN":   "token",
+		"TRADIER_ACCOUNT_ID":     "VA000001",
+		"TRADIER_BASE_URL":       server.BaseURL(),
+		"CAMELID_STORE":          "file",
+		"CAMELID_STORE_DIR":      dir,
+		"CAMELID_RATIOS":         `{"VOO": 60, "BND": 40}`,
+		"CAMELID_MAX_INVESTMENT": "1000",
+	})
+	ctx := context.TODO()
+
+	require.NoError(t, HandleRequest(ctx))
+
+	orders := server.Orders()
+	require.Len(t, orders, 2)
+	bought := map[string]decimal.Decimal{}
+	for _, order := range orders {
+		bought[order.Symbol] = order.Quantity
+	}
+	require.True(t, decimal.NewFromInt(2).Equal(bought["VOO"]))
+	require.True(t, decimal.NewFromInt(5).Equal(bought["BND"]))
+
+	server.FillOrders()
+	require.NoError(t, HandleRequest(ctx))
+
+	store, err := newRecordStore()
+	require.NoError(t, err)
+	recs, err := reconciliation.List(ctx, store, reconciliation.Filter{})
+	require.NoError(t, err)
+	statuses := map[reconciliation.Status]int{}
+	for _, rec := range recs {
+		statuses[rec.GetStatus()]++
+	}
+	require.Equal(t, map[reconciliation.Status]int{
+		reconciliation.StatusFilled: 2,
+	}, statuses)
+}
+
+func TestHandleRequest_Accounts(t *testing.T) {
+	alpacaServer := alpacatest.NewServer("key", "secret")
+	defer alpacaServer.Close()
+	defer alpacaServer.Install()()
+	alpacaServer.SetCash(decimal.NewFromInt(300))
+	tradierServer := tradiertest.NewServer("token", "VA000001")
+	defer tradierServer.Close()
+	tradierServer.SetCash(decimal.NewFromInt(800))
+	for _, quote := range []struct {
+		symbol   string
+		bid, ask decimal.Decimal
+	}{
+		{"VOO", decimal.NewFromInt(300), decimal.RequireFromString("300.5")},
+		{"BND", decimal.NewFromInt(80), decimal.RequireFromString("80.2")},
+	} {
+		alpacaServer.SetQuote(quote.symbol, quote.bid, quote.ask)
+		tradierServer.SetQuote(quote.symbol, quote.bid, quote.ask)
+	}
+
+	dir, err := ioutil.TempDir("", "camelid")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setenv(t, map[string]string{
+		"APCA_API_KEY_ID":          "key",
+		"APCA_API_SECRET_KEY":      "secret",
+		"CAMELID_ACCOUNTS":         "ira",
+		"IRA_CAMELID_BROKER":       "tradier",
+		"IRA_TRADIER_ACCESS_TOKEN": "token",
+		"IRA_TRADIER_ACCOUNT_ID":   "VA000001",
+		"IRA_TRADIER_BASE_URL":     tradierServer.BaseURL(),
+		"CAMELID_STORE":            "file",
+		"CAMELID_STORE_DIR":        dir,
+		"CAMELID_RATIOS":           `{"VOO": 60, "BND": 40}`,
+		"CAMELID_MAX_INVESTMENT":   "1000",
+	})
+	ctx := context.TODO()
+
+	require.NoError(t, HandleRequest(ctx))
+
+	// $600 of VOO fits in the ira, which has the most cash, and $400 of BND
+	// goes to the default account's $300, then the $100 left in the ira
+	alpacaOrders := alpacaServer.Orders()
+	require.Len(t, alpacaOrders, 1)
+	require.Equal(t, "BND", alpacaOrders[0].Symbol)
+	require.True(t, decimal.NewFromInt(3).Equal(alpacaOrders[0].Qty))
+	tradierOrders := tradierServer.Orders()
+	require.Len(t, tradierOrders, 2)
+	bought := map[string]decimal.Decimal{}
+	for _, order := range tradierOrders {
+		bought[order.Symbol] = order.Quantity
+	}
+	require.True(t, decimal.NewFromInt(2).Equal(bought["VOO"]))
+	require.True(t, decimal.NewFromInt(1).Equal(bought["BND"]))
+
+	store, err := newRecordStore()
+	require.NoError(t, err)
+	recs, err := reconciliation.List(ctx, store, reconciliation.Filter{})
+	require.NoError(t, err)
+	accounts := map[string]int{}
+	for _, rec := range recs {
+		accounts[rec.GetAccount()]++
+	}
+	require.Equal(t, map[string]int{"": 1, "ira": 2}, accounts)
+
+	// each account's records are closed against its own broker
+	alpacaServer.FillOrders()
+	tradierServer.FillOrders()
+	require.NoError(t, HandleRequest(ctx))
+
+	recs, err = reconciliation.List(ctx, store, reconciliation.Filter{})
+	require.NoError(t, err)
+	filled := 0
+	for _, rec := range recs {
+		if rec.GetStatus() == reconciliation.StatusFilled {
+			filled++
+		}
+	}
+	require.Equal(t, 3, filled)
+}
+
+func TestWrapExchangeClient_BrokerDefaults(t *testing.T) {
+	setenv(t, map[string]string{"IRA_CAMELID_BROKER": "tradier"})
+
+	for prefix, expected := range map[string]exchange.RateLimit{
+		"":     exchange.AlpacaDefaults().RateLimits[exchange.AllEndpoints],
+		"IRA_": exchange.TradierDefaults().RateLimits[exchange.AllEndpoints],
+	} {
+		_, limiter, err := wrapExchangeClient(exchangetest.NewMockClient("6"), prefix)
+		require.NoError(t, err)
+		for _, usage := range limiter.Usage() {
+			if usage.Class == exchange.AllEndpoints {
+				require.Equal(t, expected, usage.Limit, "account %q", prefix)
+			}
+		}
+	}
+}
+
+func TestWrapExchangeClient_AccountEnv(t *testing.T) {
+	broker := exchangetest.NewMockClient("6")
+	setenv(t, map[string]string{
+		"CAMELID_EXCHANGE_ATTEMPTS":     "none",
+		"IRA_CAMELID_EXCHANGE_ATTEMPTS": "5",
+		"CAMELID_EXCHANGE_TIMEOUT":      "20s",
+		"IRA_CAMELID_RATE_LIMITS":       "{",
+	})
+
+	_, _, err := wrapExchangeClient(broker, "")
+	require.EqualError(t, err, `CAMELID_EXCHANGE_ATTEMPTS must be a positive number, got "none"`)
+
+	// the ira's own settings come first, then the shared ones
+	_, _, err = wrapExchangeClient(broker, "IRA_")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "parsing IRA_CAMELID_RATE_LIMITS")
+
+	setenv(t, map[string]string{"IRA_CAMELID_RATE_LIMITS": `{"all": {"perMinute": 60}}`, "JOINT_CAMELID_EXCHANGE_TIMEOUT": "soon"})
+	_, _, err = wrapExchangeClient(broker, "IRA_")
+	require.NoError(t, err)
+	_, _, err = wrapExchangeClient(broker, "JOINT_")
+	require.EqualError(t, err, `JOINT_CAMELID_EXCHANGE_TIMEOUT must be a duration like 10s, got "soon"`)
+}
+
+func TestListen(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+	defer server.Install()()
+	server.SetCash(decimal.NewFromInt(1100))
+	server.SetQuote("VOO", decimal.NewFromInt(300), decimal.RequireFromString("300.5"))
+	server.SetQuote("BND", decimal.NewFromInt(80), decimal.RequireFromString("80.2"))
+
+	dir, err := ioutil.TempDir("", "camelid")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setenv(t, map[string]string{
+		"APCA_API_BASE_URL":      server.URL,
+		"APCA_API_KEY_ID":        "key",
+		"APCA_API_SECRET_KEY":    "secret",
+		"CAMELID_STORE":          "file",
+		"CAMELID_STORE_DIR":      dir,
+		"CAMELID_RATIOS":         `{"VOO": 60, "BND": 40}`,
+		"CAMELID_MAX_INVESTMENT": "1000",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- listen(ctx)
+	}()
+	require.Eventually(t, func() bool { return server.Subscribers() == 1 }, time.Second, time.Millisecond)
+
+	require.NoError(t, HandleRequest(ctx))
+	server.FillOrders()
+
+	store, err := newRecordStore()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		recs, err := reconciliation.List(ctx, store, reconciliation.Filter{})
+		if err != nil {
+			return false
+		}
+		for _, rec := range recs {
+			if rec.GetStatus().IsOpen() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	recs, err := reconciliation.List(ctx, store, reconciliation.Filter{})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	for _, rec := range recs {
+		require.Equal(t, reconciliation.StatusFilled, rec.GetStatus())
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/reconciliation"
+)
+
+const recordsUsage = `usage: camelid records <command> [flags] [args]
+
+commands:
+  list       list records, filtered by -status, -symbol, -run, -since and -until
+  show ID    show a record and its order at the broker
+  reconcile  -reason REASON ID, close a record by hand, taking the broker's status if the order is done
+  abandon    -reason REASON ID, close a record by hand, without looking at the broker
+  delete     delete records, by ID or by the same filters as list. Only prints what would go without -confirm`
+
+// records is the admin CLI for trade records, run as `camelid records <command>`
+func records(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New(recordsUsage)
+	}
+
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		return listRecords(ctx, store, args)
+	case "show":
+		return showRecord(ctx, store, args)
+	case "reconcile", "abandon":
+		return closeRecord(ctx, store, command, args)
+	case "delete":
+		return deleteRecords(ctx, store, args)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", command, recordsUsage)
+	}
+}
+
+// filterFlags adds the flags for picking out records to fs
+func filterFlags(fs *flag.FlagSet) func() (reconciliation.Filter, error) {
+	statuses := fs.String("status", "", "comma-separated statuses, e.g. submitted,pending-submit")
+	symbol := fs.String("symbol", "", "only records of this symbol")
+	runID := fs.String("run", "", "only records placed by this run")
+	since := fs.String("since", "", "only records created at or after this date (2006-01-02) or time (RFC 3339)")
+	until := fs.String("until", "", "only records created before this date (2006-01-02) or time (RFC 3339)")
+
+	return func() (reconciliation.Filter, error) {
+		filter := reconciliation.Filter{Symbol: *symbol, RunID: *runID}
+
+		if *statuses != "" {
+			for _, name := range strings.Split(*statuses, ",") {
+				status, err := reconciliation.ParseStatus(strings.TrimSpace(name))
+				if err != nil {
+					return filter, err
+				}
+				filter.Statuses = append(filter.Statuses, status)
+			}
+		}
+
+		var err error
+		if filter.Since, err = parseTime(*since); err != nil {
+			return filter, fmt.Errorf("parsing -since: %w", err)
+		}
+		if filter.Until, err = parseTime(*until); err != nil {
+			return filter, fmt.Errorf("parsing -until: %w", err)
+		}
+
+		return filter, nil
+	}
+}
+
+// parseTime reads a date or an RFC 3339 time, the zero time if s is empty
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func listRecords(ctx context.Context, store reconciliation.RecordStore, args []string) error {
+	fs := flag.NewFlagSet("records list", flag.ContinueOnError)
+	filter := filterFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	f, err := filter()
+	if err != nil {
+		return err
+	}
+
+	recs, err := reconciliation.List(ctx, store, f)
+	if err != nil {
+		return err
+	}
+
+	printRecords(recs)
+	return nil
+}
+
+func printRecords(recs []reconciliation.Record) {
+	fmt.Printf("%-36s %-20s %-6s %-4s %8s %8s %-23s %s\n", "ID", "CREATED", "SYMBOL", "SIDE", "QTY", "FILLED", "STATUS", "ALPACA ID")
+	for _, rec := range recs {
+		fmt.Printf(
+			"%-36s %-20s %-6s %-4s %8s %8s %-23s %s\n",
+			rec.GetID(), rec.GetCreatedAt().UTC().Format(time.RFC3339), rec.GetSymbol(), rec.GetSide(),
+			rec.GetRequestedQty(), rec.GetFilledQty(), rec.GetStatus(), rec.GetAlpacaOrderID(),
+		)
+	}
+}
+
+func showRecord(ctx context.Context, store reconciliation.RecordStore, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: camelid records show ID")
+	}
+
+	rec, err := reconciliation.Get(ctx, store, args[0])
+	if err != nil {
+		return err
+	}
+
+	var order *exchange.Order
+	if rec.GetAlpacaOrderID() != "" {
+		exchangeClient, _, err := newAccountClient(rec.GetAccount())
+		if err != nil {
+			return err
+		}
+		order, err = exchangeClient.GetOrder(ctx, rec.GetAlpacaOrderID())
+		if err != nil {
+			return fmt.Errorf("getting order from alpaca (%s): %w", rec.GetAlpacaOrderID(), err)
+		}
+	}
+
+	// statuses are stored as numbers, so spell it out
+	out, err := json.MarshalIndent(struct {
+		Status string                `json:"status"`
+		Record reconciliation.Record `json:"record"`
+		Order  *exchange.Order       `json:"order"`
+	}{rec.GetStatus().String(), rec, order}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+func closeRecord(ctx context.Context, store reconciliation.RecordStore, command string, args []string) error {
+	fs := flag.NewFlagSet("records "+command, flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the record is being closed by hand, required")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return fmt.Errorf("usage: camelid records %s -reason REASON ID", command)
+	} else if *reason == "" {
+		return errors.New("-reason is required")
+	}
+
+	id := fs.Arg(0)
+	if command == "abandon" {
+		err := reconciliation.Abandon(ctx, store, id, *reason)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("record %s abandoned\n", id)
+		return nil
+	}
+
+	// the order is at the broker of the record's account
+	rec, err := reconciliation.Get(ctx, store, id)
+	if err != nil {
+		return err
+	}
+	exchangeClient, _, err := newAccountClient(rec.GetAccount())
+	if err != nil {
+		return err
+	}
+
+	status, err := reconciliation.ForceReconcile(ctx, store, exchangeClient, id, *reason)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("record %s closed as %s\n", id, status)
+	return nil
+}
+
+func deleteRecords(ctx context.Context, store reconciliation.RecordStore, args []string) error {
+	fs := flag.NewFlagSet("records delete", flag.ContinueOnError)
+	filter := filterFlags(fs)
+	confirm := fs.Bool("confirm", false, "actually delete, instead of printing what would be deleted")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	f, err := filter()
+	if err != nil {
+		return err
+	}
+
+	var recs []reconciliation.Record
+	if fs.NArg() > 0 {
+		for _, id := range fs.Args() {
+			rec, err := reconciliation.Get(ctx, store, id)
+			if err != nil {
+				return fmt.Errorf("getting record %s: %w", id, err)
+			}
+			recs = append(recs, rec)
+		}
+	} else if f.Symbol == "" && f.RunID == "" && len(f.Statuses) == 0 && f.Since.IsZero() && f.Until.IsZero() {
+		return errors.New("refusing to delete every record, pass IDs or filters")
+	} else {
+		recs, err = reconciliation.List(ctx, store, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	printRecords(recs)
+	if !*confirm {
+		fmt.Fprintf(os.Stderr, "would delete %d records, pass -confirm to delete them\n", len(recs))
+		return nil
+	}
+
+	for _, rec := range recs {
+		err := store.Delete(ctx, rec.GetID())
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "deleted %d records\n", len(recs))
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/reconciliation"
+)
+
+var (
+	memoryDirOnce sync.Once
+	memoryDir     string
+	memoryDirErr  error
+)
+
+// memoryStoreDir is where CAMELID_STORE=memory keeps the run's documents, a
+// scratch directory for the file store, shared by every store so that they see
+// each other's writes, as in production. removeMemoryStore deletes it.
+func memoryStoreDir() (string, error) {
+	memoryDirOnce.Do(func() {
+		memoryDir, memoryDirErr = ioutil.TempDir("", "camelid-memory")
+		if memoryDirErr != nil {
+			memoryDirErr = fmt.Errorf("creating a directory for the memory store: %w", memoryDirErr)
+		}
+	})
+	return memoryDir, memoryDirErr
+}
+
+// removeMemoryStore deletes what CAMELID_STORE=memory kept, if anything
+func removeMemoryStore() {
+	if memoryDir == "" {
+		return
+	}
+	err := os.RemoveAll(memoryDir)
+	if err != nil {
+		glog.Errorf("removing the memory store: %v", err)
+	}
+}
+
+// newBroker connects to the default account's broker, unless CAMELID_REPLAY names a recorded
+// run to replay from CAMELID_ARCHIVE_URL instead
+func newBroker(ctx context.Context) (exchange.Client, error) {
+	runID := os.Getenv("CAMELID_REPLAY")
+	if runID == "" {
+		return connectBroker("")
+	}
+
+	// replaying against real records would trade them as if it were that day
+	if os.Getenv("CAMELID_STORE") != "memory" {
+		return nil, errors.New("CAMELID_REPLAY requires CAMELID_STORE=memory")
+	}
+
+	sink, err := newArchiveSink()
+	if err != nil {
+		return nil, err
+	}
+	recording, err := sink.Read(ctx, runID+".exchange")
+	if err != nil {
+		return nil, fmt.Errorf("reading recording of run %s: %w", runID, err)
+	}
+
+	replayer, err := exchange.NewReplayer(bytes.NewReader(recording))
+	if err != nil {
+		return nil, fmt.Errorf("reading recording of run %s: %w", runID, err)
+	}
+	glog.Infof("replaying %d recorded exchange calls from run %s", replayer.Remaining(), runID)
+	return replayer, nil
+}
+
+// seedReplay restores the records as they were at the start of the run being replayed
+func seedReplay(ctx context.Context, store reconciliation.RecordStore) error {
+	runID := os.Getenv("CAMELID_REPLAY")
+	sink, err := newArchiveSink()
+	if err != nil {
+		return err
+	}
+
+	imported, err := reconciliation.Import(ctx, store, sink, runID+".records")
+	if err != nil {
+		return fmt.Errorf("restoring records of run %s: %w", runID, err)
+	}
+	glog.Infof("restored %d records from the start of run %s", imported, runID)
+	return nil
+}
+
+// exportForReplay keeps the records as they are at the start of a recorded run,
+// which a replay of it starts from
+func exportForReplay(ctx context.Context, store reconciliation.RecordStore, runID string) error {
+	sink, err := newArchiveSink()
+	if err != nil {
+		return fmt.Errorf("recording run: %w", err)
+	}
+
+	exported, err := reconciliation.Export(ctx, store, sink, runID+".records")
+	if err != nil {
+		return fmt.Errorf("recording run: %w", err)
+	}
+	glog.Infof("recording run %s, starting from %d records", runID, exported)
+	return nil
+}
+
+// saveRecording writes the exchange calls of a recorded run next to its records.
+// It runs once the run is over, so failures are only logged.
+func saveRecording(recorder *exchange.Recorder, runID string) {
+	var buf bytes.Buffer
+	_, err := recorder.WriteTo(&buf)
+	if err != nil {
+		glog.Errorf("encoding recording of run %s: %v", runID, err)
+		return
+	}
+
+	sink, err := newArchiveSink()
+	if err != nil {
+		glog.Errorf("saving recording of run %s: %v", runID, err)
+		return
+	}
+
+	err = sink.Write(context.Background(), runID+".exchange", buf.Bytes())
+	if err != nil {
+		glog.Errorf("saving recording of run %s: %v", runID, err)
+		return
+	}
+	glog.Infof("saved recording of run %s", runID)
+}
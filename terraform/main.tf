@@ -3,6 +3,8 @@ locals {
   conf = {
     CAMELID_RATIOS         = jsonencode({ VOO = 665, VXUS = 285, BND = 50 })
     CAMELID_MAX_INVESTMENT = 5000
+    CAMELID_DYNAMO_TABLE   = aws_dynamodb_table.trade_records_test.name
+    CAMELID_RUNS_TABLE     = aws_dynamodb_table.runs_test.name
 
     APCA_API_BASE_URL   = "https://paper-api.alpaca.markets"
     APCA_API_KEY_ID     = var.alpaca_api_key
@@ -18,15 +20,14 @@ resource "aws_dynamodb_table" "trade_records" {
   write_capacity = 5
   hash_key       = "ID"
 
+  # sparse, only open records have the Open attribute
   global_secondary_index {
-    name           = "StatusIndex"
+    name           = "OpenIndex"
     read_capacity  = 5
     write_capacity = 5
 
-    hash_key           = "ID"
-    range_key          = "Status"
-    projection_type    = "INCLUDE"
-    non_key_attributes = ["AlpacaOrderID"]
+    hash_key        = "Open"
+    projection_type = "ALL"
   }
 
   attribute {
@@ -35,9 +36,15 @@ resource "aws_dynamodb_table" "trade_records" {
   }
 
   attribute {
-    name = "Status"
+    name = "Open"
     type = "N"
   }
+
+  # archived records can be set to expire, see CAMELID_ARCHIVE_EXPIRE_DAYS
+  ttl {
+    attribute_name = "ExpiresAt"
+    enabled        = true
+  }
 }
 
 resource "aws_dynamodb_table" "trade_records_test" {
@@ -47,15 +54,14 @@ resource "aws_dynamodb_table" "trade_records_test" {
   write_capacity = 5
   hash_key       = "ID"
 
+  # sparse, only open records have the Open attribute
   global_secondary_index {
-    name           = "StatusIndex"
+    name           = "OpenIndex"
     read_capacity  = 5
     write_capacity = 5
 
-    hash_key           = "ID"
-    range_key          = "Status"
-    projection_type    = "INCLUDE"
-    non_key_attributes = ["AlpacaOrderID"]
+    hash_key        = "Open"
+    projection_type = "ALL"
   }
 
   attribute {
@@ -64,9 +70,29 @@ resource "aws_dynamodb_table" "trade_records_test" {
   }
 
   attribute {
-    name = "Status"
+    name = "Open"
     type = "N"
   }
+
+  # archived records can be set to expire, see CAMELID_ARCHIVE_EXPIRE_DAYS
+  ttl {
+    attribute_name = "ExpiresAt"
+    enabled        = true
+  }
+}
+
+# ledger of what each run decided and did
+resource "aws_dynamodb_table" "runs_test" {
+  name           = "CamelidRunsTest"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 1
+  write_capacity = 1
+  hash_key       = "ID"
+
+  attribute {
+    name = "ID"
+    type = "S"
+  }
 }
 
 # iam permissions for the cron job
@@ -107,7 +133,10 @@ data "aws_iam_policy_document" "policy_document" {
     ]
 
     resources = [
-      aws_dynamodb_table.trade_records_test.arn
+      aws_dynamodb_table.trade_records_test.arn,
+      # open records are queried through OpenIndex
+      "${aws_dynamodb_table.trade_records_test.arn}/index/*",
+      aws_dynamodb_table.runs_test.arn
     ]
   }
 
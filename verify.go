@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/shopspring/decimal"
+
+	"github.com/jchorl/camelid/internal/exchange"
+	"github.com/jchorl/camelid/internal/reconciliation"
+)
+
+// verifyOptions reads the declared starting snapshot from CAMELID_STARTING_SNAPSHOT,
+// and how many dollars positions may be off by from CAMELID_MAX_POSITION_MISMATCH.
+// Without a snapshot there's nothing to verify against, and nil is returned.
+// Without a max mismatch, discrepancies are only logged.
+func verifyOptions() (*reconciliation.Snapshot, *decimal.Decimal, error) {
+	snapshotJSON := os.Getenv("CAMELID_STARTING_SNAPSHOT")
+	if snapshotJSON == "" {
+		return nil, nil, nil
+	}
+
+	snapshot, err := reconciliation.ParseSnapshot([]byte(snapshotJSON))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := os.Getenv("CAMELID_MAX_POSITION_MISMATCH")
+	if s == "" {
+		return &snapshot, nil, nil
+	}
+
+	maxMismatch, err := decimal.NewFromString(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing CAMELID_MAX_POSITION_MISMATCH: %w", err)
+	}
+
+	return &snapshot, &maxMismatch, nil
+}
+
+// verifyPositions checks positions against records and broker orders across
+// the accounts, if a snapshot is declared, logging any discrepancies. It returns a
+// *reconciliation.MismatchError if they're off by more than the configured max.
+// Positions aren't verified if a broker can't list orders back to the snapshot.
+func verifyPositions(ctx context.Context, store reconciliation.RecordStore, exchangeClients []exchange.Client) error {
+	snapshot, maxMismatch, err := verifyOptions()
+	if err != nil || snapshot == nil {
+		return err
+	}
+
+	report, err := reconciliation.Verify(ctx, store, exchangeClients, *snapshot)
+	if errors.Is(err, exchange.ErrNoOrderHistory) {
+		glog.Warningf("not verifying positions: %v", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("verifying positions: %w", err)
+	}
+
+	for _, check := range report.Symbols {
+		if len(check.Problems) > 0 {
+			glog.Warningf("%s is off by %s shares ($%s): %s", check.Symbol, check.Mismatch(), check.MismatchValue().StringFixed(2), strings.Join(check.Problems, ", "))
+		}
+	}
+
+	if maxMismatch == nil {
+		return nil
+	}
+
+	if mismatched := report.Mismatched(*maxMismatch); len(mismatched) > 0 {
+		return &reconciliation.MismatchError{Max: *maxMismatch, Checks: mismatched}
+	}
+
+	return nil
+}
+
+// verify prints the full consistency report
+func verify(ctx context.Context) error {
+	snapshot, maxMismatch, err := verifyOptions()
+	if err != nil {
+		return err
+	} else if snapshot == nil {
+		return errors.New("CAMELID_STARTING_SNAPSHOT is required to verify positions")
+	}
+
+	store, err := newRecordStore()
+	if err != nil {
+		return err
+	}
+
+	exchangeClients, err := newAccountClients()
+	if err != nil {
+		return err
+	}
+
+	report, err := reconciliation.Verify(ctx, store, exchangeClients, *snapshot)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-8s %10s %10s %10s %10s %10s  %s\n", "SYMBOL", "STARTING", "RECORDED", "ORDERED", "HELD", "OFF BY $", "PROBLEMS")
+	for _, check := range report.Symbols {
+		problems := strings.Join(check.Problems, ", ")
+		if problems == "" && check.Pending {
+			problems = "orders still open"
+		}
+		fmt.Printf("%-8s %10s %10s %10s %10s %10s  %s\n", check.Symbol, check.Starting, check.Recorded, check.Ordered, check.Held, check.MismatchValue().StringFixed(2), problems)
+	}
+
+	if maxMismatch != nil {
+		if mismatched := report.Mismatched(*maxMismatch); len(mismatched) > 0 {
+			return &reconciliation.MismatchError{Max: *maxMismatch, Checks: mismatched}
+		}
+	}
+
+	return nil
+}